@@ -520,6 +520,11 @@ func (c *cmdConfigSet) Run(cmd *cobra.Command, args []string) error {
 
 			delete(container.Config, key)
 		} else {
+			replacement, ok := shared.DeprecatedContainerConfigKeys[key]
+			if ok {
+				fmt.Fprintf(os.Stderr, i18n.G("Warning: '%s' is deprecated, use '%s' instead")+"\n", key, replacement)
+			}
+
 			container.Config[key] = value
 		}
 
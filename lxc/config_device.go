@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 
+	"github.com/lxc/lxd/shared"
 	cli "github.com/lxc/lxd/shared/cmd"
 	"github.com/lxc/lxd/shared/i18n"
 )
@@ -147,6 +148,14 @@ func (c *cmdConfigDeviceAdd) Run(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf(i18n.G("The device already exists"))
 		}
 
+		// Catch devices which can't be added live before attempting it
+		if container.IsActive() {
+			err := shared.DeviceCanHotplug(device)
+			if err != nil {
+				return err
+			}
+		}
+
 		container.Devices[devname] = device
 
 		op, err := resource.server.UpdateContainer(resource.name, container.Writable(), etag)
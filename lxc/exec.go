@@ -32,6 +32,7 @@ type cmdExec struct {
 	flagUser                uint32
 	flagGroup               uint32
 	flagCwd                 string
+	flagScratch             bool
 }
 
 func (c *cmdExec) Command() *cobra.Command {
@@ -59,6 +60,7 @@ Mode defaults to non-interactive, interactive mode is selected if both stdin AND
 	cmd.Flags().Uint32Var(&c.flagUser, "user", 0, i18n.G("User ID to run the command as (default 0)")+"``")
 	cmd.Flags().Uint32Var(&c.flagGroup, "group", 0, i18n.G("Group ID to run the command as (default 0)")+"``")
 	cmd.Flags().StringVar(&c.flagCwd, "cwd", "", i18n.G("Group ID to run the command as (default /root)")+"``")
+	cmd.Flags().BoolVar(&c.flagScratch, "scratch", false, i18n.G("Provide a writable scratch directory as $TMPDIR"))
 
 	return cmd
 }
@@ -200,6 +202,7 @@ func (c *cmdExec) Run(cmd *cobra.Command, args []string) error {
 		User:        c.flagUser,
 		Group:       c.flagGroup,
 		Cwd:         c.flagCwd,
+		Scratch:     c.flagScratch,
 	}
 
 	execArgs := lxd.ContainerExecArgs{
@@ -227,5 +230,12 @@ func (c *cmdExec) Run(cmd *cobra.Command, args []string) error {
 	<-execArgs.DataDone
 
 	c.global.ret = int(opAPI.Metadata["return"].(float64))
+
+	// Help make sense of write failures
+	readonly, ok := opAPI.Metadata["readonly"].(bool)
+	if ok && readonly && c.global.ret != 0 {
+		fmt.Fprintf(os.Stderr, i18n.G("Note: the container's root filesystem is read-only")+"\n")
+	}
+
 	return nil
 }
@@ -13,8 +13,9 @@ import (
 type cmdSnapshot struct {
 	global *cmdGlobal
 
-	flagStateful bool
-	flagNoExpiry bool
+	flagStateful     bool
+	flagNoExpiry     bool
+	flagMetadataOnly bool
 }
 
 func (c *cmdSnapshot) Command() *cobra.Command {
@@ -25,7 +26,11 @@ func (c *cmdSnapshot) Command() *cobra.Command {
 		`Create container snapshots
 
 When --stateful is used, LXD attempts to checkpoint the container's
-running state, including process memory state, TCP connections, ...`))
+running state, including process memory state, TCP connections, ...
+
+When --metadata-only is used, only the container's configuration, devices
+and profiles are recorded. Restoring such a snapshot reverts the
+configuration but leaves the filesystem untouched.`))
 	cmd.Example = cli.FormatSection("", i18n.G(
 		`lxc snapshot u1 snap0
     Create a snapshot of "u1" called "snap0".`))
@@ -33,6 +38,7 @@ running state, including process memory state, TCP connections, ...`))
 	cmd.RunE = c.Run
 	cmd.Flags().BoolVar(&c.flagStateful, "stateful", false, i18n.G("Whether or not to snapshot the container's running state"))
 	cmd.Flags().BoolVar(&c.flagNoExpiry, "no-expiry", false, i18n.G("Ignore any configured auto-expiry for the container"))
+	cmd.Flags().BoolVar(&c.flagMetadataOnly, "metadata-only", false, i18n.G("Only snapshot the container's configuration, not its filesystem"))
 
 	return cmd
 }
@@ -64,8 +70,9 @@ func (c *cmdSnapshot) Run(cmd *cobra.Command, args []string) error {
 	}
 
 	req := api.ContainerSnapshotsPost{
-		Name:     snapname,
-		Stateful: c.flagStateful,
+		Name:         snapname,
+		Stateful:     c.flagStateful,
+		MetadataOnly: c.flagMetadataOnly,
 	}
 
 	if c.flagNoExpiry {
@@ -42,6 +42,7 @@ var api10 = []APIEndpoint{
 	containerCmd,
 	containerConsoleCmd,
 	containerExecCmd,
+	containerExportCmd,
 	containerFileCmd,
 	containerLogCmd,
 	containerLogsCmd,
@@ -474,6 +475,8 @@ func doApi10UpdateTriggers(d *Daemon, nodeChanged, clusterChanged map[string]str
 			if !d.os.MockMode {
 				d.taskPruneImages.Reset()
 			}
+		case "core.container_operation_timeout":
+			d.containerOperationTimeouts = clusterConfig.ContainerOperationTimeouts()
 		case "rbac.agent.url":
 			fallthrough
 		case "rbac.agent.username":
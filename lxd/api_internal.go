@@ -36,7 +36,9 @@ var apiInternal = []APIEndpoint{
 	internalContainerOnNetworkUpCmd,
 	internalContainerOnStopNSCmd,
 	internalContainerOnStopCmd,
+	internalContainerClearOperationCmd,
 	internalContainersCmd,
+	internalContainersRepairCmd,
 	internalSQLCmd,
 	internalClusterAcceptCmd,
 	internalClusterRebalanceCmd,
@@ -82,6 +84,12 @@ var internalContainerOnNetworkUpCmd = APIEndpoint{
 	Get: APIEndpointAction{Handler: internalContainerOnNetworkUp},
 }
 
+var internalContainerClearOperationCmd = APIEndpoint{
+	Name: "containers/{id}/clear-operation",
+
+	Post: APIEndpointAction{Handler: internalContainerClearOperation},
+}
+
 var internalSQLCmd = APIEndpoint{
 	Name: "sql",
 
@@ -95,6 +103,12 @@ var internalContainersCmd = APIEndpoint{
 	Post: APIEndpointAction{Handler: internalImport},
 }
 
+var internalContainersRepairCmd = APIEndpoint{
+	Name: "containers/repair",
+
+	Post: APIEndpointAction{Handler: internalContainersRepair},
+}
+
 var internalGarbageCollectorCmd = APIEndpoint{
 	Name: "gc",
 
@@ -123,6 +137,49 @@ func internalShutdown(d *Daemon, r *http.Request) Response {
 	return EmptySyncResponse
 }
 
+func internalContainerClearOperation(d *Daemon, r *http.Request) Response {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return SmartError(err)
+	}
+
+	c, err := containerLoadById(d.State(), id)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	err = c.ClearStaleOperation()
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func internalContainersRepair(d *Daemon, r *http.Request) Response {
+	// Containers being created, renamed or deleted look half-created, so
+	// refuse to run alongside any container operation.
+	operationsLock.Lock()
+	for _, op := range operations {
+		op.lock.Lock()
+		busy := op.resources["containers"] != nil && (op.status == api.Pending || op.status == api.Running)
+		op.lock.Unlock()
+
+		if busy {
+			operationsLock.Unlock()
+			return BadRequest(fmt.Errorf("Can't repair containers while container operations are running"))
+		}
+	}
+	operationsLock.Unlock()
+
+	repaired, err := containersRepair(d.State())
+	if err != nil {
+		return SmartError(err)
+	}
+
+	return SyncResponse(true, repaired)
+}
+
 func internalContainerOnStart(d *Daemon, r *http.Request) Response {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
@@ -418,6 +475,21 @@ type internalImportPost struct {
 	Force bool   `json:"force" yaml:"force"`
 }
 
+// internalImportSnapshotsMismatch returns an error listing the snapshots that
+// differ between backup.yaml and the storage pool.
+func internalImportSnapshotsMismatch(missing []string, unrecorded []string) error {
+	problems := []string{}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf(`recorded in "backup.yaml" but missing on disk: %s`, strings.Join(missing, ", ")))
+	}
+
+	if len(unrecorded) > 0 {
+		problems = append(problems, fmt.Sprintf(`present on disk but not recorded in "backup.yaml": %s`, strings.Join(unrecorded, ", ")))
+	}
+
+	return fmt.Errorf(`Snapshots don't match the "backup.yaml" file (%s). Pass "force" to discard them`, strings.Join(problems, "; "))
+}
+
 func internalImport(d *Daemon, r *http.Request) Response {
 	project := projectParam(r)
 
@@ -496,6 +568,25 @@ func internalImport(d *Daemon, r *http.Request) Response {
 		}
 	}
 
+	// Restoring environment_file.* keys lets the container read host files
+	// and fuse disks run commands on the host
+	if !d.userIsAdmin(r) {
+		secrets := containerSecretsChanged(nil, backup.Container.Config)
+		fuse := containerFuseChanged(nil, backup.Container.Devices)
+		for _, snap := range backup.Snapshots {
+			secrets = secrets || containerSecretsChanged(nil, snap.Config)
+			fuse = fuse || containerFuseChanged(nil, snap.Devices)
+		}
+
+		if secrets {
+			return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+		}
+
+		if fuse {
+			return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+		}
+	}
+
 	// Try to retrieve the storage pool the container supposedly lives on.
 	var poolErr error
 	poolID, pool, poolErr := d.cluster.StoragePoolGet(containerPoolName)
@@ -556,8 +647,6 @@ func internalImport(d *Daemon, r *http.Request) Response {
 	}
 
 	existingSnapshots := []*api.ContainerSnapshot{}
-	needForce := fmt.Errorf(`The snapshot does not exist on disk. Pass ` +
-		`"force" to discard non-existing snapshots`)
 
 	// retrieve on-disk pool name
 	_, _, poolName := initPool.GetContainerPoolInfo()
@@ -571,6 +660,10 @@ func internalImport(d *Daemon, r *http.Request) Response {
 		switch backup.Pool.Driver {
 		case "btrfs":
 			snapshotsDirPath := getSnapshotMountPoint(project, poolName, req.Name)
+			if !shared.PathExists(snapshotsDirPath) {
+				break
+			}
+
 			snapshotsDir, err := os.Open(snapshotsDirPath)
 			if err != nil {
 				return InternalError(err)
@@ -583,6 +676,10 @@ func internalImport(d *Daemon, r *http.Request) Response {
 			snapshotsDir.Close()
 		case "dir":
 			snapshotsDirPath := getSnapshotMountPoint(project, poolName, req.Name)
+			if !shared.PathExists(snapshotsDirPath) {
+				break
+			}
+
 			snapshotsDir, err := os.Open(snapshotsDirPath)
 			if err != nil {
 				return InternalError(err)
@@ -602,13 +699,23 @@ func internalImport(d *Daemon, r *http.Request) Response {
 			}
 
 			snaps := strings.Fields(msg)
-			prefix := fmt.Sprintf("containers_%s-", req.Name)
+			prefix := fmt.Sprintf("containers_%s-", projectPrefix(project, containerNameToLVName(req.Name)))
 			for _, v := range snaps {
 				// ignore zombies
-				if strings.HasPrefix(v, prefix) {
-					onDiskSnapshots = append(onDiskSnapshots,
-						v[len(prefix):])
+				if !strings.HasPrefix(v, prefix) {
+					continue
+				}
+
+				// Dashes in names are doubled in LV names, so anything
+				// left with a single dash belongs to another container
+				// whose name merely starts with this one's (c1-web).
+				snapName := v[len(prefix):]
+				if strings.HasPrefix(snapName, "-") || strings.Contains(strings.Replace(snapName, "--", "", -1), "-") {
+					continue
 				}
+
+				onDiskSnapshots = append(onDiskSnapshots,
+					strings.Replace(snapName, "--", "-", -1))
 			}
 		case "ceph":
 			clusterName := "ceph"
@@ -657,20 +764,10 @@ func internalImport(d *Daemon, r *http.Request) Response {
 		}
 	}
 
-	if len(backup.Snapshots) != len(onDiskSnapshots) {
-		if !req.Force {
-			msg := `There are either snapshots that don't exist ` +
-				`on disk anymore or snapshots that are not ` +
-				`recorded in the "backup.yaml" file. Pass ` +
-				`"force" to remove them`
-			logger.Errorf(msg)
-			return InternalError(fmt.Errorf(msg))
-		}
-	}
-
-	// delete snapshots that do not exist in backup.yaml
-	od := ""
-	for _, od = range onDiskSnapshots {
+	// Find the snapshots that exist on disk but aren't recorded in
+	// backup.yaml.
+	unrecordedSnapshots := []string{}
+	for _, od := range onDiskSnapshots {
 		inBackupFile := false
 		for _, ib := range backup.Snapshots {
 			_, snapOnlyName, _ := containerGetParentAndSnapshotName(ib.Name)
@@ -680,82 +777,26 @@ func internalImport(d *Daemon, r *http.Request) Response {
 			}
 		}
 
-		if inBackupFile {
-			continue
-		}
-
-		if !req.Force {
-			msg := `There are snapshots that are not recorded in ` +
-				`the "backup.yaml" file. Pass "force" to ` +
-				`remove them`
-			logger.Errorf(msg)
-			return InternalError(fmt.Errorf(msg))
-		}
-
-		var err error
-		switch backup.Pool.Driver {
-		case "btrfs":
-			snapName := fmt.Sprintf("%s/%s", req.Name, od)
-			err = btrfsSnapshotDeleteInternal(project, poolName, snapName)
-		case "dir":
-			snapName := fmt.Sprintf("%s/%s", req.Name, od)
-			err = dirSnapshotDeleteInternal(project, poolName, snapName)
-		case "lvm":
-			onDiskPoolName := backup.Pool.Config["lvm.vg_name"]
-			if onDiskPoolName == "" {
-				onDiskPoolName = poolName
-			}
-			snapName := fmt.Sprintf("%s/%s", req.Name, od)
-			snapPath := containerPath(snapName, true)
-			err = lvmContainerDeleteInternal(project, poolName, req.Name,
-				true, onDiskPoolName, snapPath)
-		case "ceph":
-			clusterName := "ceph"
-			if backup.Pool.Config["ceph.cluster_name"] != "" {
-				clusterName = backup.Pool.Config["ceph.cluster_name"]
-			}
-
-			userName := "admin"
-			if backup.Pool.Config["ceph.user.name"] != "" {
-				userName = backup.Pool.Config["ceph.user.name"]
-			}
-
-			onDiskPoolName := backup.Pool.Config["ceph.osd.pool_name"]
-			snapName := fmt.Sprintf("snapshot_%s", projectPrefix(project, od))
-			ret := cephContainerSnapshotDelete(clusterName,
-				onDiskPoolName, projectPrefix(project, req.Name),
-				storagePoolVolumeTypeNameContainer, snapName, userName)
-			if ret < 0 {
-				err = fmt.Errorf(`Failed to delete snapshot`)
-			}
-		case "zfs":
-			onDiskPoolName := backup.Pool.Config["zfs.pool_name"]
-			snapName := fmt.Sprintf("%s/%s", req.Name, od)
-			err = zfsSnapshotDeleteInternal(project, poolName, snapName,
-				onDiskPoolName)
-		}
-		if err != nil {
-			logger.Warnf(`Failed to delete snapshot`)
+		if !inBackupFile {
+			unrecordedSnapshots = append(unrecordedSnapshots, od)
 		}
 	}
 
+	// Find the snapshots recorded in backup.yaml that don't exist on disk.
+	missingSnapshots := []string{}
 	for _, snap := range backup.Snapshots {
 		switch backup.Pool.Driver {
 		case "btrfs":
 			snpMntPt := getSnapshotMountPoint(project, backup.Pool.Name, snap.Name)
 			if !shared.PathExists(snpMntPt) || !isBtrfsSubVolume(snpMntPt) {
-				if req.Force {
-					continue
-				}
-				return BadRequest(needForce)
+				missingSnapshots = append(missingSnapshots, shared.ExtractSnapshotName(snap.Name))
+				continue
 			}
 		case "dir":
 			snpMntPt := getSnapshotMountPoint(project, backup.Pool.Name, snap.Name)
 			if !shared.PathExists(snpMntPt) {
-				if req.Force {
-					continue
-				}
-				return BadRequest(needForce)
+				missingSnapshots = append(missingSnapshots, shared.ExtractSnapshotName(snap.Name))
+				continue
 			}
 		case "lvm":
 			ctLvmName := containerNameToLVName(snap.Name)
@@ -768,10 +809,8 @@ func internalImport(d *Daemon, r *http.Request) Response {
 			}
 
 			if !exists {
-				if req.Force {
-					continue
-				}
-				return BadRequest(needForce)
+				missingSnapshots = append(missingSnapshots, shared.ExtractSnapshotName(snap.Name))
+				continue
 			}
 		case "ceph":
 			clusterName := "ceph"
@@ -795,10 +834,8 @@ func internalImport(d *Daemon, r *http.Request) Response {
 				storagePoolVolumeTypeNameContainer,
 				snapshotName, userName)
 			if !exists {
-				if req.Force {
-					continue
-				}
-				return BadRequest(needForce)
+				missingSnapshots = append(missingSnapshots, shared.ExtractSnapshotName(snap.Name))
+				continue
 			}
 		case "zfs":
 			ctName, csName, _ := containerGetParentAndSnapshotName(snap.Name)
@@ -808,16 +845,75 @@ func internalImport(d *Daemon, r *http.Request) Response {
 				fmt.Sprintf("containers/%s@%s", ctName,
 					snapshotName))
 			if !exists {
-				if req.Force {
-					continue
-				}
-				return BadRequest(needForce)
+				missingSnapshots = append(missingSnapshots, shared.ExtractSnapshotName(snap.Name))
+				continue
 			}
 		}
 
 		existingSnapshots = append(existingSnapshots, snap)
 	}
 
+	if len(missingSnapshots) > 0 || len(unrecordedSnapshots) > 0 {
+		if !req.Force {
+			err := internalImportSnapshotsMismatch(missingSnapshots, unrecordedSnapshots)
+			logger.Errorf("%v", err)
+			return BadRequest(err)
+		}
+
+		for _, name := range missingSnapshots {
+			logger.Warnf(`Discarding snapshot "%s" which doesn't exist on disk`, name)
+		}
+	}
+
+	// Delete the snapshots that aren't recorded in backup.yaml.
+	for _, od := range unrecordedSnapshots {
+		var err error
+		switch backup.Pool.Driver {
+		case "btrfs":
+			snapName := fmt.Sprintf("%s/%s", req.Name, od)
+			err = btrfsSnapshotDeleteInternal(project, poolName, snapName)
+		case "dir":
+			snapName := fmt.Sprintf("%s/%s", req.Name, od)
+			err = dirSnapshotDeleteInternal(project, poolName, snapName)
+		case "lvm":
+			onDiskPoolName := backup.Pool.Config["lvm.vg_name"]
+			if onDiskPoolName == "" {
+				onDiskPoolName = poolName
+			}
+			snapName := fmt.Sprintf("%s/%s", req.Name, od)
+			snapPath := containerPath(snapName, true)
+			err = lvmContainerDeleteInternal(project, poolName, req.Name,
+				true, onDiskPoolName, snapPath)
+		case "ceph":
+			clusterName := "ceph"
+			if backup.Pool.Config["ceph.cluster_name"] != "" {
+				clusterName = backup.Pool.Config["ceph.cluster_name"]
+			}
+
+			userName := "admin"
+			if backup.Pool.Config["ceph.user.name"] != "" {
+				userName = backup.Pool.Config["ceph.user.name"]
+			}
+
+			onDiskPoolName := backup.Pool.Config["ceph.osd.pool_name"]
+			snapName := fmt.Sprintf("snapshot_%s", projectPrefix(project, od))
+			ret := cephContainerSnapshotDelete(clusterName,
+				onDiskPoolName, projectPrefix(project, req.Name),
+				storagePoolVolumeTypeNameContainer, snapName, userName)
+			if ret < 0 {
+				err = fmt.Errorf(`Failed to delete snapshot`)
+			}
+		case "zfs":
+			onDiskPoolName := backup.Pool.Config["zfs.pool_name"]
+			snapName := fmt.Sprintf("%s/%s", req.Name, od)
+			err = zfsSnapshotDeleteInternal(project, poolName, snapName,
+				onDiskPoolName)
+		}
+		if err != nil {
+			logger.Warnf(`Failed to delete snapshot`)
+		}
+	}
+
 	// Check if a storage volume entry for the container already exists.
 	_, volume, ctVolErr := d.cluster.StoragePoolNodeVolumeGetType(
 		req.Name, storagePoolVolumeTypeContainer, poolID)
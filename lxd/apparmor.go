@@ -506,6 +506,12 @@ func AAProfileFull(c container) string {
 	return fmt.Sprintf("lxd-%s_<%s>", name, lxddir)
 }
 
+// AAProfileExternal returns the name of the externally managed profile the
+// container should use instead of the generated one, if any.
+func AAProfileExternal(c container) string {
+	return c.ExpandedConfig()["security.apparmor.profile"]
+}
+
 func AAProfileShort(c container) string {
 	name := projectPrefix(c.Project(), c.Name())
 	return fmt.Sprintf("lxd-%s", name)
@@ -666,6 +672,11 @@ func AALoadProfile(c container) error {
 		return nil
 	}
 
+	// Externally managed profiles are loaded by the administrator
+	if AAProfileExternal(c) != "" {
+		return aaCheckProfile(c, AAProfileExternal(c))
+	}
+
 	if err := mkApparmorNamespace(c, AANamespace(c)); err != nil {
 		return err
 	}
@@ -714,6 +725,10 @@ func AADestroy(c container) error {
 		return nil
 	}
 
+	if AAProfileExternal(c) != "" {
+		return nil
+	}
+
 	if state.OS.AppArmorStacking && !state.OS.AppArmorStacked {
 		p := path.Join("/sys/kernel/security/apparmor/policy/namespaces", AANamespace(c))
 		if err := os.Remove(p); err != nil {
@@ -731,6 +746,10 @@ func AAParseProfile(c container) error {
 		return nil
 	}
 
+	if AAProfileExternal(c) != "" {
+		return aaCheckProfile(c, AAProfileExternal(c))
+	}
+
 	return runApparmor(APPARMOR_CMD_PARSE, c)
 }
 
@@ -748,6 +767,41 @@ func AADeleteProfile(c container) {
 	os.Remove(path.Join(aaPath, "profiles", AAProfileShort(c)))
 }
 
+// aaCheckProfile ensures that an externally managed profile is loaded on the
+// host and suitable for the container. Privileged containers rely on AppArmor
+// to protect the host, so they need a profile in enforce mode.
+func aaCheckProfile(c container, name string) error {
+	if name == "unconfined" {
+		if c.IsPrivileged() {
+			return fmt.Errorf("Privileged containers can't run unconfined")
+		}
+
+		return nil
+	}
+
+	content, err := ioutil.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return err
+	}
+
+	// Each line is "<name> (<mode>)"
+	for _, line := range strings.Split(string(content), "\n") {
+		idx := strings.LastIndex(line, " (")
+		if idx < 0 || line[:idx] != name {
+			continue
+		}
+
+		mode := strings.TrimSuffix(line[idx+2:], ")")
+		if c.IsPrivileged() && mode != "enforce" {
+			return fmt.Errorf("Privileged containers require AppArmor profile \"%s\" to be in enforce mode (currently %s)", name, mode)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("AppArmor profile \"%s\" isn't loaded on the host", name)
+}
+
 func aaParserSupports(feature string) bool {
 	major, minor, micro, err := getAAParserVersion()
 	if err != nil {
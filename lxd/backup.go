@@ -53,8 +53,13 @@ func backupLoadByName(s *state.State, project, name string) (*backup, error) {
 
 // Create a new backup
 func backupCreate(s *state.State, args db.ContainerBackupArgs, sourceContainer container) error {
+	err := containerCheckMetadataOnlySnapshots(sourceContainer, args.ContainerOnly)
+	if err != nil {
+		return err
+	}
+
 	// Create the database entry
-	err := s.Cluster.ContainerBackupCreate(args)
+	err = s.Cluster.ContainerBackupCreate(args)
 	if err != nil {
 		if err == db.ErrAlreadyDefined {
 			return fmt.Errorf("backup '%s' already exists", args.Name)
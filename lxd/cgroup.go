@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+
+	"github.com/lxc/lxd/shared"
 )
 
 func getInitCgroupPath(controller string) string {
@@ -59,3 +62,32 @@ func cGroupSet(controller, cgroup, file string, value string) error {
 
 	return ioutil.WriteFile(path, []byte(value), 0755)
 }
+
+// cGroupProcessPath returns the cgroup of a process in the v1 hierarchy of the
+// given controller, or in the unified hierarchy if unified is set. A trailing
+// init.scope, where systemd moves itself to, is ignored.
+func cGroupProcessPath(pid int, controller string, unified bool) (string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if unified && fields[0] != "0" {
+			continue
+		}
+
+		if !unified && !shared.StringInSlice(controller, strings.Split(fields[1], ",")) {
+			continue
+		}
+
+		return strings.TrimSuffix(fields[2], "/init.scope"), nil
+	}
+
+	return "", fmt.Errorf("Couldn't find the %s cgroup of process %d", controller, pid)
+}
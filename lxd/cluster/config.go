@@ -7,12 +7,14 @@ import (
 	"io"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/scrypt"
 
 	"github.com/lxc/lxd/lxd/config"
 	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/shared"
 	"github.com/pkg/errors"
 )
 
@@ -130,6 +132,13 @@ func (c *Config) ImagesMinimalReplica() int64 {
 	return c.m.GetInt64("cluster.images_minimal_replica")
 }
 
+// ContainerOperationTimeouts returns the configured timeouts of container
+// operations, keyed by action, the default one being keyed by "".
+func (c *Config) ContainerOperationTimeouts() map[string]time.Duration {
+	timeouts, _ := ParseContainerOperationTimeouts(c.m.GetString("core.container_operation_timeout"))
+	return timeouts
+}
+
 // Dump current configuration keys and their values. Keys with values matching
 // their defaults are omitted.
 func (c *Config) Dump() map[string]interface{} {
@@ -219,35 +228,36 @@ func configGet(cluster *db.Cluster) (*Config, error) {
 
 // ConfigSchema defines available server configuration keys.
 var ConfigSchema = config.Schema{
-	"backups.compression_algorithm":  {Default: "gzip", Validator: validateCompression},
-	"cluster.offline_threshold":      {Type: config.Int64, Default: offlineThresholdDefault(), Validator: offlineThresholdValidator},
-	"cluster.images_minimal_replica": {Type: config.Int64, Default: "3", Validator: imageMinimalReplicaValidator},
-	"core.https_allowed_headers":     {},
-	"core.https_allowed_methods":     {},
-	"core.https_allowed_origin":      {},
-	"core.https_allowed_credentials": {Type: config.Bool},
-	"core.proxy_http":                {},
-	"core.proxy_https":               {},
-	"core.proxy_ignore_hosts":        {},
-	"core.trust_password":            {Hidden: true, Setter: passwordSetter},
-	"candid.api.key":                 {},
-	"candid.api.url":                 {},
-	"candid.domains":                 {},
-	"candid.expiry":                  {Type: config.Int64, Default: "3600"},
-	"images.auto_update_cached":      {Type: config.Bool, Default: "true"},
-	"images.auto_update_interval":    {Type: config.Int64, Default: "6"},
-	"images.compression_algorithm":   {Default: "gzip", Validator: validateCompression},
-	"images.remote_cache_expiry":     {Type: config.Int64, Default: "10"},
-	"maas.api.key":                   {},
-	"maas.api.url":                   {},
-	"rbac.agent.url":                 {},
-	"rbac.agent.username":            {},
-	"rbac.agent.private_key":         {},
-	"rbac.agent.public_key":          {},
-	"rbac.api.expiry":                {Type: config.Int64, Default: "3600"},
-	"rbac.api.key":                   {},
-	"rbac.api.url":                   {},
-	"rbac.expiry":                    {Type: config.Int64, Default: "3600"},
+	"backups.compression_algorithm":    {Default: "gzip", Validator: validateCompression},
+	"cluster.offline_threshold":        {Type: config.Int64, Default: offlineThresholdDefault(), Validator: offlineThresholdValidator},
+	"cluster.images_minimal_replica":   {Type: config.Int64, Default: "3", Validator: imageMinimalReplicaValidator},
+	"core.https_allowed_headers":       {},
+	"core.https_allowed_methods":       {},
+	"core.https_allowed_origin":        {},
+	"core.https_allowed_credentials":   {Type: config.Bool},
+	"core.container_operation_timeout": {Validator: containerOperationTimeoutValidator},
+	"core.proxy_http":                  {},
+	"core.proxy_https":                 {},
+	"core.proxy_ignore_hosts":          {},
+	"core.trust_password":              {Hidden: true, Setter: passwordSetter},
+	"candid.api.key":                   {},
+	"candid.api.url":                   {},
+	"candid.domains":                   {},
+	"candid.expiry":                    {Type: config.Int64, Default: "3600"},
+	"images.auto_update_cached":        {Type: config.Bool, Default: "true"},
+	"images.auto_update_interval":      {Type: config.Int64, Default: "6"},
+	"images.compression_algorithm":     {Default: "gzip", Validator: validateCompression},
+	"images.remote_cache_expiry":       {Type: config.Int64, Default: "10"},
+	"maas.api.key":                     {},
+	"maas.api.url":                     {},
+	"rbac.agent.url":                   {},
+	"rbac.agent.username":              {},
+	"rbac.agent.private_key":           {},
+	"rbac.agent.public_key":            {},
+	"rbac.api.expiry":                  {Type: config.Int64, Default: "3600"},
+	"rbac.api.key":                     {},
+	"rbac.api.url":                     {},
+	"rbac.expiry":                      {Type: config.Int64, Default: "3600"},
 
 	// Keys deprecated since the implementation of the storage api.
 	"storage.lvm_fstype":           {Setter: deprecatedStorage, Default: "ext4"},
@@ -279,6 +289,53 @@ func offlineThresholdValidator(value string) error {
 	return nil
 }
 
+// Container actions whose operation timeout can be configured
+var containerOperationActions = []string{"start", "stop", "dump", "restore"}
+
+// ParseContainerOperationTimeouts parses the value of
+// core.container_operation_timeout, either a number of seconds applying to all
+// actions or a comma separated list of <action>=<seconds> (e.g. 60,dump=600),
+// returning the timeouts keyed by action ("" for the default one).
+func ParseContainerOperationTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if value == "" {
+		return timeouts, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		action := ""
+		seconds := strings.TrimSpace(entry)
+		fields := strings.SplitN(seconds, "=", 2)
+		if len(fields) == 2 {
+			action = strings.TrimSpace(fields[0])
+			seconds = strings.TrimSpace(fields[1])
+
+			if !shared.StringInSlice(action, containerOperationActions) {
+				return nil, fmt.Errorf("Invalid action %q, expected one of %s", action, strings.Join(containerOperationActions, ", "))
+			}
+		}
+
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q, expected a positive number of seconds", seconds)
+		}
+
+		_, ok := timeouts[action]
+		if ok {
+			return nil, fmt.Errorf("Timeout set twice for %q", action)
+		}
+
+		timeouts[action] = time.Duration(n) * time.Second
+	}
+
+	return timeouts, nil
+}
+
+func containerOperationTimeoutValidator(value string) error {
+	_, err := ParseContainerOperationTimeouts(value)
+	return err
+}
+
 func imageMinimalReplicaValidator(value string) error {
 	count, err := strconv.Atoi(value)
 	if err != nil {
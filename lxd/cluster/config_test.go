@@ -2,6 +2,7 @@ package cluster_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/lxc/lxd/lxd/cluster"
 	"github.com/lxc/lxd/lxd/db"
@@ -64,6 +65,22 @@ func TestConfigLoad_OfflineThresholdValidator(t *testing.T) {
 
 }
 
+// Container operation timeouts can be set as a whole and per action.
+func TestParseContainerOperationTimeouts(t *testing.T) {
+	timeouts, err := cluster.ParseContainerOperationTimeouts("60, dump=600")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"": time.Minute, "dump": 10 * time.Minute}, timeouts)
+
+	_, err = cluster.ParseContainerOperationTimeouts("stop=0")
+	require.EqualError(t, err, `Invalid timeout "0", expected a positive number of seconds`)
+
+	_, err = cluster.ParseContainerOperationTimeouts("30,60")
+	require.EqualError(t, err, `Timeout set twice for ""`)
+
+	_, err = cluster.ParseContainerOperationTimeouts("stpo=60")
+	require.EqualError(t, err, `Invalid action "stpo", expected one of start, stop, dump, restore`)
+}
+
 // If some previously set values are missing from the ones passed to Replace(),
 // they are deleted from the configuration.
 func TestConfig_ReplaceDeleteValues(t *testing.T) {
@@ -4,14 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 	"gopkg.in/lxc/go-lxc.v2"
 	"gopkg.in/robfig/cron.v2"
 
@@ -68,6 +72,47 @@ func containerValidName(name string) error {
 	return nil
 }
 
+// containerConfigReference matches a ${config:<key>} reference in a config value.
+var containerConfigReference = regexp.MustCompile(`\$\{config:([^}]+)\}`)
+
+// containerConfigExpand resolves the ${config:<key>} references of value
+// against config. The keys currently being resolved are passed in seen so
+// that recursive references can be detected.
+func containerConfigExpand(config map[string]string, value string, seen ...string) (string, error) {
+	var err error
+
+	result := containerConfigReference.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		key := containerConfigReference.FindStringSubmatch(match)[1]
+		if shared.StringInSlice(key, seen) {
+			err = fmt.Errorf("Recursive reference to config key %q", key)
+			return match
+		}
+
+		target, ok := config[key]
+		if !ok {
+			err = fmt.Errorf("Unresolved reference to config key %q", key)
+			return match
+		}
+
+		expanded, expandErr := containerConfigExpand(config, target, append(seen, key)...)
+		if expandErr != nil {
+			err = expandErr
+			return match
+		}
+
+		return expanded
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
 func containerValidConfigKey(os *sys.OS, key string, value string) error {
 	f, err := shared.ConfigKeyChecker(key)
 	if err != nil {
@@ -79,7 +124,11 @@ func containerValidConfigKey(os *sys.OS, key string, value string) error {
 	if key == "raw.lxc" {
 		return lxcValidConfig(value)
 	}
-	if key == "security.syscalls.blacklist_compat" {
+	if strings.HasPrefix(key, "environment_file.") && value != "" {
+		_, err := containerReadSecret(value)
+		return err
+	}
+	if key == "security.syscalls.blacklist_compat" || key == "security.syscalls.deny_compat" {
 		for _, arch := range os.Architectures {
 			if arch == osarch.ARCH_64BIT_INTEL_X86 ||
 				arch == osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN ||
@@ -87,8 +136,193 @@ func containerValidConfigKey(os *sys.OS, key string, value string) error {
 				return nil
 			}
 		}
-		return fmt.Errorf("security.syscalls.blacklist_compat isn't supported on this architecture")
+		return fmt.Errorf("%s isn't supported on this architecture", key)
+	}
+	return nil
+}
+
+// containerReadSecret reads the value of an environment_file.* key from the
+// file it points to in LXD's secrets directory.
+func containerReadSecret(name string) (string, error) {
+	secretsDir, err := filepath.EvalSymlinks(shared.VarPath("secrets"))
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(secretsDir, name))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read secret file '%s': %v", name, err)
+	}
+
+	if !strings.HasPrefix(path, secretsDir+"/") {
+		return "", fmt.Errorf("Secret file '%s' is outside of the secrets directory", name)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read secret file '%s': %v", name, err)
+	}
+
+	return strings.TrimSuffix(string(content), "\n"), nil
+}
+
+// containerSecretsChanged returns whether any environment_file.* key differs
+// between the two configs. Those keys let whoever sets them read host files
+// and so are restricted to administrators.
+func containerSecretsChanged(oldConfig map[string]string, newConfig map[string]string) bool {
+	for k, v := range newConfig {
+		if strings.HasPrefix(k, "environment_file.") && oldConfig[k] != v {
+			return true
+		}
+	}
+
+	for k, v := range oldConfig {
+		if strings.HasPrefix(k, "environment_file.") && newConfig[k] != v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containerFuseChanged returns whether any disk device gets a fuse property it
+// didn't have before. The fuse command is run as root on the host and so is
+// restricted to administrators.
+func containerFuseChanged(oldDevices types.Devices, newDevices types.Devices) bool {
+	for name, m := range newDevices {
+		if m["type"] != "disk" || m["fuse"] == "" {
+			continue
+		}
+
+		old, ok := oldDevices[name]
+		if !ok || old["type"] != "disk" || old["fuse"] != m["fuse"] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containerSysfsPaths splits the value of a linux.sysfs.* key into paths.
+func containerSysfsPaths(value string) []string {
+	paths := []string{}
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// containerValidNicHostAddress checks the address to give to the host side of
+// a p2p nic, which mustn't conflict with the container's own addresses.
+func containerValidNicHostAddress(m types.Device, family string) error {
+	if m["nictype"] != "p2p" {
+		return fmt.Errorf("Bad nic type: %s", m["nictype"])
+	}
+
+	address := m[fmt.Sprintf("%s.host_address", family)]
+	if family == "ipv4" {
+		err := networkValidAddressV4(address)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := networkValidAddressV6(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	ip := net.ParseIP(address)
+	if m[fmt.Sprintf("%s.address", family)] != "" && ip.Equal(net.ParseIP(m[fmt.Sprintf("%s.address", family)])) {
+		return fmt.Errorf("The host address can't be the same as the container's")
+	}
+
+	for _, route := range strings.Split(m[fmt.Sprintf("%s.routes", family)], ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(route)
+		if err == nil && subnet.Contains(ip) {
+			return fmt.Errorf("The host address can't be part of the routes to the container (%s)", route)
+		}
 	}
+
+	return nil
+}
+
+func containerValidDiskFuse(m types.Device) error {
+	// The command is split on whitespace, quoting isn't supported
+	if len(strings.Fields(m["fuse"])) == 0 {
+		return fmt.Errorf("FUSE disk entries must have a mount command in their \"fuse\" property")
+	}
+
+	if m["source"] != "" || m["pool"] != "" || m["overlay.lowerdir"] != "" {
+		return fmt.Errorf("FUSE disk entries may not have a \"source\", \"pool\" or \"overlay.lowerdir\" property set")
+	}
+
+	if m["path"] == "/" {
+		return fmt.Errorf("The root disk can't be a FUSE filesystem")
+	}
+
+	if m["limits.read"] != "" || m["limits.write"] != "" || m["limits.max"] != "" || m["limits.read.latency"] != "" || m["limits.weight"] != "" {
+		return fmt.Errorf("I/O limits aren't supported on FUSE disk entries")
+	}
+
+	if m["recursive"] != "" {
+		return fmt.Errorf("The recursive option isn't supported on FUSE disk entries")
+	}
+
+	return nil
+}
+
+// containerValidDiskOverlay checks the overlay properties of a disk device.
+func containerValidDiskOverlay(m types.Device) error {
+	if m["overlay.lowerdir"] == "" {
+		return fmt.Errorf("Overlay disk entry is missing the required \"overlay.lowerdir\" property")
+	}
+
+	if m["source"] != "" || m["pool"] != "" {
+		return fmt.Errorf("Overlay disk entries may not have a \"source\" or \"pool\" property set")
+	}
+
+	if m["path"] == "/" {
+		return fmt.Errorf("The root disk can't be an overlay")
+	}
+
+	if m["limits.read"] != "" || m["limits.write"] != "" || m["limits.max"] != "" || m["limits.read.latency"] != "" || m["limits.weight"] != "" {
+		return fmt.Errorf("I/O limits aren't supported on overlay disk entries")
+	}
+
+	if (m["overlay.upperdir"] == "") != (m["overlay.workdir"] == "") {
+		return fmt.Errorf("The \"overlay.upperdir\" and \"overlay.workdir\" properties must be set together")
+	}
+
+	dirs := strings.Split(m["overlay.lowerdir"], ",")
+	if m["overlay.upperdir"] != "" {
+		dirs = append(dirs, m["overlay.upperdir"], m["overlay.workdir"])
+	}
+
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("Overlay directory %q must be an absolute path", dir)
+		}
+
+		// Those are the separators of the overlayfs mount options
+		if strings.ContainsAny(dir, ":,") {
+			return fmt.Errorf("Overlay directory %q may not contain ':' or ','", dir)
+		}
+
+		if !shared.IsTrue(m["optional"]) && !shared.IsDir(shared.HostPath(dir)) {
+			return fmt.Errorf("Overlay directory %q doesn't exist", dir)
+		}
+	}
+
 	return nil
 }
 
@@ -116,6 +350,10 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "uid":
 			return true
+		case "hotplug":
+			return true
+		case "readonly":
+			return true
 		default:
 			return false
 		}
@@ -127,6 +365,18 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "limits.egress":
 			return true
+		case "limits.connections":
+			return true
+		case "mss_clamp":
+			return true
+		case "promisc":
+			return true
+		case "vrf":
+			return true
+		case "ipv4.host_address":
+			return true
+		case "ipv6.host_address":
+			return true
 		case "host_name":
 			return true
 		case "hwaddr":
@@ -143,6 +393,10 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "ipv4.address":
 			return true
+		case "ipv4.dhcp":
+			return true
+		case "ipv4.pmtu_discovery":
+			return true
 		case "ipv6.address":
 			return true
 		case "ipv4.routes":
@@ -159,6 +413,12 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "maas.subnet.ipv6":
 			return true
+		case "dns.register":
+			return true
+		case "dns.domain":
+			return true
+		case "dns.aliases":
+			return true
 		default:
 			return false
 		}
@@ -170,6 +430,10 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "limits.write":
 			return true
+		case "limits.read.latency":
+			return true
+		case "limits.weight":
+			return true
 		case "optional":
 			return true
 		case "path":
@@ -186,6 +450,18 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "propagation":
 			return true
+		case "overlay.lowerdir":
+			return true
+		case "overlay.upperdir":
+			return true
+		case "overlay.workdir":
+			return true
+		case "fs":
+			return true
+		case "source.timeout":
+			return true
+		case "fuse":
+			return true
 		default:
 			return false
 		}
@@ -222,6 +498,8 @@ func containerValidDeviceConfigKey(t, k string) bool {
 			return true
 		case "uid":
 			return true
+		case "mig.uuid":
+			return true
 		default:
 			return false
 		}
@@ -305,15 +583,25 @@ func containerValidConfig(sysOS *sys.OS, config map[string]string, profile bool,
 		if err != nil {
 			return err
 		}
+
+		// Only warn about keys set directly, not when validating the expanded config
+		replacement, deprecated := shared.DeprecatedContainerConfigKeys[k]
+		if deprecated && !expanded {
+			logger.Warn("Deprecated config key used, please migrate to its replacement", log.Ctx{"key": k, "replacement": replacement})
+		}
 	}
 
 	_, rawSeccomp := config["raw.seccomp"]
 	_, whitelist := config["security.syscalls.whitelist"]
 	_, blacklist := config["security.syscalls.blacklist"]
-	blacklistDefault := shared.IsTrue(config["security.syscalls.blacklist_default"])
-	blacklistCompat := shared.IsTrue(config["security.syscalls.blacklist_compat"])
-
-	if rawSeccomp && (whitelist || blacklist || blacklistDefault || blacklistCompat) {
+	blacklistDefaultValue, _ := shared.ContainerConfigValue(config, "security.syscalls.deny_default")
+	blacklistDefault := shared.IsTrue(blacklistDefaultValue)
+	blacklistCompatValue, _ := shared.ContainerConfigValue(config, "security.syscalls.deny_compat")
+	blacklistCompat := shared.IsTrue(blacklistCompatValue)
+	allow := config["security.syscalls.allow"] != ""
+	deny := config["security.syscalls.deny"] != ""
+
+	if rawSeccomp && (whitelist || blacklist || blacklistDefault || blacklistCompat || allow || deny) {
 		return fmt.Errorf("raw.seccomp is mutually exclusive with security.syscalls*")
 	}
 
@@ -321,6 +609,25 @@ func containerValidConfig(sysOS *sys.OS, config map[string]string, profile bool,
 		return fmt.Errorf("security.syscalls.whitelist is mutually exclusive with security.syscalls.blacklist*")
 	}
 
+	if allow && (whitelist || blacklist || blacklistDefault || blacklistCompat || deny) {
+		return fmt.Errorf("security.syscalls.allow is mutually exclusive with the other security.syscalls* keys")
+	}
+
+	if whitelist && deny {
+		return fmt.Errorf("security.syscalls.deny can't be used with security.syscalls.whitelist")
+	}
+
+	if config["limits.shm"] != "" && config["limits.tmpfs"] != "" && filepath.Clean(config["limits.tmpfs.path"]) == "/dev/shm" {
+		return fmt.Errorf("limits.tmpfs can't be mounted on /dev/shm when limits.shm is set")
+	}
+
+	sysfsRW := containerSysfsPaths(config["linux.sysfs.rw"])
+	for _, path := range containerSysfsPaths(config["linux.sysfs.ro"]) {
+		if shared.StringInSlice(path, sysfsRW) {
+			return fmt.Errorf("The sysfs path %q can't be both read-only and read-write", path)
+		}
+	}
+
 	if expanded && (config["security.privileged"] == "" || !shared.IsTrue(config["security.privileged"])) && sysOS.IdmapSet == nil {
 		return fmt.Errorf("LXD doesn't have a uid/gid allocation. In this mode, only privileged containers are supported")
 	}
@@ -349,6 +656,7 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 	}
 
 	var diskDevicePaths []string
+	pmtuDiscovery := ""
 	// Check each device individually
 	for name, m := range devices {
 		if m["type"] == "" {
@@ -378,6 +686,10 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				return fmt.Errorf("Missing parent for %s type nic", m["nictype"])
 			}
 
+			if strings.Contains(m["parent"], ",") && !shared.StringInSlice(m["nictype"], []string{"macvlan", "physical"}) {
+				return fmt.Errorf("Multiple parents are only supported for macvlan and physical type nics")
+			}
+
 			if m["ipv4.address"] != "" {
 				if m["nictype"] == "ipvlan" {
 					err := networkValidAddressV4List(m["ipv4.address"])
@@ -406,6 +718,21 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				}
 			}
 
+			if m["ipv4.dhcp"] != "" {
+				err := shared.IsBool(m["ipv4.dhcp"])
+				if err != nil {
+					return err
+				}
+
+				if m["nictype"] != "bridged" {
+					return fmt.Errorf("Bad nic type for ipv4.dhcp: %s", m["nictype"])
+				}
+
+				if !shared.IsTrue(m["ipv4.dhcp"]) && m["ipv4.address"] == "" {
+					return fmt.Errorf("A static ipv4.address is required when ipv4.dhcp is disabled")
+				}
+			}
+
 			if m["ipv4.routes"] != "" {
 				if !shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
 					return fmt.Errorf("Bad nic type for ipv4.routes: %s", m["nictype"])
@@ -420,6 +747,44 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				}
 			}
 
+			if m["dns.register"] != "" {
+				err := shared.IsBool(m["dns.register"])
+				if err != nil {
+					return err
+				}
+
+				if m["nictype"] != "bridged" {
+					return fmt.Errorf("Bad nic type for dns.register: %s", m["nictype"])
+				}
+
+				if shared.IsTrue(m["dns.register"]) && m["ipv4.address"] == "" && m["ipv6.address"] == "" {
+					return fmt.Errorf("A static ipv4.address or ipv6.address is required to register DNS records")
+				}
+			}
+
+			if (m["dns.domain"] != "" || m["dns.aliases"] != "") && !shared.IsTrue(m["dns.register"]) {
+				return fmt.Errorf("dns.domain and dns.aliases require dns.register")
+			}
+
+			if m["dns.domain"] != "" {
+				for _, label := range strings.Split(m["dns.domain"], ".") {
+					if !shared.ValidHostname(label) {
+						return fmt.Errorf("Invalid DNS domain: %s", m["dns.domain"])
+					}
+				}
+			}
+
+			if m["dns.aliases"] != "" {
+				for _, alias := range strings.Split(m["dns.aliases"], ",") {
+					alias = strings.TrimSpace(alias)
+					for _, label := range strings.Split(alias, ".") {
+						if !shared.ValidHostname(label) {
+							return fmt.Errorf("Invalid DNS alias: %s", alias)
+						}
+					}
+				}
+			}
+
 			if m["ipv6.routes"] != "" {
 				if !shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
 					return fmt.Errorf("Bad nic type for ipv6.routes: %s", m["nictype"])
@@ -451,6 +816,75 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 					return fmt.Errorf("Bad nic type for security.ipv6_filtering: %s", m["nictype"])
 				}
 			}
+
+			if m["limits.connections"] != "" {
+				limit, err := strconv.ParseInt(m["limits.connections"], 10, 64)
+				if err != nil || limit < 1 {
+					return fmt.Errorf("Invalid value for limits.connections: %s", m["limits.connections"])
+				}
+
+				if m["nictype"] != "bridged" {
+					return fmt.Errorf("Bad nic type for limits.connections: %s", m["nictype"])
+				}
+
+				if m["ipv4.address"] == "" && m["ipv6.address"] == "" && !shared.IsTrue(m["security.ipv4_filtering"]) && !shared.IsTrue(m["security.ipv6_filtering"]) {
+					return fmt.Errorf("limits.connections requires a known address (ipv4.address, ipv6.address or IP filtering)")
+				}
+			}
+
+			if m["ipv4.pmtu_discovery"] != "" {
+				err := shared.IsBool(m["ipv4.pmtu_discovery"])
+				if err != nil {
+					return fmt.Errorf("Invalid value for ipv4.pmtu_discovery: %s", m["ipv4.pmtu_discovery"])
+				}
+
+				// The sysctl applies to the whole network namespace.
+				if pmtuDiscovery != "" && shared.IsTrue(pmtuDiscovery) != shared.IsTrue(m["ipv4.pmtu_discovery"]) {
+					return fmt.Errorf("Conflicting ipv4.pmtu_discovery values between nic devices")
+				}
+
+				pmtuDiscovery = m["ipv4.pmtu_discovery"]
+			}
+
+			for _, family := range []string{"ipv4", "ipv6"} {
+				key := fmt.Sprintf("%s.host_address", family)
+				if m[key] == "" {
+					continue
+				}
+
+				err := containerValidNicHostAddress(m, family)
+				if err != nil {
+					return errors.Wrapf(err, "Invalid value for %s", key)
+				}
+			}
+
+			if m["vrf"] != "" {
+				if m["nictype"] != "p2p" {
+					return fmt.Errorf("Bad nic type for vrf: %s", m["nictype"])
+				}
+
+				err := networkValidName(m["vrf"])
+				if err != nil {
+					return fmt.Errorf("Invalid value for vrf: %s", err)
+				}
+			}
+
+			if shared.IsTrue(m["promisc"]) && !shared.StringInSlice(m["nictype"], []string{"bridged", "physical", "macvlan"}) {
+				return fmt.Errorf("Promiscuous mode is only supported on bridged, physical and macvlan nics")
+			}
+
+			if m["mss_clamp"] != "" {
+				if m["mss_clamp"] != "pmtu" {
+					mss, err := strconv.ParseInt(m["mss_clamp"], 10, 64)
+					if err != nil || mss < 536 || mss > 65495 {
+						return fmt.Errorf("Invalid value for mss_clamp: %s", m["mss_clamp"])
+					}
+				}
+
+				if m["nictype"] != "bridged" {
+					return fmt.Errorf("Bad nic type for mss_clamp: %s", m["nictype"])
+				}
+			}
 		} else if m["type"] == "infiniband" {
 			if m["nictype"] == "" {
 				return fmt.Errorf("Missing nic type")
@@ -474,7 +908,7 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				return fmt.Errorf("Disk entry is missing the required \"path\" property")
 			}
 
-			if m["source"] == "" && m["path"] != "/" {
+			if m["source"] == "" && m["path"] != "/" && m["overlay.lowerdir"] == "" && m["fuse"] == "" {
 				return fmt.Errorf("Disk entry is missing the required \"source\" property")
 			}
 
@@ -486,6 +920,16 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				return fmt.Errorf("Only the root disk may have a size quota")
 			}
 
+			if m["fs"] != "" {
+				if m["path"] != "/" {
+					return fmt.Errorf("Only the root disk may have a filesystem set")
+				}
+
+				if !shared.StringInSlice(m["fs"], []string{"btrfs", "ext4", "xfs"}) {
+					return fmt.Errorf("Invalid root disk filesystem: %s", m["fs"])
+				}
+			}
+
 			if (m["path"] == "/" || !shared.IsDir(shared.HostPath(m["source"]))) && m["recursive"] != "" {
 				return fmt.Errorf("The recursive option is only supported for additional bind-mounted paths")
 			}
@@ -514,6 +958,32 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 				}
 			}
 
+			if m["overlay.lowerdir"] != "" || m["overlay.upperdir"] != "" || m["overlay.workdir"] != "" {
+				err := containerValidDiskOverlay(m)
+				if err != nil {
+					return err
+				}
+			}
+
+			if m["fuse"] != "" {
+				err := containerValidDiskFuse(m)
+				if err != nil {
+					return err
+				}
+			}
+
+			_, _, err := deviceParseDiskQoS(m["limits.read.latency"], m["limits.weight"])
+			if err != nil {
+				return err
+			}
+
+			if m["source.timeout"] != "" {
+				_, err := strconv.ParseUint(m["source.timeout"], 10, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid source timeout '%s'", m["source.timeout"])
+				}
+			}
+
 			if m["propagation"] != "" {
 				if !util.RuntimeLiblxcVersionAtLeast(3, 0, 0) {
 					return fmt.Errorf("liblxc 3.0 is required for mount propagation configuration")
@@ -523,6 +993,21 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 					return fmt.Errorf("Invalid propagation mode '%s'", m["propagation"])
 				}
 			}
+		} else if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) && m["hotplug"] != "" {
+			if !strings.HasPrefix(m["hotplug"], "/devices/") {
+				return fmt.Errorf("The hotplug rule must match paths under /sys/devices")
+			}
+
+			_, err := filepath.Match(m["hotplug"], "")
+			if err != nil {
+				return fmt.Errorf("Invalid hotplug rule \"%s\": %v", m["hotplug"], err)
+			}
+
+			for _, key := range []string{"source", "major", "minor", "required"} {
+				if m[key] != "" {
+					return fmt.Errorf("The \"%s\" property can't be combined with a hotplug rule", key)
+				}
+			}
 		} else if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
 			if m["source"] == "" && m["path"] == "" {
 				return fmt.Errorf("Unix device entry is missing the required \"source\" or \"path\" property")
@@ -564,6 +1049,10 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 			if m["id"] != "" && (m["pci"] != "" || m["productid"] != "" || m["vendorid"] != "") {
 				return fmt.Errorf("Cannot use pci, productid or vendorid when id is set")
 			}
+
+			if m["mig.uuid"] != "" && !deviceValidMigUUID(m["mig.uuid"]) {
+				return fmt.Errorf("Invalid MIG device UUID: %s", m["mig.uuid"])
+			}
 		} else if m["type"] == "proxy" {
 			if m["listen"] == "" {
 				return fmt.Errorf("Proxy device entry is missing the required \"listen\" property")
@@ -608,6 +1097,14 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 					return fmt.Errorf("Proxying %s <-> %s is not supported when using NAT",
 						listenAddr.connType, connectAddr.connType)
 				}
+
+				// Require a bridged nic with a static IP matching the target
+				if expanded {
+					_, _, err := proxyNatNicAddrs(devices, connectAddr)
+					if err != nil {
+						return errors.Wrapf(err, "Invalid NAT proxy device %q", name)
+					}
+				}
 			}
 
 		} else if m["type"] == "none" {
@@ -628,14 +1125,30 @@ func containerValidDevices(cluster *db.Cluster, devices types.Devices, profile b
 	return nil
 }
 
+// execScratchSize is the size of the tmpfs provided to commands run with a
+// scratch directory.
+const execScratchSize = "64m"
+
+// containerExecSandbox holds the confinement applied to a command run through
+// Exec on top of the container's own.
+type containerExecSandbox struct {
+	dropCapabilities []string
+	noNewPrivs       bool
+	syscallsDeny     []string
+	scratch          bool
+}
+
 // The container interface
 type container interface {
 	// Container actions
 	Freeze() error
+	Kill() error
 	Shutdown(timeout time.Duration) error
+	Signal(signal unix.Signal) error
 	Start(stateful bool) error
 	Stop(stateful bool) error
 	Unfreeze() error
+	RunFreezeHook(key string) error
 
 	// Snapshots & migration & backups
 	Restore(sourceContainer container, stateful bool) error
@@ -644,18 +1157,25 @@ type container interface {
 	 */
 	Migrate(args *CriuMigrationArgs) error
 	Snapshots() ([]container, error)
+	SnapshotDevice(deviceName string, snapshotName string) (string, error)
+	SnapshotsDiff(from string, to string) (*snapshotsDiff, error)
+	SelfSnapshot(name string) error
 	Backups() ([]backup, error)
 
 	// Config handling
 	Rename(newName string) error
 	Update(newConfig db.ContainerArgs, userRequested bool) error
+	RemoveDevicesByType(devType string) error
 
 	Delete() error
 	Export(w io.Writer, properties map[string]string) error
+	ExportOCI(w io.Writer, properties map[string]string) error
 
 	// Live configuration
 	CGroupGet(key string) (string, error)
 	CGroupSet(key string, value string) error
+	CPUSet() (string, error)
+	CGroupRepair() ([]string, error)
 	VolatileSet(changes map[string]string) error
 
 	// File handling
@@ -672,6 +1192,10 @@ type container interface {
 	// the user.
 	Console(terminal *os.File) *exec.Cmd
 	ConsoleLog(opts lxc.ConsoleLogOptions) (string, error)
+
+	// Log following - Return a reader of the liblxc log which waits for
+	// new lines, optionally filtered to those at or above level.
+	LogFollow(level string) (io.ReadCloser, error)
 	/* Command execution:
 		 * 1. passing in false for wait
 		 *    - equivalent to calling cmd.Run()
@@ -684,19 +1208,29 @@ type container interface {
 	         *      (the PID returned in the first return argument). It can however
 	         *      be used to e.g. forward signals.)
 	*/
-	Exec(command []string, env map[string]string, stdin *os.File, stdout *os.File, stderr *os.File, wait bool, cwd string, uid uint32, gid uint32) (*exec.Cmd, int, int, error)
+	Exec(command []string, env map[string]string, stdin *os.File, stdout *os.File, stderr *os.File, wait bool, cwd string, uid uint32, gid uint32, sandbox containerExecSandbox) (func() error, int, int, error)
 
 	// Status
 	Render() (interface{}, interface{}, error)
 	RenderFull() (*api.ContainerFull, interface{}, error)
 	RenderState() (*api.ContainerState, error)
+	RenderMetrics() ([]byte, error)
+	ExportFullConfig() (*backupFile, error)
+	VolatileKeys() map[string][]containerVolatileKey
 	IsPrivileged() bool
 	IsRunning() bool
 	IsFrozen() bool
 	IsEphemeral() bool
 	IsSnapshot() bool
 	IsStateful() bool
+	IsMetadataOnly() bool
 	IsNesting() bool
+	IsReady() bool
+	IsReadOnly() bool
+
+	// Readiness signalled by the container through devlxd
+	SetReady(ready bool) error
+	WaitForReady(timeout time.Duration) error
 
 	// Hooks
 	OnStart() error
@@ -721,6 +1255,7 @@ type container interface {
 	InitPID() int
 	State() string
 	ExpiryDate() time.Time
+	AutostartPriority() int
 
 	// Paths
 	Path() string
@@ -733,6 +1268,7 @@ type container interface {
 
 	// Storage
 	StoragePool() (string, error)
+	DiskUsage() (int64, bool, error)
 
 	// Progress reporting
 	SetOperation(op *operation)
@@ -741,6 +1277,8 @@ type container interface {
 	// Needed for migration for now.
 	StorageStart() (bool, error)
 	StorageStop() (bool, error)
+	RepairStorage() error
+	Trim() error
 	Storage() storage
 	TemplateApply(trigger string) error
 	DaemonState() *state.State
@@ -749,6 +1287,8 @@ type container interface {
 	CurrentIdmap() (*idmap.IdmapSet, error)
 	DiskIdmap() (*idmap.IdmapSet, error)
 	NextIdmap() (*idmap.IdmapSet, error)
+
+	ClearStaleOperation() error
 }
 
 // Loader functions
@@ -933,7 +1473,11 @@ func containerCreateFromImage(d *Daemon, args db.ContainerArgs, hash string, tra
 
 func containerCreateAsCopy(s *state.State, args db.ContainerArgs, sourceContainer container, containerOnly bool, refresh bool) (container, error) {
 	var ct container
-	var err error
+
+	err := containerCheckMetadataOnlySnapshots(sourceContainer, containerOnly)
+	if err != nil {
+		return nil, err
+	}
 
 	if refresh {
 		// Load the target container
@@ -1099,7 +1643,38 @@ func containerCreateAsCopy(s *state.State, args db.ContainerArgs, sourceContaine
 	return ct, nil
 }
 
+// containerCheckMetadataOnlySnapshots returns an error if the container is a metadata-only
+// snapshot or, unless containerOnly is set, has any. Those have no filesystem so can't be
+// copied, migrated or backed up.
+func containerCheckMetadataOnlySnapshots(c container, containerOnly bool) error {
+	if c.IsMetadataOnly() {
+		return fmt.Errorf("Snapshot %q is metadata-only and has no filesystem", c.Name())
+	}
+
+	if containerOnly {
+		return nil
+	}
+
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snapshots {
+		if snap.IsMetadataOnly() {
+			return fmt.Errorf("Snapshot %q is metadata-only and can't be transferred, delete it or only copy the container", snap.Name())
+		}
+	}
+
+	return nil
+}
+
 func containerCreateAsSnapshot(s *state.State, args db.ContainerArgs, sourceContainer container) (container, error) {
+	metadataOnly := shared.IsTrue(args.Config["volatile.snapshot.metadata_only"])
+	if metadataOnly && args.Stateful {
+		return nil, fmt.Errorf("Metadata-only snapshots can't be stateful")
+	}
+
 	// Deal with state
 	if args.Stateful {
 		if !sourceContainer.IsRunning() {
@@ -1150,11 +1725,13 @@ func containerCreateAsSnapshot(s *state.State, args db.ContainerArgs, sourceCont
 		return nil, err
 	}
 
-	// Clone the container
-	err = sourceContainer.Storage().ContainerSnapshotCreate(c, sourceContainer)
-	if err != nil {
-		c.Delete()
-		return nil, err
+	// Clone the container, metadata-only snapshots only record the configuration
+	if !metadataOnly {
+		err = sourceContainer.Storage().ContainerSnapshotCreate(c, sourceContainer)
+		if err != nil {
+			c.Delete()
+			return nil, err
+		}
 	}
 
 	// Attempt to update backup.yaml on container
@@ -1630,6 +2207,34 @@ func containerCompareSnapshots(source container, target container) ([]container,
 	return toSync, toDelete, nil
 }
 
+// containerScheduleDue returns whether a cron schedule (without seconds), as
+// used by snapshots.schedule, fires during the minute of now.
+func containerScheduleDue(schedule string, now time.Time) bool {
+	if schedule == "" {
+		return false
+	}
+
+	// Extend our schedule to one that is accepted by the used cron parser
+	sched, err := cron.Parse(fmt.Sprintf("* %s", schedule))
+	if err != nil {
+		return false
+	}
+
+	// Truncate the time now back to the start of the minute, before passing to
+	// the cron scheduler, as it will add 1s to the scheduled time and we don't
+	// want the next scheduled time to roll over to the next minute and break
+	// the time comparison below.
+	now = now.Truncate(time.Minute)
+
+	// Calculate the next scheduled time based on the pattern and the time now.
+	next := sched.Next(now)
+
+	// Ignore everything that is more precise than minutes.
+	next = next.Truncate(time.Minute)
+
+	return now.Equal(next)
+}
+
 func autoCreateContainerSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	f := func(ctx context.Context) {
 		// Load all local containers
@@ -1642,35 +2247,8 @@ func autoCreateContainerSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 		// Figure out which need snapshotting (if any)
 		containers := []container{}
 		for _, c := range allContainers {
-			schedule := c.ExpandedConfig()["snapshots.schedule"]
-
-			if schedule == "" {
-				continue
-			}
-
-			// Extend our schedule to one that is accepted by the used cron parser
-			sched, err := cron.Parse(fmt.Sprintf("* %s", schedule))
-			if err != nil {
-				continue
-			}
-
 			// Check if it's time to snapshot
-			now := time.Now()
-
-			// Truncate the time now back to the start of the minute, before passing to
-			// the cron scheduler, as it will add 1s to the scheduled time and we don't
-			// want the next scheduled time to roll over to the next minute and break
-			// the time comparison below.
-			now = now.Truncate(time.Minute)
-
-			// Calculate the next scheduled time based on the snapshots.schedule
-			// pattern and the time now.
-			next := sched.Next(now)
-
-			// Ignore everything that is more precise than minutes.
-			next = next.Truncate(time.Minute)
-
-			if !now.Equal(next) {
+			if !containerScheduleDue(c.ExpandedConfig()["snapshots.schedule"], time.Now()) {
 				continue
 			}
 
@@ -1772,6 +2350,49 @@ func autoCreateContainerSnapshots(ctx context.Context, d *Daemon, containers []c
 	return nil
 }
 
+func autoTrimContainersTask(d *Daemon) (task.Func, task.Schedule) {
+	f := func(ctx context.Context) {
+		// Load all local containers
+		allContainers, err := containerLoadNodeAll(d.State())
+		if err != nil {
+			logger.Error("Failed to load containers for scheduled trimming", log.Ctx{"err": err})
+			return
+		}
+
+		now := time.Now()
+		for _, c := range allContainers {
+			if !containerScheduleDue(c.ExpandedConfig()["trim.schedule"], now) {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			err := c.Trim()
+			if err != nil {
+				logger.Error("Failed to trim container filesystem", log.Ctx{"err": err, "container": c.Name(), "project": c.Project()})
+			}
+		}
+	}
+
+	first := true
+	schedule := func() (time.Duration, error) {
+		interval := time.Minute
+
+		if first {
+			first = false
+			return interval, task.ErrSkip
+		}
+
+		return interval, nil
+	}
+
+	return f, schedule
+}
+
 func pruneExpiredContainerSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	f := func(ctx context.Context) {
 		// Load all local containers
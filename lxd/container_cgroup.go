@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/lxc/go-lxc.v2"
+
+	"github.com/lxc/lxd/shared/logger"
+
+	log "github.com/lxc/lxd/shared/log15"
+)
+
+// cgroupController returns the (v1) controller a cgroup file belongs to.
+func cgroupController(key string) string {
+	controller := strings.SplitN(key, ".", 2)[0]
+
+	// The io controller is blkio on v1
+	if controller == "io" {
+		return "blkio"
+	}
+
+	return controller
+}
+
+// cgroupUnifiedItem translates a cgroup v1 file and value to their equivalent
+// on the unified hierarchy (cgroup v2). The returned key is empty when there's
+// no such equivalent (e.g. memory.swappiness), in which case the value should
+// be dropped. Keys unknown to v1 are passed through as is.
+func cgroupUnifiedItem(key string, value string) (string, string) {
+	unlimited := func(value string) string {
+		if value == "-1" {
+			return "max"
+		}
+
+		return value
+	}
+
+	switch key {
+	case "memory.limit_in_bytes":
+		return "memory.max", unlimited(value)
+	case "memory.soft_limit_in_bytes":
+		return "memory.high", unlimited(value)
+	case "memory.usage_in_bytes":
+		return "memory.current", value
+	case "memory.max_usage_in_bytes":
+		return "memory.peak", value
+	case "memory.memsw.usage_in_bytes":
+		return "memory.swap.current", value
+	case "memory.swappiness", "memory.memsw.max_usage_in_bytes":
+		return "", ""
+	case "memory.memsw.limit_in_bytes":
+		// Memory plus swap on v1, swap is limited on its own on v2
+		// through memory.swap.max
+		return "", ""
+	case "cpu.shares":
+		// Map [2, 262144] onto [1, 10000] the same way runc does
+		shares, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "cpu.weight", value
+		}
+
+		return "cpu.weight", fmt.Sprintf("%d", 1+((shares-2)*9999)/262142)
+	case "cpu.cfs_quota_us":
+		// Writing a single value only updates the quota
+		return "cpu.max", unlimited(value)
+	case "cpu.cfs_period_us":
+		return "cpu.max", fmt.Sprintf("max %s", value)
+	case "blkio.weight":
+		// Map [10, 1000] onto [1, 10000]
+		weight, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "io.weight", value
+		}
+
+		return "io.weight", fmt.Sprintf("default %d", 1+((weight-10)*9999)/990)
+	}
+
+	throttles := map[string]string{
+		"blkio.throttle.read_bps_device":   "rbps",
+		"blkio.throttle.read_iops_device":  "riops",
+		"blkio.throttle.write_bps_device":  "wbps",
+		"blkio.throttle.write_iops_device": "wiops",
+	}
+
+	limit, ok := throttles[key]
+	if ok {
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return "io.max", value
+		}
+
+		// Clearing a throttle is done by writing 0 on v1
+		value = fields[1]
+		if value == "0" {
+			value = "max"
+		}
+
+		return "io.max", fmt.Sprintf("%s %s=%s", fields[0], limit, unlimited(value))
+	}
+
+	if strings.HasPrefix(key, "hugetlb.") && strings.HasSuffix(key, ".limit_in_bytes") {
+		return strings.TrimSuffix(key, ".limit_in_bytes") + ".max", unlimited(value)
+	}
+
+	if strings.HasPrefix(key, "cpuacct.") || strings.HasPrefix(key, "net_prio.") {
+		return "", ""
+	}
+
+	return key, value
+}
+
+// cgroupUnified returns whether the container sees the controller of the
+// given cgroup file on the unified hierarchy.
+func (c *containerLXC) cgroupUnified(key string) bool {
+	return c.state.OS.CGroupUnified(cgroupController(key))
+}
+
+// setCGroupConfigItem sets a cgroup v1 file in the LXC config, translating it
+// to a lxc.cgroup2 item when the container gets the controller on the unified
+// hierarchy.
+func (c *containerLXC) setCGroupConfigItem(cc *lxc.Container, key string, value string) error {
+	if !c.cgroupUnified(key) {
+		return lxcSetConfigItem(cc, "lxc.cgroup."+key, value)
+	}
+
+	key, value = cgroupUnifiedItem(key, value)
+	if key == "" {
+		return nil
+	}
+
+	return lxcSetConfigItem(cc, "lxc.cgroup2."+key, value)
+}
+
+// lxcConfigCGroupItems extracts the cgroup items (v1 and unified) from a LXC
+// config file, keyed by cgroup file. Keys can be set multiple times (e.g. blkio
+// throttling of several devices).
+func lxcConfigCGroupItems(config string) map[string][]string {
+	items := map[string][]string{}
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "lxc.cgroup.") && !strings.HasPrefix(line, "lxc.cgroup2.") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(fields[0])
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "lxc.cgroup."), "lxc.cgroup2.")
+		if key == "dir" {
+			continue
+		}
+
+		items[key] = append(items[key], strings.TrimSpace(fields[1]))
+	}
+
+	return items
+}
+
+// cgroupDriftedValues returns the expected values of a cgroup file which
+// aren't part of its current content.
+func cgroupDriftedValues(expected []string, current string) []string {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(current, "\n") {
+		lines[strings.Join(strings.Fields(line), " ")] = true
+	}
+
+	drifted := []string{}
+	for _, value := range expected {
+		if !lines[strings.Join(strings.Fields(value), " ")] {
+			drifted = append(drifted, value)
+		}
+	}
+
+	return drifted
+}
+
+// cgroupMaxDriftedValues is cgroupDriftedValues for cpu.max and io.max. Those
+// are written one field at a time but read back with all fields combined, so
+// the fields are compared rather than the lines. All the cpu.max values are
+// returned on drift as they need to be written again in order.
+func cgroupMaxDriftedValues(key string, expected []string, current string) []string {
+	if key == "cpu.max" {
+		quota, period := "max", "100000"
+		for _, value := range expected {
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				quota = fields[0]
+			}
+
+			if len(fields) > 1 {
+				period = fields[1]
+			}
+		}
+
+		if strings.Join(strings.Fields(current), " ") == fmt.Sprintf("%s %s", quota, period) {
+			return []string{}
+		}
+
+		return expected
+	}
+
+	// Lines of io.max are "<major>:<minor> rbps=<value> wbps=<value> ..."
+	limits := map[string]string{}
+	for _, line := range strings.Split(current, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			limit := strings.SplitN(field, "=", 2)
+			if len(limit) == 2 {
+				limits[fields[0]+" "+limit[0]] = limit[1]
+			}
+		}
+	}
+
+	drifted := []string{}
+	for _, value := range expected {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			limit := strings.SplitN(field, "=", 2)
+			if len(limit) != 2 {
+				continue
+			}
+
+			// Devices without any limit aren't listed
+			currentValue, ok := limits[fields[0]+" "+limit[0]]
+			if !ok {
+				currentValue = "max"
+			}
+
+			if currentValue != limit[1] {
+				drifted = append(drifted, value)
+				break
+			}
+		}
+	}
+
+	return drifted
+}
+
+// CGroupRepair compares the cgroup values of the running container with the
+// ones its configuration sets on start and applies those which drifted again,
+// returning the cgroup files which were corrected.
+func (c *containerLXC) CGroupRepair() ([]string, error) {
+	if !c.IsRunning() {
+		return nil, fmt.Errorf("Can't repair the cgroups of a stopped container")
+	}
+
+	// Render the configuration the container would be started with
+	err := c.initLXC(true)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "lxd_cgroup_")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	err = c.c.SaveConfigFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	corrected := []string{}
+	for key, expected := range lxcConfigCGroupItems(string(config)) {
+		// Device rules are only ever added and the cpuset is managed by
+		// the scheduler
+		if strings.HasPrefix(key, "devices.") || strings.HasPrefix(key, "cpuset.") {
+			continue
+		}
+
+		// Unlimited values read back as the largest page aligned value
+		if len(expected) == 1 && expected[0] == "-1" {
+			continue
+		}
+
+		current, err := c.CGroupGet(key)
+		if err != nil {
+			return corrected, err
+		}
+
+		var drifted []string
+		if key == "cpu.max" || key == "io.max" {
+			drifted = cgroupMaxDriftedValues(key, expected, current)
+		} else {
+			drifted = cgroupDriftedValues(expected, current)
+		}
+		if len(drifted) == 0 {
+			continue
+		}
+
+		for _, value := range drifted {
+			err := c.CGroupSet(key, value)
+			if err != nil {
+				return corrected, fmt.Errorf("Failed to restore %s to %s: %v", key, value, err)
+			}
+		}
+
+		logger.Info("Restored drifted cgroup value", log.Ctx{"container": c.name, "project": c.project, "key": key, "expected": strings.Join(expected, ", "), "current": current})
+		corrected = append(corrected, key)
+	}
+
+	sort.Strings(corrected)
+
+	// Have the scheduler put back the cpu pinning
+	if c.expandedConfig["limits.cpu"] != "" {
+		deviceTaskSchedulerTrigger("container", c.name, "changed")
+	}
+
+	return corrected, nil
+}
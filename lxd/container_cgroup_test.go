@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCConfigCGroupItems(t *testing.T) {
+	config := `lxc.uts.name = c1
+lxc.cgroup.memory.limit_in_bytes = 1073741824
+lxc.cgroup.blkio.throttle.read_bps_device = 8:0 1048576
+lxc.cgroup.blkio.throttle.read_bps_device = 8:16 1048576
+lxc.cgroup2.pids.max = 100
+lxc.cgroup2.memory.max = 1073741824
+lxc.cgroup2.memory.swap.max = max
+lxc.cgroup2.cpu.max = max 100000
+lxc.cgroup2.cpu.max = 50000
+lxc.cgroup.dir = lxd/c1
+`
+
+	items := lxcConfigCGroupItems(config)
+	require.Equal(t, map[string][]string{
+		"memory.limit_in_bytes":          {"1073741824"},
+		"blkio.throttle.read_bps_device": {"8:0 1048576", "8:16 1048576"},
+		"pids.max":                       {"100"},
+		"memory.max":                     {"1073741824"},
+		"memory.swap.max":                {"max"},
+		"cpu.max":                        {"max 100000", "50000"},
+	}, items)
+}
+
+func TestCGroupUnifiedItem(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		value         string
+		expectedKey   string
+		expectedValue string
+	}{
+		{"Memory limit", "memory.limit_in_bytes", "1073741824", "memory.max", "1073741824"},
+		{"Unlimited soft limit", "memory.soft_limit_in_bytes", "-1", "memory.high", "max"},
+		{"Memory and swap limit", "memory.memsw.limit_in_bytes", "1073741824", "", ""},
+		{"Swappiness", "memory.swappiness", "0", "", ""},
+		{"Hugepages", "hugetlb.2MB.limit_in_bytes", "4194304", "hugetlb.2MB.max", "4194304"},
+		{"Default CPU shares", "cpu.shares", "1024", "cpu.weight", "39"},
+		{"Maximum CPU shares", "cpu.shares", "262144", "cpu.weight", "10000"},
+		{"CPU period", "cpu.cfs_period_us", "100000", "cpu.max", "max 100000"},
+		{"CPU quota", "cpu.cfs_quota_us", "50000", "cpu.max", "50000"},
+		{"Disk priority", "blkio.weight", "500", "io.weight", "default 4950"},
+		{"Disk throttle", "blkio.throttle.write_iops_device", "8:0 100", "io.max", "8:0 wiops=100"},
+		{"Cleared disk throttle", "blkio.throttle.read_bps_device", "8:0 0", "io.max", "8:0 rbps=max"},
+		{"Processes", "pids.max", "100", "pids.max", "100"},
+		{"Network priority", "net_prio.ifpriomap", "eth0 5", "", ""},
+	}
+
+	for i, tt := range tests {
+		log.Printf("Running test #%d: %s", i, tt.name)
+		key, value := cgroupUnifiedItem(tt.key, tt.value)
+		require.Equal(t, tt.expectedKey, key)
+		require.Equal(t, tt.expectedValue, value)
+	}
+}
+
+func TestCGroupDriftedValues(t *testing.T) {
+	require.Len(t, cgroupDriftedValues([]string{"1024"}, "1024\n"), 0)
+	require.Equal(t, []string{"512"}, cgroupDriftedValues([]string{"512"}, "1024"))
+
+	// Multi-valued files only need to contain the expected values
+	current := "8:0 1048576\n8:32 2048\n"
+	require.Equal(t, []string{"8:16 1048576"}, cgroupDriftedValues([]string{"8:0 1048576", "8:16 1048576"}, current))
+}
+
+func TestCGroupMaxDriftedValues(t *testing.T) {
+	// The quota and period are written separately but read back together
+	expected := []string{"max 100000", "50000"}
+	require.Len(t, cgroupMaxDriftedValues("cpu.max", expected, "50000 100000\n"), 0)
+	require.Equal(t, expected, cgroupMaxDriftedValues("cpu.max", expected, "max 100000\n"))
+
+	// Each throttle is written on its own but read back per device
+	expected = []string{"8:0 rbps=1048576", "8:0 wiops=max", "8:16 wbps=2048"}
+	current := "8:0 rbps=1048576 wbps=max riops=max wiops=max\n"
+	require.Equal(t, []string{"8:16 wbps=2048"}, cgroupMaxDriftedValues("io.max", expected, current))
+}
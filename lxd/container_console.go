@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/syslog"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -18,12 +21,20 @@ import (
 
 	"github.com/lxc/lxd/lxd/cluster"
 	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/logger"
+
+	log "github.com/lxc/lxd/shared/log15"
 )
 
+// Stop channels of the containers whose console output is being forwarded for
+// console.forward
+var consoleForwardersLock sync.Mutex
+var consoleForwarders map[int]chan struct{} = make(map[int]chan struct{})
+
 type consoleWs struct {
 	// container currently worked on
 	container container
@@ -461,3 +472,168 @@ func containerConsoleLogDelete(d *Daemon, r *http.Request) Response {
 
 	return SmartError(nil)
 }
+
+// consoleForwardStart starts forwarding the console output of a container to
+// the given console.forward target, replacing any existing forwarder.
+func consoleForwardStart(s *state.State, id int, target string) {
+	stop := make(chan struct{})
+
+	consoleForwardersLock.Lock()
+	old, ok := consoleForwarders[id]
+	if ok {
+		close(old)
+	}
+	consoleForwarders[id] = stop
+	consoleForwardersLock.Unlock()
+
+	go consoleForward(s, id, target, stop)
+}
+
+// consoleForwardStop stops forwarding the console output of a container.
+func consoleForwardStop(id int) {
+	consoleForwardersLock.Lock()
+	defer consoleForwardersLock.Unlock()
+
+	stop, ok := consoleForwarders[id]
+	if !ok {
+		return
+	}
+
+	close(stop)
+	delete(consoleForwarders, id)
+}
+
+// consoleForwardResume restarts forwarding the console output of the running
+// containers using console.forward, on daemon startup.
+func consoleForwardResume(s *state.State) error {
+	containers, err := containerLoadNodeAll(s)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		target := c.ExpandedConfig()["console.forward"]
+		if target == "" || !c.IsRunning() {
+			continue
+		}
+
+		consoleForwardStart(s, c.Id(), target)
+	}
+
+	return nil
+}
+
+// consoleForward forwards the new lines of the container's console ringbuffer
+// to the host's syslog (and so the systemd journal) or to a remote syslog
+// server, as set in console.forward. It runs until stop is closed, when the
+// container stops or the key changes.
+func consoleForward(s *state.State, id int, target string, stop chan struct{}) {
+	var c container
+	var writer *syslog.Writer
+	previous := ""
+
+	defer func() {
+		if writer != nil {
+			writer.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if c == nil {
+			c, err = containerLoadById(s, id)
+			if err != nil {
+				c = nil
+				continue
+			}
+		}
+
+		if writer == nil {
+			network := ""
+			raddr := ""
+			if target != "local" {
+				fields := strings.SplitN(target, ":", 2)
+				network = fields[0]
+				raddr = fields[1]
+			}
+
+			tag := fmt.Sprintf("lxd.%s", projectPrefix(c.Project(), c.Name()))
+			writer, err = syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+			if err != nil {
+				logger.Warn("Failed to connect to syslog to forward the console", log.Ctx{"container": c.Name(), "target": target, "err": err})
+				writer = nil
+				continue
+			}
+		}
+
+		// The ringbuffer is empty (ENODATA) until something is written
+		content, err := c.ConsoleLog(lxc.ConsoleLogOptions{ReadLog: true})
+		if err != nil {
+			continue
+		}
+
+		var lines []string
+		lines, previous = consoleNewLines(previous, content)
+		for _, line := range lines {
+			writer.Info(line)
+		}
+	}
+}
+
+// consoleNewLines returns the complete lines of the console ringbuffer which
+// weren't part of the previous content, along with the content to compare
+// against on the next call.
+func consoleNewLines(previous string, content string) ([]string, string) {
+	// Only forward complete lines, the rest will be picked up next time
+	end := strings.LastIndex(content, "\n")
+	if end < 0 {
+		return nil, previous
+	}
+	content = content[:end+1]
+
+	added := content
+	if strings.HasPrefix(content, previous) {
+		added = content[len(previous):]
+	} else if previous != "" {
+		// The ringbuffer wrapped and dropped its oldest content, look for
+		// the previous last line with everything before it being the end
+		// of the previous content.
+		last := previous[strings.LastIndex(strings.TrimSuffix(previous, "\n"), "\n")+1:]
+
+		offset := 0
+		for {
+			idx := strings.Index(content[offset:], last)
+			if idx < 0 {
+				break
+			}
+
+			end := offset + idx + len(last)
+			if strings.HasSuffix(previous, content[:end]) {
+				added = content[end:]
+				break
+			}
+
+			offset += idx + 1
+		}
+	}
+
+	if added == "" {
+		return nil, content
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(added, "\n"), "\n") {
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+
+	return lines, content
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleNewLines(t *testing.T) {
+	// Incomplete lines are held back
+	lines, previous := consoleNewLines("", "first\nsecond")
+	require.Equal(t, []string{"first"}, lines)
+	require.Equal(t, "first\n", previous)
+
+	lines, previous = consoleNewLines(previous, "first\nsecond\r\nthird\n")
+	require.Equal(t, []string{"second", "third"}, lines)
+	require.Equal(t, "first\nsecond\r\nthird\n", previous)
+
+	// Nothing new
+	lines, previous = consoleNewLines(previous, "first\nsecond\r\nthird\n")
+	require.Len(t, lines, 0)
+
+	// The ringbuffer wrapped and dropped its oldest content
+	lines, _ = consoleNewLines(previous, "cond\r\nthird\nfourth\n")
+	require.Equal(t, []string{"fourth"}, lines)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+
+	"github.com/lxc/lxd/lxd/types"
+	"github.com/lxc/lxd/shared"
+)
+
+// Properties supported by all nic types. The parent is tolerated on p2p nics
+// so that a nic can be switched to another nictype one property at a time.
+var containerNicCommonKeys = []string{"type", "nictype", "name", "hwaddr", "mtu", "parent", "ipv4.pmtu_discovery"}
+
+// Properties supported by each nictype on top of containerNicCommonKeys.
+var containerNicTypeKeys = map[string][]string{
+	"bridged": {
+		"host_name", "mss_clamp", "promisc",
+		"limits.ingress", "limits.egress", "limits.max", "limits.connections",
+		"ipv4.address", "ipv4.dhcp", "ipv6.address", "ipv4.routes", "ipv6.routes",
+		"security.mac_filtering", "security.ipv4_filtering", "security.ipv6_filtering",
+		"maas.subnet.ipv4", "maas.subnet.ipv6",
+		"dns.register", "dns.domain", "dns.aliases",
+	},
+	"ipvlan":   {"host_name", "ipv4.address", "ipv6.address", "vlan"},
+	"macvlan":  {"host_name", "promisc", "vlan", "maas.subnet.ipv4", "maas.subnet.ipv6"},
+	"p2p":      {"host_name", "limits.ingress", "limits.egress", "limits.max", "ipv4.routes", "ipv6.routes", "vrf", "ipv4.host_address", "ipv6.host_address"},
+	"physical": {"promisc", "vlan", "maas.subnet.ipv4", "maas.subnet.ipv6"},
+	"sriov":    {"security.mac_filtering", "vlan", "maas.subnet.ipv4", "maas.subnet.ipv6"},
+}
+
+// Properties which can't be combined, per device type. The first one of each
+// pair supersedes the second.
+var containerDeviceExclusiveKeys = map[string][][2]string{
+	"nic":   {{"limits.max", "limits.ingress"}, {"limits.max", "limits.egress"}},
+	"disk":  {{"limits.max", "limits.read"}, {"limits.max", "limits.write"}, {"pool", "source.timeout"}},
+	"gpu":   {{"pci", "id"}, {"pci", "vendorid"}, {"pci", "productid"}, {"id", "vendorid"}, {"id", "productid"}},
+	"proxy": {{"nat", "proxy_protocol"}, {"nat", "security.uid"}, {"nat", "security.gid"}},
+}
+
+// Properties requiring another one to be set, per device type.
+var containerDeviceRequiredKeys = map[string]map[string]string{
+	"disk": {"source.timeout": "source"},
+	"gpu":  {"productid": "vendorid"},
+	"usb":  {"productid": "vendorid"},
+}
+
+// Boolean properties which only conflict with others when enabled.
+var containerDeviceBoolKeys = []string{"nat"}
+
+// USB and PCI ids as found in sysfs.
+var containerDeviceHexID = regexp.MustCompile("^[0-9a-f]{4}$")
+
+// containerValidDeviceKeys checks the combination of properties of a device,
+// catching configurations which would otherwise only fail (or be silently
+// ignored) when the device gets set up.
+func containerValidDeviceKeys(m types.Device) error {
+	if m["type"] == "nic" && m["nictype"] != "" {
+		supported, ok := containerNicTypeKeys[m["nictype"]]
+		if !ok {
+			return fmt.Errorf("Bad nic type: %s", m["nictype"])
+		}
+
+		for k := range m {
+			if !shared.StringInSlice(k, containerNicCommonKeys) && !shared.StringInSlice(k, supported) {
+				return fmt.Errorf("The \"%s\" property isn't supported by %s nics", k, m["nictype"])
+			}
+		}
+	}
+
+	isSet := func(k string) bool {
+		if shared.StringInSlice(k, containerDeviceBoolKeys) {
+			return shared.IsTrue(m[k])
+		}
+
+		return m[k] != ""
+	}
+
+	for _, keys := range containerDeviceExclusiveKeys[m["type"]] {
+		if isSet(keys[0]) && isSet(keys[1]) {
+			return fmt.Errorf("The \"%s\" and \"%s\" properties can't be combined", keys[0], keys[1])
+		}
+	}
+
+	for k, required := range containerDeviceRequiredKeys[m["type"]] {
+		if m[k] != "" && m[required] == "" {
+			return fmt.Errorf("The \"%s\" property requires \"%s\" to be set", k, required)
+		}
+	}
+
+	if shared.StringInSlice(m["type"], []string{"gpu", "usb"}) {
+		for _, k := range []string{"vendorid", "productid"} {
+			if m[k] != "" && !containerDeviceHexID.MatchString(m[k]) {
+				return fmt.Errorf("Invalid value for %s (expected 4 lowercase hexadecimal digits): %s", k, m[k])
+			}
+		}
+	}
+
+	if m["type"] == "disk" && m["path"] == "/" && m["propagation"] != "" {
+		return fmt.Errorf("The root disk can't have a propagation mode set")
+	}
+
+	return nil
+}
+
+// containerValidChangedDeviceKeys runs containerValidDeviceKeys on the devices
+// which were added or modified compared to oldDevices. Devices stored before
+// those checks existed may carry properties which used to be ignored, they
+// must remain usable as they are.
+func containerValidChangedDeviceKeys(oldDevices types.Devices, newDevices types.Devices) error {
+	for _, name := range newDevices.DeviceNames() {
+		m := newDevices[name]
+		if oldDevices.Contains(name, m) {
+			continue
+		}
+
+		err := containerValidDeviceKeys(m)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid device %q", name)
+		}
+	}
+
+	return nil
+}
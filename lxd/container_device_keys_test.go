@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/types"
+)
+
+func TestContainerValidDeviceKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		device   types.Device
+		expected string
+	}{
+		// nic
+		{
+			"Bridged nic",
+			types.Device{"type": "nic", "nictype": "bridged", "parent": "lxdbr0", "ipv4.address": "10.0.0.2", "limits.ingress": "1Mbit"},
+			"",
+		},
+		{
+			"Parent tolerated on p2p nic",
+			types.Device{"type": "nic", "nictype": "p2p", "parent": "lxdbr0"},
+			"",
+		},
+		{
+			"DHCP on macvlan nic",
+			types.Device{"type": "nic", "nictype": "macvlan", "parent": "eth0", "ipv4.dhcp": "false"},
+			`The "ipv4.dhcp" property isn't supported by macvlan nics`,
+		},
+		{
+			"VLAN on bridged nic",
+			types.Device{"type": "nic", "nictype": "bridged", "parent": "lxdbr0", "vlan": "10"},
+			`The "vlan" property isn't supported by bridged nics`,
+		},
+		{
+			"Host address on bridged nic",
+			types.Device{"type": "nic", "nictype": "bridged", "parent": "lxdbr0", "ipv4.host_address": "10.0.0.1"},
+			`The "ipv4.host_address" property isn't supported by bridged nics`,
+		},
+		{
+			"Limits on sriov nic",
+			types.Device{"type": "nic", "nictype": "sriov", "parent": "eth0", "limits.max": "1Mbit"},
+			`The "limits.max" property isn't supported by sriov nics`,
+		},
+		{
+			"Overall and directional nic limits",
+			types.Device{"type": "nic", "nictype": "p2p", "limits.max": "1Mbit", "limits.egress": "2Mbit"},
+			`The "limits.max" and "limits.egress" properties can't be combined`,
+		},
+		{
+			"Unknown nictype",
+			types.Device{"type": "nic", "nictype": "veth"},
+			"Bad nic type: veth",
+		},
+
+		// disk
+		{
+			"Overall and directional disk limits",
+			types.Device{"type": "disk", "path": "/mnt", "source": "/srv", "limits.max": "10MB", "limits.read": "20MB"},
+			`The "limits.max" and "limits.read" properties can't be combined`,
+		},
+		{
+			"Source timeout on storage volume",
+			types.Device{"type": "disk", "path": "/mnt", "pool": "default", "source": "vol1", "source.timeout": "5"},
+			`The "pool" and "source.timeout" properties can't be combined`,
+		},
+		{
+			"Source timeout without source",
+			types.Device{"type": "disk", "path": "/mnt", "fuse": "sshfs host:/srv", "source.timeout": "5"},
+			`The "source.timeout" property requires "source" to be set`,
+		},
+		{
+			"Propagation on root disk",
+			types.Device{"type": "disk", "path": "/", "pool": "default", "propagation": "shared"},
+			"The root disk can't have a propagation mode set",
+		},
+
+		// gpu
+		{
+			"GPU by vendor and product",
+			types.Device{"type": "gpu", "vendorid": "10de", "productid": "1b80"},
+			"",
+		},
+		{
+			"GPU by id and vendor",
+			types.Device{"type": "gpu", "id": "0", "vendorid": "10de"},
+			`The "id" and "vendorid" properties can't be combined`,
+		},
+		{
+			"GPU product without vendor",
+			types.Device{"type": "gpu", "productid": "1b80"},
+			`The "productid" property requires "vendorid" to be set`,
+		},
+		{
+			"GPU with uppercase vendor",
+			types.Device{"type": "gpu", "vendorid": "10DE"},
+			"Invalid value for vendorid (expected 4 lowercase hexadecimal digits): 10DE",
+		},
+
+		// usb
+		{
+			"USB product without vendor",
+			types.Device{"type": "usb", "productid": "5678"},
+			`The "productid" property requires "vendorid" to be set`,
+		},
+
+		// proxy
+		{
+			"NAT proxy with PROXY header",
+			types.Device{"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:10.0.0.2:80", "nat": "true", "proxy_protocol": "true"},
+			`The "nat" and "proxy_protocol" properties can't be combined`,
+		},
+		{
+			"Non-NAT proxy with PROXY header",
+			types.Device{"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:80", "nat": "false", "proxy_protocol": "true"},
+			"",
+		},
+	}
+
+	for i, tt := range tests {
+		log.Printf("Running test #%d: %s", i, tt.name)
+		err := containerValidDeviceKeys(tt.device)
+		if tt.expected == "" {
+			require.NoError(t, err)
+			continue
+		}
+
+		require.EqualError(t, err, tt.expected)
+	}
+}
+
+func TestContainerValidChangedDeviceKeys(t *testing.T) {
+	stored := types.Devices{
+		"eth0": {"type": "nic", "nictype": "macvlan", "parent": "eth0", "limits.max": "10Mbit"},
+	}
+
+	// Unchanged devices are left alone
+	err := containerValidChangedDeviceKeys(stored, types.Devices{
+		"eth0": {"type": "nic", "nictype": "macvlan", "parent": "eth0", "limits.max": "10Mbit"},
+		"eth1": {"type": "nic", "nictype": "macvlan", "parent": "eth1"},
+	})
+	require.NoError(t, err)
+
+	// Modified devices are checked
+	err = containerValidChangedDeviceKeys(stored, types.Devices{
+		"eth0": {"type": "nic", "nictype": "macvlan", "parent": "eth1", "limits.max": "10Mbit"},
+	})
+	require.EqualError(t, err, `Invalid device "eth0": The "limits.max" property isn't supported by macvlan nics`)
+}
+
+func TestContainerFuseChanged(t *testing.T) {
+	stored := types.Devices{
+		"data": {"type": "disk", "path": "/mnt", "fuse": "sshfs host:/srv"},
+	}
+
+	// Keeping or dropping an existing command is fine
+	require.False(t, containerFuseChanged(stored, stored))
+	require.False(t, containerFuseChanged(stored, types.Devices{}))
+
+	// Setting or changing one isn't
+	require.True(t, containerFuseChanged(nil, stored))
+	require.True(t, containerFuseChanged(stored, types.Devices{
+		"data": {"type": "disk", "path": "/mnt", "fuse": "sshfs other:/srv"},
+	}))
+}
@@ -46,6 +46,47 @@ type execWs struct {
 	uid              uint32
 	gid              uint32
 	cwd              string
+	sandbox          containerExecSandbox
+}
+
+// execCapabilities lists the capabilities which may be dropped from an exec.
+var execCapabilities = []string{
+	"audit_control", "audit_read", "audit_write", "block_suspend", "chown",
+	"dac_override", "dac_read_search", "fowner", "fsetid", "ipc_lock",
+	"ipc_owner", "kill", "lease", "linux_immutable", "mac_admin",
+	"mac_override", "mknod", "net_admin", "net_bind_service", "net_broadcast",
+	"net_raw", "setfcap", "setgid", "setpcap", "setuid", "sys_admin",
+	"sys_boot", "sys_chroot", "sys_module", "sys_nice", "sys_pacct",
+	"sys_ptrace", "sys_rawio", "sys_resource", "sys_time", "sys_tty_config",
+	"syslog", "wake_alarm",
+}
+
+// execSandboxGet validates the confinement requested for an exec.
+func execSandboxGet(post api.ContainerExecPost) (containerExecSandbox, error) {
+	sandbox := containerExecSandbox{
+		noNewPrivs: post.NoNewPrivs,
+		scratch:    post.Scratch,
+	}
+
+	for _, capability := range post.DropCapabilities {
+		name := strings.TrimPrefix(strings.ToLower(capability), "cap_")
+		if !shared.StringInSlice(name, execCapabilities) {
+			return sandbox, fmt.Errorf("Unknown capability: %s", capability)
+		}
+
+		sandbox.dropCapabilities = append(sandbox.dropCapabilities, name)
+	}
+
+	for _, entry := range post.SyscallsDeny {
+		name := strings.TrimSpace(entry)
+		if !shared.StringInSlice(name, shared.SyscallNames) {
+			return sandbox, fmt.Errorf("Unknown system call: %s", entry)
+		}
+
+		sandbox.syscallsDeny = append(sandbox.syscallsDeny, name)
+	}
+
+	return sandbox, nil
 }
 
 func (s *execWs) Metadata() interface{} {
@@ -63,6 +104,7 @@ func (s *execWs) Metadata() interface{} {
 		"command":     s.command,
 		"environment": s.env,
 		"interactive": s.interactive,
+		"readonly":    s.container.IsReadOnly(),
 	}
 }
 
@@ -302,7 +344,7 @@ func (s *execWs) Do(op *operation) error {
 			pty.Close()
 		}
 
-		metadata := shared.Jmap{"return": cmdResult}
+		metadata := shared.Jmap{"return": cmdResult, "readonly": s.container.IsReadOnly()}
 		err = op.UpdateMetadata(metadata)
 		if err != nil {
 			return err
@@ -311,7 +353,7 @@ func (s *execWs) Do(op *operation) error {
 		return cmdErr
 	}
 
-	cmd, _, attachedPid, err := s.container.Exec(s.command, s.env, stdin, stdout, stderr, false, s.cwd, s.uid, s.gid)
+	waitCmd, _, attachedPid, err := s.container.Exec(s.command, s.env, stdin, stdout, stderr, false, s.cwd, s.uid, s.gid, s.sandbox)
 	if err != nil {
 		return err
 	}
@@ -320,7 +362,7 @@ func (s *execWs) Do(op *operation) error {
 		attachedChildIsBorn <- attachedPid
 	}
 
-	err = cmd.Wait()
+	err = waitCmd()
 	if err == nil {
 		return finisher(0, nil)
 	}
@@ -382,18 +424,39 @@ func containerExecPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(fmt.Errorf("Container is not running"))
 	}
 
-	if c.IsFrozen() {
+	if c.IsFrozen() && !shared.IsTrue(c.ExpandedConfig()["security.thaw_on_access"]) {
 		return BadRequest(fmt.Errorf("Container is frozen"))
 	}
 
+	sandbox, err := execSandboxGet(post)
+	if err != nil {
+		return BadRequest(err)
+	}
+
 	env := map[string]string{}
 
 	for k, v := range c.ExpandedConfig() {
 		if strings.HasPrefix(k, "environment.") {
+			v, err := containerConfigExpand(c.ExpandedConfig(), v, k)
+			if err != nil {
+				return BadRequest(fmt.Errorf("Failed to expand %s: %v", k, err))
+			}
+
 			env[strings.TrimPrefix(k, "environment.")] = v
 		}
 	}
 
+	for k, v := range c.ExpandedConfig() {
+		if strings.HasPrefix(k, "environment_file.") && v != "" {
+			secret, err := containerReadSecret(v)
+			if err != nil {
+				return InternalError(err)
+			}
+
+			env[strings.TrimPrefix(k, "environment_file.")] = secret
+		}
+	}
+
 	if post.Environment != nil {
 		for k, v := range post.Environment {
 			env[k] = v
@@ -470,6 +533,7 @@ func containerExecPost(d *Daemon, r *http.Request) Response {
 		ws.cwd = post.Cwd
 		ws.uid = post.User
 		ws.gid = post.Group
+		ws.sandbox = sandbox
 
 		resources := map[string][]string{}
 		resources["containers"] = []string{ws.container.Name()}
@@ -485,7 +549,7 @@ func containerExecPost(d *Daemon, r *http.Request) Response {
 	run := func(op *operation) error {
 		var cmdErr error
 		var cmdResult int
-		metadata := shared.Jmap{}
+		metadata := shared.Jmap{"readonly": c.IsReadOnly()}
 
 		if post.RecordOutput {
 			// Prepare stdout and stderr recording
@@ -502,7 +566,7 @@ func containerExecPost(d *Daemon, r *http.Request) Response {
 			defer stderr.Close()
 
 			// Run the command
-			_, cmdResult, _, cmdErr = c.Exec(post.Command, env, nil, stdout, stderr, true, post.Cwd, post.User, post.Group)
+			_, cmdResult, _, cmdErr = c.Exec(post.Command, env, nil, stdout, stderr, true, post.Cwd, post.User, post.Group, sandbox)
 
 			// Update metadata with the right URLs
 			metadata["return"] = cmdResult
@@ -511,7 +575,7 @@ func containerExecPost(d *Daemon, r *http.Request) Response {
 				"2": fmt.Sprintf("/%s/containers/%s/logs/%s", version.APIVersion, c.Name(), filepath.Base(stderr.Name())),
 			}
 		} else {
-			_, cmdResult, _, cmdErr = c.Exec(post.Command, env, nil, nil, nil, true, post.Cwd, post.User, post.Group)
+			_, cmdResult, _, cmdErr = c.Exec(post.Command, env, nil, nil, nil, true, post.Cwd, post.User, post.Group, sandbox)
 			metadata["return"] = cmdResult
 		}
 
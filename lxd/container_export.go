@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+
+	"github.com/lxc/lxd/shared"
+)
+
+func containerExportGet(d *Daemon, r *http.Request) Response {
+	project := projectParam(r)
+	name := mux.Vars(r)["name"]
+
+	// Handle requests targeted to a container on a different node
+	response, err := ForwardedResponseIfContainerIsRemote(d, r, project, name)
+	if err != nil {
+		return SmartError(err)
+	}
+	if response != nil {
+		return response
+	}
+
+	c, err := containerLoadByProjectAndName(d.State(), project, name)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if c.IsRunning() {
+		return BadRequest(fmt.Errorf("Cannot export a running container as an image"))
+	}
+
+	// The image layout is staged next to the images and removed once served
+	f, err := ioutil.TempFile(shared.VarPath("images"), "lxd_oci_export_")
+	if err != nil {
+		return InternalError(err)
+	}
+	defer f.Close()
+
+	err = c.ExportOCI(f, map[string]string{})
+	if err != nil {
+		os.Remove(f.Name())
+		return SmartError(err)
+	}
+
+	ent := fileResponseEntry{
+		path:     f.Name(),
+		filename: name + ".oci.tar",
+	}
+
+	return FileResponse(r, []fileResponseEntry{ent}, nil, true)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -139,3 +143,192 @@ func containerLogDelete(d *Daemon, r *http.Request) Response {
 
 	return SmartError(os.Remove(shared.LogPath(name, file)))
 }
+
+// lxcLogLevels lists the liblxc log levels by increasing priority.
+var lxcLogLevels = []string{"TRACE", "DEBUG", "INFO", "NOTICE", "WARN", "ERROR", "CRIT", "ALERT", "FATAL"}
+
+// lxcLogFollower is a reader of a liblxc log file which waits for new content
+// to be written and follows the rotation of the file done on container start.
+type lxcLogFollower struct {
+	path     string
+	minLevel int
+
+	file     *os.File
+	fileLock sync.Mutex
+	pending  []byte
+	buffer   []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLxcLogFollower(path string, level string) (*lxcLogFollower, error) {
+	minLevel := 0
+	if level != "" {
+		minLevel = -1
+		for i, name := range lxcLogLevels {
+			if strings.ToUpper(level) == name {
+				minLevel = i
+				break
+			}
+		}
+
+		if minLevel == -1 {
+			return nil, fmt.Errorf("Invalid log level: %s", level)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lxcLogFollower{
+		path:     path,
+		minLevel: minLevel,
+		file:     file,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// keep returns whether a log line passes the level filter.
+func (f *lxcLogFollower) keep(line []byte) bool {
+	if f.minLevel == 0 {
+		return true
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 4 {
+		return false
+	}
+
+	// Depending on the liblxc version, the container name may precede
+	// the timestamp and level.
+	for _, field := range fields[2:4] {
+		for i, name := range lxcLogLevels {
+			if field == name {
+				return i >= f.minLevel
+			}
+		}
+	}
+
+	return false
+}
+
+// currentFile returns the log file being followed.
+func (f *lxcLogFollower) currentFile() *os.File {
+	f.fileLock.Lock()
+	defer f.fileLock.Unlock()
+
+	return f.file
+}
+
+// reopen switches to a new log file if the current one got rotated.
+func (f *lxcLogFollower) reopen() bool {
+	current, err := f.currentFile().Stat()
+	if err != nil {
+		return false
+	}
+
+	latest, err := os.Stat(f.path)
+	if err != nil || os.SameFile(current, latest) {
+		return false
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false
+	}
+
+	f.fileLock.Lock()
+	defer f.fileLock.Unlock()
+
+	// Don't leak the new file if the follower got closed meanwhile
+	select {
+	case <-f.closed:
+		file.Close()
+		return false
+	default:
+	}
+
+	f.file.Close()
+	f.file = file
+
+	return true
+}
+
+func (f *lxcLogFollower) Read(p []byte) (int, error) {
+	buf := make([]byte, 4096)
+
+	for len(f.pending) == 0 {
+		select {
+		case <-f.closed:
+			return 0, io.EOF
+		default:
+		}
+
+		n, err := f.currentFile().Read(buf)
+		if n > 0 {
+			f.buffer = append(f.buffer, buf[:n]...)
+
+			// Only pass on complete lines which match the filter
+			for {
+				idx := bytes.IndexByte(f.buffer, '\n')
+				if idx < 0 {
+					break
+				}
+
+				line := f.buffer[:idx+1]
+				if f.keep(line) {
+					f.pending = append(f.pending, line...)
+				}
+
+				f.buffer = f.buffer[idx+1:]
+			}
+
+			continue
+		}
+
+		if err != nil && err != io.EOF {
+			// The file gets closed under us when the follower is closed
+			select {
+			case <-f.closed:
+				return 0, io.EOF
+			default:
+			}
+
+			return 0, err
+		}
+
+		// Reached the end of the file, check for rotation or wait for more
+		if f.reopen() {
+			f.buffer = nil
+			continue
+		}
+
+		select {
+		case <-f.closed:
+			return 0, io.EOF
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+
+	return n, nil
+}
+
+func (f *lxcLogFollower) Close() error {
+	var err error
+
+	f.closeOnce.Do(func() {
+		close(f.closed)
+
+		f.fileLock.Lock()
+		err = f.file.Close()
+		f.fileLock.Unlock()
+	})
+
+	return err
+}
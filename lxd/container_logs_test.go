@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLxcLogFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd-logs-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logfile := filepath.Join(dir, "lxc.log")
+	err = ioutil.WriteFile(logfile, []byte(
+		"lxc c1 20190101000000.000 INFO     start - start.c:1 - first\n"+
+			"lxc c1 20190101000000.000 ERROR    start - start.c:2 - second\n"), 0644)
+	require.NoError(t, err)
+
+	follower, err := newLxcLogFollower(logfile, "error")
+	require.NoError(t, err)
+	defer follower.Close()
+
+	buf := make([]byte, 4096)
+	n, err := follower.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "lxc c1 20190101000000.000 ERROR    start - start.c:2 - second\n", string(buf[:n]))
+
+	// Rotate the log file as done on container start
+	err = os.Rename(logfile, logfile+".old")
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(logfile, []byte("lxc c1 20190101000001.000 ERROR    start - start.c:3 - third\n"), 0644)
+	require.NoError(t, err)
+
+	n, err = follower.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "lxc c1 20190101000001.000 ERROR    start - start.c:3 - third\n", string(buf[:n]))
+
+	// Closing releases the file, even without a pending read
+	err = follower.Close()
+	require.NoError(t, err)
+	require.Equal(t, ^uintptr(0), follower.file.Fd())
+
+	_, err = follower.Read(buf)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestLxcLogFollowerInvalidLevel(t *testing.T) {
+	_, err := newLxcLogFollower("/nonexistent", "verbose")
+	require.Error(t, err)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -32,6 +35,7 @@ import (
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/lxc/lxd/lxd/maas"
+	"github.com/lxc/lxd/lxd/resources"
 	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/lxd/template"
 	"github.com/lxc/lxd/lxd/types"
@@ -56,22 +60,44 @@ type lxcContainerOperation struct {
 	err       error
 	id        int
 	reusable  bool
+	timeout   time.Duration
 }
 
+// lxcContainerOperationTimeout is how long an operation may go without
+// activity before it's considered finished, unless configured otherwise
+// through core.container_operation_timeout
+const lxcContainerOperationTimeout = 30 * time.Second
+
+// Default timeouts of the actions which take longer, CRIU dumps and restores
+// of big containers routinely going past lxcContainerOperationTimeout
+var lxcContainerOperationTimeouts = map[string]time.Duration{
+	"dump":    300 * time.Second,
+	"restore": 300 * time.Second,
+}
+
+// lxcContainerFileTimeout is how long a file operation may run for by default
+// before it's killed
+const lxcContainerFileTimeout = 300 * time.Second
+
 func (op *lxcContainerOperation) Create(id int, action string, reusable bool) *lxcContainerOperation {
 	op.id = id
 	op.action = action
 	op.reusable = reusable
 	op.chanDone = make(chan error, 0)
 	op.chanReset = make(chan bool, 0)
+	if op.timeout == 0 {
+		op.timeout = lxcContainerOperationTimeout
+	}
 
 	go func(op *lxcContainerOperation) {
 		for {
+			timeout := op.getTimeout()
+
 			select {
 			case <-op.chanReset:
 				continue
-			case <-time.After(time.Second * 30):
-				op.Done(fmt.Errorf("Container %s operation timed out after 30 seconds", op.action))
+			case <-time.After(timeout):
+				op.Done(fmt.Errorf("Container %s operation timed out after %s", op.action, timeout))
 				return
 			}
 		}
@@ -80,6 +106,27 @@ func (op *lxcContainerOperation) Create(id int, action string, reusable bool) *l
 	return op
 }
 
+func (op *lxcContainerOperation) getTimeout() time.Duration {
+	lxcContainerOperationsLock.Lock()
+	defer lxcContainerOperationsLock.Unlock()
+
+	return op.timeout
+}
+
+// Extend raises the timeout of the operation (if lower) and restarts it.
+func (op *lxcContainerOperation) Extend(timeout time.Duration) {
+	lxcContainerOperationsLock.Lock()
+	if timeout > op.timeout {
+		op.timeout = timeout
+	}
+	lxcContainerOperationsLock.Unlock()
+
+	select {
+	case op.chanReset <- true:
+	case <-op.chanDone:
+	}
+}
+
 func (op *lxcContainerOperation) Reset() error {
 	if !op.reusable {
 		return fmt.Errorf("Can't reset a non-reusable operation")
@@ -114,6 +161,29 @@ func (op *lxcContainerOperation) Done(err error) {
 var lxcContainerOperationsLock sync.Mutex
 var lxcContainerOperations map[int]*lxcContainerOperation = make(map[int]*lxcContainerOperation)
 
+// Containers whose memory usage is being monitored for limits.memory.pause_threshold
+var lxcMemoryMonitorsLock sync.Mutex
+var lxcMemoryMonitors map[int]bool = make(map[int]bool)
+
+// How often memory pause monitors pick up config changes without kernel events
+const memoryPauseInterval = time.Minute
+
+// Containers which were already warned about missing cgroup device control
+var lxcCGroupDevicesWarnedLock sync.Mutex
+var lxcCGroupDevicesWarned map[int]bool = make(map[int]bool)
+
+// Storage mounts of stopped containers shared by concurrent file operations
+var lxcFileMountsLock sync.Mutex
+var lxcFileMounts map[int]*lxcFileMount = make(map[int]*lxcFileMount)
+
+// Whether shiftfs works, per storage pool and filesystem type
+var lxcShiftfsSupportLock sync.Mutex
+var lxcShiftfsSupport map[string]bool = make(map[string]bool)
+
+// Listeners waiting for containers to signal readiness
+var lxcReadyListenersLock sync.Mutex
+var lxcReadyListeners map[int][]chan struct{} = make(map[int][]chan struct{})
+
 // Helper functions
 func lxcSetConfigItem(c *lxc.Container, key string, value string) error {
 	if c == nil {
@@ -179,6 +249,82 @@ func lxcSetConfigItem(c *lxc.Container, key string, value string) error {
 	return nil
 }
 
+// checkTun returns an error explaining why /dev/net/tun won't be usable in the
+// container, or nil if it should work.
+func (c *containerLXC) checkTun() error {
+	// The device is only bind-mounted if present on the host
+	dType, major, minor, err := deviceGetAttributes("/dev/net/tun")
+	if err != nil {
+		return fmt.Errorf("/dev/net/tun isn't available on the host: %v", err)
+	}
+
+	if dType != "c" || major != 10 || minor != 200 {
+		return fmt.Errorf("/dev/net/tun on the host isn't the TUN/TAP device (%s %d:%d)", dType, major, minor)
+	}
+
+	// Opening the device loads the tun module if needed
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open /dev/net/tun on the host, is the tun module available? %v", err)
+	}
+	f.Close()
+
+	// Creating a TUN/TAP interface requires CAP_NET_ADMIN in the container
+	for _, line := range strings.Split(c.expandedConfig["raw.lxc"], "\n") {
+		key, value, err := lxcParseRawLXC(line)
+		if err != nil {
+			continue
+		}
+
+		caps := strings.Fields(strings.ToLower(value))
+		if key == "lxc.cap.drop" && shared.StringInSlice("net_admin", caps) {
+			return fmt.Errorf("CAP_NET_ADMIN is dropped through raw.lxc")
+		}
+
+		if key == "lxc.cap.keep" && !shared.StringInSlice("net_admin", caps) {
+			return fmt.Errorf("CAP_NET_ADMIN isn't kept through raw.lxc")
+		}
+
+		// The devices cgroup of privileged containers only allows it by default
+		if (key == "lxc.cgroup.devices.deny" || key == "lxc.cgroup2.devices.deny") && c.IsPrivileged() && shared.StringInSlice(value, []string{"c 10:200 rwm", "c 10:* rwm", "c *:* rwm"}) {
+			return fmt.Errorf("Access to /dev/net/tun is denied through raw.lxc")
+		}
+	}
+
+	return nil
+}
+
+// checkHugepages returns an error naming the shortfall if the host doesn't
+// have enough free hugepages to back limits.memory.hugepages.
+func (c *containerLXC) checkHugepages() error {
+	// Without the hugetlb controller the limit is ignored
+	if !c.state.OS.CGroupHugetlbController {
+		return nil
+	}
+
+	limit, err := units.ParseByteSizeString(c.expandedConfig["limits.memory.hugepages"])
+	if err != nil {
+		return err
+	}
+
+	pageSize, free, err := resources.GetHugepages()
+	if err != nil {
+		return err
+	}
+
+	if pageSize == 0 {
+		return fmt.Errorf("limits.memory.hugepages is set but the host doesn't support hugepages")
+	}
+
+	// Round up to a whole number of pages
+	pages := (uint64(limit) + pageSize - 1) / pageSize
+	if pages > free {
+		return fmt.Errorf("Not enough free hugepages on the host: limits.memory.hugepages requires %d pages of %s but only %d are free (%d missing)", pages, units.GetByteSizeString(int64(pageSize), 0), free, pages-free)
+	}
+
+	return nil
+}
+
 func lxcParseRawLXC(line string) (string, string, error) {
 	// Ignore empty lines
 	if len(line) == 0 {
@@ -374,6 +520,16 @@ func containerLXCCreate(s *state.State, args db.ContainerArgs) (container, error
 		return nil, err
 	}
 
+	// The pinned cpus must exist on the node running the container
+	if c.expandedConfig["limits.cpu"] != "" && !s.OS.MockMode {
+		err = deviceValidCPUSet(c.expandedConfig["limits.cpu"])
+		if err != nil {
+			c.Delete()
+			logger.Error("Failed creating container", ctxMap)
+			return nil, errors.Wrap(err, "Invalid limits.cpu")
+		}
+	}
+
 	err = containerValidDevices(s.Cluster, c.expandedDevices, false, true)
 	if err != nil {
 		c.Delete()
@@ -404,6 +560,15 @@ func containerLXCCreate(s *state.State, args db.ContainerArgs) (container, error
 
 	// Fill in any default volume config
 	volumeConfig := map[string]string{}
+	if rootDiskDevice["fs"] != "" {
+		if !shared.StringInSlice(pool.Driver, []string{"ceph", "lvm"}) {
+			c.Delete()
+			return nil, fmt.Errorf("The \"%s\" storage driver doesn't support setting the root disk filesystem", pool.Driver)
+		}
+
+		volumeConfig["block.filesystem"] = rootDiskDevice["fs"]
+	}
+
 	err = storageVolumeFillDefault(storagePool, volumeConfig, pool)
 	if err != nil {
 		c.Delete()
@@ -608,6 +773,9 @@ type containerLXC struct {
 	c       *lxc.Container
 	cConfig bool
 
+	// Whether shiftfs is used for the rootfs, decided when starting
+	shiftfs bool
+
 	state    *state.State
 	idmapset *idmap.IdmapSet
 
@@ -618,7 +786,8 @@ type containerLXC struct {
 	node string
 
 	// Progress tracking
-	op *operation
+	op         *operation
+	startTimer *lxcStartTimer
 
 	expiryDate time.Time
 }
@@ -628,22 +797,49 @@ func (c *containerLXC) createOperation(action string, reusable bool, reuse bool)
 	if op != nil {
 		if reuse && op.reusable {
 			op.Reset()
+			op.Extend(c.operationTimeout(action))
 			return op, nil
 		}
 
 		return nil, fmt.Errorf("Container is busy running a %s operation", op.action)
 	}
 
+	timeout := c.operationTimeout(action)
+
 	lxcContainerOperationsLock.Lock()
 	defer lxcContainerOperationsLock.Unlock()
 
-	op = &lxcContainerOperation{}
+	op = &lxcContainerOperation{timeout: timeout}
 	op.Create(c.id, action, reusable)
 	lxcContainerOperations[c.id] = op
 
 	return lxcContainerOperations[c.id], nil
 }
 
+// operationTimeout returns how long an operation for the given action (start,
+// stop, dump, restore, ...) may go without activity. Timeouts set for the action
+// in core.container_operation_timeout take precedence over the configured
+// default one, which itself overrides the built-in ones.
+func (c *containerLXC) operationTimeout(action string) time.Duration {
+	timeout, ok := lxcContainerOperationTimeouts[action]
+	if !ok {
+		timeout = lxcContainerOperationTimeout
+	}
+
+	timeouts := c.state.ContainerOperationTimeouts
+	configured, ok := timeouts[action]
+	if ok {
+		return configured
+	}
+
+	configured, ok = timeouts[""]
+	if ok {
+		return configured
+	}
+
+	return timeout
+}
+
 func (c *containerLXC) getOperation(action string) (*lxcContainerOperation, error) {
 	lxcContainerOperationsLock.Lock()
 	defer lxcContainerOperationsLock.Unlock()
@@ -661,6 +857,31 @@ func (c *containerLXC) getOperation(action string) (*lxcContainerOperation, erro
 	return op, nil
 }
 
+// ClearStaleOperation forcibly completes the container's running operation
+// when nothing is left to complete it. Stop operations are completed by the
+// stop hook, so they're stale once the container is stopped and its liblxc
+// monitor, which runs the hooks, is gone. Other operations are completed by
+// LXD itself.
+func (c *containerLXC) ClearStaleOperation() error {
+	op, _ := c.getOperation("")
+	if op == nil {
+		return fmt.Errorf("No running container operation")
+	}
+
+	if op.action != "stop" {
+		return fmt.Errorf("The container's %s operation isn't waiting on a hook", op.action)
+	}
+
+	if c.IsRunning() || lxcMonitorRunning(c.state.OS.LxcPath, projectPrefix(c.Project(), c.Name())) {
+		return fmt.Errorf("The container's stop operation isn't stale, its liblxc monitor is still running")
+	}
+
+	logger.Warn("Clearing stale container operation", log.Ctx{"container": c.name, "action": op.action})
+	op.Done(fmt.Errorf("Container %s operation was cleared as its liblxc monitor is gone", op.action))
+
+	return nil
+}
+
 func (c *containerLXC) waitOperation() error {
 	op, _ := c.getOperation("")
 	if op != nil {
@@ -1012,7 +1233,23 @@ func (c *containerLXC) initLXC(config bool) error {
 			return err
 		}
 
-		err = lxcSetConfigItem(cc, "lxc.console.size", "auto")
+		// Rotate the console log file once it reaches the configured size
+		consoleLogSize := "auto"
+		if c.expandedConfig["console.log.size"] != "" {
+			size, err := units.ParseByteSizeString(c.expandedConfig["console.log.size"])
+			if err != nil {
+				return err
+			}
+
+			consoleLogSize = fmt.Sprintf("%d", size)
+
+			err = lxcSetConfigItem(cc, "lxc.console.rotate", "1")
+			if err != nil {
+				return err
+			}
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.console.size", consoleLogSize)
 		if err != nil {
 			return err
 		}
@@ -1117,6 +1354,27 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 	}
 
+	// Selectively bind /sys paths read-only or read-write
+	for _, mode := range []string{"ro", "rw"} {
+		for _, mnt := range containerSysfsPaths(c.expandedConfig[fmt.Sprintf("linux.sysfs.%s", mode)]) {
+			// Mount targets in the container can't be symlinks
+			mnt, err := filepath.EvalSymlinks(mnt)
+			if err != nil {
+				continue
+			}
+
+			create := "file"
+			if shared.IsDir(mnt) {
+				create = "dir"
+			}
+
+			err = lxcSetConfigItem(cc, "lxc.mount.entry", fmt.Sprintf("%s %s none bind,%s,create=%s,optional 0 0", mnt, strings.TrimPrefix(mnt, "/"), mode, create))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// For lxcfs
 	templateConfDir := os.Getenv("LXD_LXC_TEMPLATE_CONFIG")
 	if templateConfDir == "" {
@@ -1130,9 +1388,23 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 	}
 
+	// Place the container under a custom cgroup parent, kept within the lxc/
+	// hierarchy the containers' cgroups live in
+	cgroupParent := c.expandedConfig["linux.cgroup.parent"]
+	if cgroupParent != "" {
+		if !util.RuntimeLiblxcVersionAtLeast(2, 1, 0) {
+			return fmt.Errorf("linux.cgroup.parent requires liblxc >= 2.1")
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.cgroup.dir", fmt.Sprintf("lxc/%s/%s", cgroupParent, projectPrefix(c.Project(), c.Name())))
+		if err != nil {
+			return err
+		}
+	}
+
 	// Configure devices cgroup
 	if c.IsPrivileged() && !c.state.OS.RunningInUserNS && c.state.OS.CGroupDevicesController {
-		err = lxcSetConfigItem(cc, "lxc.cgroup.devices.deny", "a")
+		err = c.setCGroupConfigItem(cc, "devices.deny", "a")
 		if err != nil {
 			return err
 		}
@@ -1154,7 +1426,7 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 
 		for _, dev := range devices {
-			err = lxcSetConfigItem(cc, "lxc.cgroup.devices.allow", dev)
+			err = c.setCGroupConfigItem(cc, "devices.allow", dev)
 			if err != nil {
 				return err
 			}
@@ -1177,6 +1449,37 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 	}
 
+	// Setup a size limited tmpfs
+	if c.expandedConfig["limits.tmpfs"] != "" {
+		tmpfsSize, err := units.ParseByteSizeString(c.expandedConfig["limits.tmpfs"])
+		if err != nil {
+			return err
+		}
+
+		tmpfsPath := c.expandedConfig["limits.tmpfs.path"]
+		if tmpfsPath == "" {
+			tmpfsPath = "/tmp"
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.mount.entry", fmt.Sprintf("tmpfs %s tmpfs rw,nosuid,nodev,size=%d,create=dir 0 0", strings.TrimPrefix(tmpfsPath, "/"), tmpfsSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Setup a size limited /dev/shm
+	if c.expandedConfig["limits.shm"] != "" {
+		shmSize, err := units.ParseByteSizeString(c.expandedConfig["limits.shm"])
+		if err != nil {
+			return err
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.mount.entry", fmt.Sprintf("tmpfs dev/shm tmpfs rw,nosuid,nodev,mode=1777,size=%d,create=dir 0 0", shmSize))
+		if err != nil {
+			return err
+		}
+	}
+
 	// Setup architecture
 	personality, err := osarch.ArchitecturePersonality(c.architecture)
 	if err != nil {
@@ -1207,7 +1510,7 @@ func (c *containerLXC) initLXC(config bool) error {
 		return err
 	}
 
-	if c.state.OS.Shiftfs && !c.IsPrivileged() && diskIdmap == nil {
+	if c.shiftfs && !c.IsPrivileged() && diskIdmap == nil {
 		// Host side mark mount
 		err = lxcSetConfigItem(cc, "lxc.hook.pre-start", fmt.Sprintf("/bin/mount -t shiftfs -o mark,passthrough=3 %s %s", c.RootfsPath(), c.RootfsPath()))
 		if err != nil {
@@ -1244,7 +1547,7 @@ func (c *containerLXC) initLXC(config bool) error {
 	}
 
 	// Setup the hostname
-	err = lxcSetConfigItem(cc, "lxc.uts.name", c.Name())
+	err = lxcSetConfigItem(cc, "lxc.uts.name", c.hostname())
 	if err != nil {
 		return err
 	}
@@ -1267,6 +1570,12 @@ func (c *containerLXC) initLXC(config bool) error {
 			if err != nil {
 				return err
 			}
+		} else if AAProfileExternal(c) != "" {
+			// Use the externally managed profile as-is
+			err := lxcSetConfigItem(cc, "lxc.apparmor.profile", AAProfileExternal(c))
+			if err != nil {
+				return err
+			}
 		} else {
 			// If not currently confined, use the container's profile
 			profile := AAProfileFull(c)
@@ -1316,6 +1625,11 @@ func (c *containerLXC) initLXC(config bool) error {
 	// Setup environment
 	for k, v := range c.expandedConfig {
 		if strings.HasPrefix(k, "environment.") {
+			v, err = containerConfigExpand(c.expandedConfig, v, k)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to expand %s", k)
+			}
+
 			err = lxcSetConfigItem(cc, "lxc.environment", fmt.Sprintf("%s=%s", strings.TrimPrefix(k, "environment."), v))
 			if err != nil {
 				return err
@@ -1323,6 +1637,19 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 	}
 
+	// Collect the MIG devices to expose through the NVIDIA runtime
+	migDevices := []string{}
+	for _, k := range c.expandedDevices.DeviceNames() {
+		m := c.expandedDevices[k]
+		if m["type"] == "gpu" && m["mig.uuid"] != "" {
+			migDevices = append(migDevices, m["mig.uuid"])
+		}
+	}
+
+	if len(migDevices) > 0 && !shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
+		return fmt.Errorf("MIG device selection requires nvidia.runtime to be enabled")
+	}
+
 	// Setup NVIDIA runtime
 	if shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
 		hookDir := os.Getenv("LXD_LXC_HOOK")
@@ -1340,7 +1667,13 @@ func (c *containerLXC) initLXC(config bool) error {
 			return fmt.Errorf("The NVIDIA container tools couldn't be found")
 		}
 
-		err = lxcSetConfigItem(cc, "lxc.environment", "NVIDIA_VISIBLE_DEVICES=none")
+		// Devices are passed through the gpu devices unless a MIG instance was selected
+		visibleDevices := "none"
+		if len(migDevices) > 0 {
+			visibleDevices = strings.Join(migDevices, ",")
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.environment", fmt.Sprintf("NVIDIA_VISIBLE_DEVICES=%s", visibleDevices))
 		if err != nil {
 			return err
 		}
@@ -1386,6 +1719,7 @@ func (c *containerLXC) initLXC(config bool) error {
 		memoryEnforce := c.expandedConfig["limits.memory.enforce"]
 		memorySwap := c.expandedConfig["limits.memory.swap"]
 		memorySwapPriority := c.expandedConfig["limits.memory.swap.priority"]
+		memorySwappiness := c.expandedConfig["limits.memory.swappiness"]
 
 		// Configure the memory limits
 		if memory != "" {
@@ -1410,37 +1744,59 @@ func (c *containerLXC) initLXC(config bool) error {
 			}
 
 			if memoryEnforce == "soft" {
-				err = lxcSetConfigItem(cc, "lxc.cgroup.memory.soft_limit_in_bytes", fmt.Sprintf("%d", valueInt))
+				err = c.setCGroupConfigItem(cc, "memory.soft_limit_in_bytes", fmt.Sprintf("%d", valueInt))
 				if err != nil {
 					return err
 				}
 			} else {
 				if c.state.OS.CGroupSwapAccounting && (memorySwap == "" || shared.IsTrue(memorySwap)) {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.memory.limit_in_bytes", fmt.Sprintf("%d", valueInt))
+					err = c.setCGroupConfigItem(cc, "memory.limit_in_bytes", fmt.Sprintf("%d", valueInt))
 					if err != nil {
 						return err
 					}
-					err = lxcSetConfigItem(cc, "lxc.cgroup.memory.memsw.limit_in_bytes", fmt.Sprintf("%d", valueInt))
+					err = c.setCGroupConfigItem(cc, "memory.memsw.limit_in_bytes", fmt.Sprintf("%d", valueInt))
 					if err != nil {
 						return err
 					}
+
+					// Swap is limited on its own on cgroup2, with
+					// limits.memory only covering the memory
+					if c.cgroupUnified("memory") {
+						err = c.setCGroupConfigItem(cc, "memory.swap.max", "max")
+						if err != nil {
+							return err
+						}
+					}
 				} else {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.memory.limit_in_bytes", fmt.Sprintf("%d", valueInt))
+					err = c.setCGroupConfigItem(cc, "memory.limit_in_bytes", fmt.Sprintf("%d", valueInt))
 					if err != nil {
 						return err
 					}
 				}
-				// Set soft limit to value 10% less than hard limit
-				err = lxcSetConfigItem(cc, "lxc.cgroup.memory.soft_limit_in_bytes", fmt.Sprintf("%.0f", float64(valueInt)*0.9))
-				if err != nil {
-					return err
+				// Set soft limit to value 10% less than hard limit (on
+				// cgroup2 that would throttle the container instead)
+				if !c.cgroupUnified("memory") {
+					err = c.setCGroupConfigItem(cc, "memory.soft_limit_in_bytes", fmt.Sprintf("%.0f", float64(valueInt)*0.9))
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
 
 		// Configure the swappiness
 		if memorySwap != "" && !shared.IsTrue(memorySwap) {
-			err = lxcSetConfigItem(cc, "lxc.cgroup.memory.swappiness", "0")
+			// There's no swappiness on cgroup2, forbid swapping instead
+			if c.cgroupUnified("memory") {
+				err = lxcSetConfigItem(cc, "lxc.cgroup2.memory.swap.max", "0")
+			} else {
+				err = c.setCGroupConfigItem(cc, "memory.swappiness", "0")
+			}
+			if err != nil {
+				return err
+			}
+		} else if memorySwappiness != "" {
+			err = c.setCGroupConfigItem(cc, "memory.swappiness", memorySwappiness)
 			if err != nil {
 				return err
 			}
@@ -1450,7 +1806,56 @@ func (c *containerLXC) initLXC(config bool) error {
 				return err
 			}
 
-			err = lxcSetConfigItem(cc, "lxc.cgroup.memory.swappiness", fmt.Sprintf("%d", 60-10+priority))
+			err = c.setCGroupConfigItem(cc, "memory.swappiness", fmt.Sprintf("%d", 60-10+priority))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Hugepages limit
+	hugepages := c.expandedConfig["limits.memory.hugepages"]
+	if hugepages != "" && c.state.OS.CGroupHugetlbController {
+		valueInt, err := units.ParseByteSizeString(hugepages)
+		if err != nil {
+			return err
+		}
+
+		pageSize, _, err := resources.GetHugepages()
+		if err != nil {
+			return err
+		}
+
+		// The hugetlb controller names its files after the page size (2MB, 1GB, ...)
+		label := units.GetByteSizeString(int64(pageSize), 0)
+		err = c.setCGroupConfigItem(cc, fmt.Sprintf("hugetlb.%s.limit_in_bytes", label), fmt.Sprintf("%d", valueInt))
+		if err != nil {
+			return err
+		}
+	}
+
+	// CPU pinning, counts being handled by the load-balancer once started
+	cpuLimit := c.expandedConfig["limits.cpu"]
+	_, err = strconv.Atoi(cpuLimit)
+	if cpuLimit != "" && err != nil && c.state.OS.CGroupCPUsetController {
+		online, err := deviceHostCPUs("online")
+		if err != nil {
+			return err
+		}
+
+		// Offline cpus would make the container fail to start
+		cpus, _, err := deviceCPUSetSplit(cpuLimit, online)
+		if err != nil {
+			return err
+		}
+
+		if len(cpus) > 0 {
+			set := []string{}
+			for _, id := range cpus {
+				set = append(set, fmt.Sprintf("%d", id))
+			}
+
+			err = c.setCGroupConfigItem(cc, "cpuset.cpus", strings.Join(set, ","))
 			if err != nil {
 				return err
 			}
@@ -1468,21 +1873,21 @@ func (c *containerLXC) initLXC(config bool) error {
 		}
 
 		if cpuShares != "1024" {
-			err = lxcSetConfigItem(cc, "lxc.cgroup.cpu.shares", cpuShares)
+			err = c.setCGroupConfigItem(cc, "cpu.shares", cpuShares)
 			if err != nil {
 				return err
 			}
 		}
 
 		if cpuCfsPeriod != "-1" {
-			err = lxcSetConfigItem(cc, "lxc.cgroup.cpu.cfs_period_us", cpuCfsPeriod)
+			err = c.setCGroupConfigItem(cc, "cpu.cfs_period_us", cpuCfsPeriod)
 			if err != nil {
 				return err
 			}
 		}
 
 		if cpuCfsQuota != "-1" {
-			err = lxcSetConfigItem(cc, "lxc.cgroup.cpu.cfs_quota_us", cpuCfsQuota)
+			err = c.setCGroupConfigItem(cc, "cpu.cfs_quota_us", cpuCfsQuota)
 			if err != nil {
 				return err
 			}
@@ -1504,7 +1909,7 @@ func (c *containerLXC) initLXC(config bool) error {
 				priority = 10
 			}
 
-			err = lxcSetConfigItem(cc, "lxc.cgroup.blkio.weight", fmt.Sprintf("%d", priority))
+			err = c.setCGroupConfigItem(cc, "blkio.weight", fmt.Sprintf("%d", priority))
 			if err != nil {
 				return err
 			}
@@ -1518,7 +1923,7 @@ func (c *containerLXC) initLXC(config bool) error {
 				continue
 			}
 
-			if m["limits.read"] != "" || m["limits.write"] != "" || m["limits.max"] != "" {
+			if m["limits.read"] != "" || m["limits.write"] != "" || m["limits.max"] != "" || m["limits.read.latency"] != "" || m["limits.weight"] != "" {
 				if m["path"] == "/" {
 					hasRootLimit = true
 				}
@@ -1556,28 +1961,43 @@ func (c *containerLXC) initLXC(config bool) error {
 
 			for block, limit := range diskLimits {
 				if limit.readBps > 0 {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.blkio.throttle.read_bps_device", fmt.Sprintf("%s %d", block, limit.readBps))
+					err = c.setCGroupConfigItem(cc, "blkio.throttle.read_bps_device", fmt.Sprintf("%s %d", block, limit.readBps))
 					if err != nil {
 						return err
 					}
 				}
 
 				if limit.readIops > 0 {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.blkio.throttle.read_iops_device", fmt.Sprintf("%s %d", block, limit.readIops))
+					err = c.setCGroupConfigItem(cc, "blkio.throttle.read_iops_device", fmt.Sprintf("%s %d", block, limit.readIops))
 					if err != nil {
 						return err
 					}
 				}
 
 				if limit.writeBps > 0 {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.blkio.throttle.write_bps_device", fmt.Sprintf("%s %d", block, limit.writeBps))
+					err = c.setCGroupConfigItem(cc, "blkio.throttle.write_bps_device", fmt.Sprintf("%s %d", block, limit.writeBps))
 					if err != nil {
 						return err
 					}
 				}
 
 				if limit.writeIops > 0 {
-					err = lxcSetConfigItem(cc, "lxc.cgroup.blkio.throttle.write_iops_device", fmt.Sprintf("%s %d", block, limit.writeIops))
+					err = c.setCGroupConfigItem(cc, "blkio.throttle.write_iops_device", fmt.Sprintf("%s %d", block, limit.writeIops))
+					if err != nil {
+						return err
+					}
+				}
+
+				// Latency targets and weights only exist on cgroup2
+				if limit.readLatency > 0 && c.cgroupUnified("blkio") {
+					err = c.setCGroupConfigItem(cc, "io.latency", fmt.Sprintf("%s target=%d", block, limit.readLatency))
+					if err != nil {
+						return err
+					}
+				}
+
+				if limit.weight > 0 && c.cgroupUnified("blkio") {
+					err = c.setCGroupConfigItem(cc, "io.weight", fmt.Sprintf("%s %d", block, limit.weight))
 					if err != nil {
 						return err
 					}
@@ -1595,7 +2015,7 @@ func (c *containerLXC) initLXC(config bool) error {
 				return err
 			}
 
-			err = lxcSetConfigItem(cc, "lxc.cgroup.pids.max", fmt.Sprintf("%d", valueInt))
+			err = c.setCGroupConfigItem(cc, "pids.max", fmt.Sprintf("%d", valueInt))
 			if err != nil {
 				return err
 			}
@@ -1607,10 +2027,33 @@ func (c *containerLXC) initLXC(config bool) error {
 		if strings.HasPrefix(k, "limits.kernel.") {
 			prlimitSuffix := strings.TrimPrefix(k, "limits.kernel.")
 			prlimitKey := fmt.Sprintf("lxc.prlimit.%s", prlimitSuffix)
-			err = lxcSetConfigItem(cc, prlimitKey, v)
+			prlimitValue, err := shared.ParseKernelLimit(v)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid value for %s", k)
+			}
+
+			err = lxcSetConfigItem(cc, prlimitKey, prlimitValue)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Setup the core dump size, limits.kernel.core takes precedence
+	coreLimit := c.expandedConfig["limits.core"]
+	if coreLimit != "" && c.expandedConfig["limits.kernel.core"] == "" {
+		if coreLimit != "unlimited" {
+			valueInt, err := units.ParseByteSizeString(coreLimit)
 			if err != nil {
 				return err
 			}
+
+			coreLimit = fmt.Sprintf("%d", valueInt)
+		}
+
+		err = lxcSetConfigItem(cc, "lxc.prlimit.core", coreLimit)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -1619,6 +2062,11 @@ func (c *containerLXC) initLXC(config bool) error {
 	for _, k := range c.expandedDevices.DeviceNames() {
 		m := c.expandedDevices[k]
 		if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
+			// Devices matched by a hotplug rule are set up on start
+			if m["hotplug"] != "" {
+				continue
+			}
+
 			// destination paths
 			destPath := m["path"]
 			if destPath == "" {
@@ -1640,10 +2088,10 @@ func (c *containerLXC) initLXC(config bool) error {
 
 			// inform liblxc about the mount
 			err = lxcSetConfigItem(cc, "lxc.mount.entry",
-				fmt.Sprintf("%s %s %s",
+				fmt.Sprintf("%s %s none %s 0 0",
 					shared.EscapePathFstab(sourceDevPath),
 					shared.EscapePathFstab(relativeDestPath),
-					"none bind,create=file 0 0"))
+					unixDeviceMountOptions(m)))
 			if err != nil {
 				return err
 			}
@@ -1711,7 +2159,7 @@ func (c *containerLXC) initLXC(config bool) error {
 					return err
 				}
 			} else if shared.StringInSlice(m["nictype"], []string{"macvlan", "ipvlan", "physical"}) {
-				err = lxcSetConfigItem(cc, fmt.Sprintf("%s.%d.link", networkKeyPrefix, networkidx), networkGetHostDevice(m["parent"], m["vlan"]))
+				err = lxcSetConfigItem(cc, fmt.Sprintf("%s.%d.link", networkKeyPrefix, networkidx), networkGetHostDevice(c.physicalParent(k, m), m["vlan"]))
 				if err != nil {
 					return err
 				}
@@ -1721,6 +2169,10 @@ func (c *containerLXC) initLXC(config bool) error {
 			vethName := ""
 			if m["host_name"] != "" && shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
 				vethName = m["host_name"]
+			} else if shared.IsTrue(c.localConfig[fmt.Sprintf("volatile.%s.host_preserved", k)]) && shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
+				vethName = c.getVolatileHostName(k)
+			} else if c.expandedConfig["network.host_name_template"] != "" && shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
+				vethName = deviceNextVethFromTemplate(c.expandedConfig["network.host_name_template"], c.Name(), k)
 			}
 
 			if vethName != "" {
@@ -1777,7 +2229,7 @@ func (c *containerLXC) initLXC(config bool) error {
 			// pool we created via our storage api, we are always
 			// mounting a directory.
 			isFile := false
-			if m["pool"] == "" {
+			if m["pool"] == "" && m["overlay.lowerdir"] == "" && m["fuse"] == "" {
 				isFile = !shared.IsDir(srcPath) && !deviceIsBlockdev(srcPath)
 			}
 
@@ -2010,7 +2462,7 @@ func (c *containerLXC) expandConfig(profiles []api.Profile) error {
 		var err error
 		profiles, err = c.state.Cluster.ProfilesGet(c.project, c.profiles)
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "Failed to expand config of container %q", c.Name())
 		}
 	}
 
@@ -2024,7 +2476,7 @@ func (c *containerLXC) expandDevices(profiles []api.Profile) error {
 		var err error
 		profiles, err = c.state.Cluster.ProfilesGet(c.project, c.profiles)
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "Failed to expand devices of container %q", c.Name())
 		}
 	}
 
@@ -2033,11 +2485,42 @@ func (c *containerLXC) expandDevices(profiles []api.Profile) error {
 	return nil
 }
 
+// unixDeviceReadOnly returns whether a unix-char or unix-block device is to be
+// exposed read-only to the container.
+func unixDeviceReadOnly(m types.Device) bool {
+	return shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) && shared.IsTrue(m["readonly"])
+}
+
+// unixDeviceAccess returns the access to a unix device allowed by its device
+// cgroup rule.
+func unixDeviceAccess(m types.Device) string {
+	if unixDeviceReadOnly(m) {
+		return "rm"
+	}
+
+	return "rwm"
+}
+
+// unixDeviceMountOptions returns the options of the bind-mount of a unix
+// device into the container.
+func unixDeviceMountOptions(m types.Device) string {
+	if unixDeviceReadOnly(m) {
+		return "bind,create=file,ro"
+	}
+
+	return "bind,create=file"
+}
+
 // setupUnixDevice() creates the unix device and sets up the necessary low-level
 // liblxc configuration items.
 func (c *containerLXC) setupUnixDevice(prefix string, dev types.Device, major int, minor int, path string, createMustSucceed bool, defaultMode bool) error {
 	if c.isCurrentlyPrivileged() && !c.state.OS.RunningInUserNS && c.state.OS.CGroupDevicesController {
-		err := lxcSetConfigItem(c.c, "lxc.cgroup.devices.allow", fmt.Sprintf("c %d:%d rwm", major, minor))
+		dType := "c"
+		if dev["type"] == "unix-block" {
+			dType = "b"
+		}
+
+		err := c.setCGroupConfigItem(c.c, "devices.allow", fmt.Sprintf("%s %d:%d %s", dType, major, minor, unixDeviceAccess(dev)))
 		if err != nil {
 			return err
 		}
@@ -2065,12 +2548,12 @@ func (c *containerLXC) setupUnixDevice(prefix string, dev types.Device, major in
 
 	devPath := shared.EscapePathFstab(paths[0])
 	tgtPath := shared.EscapePathFstab(paths[1])
-	val := fmt.Sprintf("%s %s none bind,create=file 0 0", devPath, tgtPath)
+	val := fmt.Sprintf("%s %s none %s 0 0", devPath, tgtPath, unixDeviceMountOptions(dev))
 
 	return lxcSetConfigItem(c.c, "lxc.mount.entry", val)
 }
 
-func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool) error {
+func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool, progress func(files int64, bytes int64)) error {
 	var err error
 	roSubvols := []string{}
 	subvols, _ := btrfsSubVolumesGet(path)
@@ -2087,9 +2570,9 @@ func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool) error
 	}
 
 	if shift {
-		err = diskIdmap.ShiftRootfs(path, nil)
+		err = diskIdmap.ShiftRootfs(path, nil, progress)
 	} else {
-		err = diskIdmap.UnshiftRootfs(path, nil)
+		err = diskIdmap.UnshiftRootfs(path, nil, progress)
 	}
 
 	for _, subvol := range roSubvols {
@@ -2099,21 +2582,103 @@ func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool) error
 	return err
 }
 
-func ShiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
-	return shiftBtrfsRootfs(path, diskIdmap, true)
+func ShiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, progress func(files int64, bytes int64)) error {
+	return shiftBtrfsRootfs(path, diskIdmap, true, progress)
 }
 
-func UnshiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
-	return shiftBtrfsRootfs(path, diskIdmap, false)
+func UnshiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, progress func(files int64, bytes int64)) error {
+	return shiftBtrfsRootfs(path, diskIdmap, false, progress)
 }
 
 // Start functions
-func (c *containerLXC) startCommon() (string, error) {
-	var ourStart bool
+// checkLocalNode makes sure the container is located on this cluster member,
+// acting on another member's container failing later on with confusing
+// storage errors.
+func (c *containerLXC) checkLocalNode() error {
+	if c.node == "" {
+		return nil
+	}
 
-	// Load the go-lxc struct
-	err := c.initLXC(true)
-	if err != nil {
+	var node string
+	err := c.state.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		node, err = tx.NodeName()
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to get the name of the local cluster member")
+	}
+
+	if c.node != node {
+		return fmt.Errorf("Container is located on a different cluster member (%s)", c.node)
+	}
+
+	return nil
+}
+
+// secretsEnvironment reads the environment_file.* secrets and returns them as
+// NUL separated NAME=value entries, the format forkstart expects on stdin.
+func (c *containerLXC) secretsEnvironment() (string, error) {
+	entries := []string{}
+	for k, v := range c.expandedConfig {
+		if !strings.HasPrefix(k, "environment_file.") || v == "" {
+			continue
+		}
+
+		secret, err := containerReadSecret(v)
+		if err != nil {
+			return "", err
+		}
+
+		entries = append(entries, fmt.Sprintf("%s=%s\x00", strings.TrimPrefix(k, "environment_file."), secret))
+	}
+
+	return strings.Join(entries, ""), nil
+}
+
+func (c *containerLXC) startCommon() (string, error) {
+	var ourStart bool
+
+	err := c.checkLocalNode()
+	if err != nil {
+		return "", err
+	}
+
+	// Decide on shiftfs once as both the generated hooks and the idmap
+	// handling below depend on it
+	shiftfs := c.shiftfsUsable()
+	if shiftfs != c.shiftfs {
+		c.shiftfs = shiftfs
+		if c.c != nil {
+			c.c.Release()
+			c.c = nil
+		}
+		c.cConfig = false
+	}
+
+	// Pick the parents of nics with failover parents before generating
+	// the config as those are referenced there
+	for _, k := range c.expandedDevices.DeviceNames() {
+		m := c.expandedDevices[k]
+		if m["type"] != "nic" || !strings.Contains(m["parent"], ",") {
+			continue
+		}
+
+		_, err := c.selectPhysicalParent(k, m)
+		if err != nil {
+			return "", err
+		}
+
+		if c.c != nil {
+			c.c.Release()
+			c.c = nil
+		}
+		c.cConfig = false
+	}
+
+	// Load the go-lxc struct
+	err = c.initLXC(true)
+	if err != nil {
 		return "", errors.Wrap(err, "Load go-lxc struct")
 	}
 
@@ -2131,12 +2696,20 @@ func (c *containerLXC) startCommon() (string, error) {
 			// the storage volume, not the path where it is mounted.
 			// So do only check for the existence of m["source"]
 			// when m["pool"] is empty.
-			if m["pool"] == "" && m["source"] != "" && !shared.IsTrue(m["optional"]) && !shared.PathExists(shared.HostPath(m["source"])) {
-				return "", fmt.Errorf("Missing source '%s' for disk '%s'", m["source"], name)
+			if m["pool"] == "" && m["source"] != "" && !shared.IsTrue(m["optional"]) {
+				exists, err := pathExistsTimeout(shared.HostPath(m["source"]), diskSourceTimeout(m))
+				if err != nil {
+					return "", fmt.Errorf("Source '%s' for disk '%s' is unreachable: %v", m["source"], name, err)
+				}
+
+				if !exists {
+					return "", fmt.Errorf("Missing source '%s' for disk '%s'", m["source"], name)
+				}
 			}
 		case "nic":
-			if m["parent"] != "" && !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", m["parent"])) {
-				return "", fmt.Errorf("Missing parent '%s' for nic '%s'", m["parent"], name)
+			parent := c.physicalParent(name, m)
+			if parent != "" && !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", parent)) {
+				return "", fmt.Errorf("Missing parent '%s' for nic '%s'", parent, name)
 			}
 
 			if shared.IsTrue(m["security.ipv6_filtering"]) {
@@ -2146,7 +2719,18 @@ func (c *containerLXC) startCommon() (string, error) {
 					return "", errors.Wrapf(err, "security.ipv6_filtering requires br_netfilter and sysctl net.bridge.bridge-nf-call-ip6tables=1")
 				}
 			}
+
+			if m["nictype"] == "bridged" && m["mss_clamp"] != "" {
+				err := networkCheckMSSClamp()
+				if err != nil {
+					return "", err
+				}
+			}
 		case "unix-char", "unix-block":
+			if m["hotplug"] != "" {
+				continue
+			}
+
 			srcPath, exist := m["source"]
 			if !exist {
 				srcPath = m["path"]
@@ -2165,14 +2749,15 @@ func (c *containerLXC) startCommon() (string, error) {
 	}
 
 	// Load any required kernel modules
-	kernelModules := c.expandedConfig["linux.kernel_modules"]
-	if kernelModules != "" {
-		for _, module := range strings.Split(kernelModules, ",") {
-			module = strings.TrimPrefix(module, " ")
-			err := util.LoadModule(module)
-			if err != nil {
-				return "", fmt.Errorf("Failed to load kernel module '%s': %s", module, err)
-			}
+	kernelModules, err := shared.ParseKernelModules(c.expandedConfig["linux.kernel_modules"])
+	if err != nil {
+		return "", err
+	}
+
+	for _, module := range kernelModules {
+		err := util.LoadModule(module.Name, module.Params...)
+		if err != nil {
+			return "", fmt.Errorf("Failed to load kernel module '%s': %s", module.Name, err)
 		}
 	}
 
@@ -2209,12 +2794,20 @@ func (c *containerLXC) startCommon() (string, error) {
 		return "", errors.Wrap(err, "Set ID map")
 	}
 
-	diskIdmap, err := c.DiskIdmap()
+	c.startTimer.done("config")
+
+	// Check that the recorded disk idmap matches the rootfs ownership
+	var diskIdmap *idmap.IdmapSet
+	if shiftfs {
+		diskIdmap, err = c.DiskIdmap()
+	} else {
+		diskIdmap, err = c.checkDiskIdmap(nextIdmap)
+	}
 	if err != nil {
 		return "", errors.Wrap(err, "Set last ID map")
 	}
 
-	if !nextIdmap.Equals(diskIdmap) && !(diskIdmap == nil && c.state.OS.Shiftfs) {
+	if !nextIdmap.Equals(diskIdmap) && !(diskIdmap == nil && shiftfs) {
 		if shared.IsTrue(c.expandedConfig["security.protection.shift"]) {
 			return "", fmt.Errorf("Container is protected against filesystem shifting")
 		}
@@ -2228,12 +2821,13 @@ func (c *containerLXC) startCommon() (string, error) {
 		}
 
 		if diskIdmap != nil {
+			progress := c.shiftProgress("Unshifting container filesystem")
 			if c.Storage().GetStorageType() == storageTypeZfs {
-				err = diskIdmap.UnshiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper)
+				err = diskIdmap.UnshiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper, progress)
 			} else if c.Storage().GetStorageType() == storageTypeBtrfs {
-				err = UnshiftBtrfsRootfs(c.RootfsPath(), diskIdmap)
+				err = UnshiftBtrfsRootfs(c.RootfsPath(), diskIdmap, progress)
 			} else {
-				err = diskIdmap.UnshiftRootfs(c.RootfsPath(), nil)
+				err = diskIdmap.UnshiftRootfs(c.RootfsPath(), nil, progress)
 			}
 			if err != nil {
 				if ourStart {
@@ -2243,13 +2837,14 @@ func (c *containerLXC) startCommon() (string, error) {
 			}
 		}
 
-		if nextIdmap != nil && !c.state.OS.Shiftfs {
+		if nextIdmap != nil && !shiftfs {
+			progress := c.shiftProgress("Shifting container filesystem")
 			if c.Storage().GetStorageType() == storageTypeZfs {
-				err = nextIdmap.ShiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper)
+				err = nextIdmap.ShiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper, progress)
 			} else if c.Storage().GetStorageType() == storageTypeBtrfs {
-				err = ShiftBtrfsRootfs(c.RootfsPath(), nextIdmap)
+				err = ShiftBtrfsRootfs(c.RootfsPath(), nextIdmap, progress)
 			} else {
-				err = nextIdmap.ShiftRootfs(c.RootfsPath(), nil)
+				err = nextIdmap.ShiftRootfs(c.RootfsPath(), nil, progress)
 			}
 			if err != nil {
 				if ourStart {
@@ -2260,7 +2855,7 @@ func (c *containerLXC) startCommon() (string, error) {
 		}
 
 		jsonDiskIdmap := "[]"
-		if nextIdmap != nil && !c.state.OS.Shiftfs {
+		if nextIdmap != nil && !shiftfs {
 			idmapBytes, err := json.Marshal(nextIdmap.Idmap)
 			if err != nil {
 				return "", err
@@ -2274,6 +2869,13 @@ func (c *containerLXC) startCommon() (string, error) {
 		}
 
 		c.updateProgress("")
+		c.startTimer.done("shift")
+	}
+
+	// Verify the integrity of the protected rootfs files
+	err = c.checkIntegrity()
+	if err != nil {
+		return "", err
 	}
 
 	var idmapBytes []byte
@@ -2310,7 +2912,24 @@ func (c *containerLXC) startCommon() (string, error) {
 	// Create the devices
 	for _, k := range c.expandedDevices.DeviceNames() {
 		m := c.expandedDevices[k]
-		if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
+		if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) && m["hotplug"] != "" {
+			// Devices matching the hotplug rule which are already present
+			devs, err := deviceLoadHotplug(m["hotplug"])
+			if err != nil {
+				return "", err
+			}
+
+			for _, dev := range devs {
+				if !deviceHotplugMatch(m, dev) {
+					continue
+				}
+
+				err := c.setupUnixDevice(fmt.Sprintf("unix.%s", k), c.hotplugDeviceConfig(m, dev), dev.major, dev.minor, c.hotplugDestPath(m, dev), false, false)
+				if err != nil {
+					return "", err
+				}
+			}
+		} else if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
 			// Unix device
 			paths, err := c.createUnixDevice(fmt.Sprintf("unix.%s", k), m, true)
 			if err != nil {
@@ -2341,7 +2960,7 @@ func (c *containerLXC) startCommon() (string, error) {
 						return "", err
 					}
 				} else {
-					err = lxcSetConfigItem(c.c, "lxc.cgroup.devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
+					err = c.setCGroupConfigItem(c.c, "devices.allow", fmt.Sprintf("%s %d:%d %s", dType, dMajor, dMinor, unixDeviceAccess(m)))
 					if err != nil {
 						return "", fmt.Errorf("Failed to add cgroup rule for device")
 					}
@@ -2464,7 +3083,7 @@ func (c *containerLXC) startCommon() (string, error) {
 					continue
 				}
 
-				reserved = append(reserved, m["parent"])
+				reserved = append(reserved, c.physicalParent(dName, m))
 			}
 
 			for _, dName := range c.expandedDevices.DeviceNames() {
@@ -2556,6 +3175,38 @@ func (c *containerLXC) startCommon() (string, error) {
 		return "", err
 	}
 
+	// Pass the host RTC into the container
+	if shared.IsTrue(c.expandedConfig["linux.rtc"]) {
+		_, major, minor, err := deviceGetAttributes("/dev/rtc0")
+		if err == nil {
+			err = c.setupUnixDevice("unix.linux.rtc", types.Device{"type": "unix-char"}, major, minor, "/dev/rtc0", true, false)
+		}
+
+		if err != nil {
+			if c.expandedConfig["linux.rtc.required"] == "" || shared.IsTrue(c.expandedConfig["linux.rtc.required"]) {
+				return "", errors.Wrap(err, "Failed to pass /dev/rtc0 into the container")
+			}
+
+			logger.Warn("Skipping optional /dev/rtc0", log.Ctx{"container": c.name, "err": err})
+		}
+	}
+
+	// Warn when TUN/TAP is expected to work but won't
+	if shared.IsTrue(c.expandedConfig["linux.tun"]) {
+		err := c.checkTun()
+		if err != nil {
+			logger.Warn("TUN/TAP devices won't work in the container", log.Ctx{"container": c.name, "err": err})
+		}
+	}
+
+	// Fail early rather than inside liblxc when hugepages are missing
+	if c.expandedConfig["limits.memory.hugepages"] != "" {
+		err := c.checkHugepages()
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// Create any missing directory
 	err = os.MkdirAll(c.LogPath(), 0700)
 	if err != nil {
@@ -2582,6 +3233,22 @@ func (c *containerLXC) startCommon() (string, error) {
 		}
 	}
 
+	// The container has to signal readiness again
+	err = c.SetReady(false)
+	if err != nil {
+		return "", err
+	}
+
+	// Rotate the console log file
+	consoleLogfile := c.ConsoleBufferLogPath()
+	if shared.PathExists(consoleLogfile) {
+		os.Remove(consoleLogfile + ".old")
+		err := os.Rename(consoleLogfile, consoleLogfile+".old")
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// Storage is guaranteed to be mountable now.
 	ourStart, err = c.StorageStart()
 	if err != nil {
@@ -2645,6 +3312,7 @@ func (c *containerLXC) startCommon() (string, error) {
 func (c *containerLXC) snapshotPhysicalNic(deviceName string, hostName string, volatile map[string]string) error {
 	mtuKey := "volatile." + deviceName + ".last_state.mtu"
 	macKey := "volatile." + deviceName + ".last_state.hwaddr"
+	promiscKey := "volatile." + deviceName + ".last_state.promisc"
 
 	// Store current MTU for restoration on detach
 	mtu, err := networkGetDevMTU(hostName)
@@ -2660,6 +3328,13 @@ func (c *containerLXC) snapshotPhysicalNic(deviceName string, hostName string, v
 	}
 	volatile[macKey] = mac
 
+	// Store current promiscuous mode for restoration on detach
+	promisc, err := networkGetDevPromisc(hostName)
+	if err != nil {
+		return err
+	}
+	volatile[promiscKey] = fmt.Sprintf("%t", promisc)
+
 	return nil
 }
 
@@ -2693,6 +3368,27 @@ func (c *containerLXC) setupPhysicalParent(deviceName string, m types.Device) (s
 		return "", errors.New("No parent property on device")
 	}
 
+	// Resolve failover parents
+	parent := c.physicalParent(deviceName, m)
+	if parent == "" {
+		var err error
+		parent, err = c.selectPhysicalParent(deviceName, m)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if parent != m["parent"] {
+		temp := types.Device{}
+		err := shared.DeepCopy(&m, &temp)
+		if err != nil {
+			return "", err
+		}
+
+		m = temp
+		m["parent"] = parent
+	}
+
 	hostName := networkGetHostDevice(m["parent"], m["vlan"])
 	createdDev, err := c.createVlanDeviceIfNeeded(m, hostName)
 	if err != nil {
@@ -2723,9 +3419,57 @@ func (c *containerLXC) setupPhysicalParent(deviceName string, m types.Device) (s
 		}
 	}
 
+	// Monitoring containers need to see all the traffic reaching the parent. As
+	// macvlan parents are shared with other containers, those are left as-is
+	// when the device goes away.
+	if shared.IsTrue(m["promisc"]) {
+		err = networkSetDevPromisc(hostName, true)
+		if err != nil {
+			return hostName, fmt.Errorf("Failed to set \"%s\" in promiscuous mode: %v", hostName, err)
+		}
+	}
+
 	return hostName, nil
 }
 
+// physicalParent returns the parent of a nic. For nics with a comma separated
+// list of failover parents, this is the one recorded by selectPhysicalParent.
+func (c *containerLXC) physicalParent(deviceName string, m types.Device) string {
+	if !strings.Contains(m["parent"], ",") {
+		return m["parent"]
+	}
+
+	return c.localConfig["volatile."+deviceName+".last_state.parent"]
+}
+
+// selectPhysicalParent picks the first parent of a nic's comma separated list
+// of failover parents which exists and is up, and records it in volatile.
+func (c *containerLXC) selectPhysicalParent(deviceName string, m types.Device) (string, error) {
+	for _, parent := range strings.Split(m["parent"], ",") {
+		parent = strings.TrimSpace(parent)
+
+		operstate, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/operstate", parent))
+		if err != nil {
+			continue
+		}
+
+		// Virtual devices may not report their state
+		state := strings.TrimSpace(string(operstate))
+		if state != "up" && state != "unknown" {
+			continue
+		}
+
+		err = c.VolatileSet(map[string]string{"volatile." + deviceName + ".last_state.parent": parent})
+		if err != nil {
+			return "", err
+		}
+
+		return parent, nil
+	}
+
+	return "", fmt.Errorf("None of the parents '%s' of nic '%s' is available", m["parent"], deviceName)
+}
+
 // detachInterfaceRename enters the container's network namespace and moves the named interface
 // in ifName back to the network namespace of the running process as the name specified in hostName.
 func (c *containerLXC) detachInterfaceRename(netns string, ifName string, hostName string) error {
@@ -2756,6 +3500,7 @@ func (c *containerLXC) restorePhysicalNic(deviceName string, hostName string) er
 	createdKey := "volatile." + deviceName + ".last_state.created"
 	mtuKey := "volatile." + deviceName + ".last_state.mtu"
 	macKey := "volatile." + deviceName + ".last_state.hwaddr"
+	promiscKey := "volatile." + deviceName + ".last_state.promisc"
 
 	// If we created the "physical" device and then it should be removed.
 	if shared.IsTrue(c.localConfig[createdKey]) {
@@ -2789,6 +3534,14 @@ func (c *containerLXC) restorePhysicalNic(deviceName string, hostName string) er
 		}
 	}
 
+	// If promiscuous mode is specified then there is an original mode that needs restoring.
+	if c.localConfig[promiscKey] != "" {
+		err := networkSetDevPromisc(hostName, shared.IsTrue(c.localConfig[promiscKey]))
+		if err != nil {
+			return fmt.Errorf("Failed to restore physical dev \"%s\" promiscuous mode: %v", hostName, err)
+		}
+	}
+
 	return nil
 }
 
@@ -2801,15 +3554,17 @@ func (c *containerLXC) restorePhysicalParent(deviceName string, m types.Device)
 		createdKey := "volatile." + deviceName + ".last_state.created"
 		mtuKey := "volatile." + deviceName + ".last_state.mtu"
 		macKey := "volatile." + deviceName + ".last_state.hwaddr"
+		promiscKey := "volatile." + deviceName + ".last_state.promisc"
+		parentKey := "volatile." + deviceName + ".last_state.parent"
 
-		err := c.VolatileSet(map[string]string{createdKey: "", mtuKey: "", macKey: ""})
+		err := c.VolatileSet(map[string]string{createdKey: "", mtuKey: "", macKey: "", promiscKey: "", parentKey: ""})
 		if err != nil {
 			logger.Errorf("Failed to remove volatile config for %s: %v", deviceName, err)
 		}
 	}()
 
 	// Nothing to do if we don't know the original device name.
-	hostName := networkGetHostDevice(m["parent"], m["vlan"])
+	hostName := networkGetHostDevice(c.physicalParent(deviceName, m), m["vlan"])
 	if hostName == "" {
 		return
 	}
@@ -2972,11 +3727,13 @@ func (c *containerLXC) restoreSriovParent(deviceName string, m types.Device) {
 		createdKey := "volatile." + deviceName + ".last_state.created"
 		mtuKey := "volatile." + deviceName + ".last_state.mtu"
 		macKey := "volatile." + deviceName + ".last_state.hwaddr"
+		promiscKey := "volatile." + deviceName + ".last_state.promisc"
 
 		volatile := map[string]string{
 			createdKey:      "",
 			mtuKey:          "",
 			macKey:          "",
+			promiscKey:      "",
 			hostNameKey:     "",
 			vfIDKey:         "",
 			vfMacKey:        "",
@@ -3078,6 +3835,35 @@ func (c *containerLXC) restoreSriovParent(deviceName string, m types.Device) {
 	}
 }
 
+// lxcStartTimer records how long each phase of a container start took.
+type lxcStartTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []string
+}
+
+func newLxcStartTimer() *lxcStartTimer {
+	now := time.Now()
+	return &lxcStartTimer{start: now, last: now}
+}
+
+// done records the time spent since the previous phase. It's a no-op on a nil
+// timer so that code shared with other actions doesn't need to check.
+func (t *lxcStartTimer) done(phase string) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.phases = append(t.phases, fmt.Sprintf("%s=%s", phase, now.Sub(t.last).Round(time.Millisecond)))
+	t.last = now
+}
+
+func (t *lxcStartTimer) String() string {
+	phases := append(t.phases, fmt.Sprintf("total=%s", time.Since(t.start).Round(time.Millisecond)))
+	return strings.Join(phases, ",")
+}
+
 func (c *containerLXC) Start(stateful bool) error {
 	var ctxMap log.Ctx
 
@@ -3088,6 +3874,12 @@ func (c *containerLXC) Start(stateful bool) error {
 	}
 	defer op.Done(nil)
 
+	// Time the start phases to help diagnosing slow starts
+	c.startTimer = newLxcStartTimer()
+	defer func() {
+		c.startTimer = nil
+	}()
+
 	err = setupSharedMounts()
 	if err != nil {
 		return fmt.Errorf("Daemon failed to setup shared mounts base: %s.\nDoes security.nesting need to be turned on?", err)
@@ -3098,12 +3890,14 @@ func (c *containerLXC) Start(stateful bool) error {
 	if err != nil {
 		return errors.Wrap(err, "Common start logic")
 	}
+	c.startTimer.done("devices")
 
 	// Ensure that the container storage volume is mounted.
 	_, err = c.StorageStart()
 	if err != nil {
 		return errors.Wrap(err, "Storage start")
 	}
+	c.startTimer.done("storage")
 
 	ctxMap = log.Ctx{
 		"project":   c.project,
@@ -3122,6 +3916,9 @@ func (c *containerLXC) Start(stateful bool) error {
 			return fmt.Errorf("Container has no existing state to restore")
 		}
 
+		// Restoring a big container takes a while
+		op.Extend(c.operationTimeout("restore"))
+
 		criuMigrationArgs := CriuMigrationArgs{
 			cmd:          lxc.MIGRATE_RESTORE,
 			stateDir:     c.StatePath(),
@@ -3136,6 +3933,7 @@ func (c *containerLXC) Start(stateful bool) error {
 		if err != nil && !c.IsRunning() {
 			return errors.Wrap(err, "Migrate")
 		}
+		c.startTimer.done("restore")
 
 		os.RemoveAll(c.StatePath())
 		c.stateful = false
@@ -3146,6 +3944,11 @@ func (c *containerLXC) Start(stateful bool) error {
 			return errors.Wrap(err, "Start container")
 		}
 
+		err = c.VolatileSet(map[string]string{"volatile.last_state.stateful_at": ""})
+		if err != nil {
+			logger.Warn("Failed to clear stateful timestamp", log.Ctx{"name": c.name, "err": err})
+		}
+
 		// Start proxy devices
 		err = c.restartProxyDevices()
 		if err != nil {
@@ -3153,7 +3956,9 @@ func (c *containerLXC) Start(stateful bool) error {
 			c.Stop(false)
 			return err
 		}
+		c.startTimer.done("network")
 
+		c.recordStartTimings(ctxMap)
 		logger.Info("Started container", ctxMap)
 		return nil
 	} else if c.stateful {
@@ -3168,18 +3973,33 @@ func (c *containerLXC) Start(stateful bool) error {
 		if err != nil {
 			return errors.Wrap(err, "Persist stateful flag")
 		}
+
+		err = c.VolatileSet(map[string]string{"volatile.last_state.stateful_at": ""})
+		if err != nil {
+			return errors.Wrap(err, "Clear stateful timestamp")
+		}
 	}
 
 	name := projectPrefix(c.Project(), c.name)
 
+	// Secrets are handed to forkstart over stdin so they never end up in
+	// the saved LXC config
+	secrets, err := c.secretsEnvironment()
+	if err != nil {
+		return err
+	}
+
 	// Start the LXC container
-	out, err := shared.RunCommand(
+	out, err := shared.RunCommandStdin(
+		strings.NewReader(secrets),
 		c.state.OS.ExecPath,
 		"forkstart",
 		name,
 		c.state.OS.LxcPath,
 		configPath)
 
+	c.startTimer.done("forkstart")
+
 	// Capture debug output
 	if out != "" {
 		for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
@@ -3221,6 +4041,14 @@ func (c *containerLXC) Start(stateful bool) error {
 		return err
 	}
 
+	// Apply path MTU discovery setting
+	err = c.setNetworkPMTUDiscovery()
+	if err != nil {
+		// Attempt to stop the container
+		c.Stop(false)
+		return err
+	}
+
 	// Start proxy devices
 	err = c.restartProxyDevices()
 	if err != nil {
@@ -3228,7 +4056,9 @@ func (c *containerLXC) Start(stateful bool) error {
 		c.Stop(false)
 		return err
 	}
+	c.startTimer.done("network")
 
+	c.recordStartTimings(ctxMap)
 	logger.Info("Started container", ctxMap)
 	eventSendLifecycle(c.project, "container-started",
 		fmt.Sprintf("/1.0/containers/%s", c.name), nil)
@@ -3236,6 +4066,18 @@ func (c *containerLXC) Start(stateful bool) error {
 	return nil
 }
 
+// recordStartTimings stores the duration of the start phases in
+// volatile.last_state.start_timings and adds them to the start log entry.
+func (c *containerLXC) recordStartTimings(ctxMap log.Ctx) {
+	timings := c.startTimer.String()
+	ctxMap["timings"] = timings
+
+	err := c.VolatileSet(map[string]string{"volatile.last_state.start_timings": timings})
+	if err != nil {
+		logger.Warn("Failed to record start timings", log.Ctx{"name": c.name, "err": err})
+	}
+}
+
 func (c *containerLXC) OnStart() error {
 	// Make sure we can't call go-lxc functions by mistake
 	c.fromHook = true
@@ -3291,6 +4133,24 @@ func (c *containerLXC) OnStart() error {
 	// Trigger a rebalance
 	deviceTaskSchedulerTrigger("container", c.name, "started")
 
+	// Clear any previous memory pause
+	if c.localConfig["volatile.last_state.memory_paused"] != "" {
+		err = c.VolatileSet(map[string]string{"volatile.last_state.memory_paused": ""})
+		if err != nil {
+			logger.Warn("Failed to clear memory pause", log.Ctx{"container": c.name, "err": err})
+		}
+	}
+
+	// Start monitoring memory usage for the pause policy
+	if c.state.OS.CGroupMemoryController && c.state.OS.CGroupFreezerController && c.expandedConfig["limits.memory.pause_threshold"] != "" {
+		go memoryPauseMonitor(c.state, c.id)
+	}
+
+	// Start forwarding the console output
+	if c.expandedConfig["console.forward"] != "" {
+		consoleForwardStart(c.state, c.id, c.expandedConfig["console.forward"])
+	}
+
 	// Apply network priority
 	if c.expandedConfig["limits.network.priority"] != "" {
 		go func(c *containerLXC) {
@@ -3365,6 +4225,9 @@ func (c *containerLXC) Stop(stateful bool) error {
 
 	// Handle stateful stop
 	if stateful {
+		// Dumping a big container takes a while
+		op.Extend(c.operationTimeout("dump"))
+
 		// Cleanup any existing state
 		stateDir := c.StatePath()
 		os.RemoveAll(stateDir)
@@ -3408,6 +4271,12 @@ func (c *containerLXC) Stop(stateful bool) error {
 			return err
 		}
 
+		// Record when the state was saved
+		err = c.VolatileSet(map[string]string{"volatile.last_state.stateful_at": time.Now().UTC().Format(time.RFC3339)})
+		if err != nil {
+			logger.Warn("Failed to record stateful timestamp", log.Ctx{"name": c.name, "err": err})
+		}
+
 		op.Done(nil)
 		logger.Info("Stopped container", ctxMap)
 		eventSendLifecycle(c.project, "container-stopped",
@@ -3515,6 +4384,43 @@ func (c *containerLXC) Shutdown(timeout time.Duration) error {
 	return nil
 }
 
+// Signal sends a signal to the container's init process, leaving it to the
+// init system to act on it (e.g. SIGTERM or SIGUSR1).
+func (c *containerLXC) Signal(signal unix.Signal) error {
+	if !c.IsRunning() {
+		return fmt.Errorf("The container isn't running")
+	}
+
+	pid := c.InitPID()
+	if pid <= 0 {
+		return fmt.Errorf("Couldn't find the container's init process")
+	}
+
+	ctxMap := log.Ctx{
+		"project": c.project,
+		"name":    c.name,
+		"action":  "signal",
+		"signal":  int(signal)}
+
+	err := unix.Kill(pid, signal)
+	if err != nil {
+		logger.Error("Failed signalling container", ctxMap)
+		return errors.Wrapf(err, "Failed to send signal %d to the container", signal)
+	}
+
+	logger.Info("Signalled container", ctxMap)
+	eventSendLifecycle(c.project, "container-signalled",
+		fmt.Sprintf("/1.0/containers/%s", c.name), map[string]interface{}{"signal": int(signal)})
+
+	return nil
+}
+
+// Kill sends SIGKILL to the container's init process, tearing the container
+// down right away, without the fork-bomb mitigation of Stop().
+func (c *containerLXC) Kill() error {
+	return c.Signal(unix.SIGKILL)
+}
+
 // OnStopNS is triggered by LXC's stop hook once a container is shutdown but before the container's
 // namespaces have been closed. The netns path of the stopped container is provided.
 func (c *containerLXC) OnStopNS(target string, netns string) error {
@@ -3548,6 +4454,9 @@ func (c *containerLXC) OnStop(target string) error {
 	// Make sure we can't call go-lxc functions by mistake
 	c.fromHook = true
 
+	// Stop forwarding the console output
+	consoleForwardStop(c.id)
+
 	// Kill all proxy devices, must happen before StorageStop
 	err := c.removeProxyDevices()
 	if err != nil {
@@ -3584,8 +4493,30 @@ func (c *containerLXC) OnStop(target string) error {
 		logger.Error("Failed to set container state", log.Ctx{"container": c.Name(), "err": err})
 	}
 
-	// Clean up networking veth devices
-	c.cleanupHostVethDevices()
+	// The container is no longer ready
+	err = c.SetReady(false)
+	if err != nil {
+		logger.Error("Failed to clear container readiness", log.Ctx{"container": c.Name(), "err": err})
+	}
+
+	// Record how the container's init exited
+	exitCode := ""
+	code, ok := lxcInitExitCode(projectPrefix(c.Project(), c.Name()))
+	if ok {
+		exitCode = strconv.Itoa(code)
+	}
+
+	err = c.VolatileSet(map[string]string{"volatile.last_state.exit_code": exitCode})
+	if err != nil {
+		logger.Error("Failed to record container exit code", log.Ctx{"container": c.Name(), "err": err})
+	}
+
+	// Clean up networking veth devices, keeping them in place for the next boot if requested
+	if target == "reboot" && shared.IsTrue(c.expandedConfig["boot.reboot.preserve_network"]) {
+		c.preserveHostVethDevices()
+	} else {
+		c.cleanupHostVethDevices()
+	}
 
 	go func(c *containerLXC, target string, op *lxcContainerOperation) {
 		c.fromHook = false
@@ -3654,13 +4585,43 @@ func (c *containerLXC) cleanupHostVethDevices() {
 	}
 }
 
-func (c *containerLXC) cleanupHostVethDevice(deviceName string, m types.Device) {
-	// If not configured, check if volatile data contains the most recently added host_name.
-	if m["host_name"] == "" {
-		m["host_name"] = c.getVolatileHostName(deviceName)
-	}
+// preserveHostVethDevices keeps the host side configuration of veth devices across an
+// in-guest reboot. The veth pairs go away with the network namespace, but are recreated
+// with the same host name so that the bridge filters and routes still apply to them.
+func (c *containerLXC) preserveHostVethDevices() {
+	for _, k := range c.expandedDevices.DeviceNames() {
+		m := c.expandedDevices[k]
+		if m["type"] != "nic" || !shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
+			continue
+		}
 
-	// Check whether host device resolution succeeded.
+		// Without a known host name, the new veth can't take over the old one's setup.
+		if m["host_name"] == "" && c.getVolatileHostName(k) == "" {
+			m, err := c.fillNetworkDevice(k, m)
+			if err != nil {
+				logger.Error("Failed to cleanup veth device: ", log.Ctx{"container": c.Name(), "device": k, "err": err})
+				continue
+			}
+
+			c.cleanupHostVethDevice(k, m)
+			continue
+		}
+
+		preservedKey := fmt.Sprintf("volatile.%s.host_preserved", k)
+		err := c.VolatileSet(map[string]string{preservedKey: "true"})
+		if err != nil {
+			logger.Error("Failed to preserve veth device: ", log.Ctx{"container": c.Name(), "device": k, "err": err})
+		}
+	}
+}
+
+func (c *containerLXC) cleanupHostVethDevice(deviceName string, m types.Device) {
+	// If not configured, check if volatile data contains the most recently added host_name.
+	if m["host_name"] == "" {
+		m["host_name"] = c.getVolatileHostName(deviceName)
+	}
+
+	// Check whether host device resolution succeeded.
 	if m["host_name"] == "" {
 		logger.Error("Failed to cleanup veth device: ", log.Ctx{"container": c.Name(), "device": deviceName, "err": fmt.Errorf("host_name not set")})
 	}
@@ -3668,15 +4629,26 @@ func (c *containerLXC) cleanupHostVethDevice(deviceName string, m types.Device)
 	// Remove any filters
 	if m["nictype"] == "bridged" {
 		c.removeNetworkFilters(deviceName, m)
+		c.removeNetworkConnLimit(deviceName)
+		c.removeNetworkMSSClamp(deviceName)
 	}
 
 	// Remove any static host side veth routes
 	if shared.StringInSlice(m["nictype"], []string{"bridged", "p2p"}) {
 		c.removeNetworkRoutes(deviceName, m)
 
-		// Remove volatile host_name for device
+		if m["nictype"] == "p2p" && m["vrf"] != "" {
+			c.removeNetworkVrf(m)
+		}
+
+		if m["nictype"] == "p2p" {
+			c.removeNetworkHostAddresses(m)
+		}
+
+		// Remove volatile host_name and any reboot preservation marker for device
 		hostNameKey := fmt.Sprintf("volatile.%s.host_name", deviceName)
-		err := c.VolatileSet(map[string]string{hostNameKey: ""})
+		preservedKey := fmt.Sprintf("volatile.%s.host_preserved", deviceName)
+		err := c.VolatileSet(map[string]string{hostNameKey: "", preservedKey: ""})
 		if err != nil {
 			logger.Error("Failed to cleanup veth device: ", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
 		}
@@ -3738,7 +4710,23 @@ func (c *containerLXC) OnNetworkUp(deviceName string, hostName string) error {
 		}
 	}
 
-	_, err := c.setupHostVethDevice(deviceName, device, types.Device{})
+	// The bridge filters and routes may have been kept across an in-guest reboot,
+	// but they are gone if the host rebooted or the restart failed half way. So
+	// clear whatever is left of them before setting them all up again.
+	oldDevice := types.Device{}
+	preservedKey := fmt.Sprintf("volatile.%s.host_preserved", deviceName)
+	if shared.IsTrue(c.localConfig[preservedKey]) {
+		err := c.VolatileSet(map[string]string{preservedKey: ""})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range device {
+			oldDevice[k] = v
+		}
+	}
+
+	_, err := c.setupHostVethDevice(deviceName, device, oldDevice)
 
 	return err
 }
@@ -3785,6 +4773,44 @@ func (c *containerLXC) setupHostVethDevice(deviceName string, device types.Devic
 		}
 	}
 
+	// Refresh connection limits.
+	if oldDevice["nictype"] == "bridged" && oldDevice["limits.connections"] != "" {
+		c.removeNetworkConnLimit(deviceName)
+	}
+
+	if device["nictype"] == "bridged" && device["limits.connections"] != "" {
+		err := c.setNetworkConnLimit(deviceName, device)
+		if err != nil {
+			return bounceInterfaces, err
+		}
+	}
+
+	// Refresh MSS clamping.
+	if oldDevice["nictype"] == "bridged" && oldDevice["mss_clamp"] != "" {
+		c.removeNetworkMSSClamp(deviceName)
+	}
+
+	if device["nictype"] == "bridged" && device["mss_clamp"] != "" {
+		err := c.setNetworkMSSClamp(deviceName, device)
+		if err != nil {
+			return bounceInterfaces, err
+		}
+	}
+
+	// Put the host side in promiscuous mode, it goes away with the veth pair.
+	if device["nictype"] == "bridged" && shared.IsTrue(device["promisc"]) {
+		err := networkSetDevPromisc(device["host_name"], true)
+		if err != nil {
+			return bounceInterfaces, err
+		}
+	} else if oldDevice["nictype"] == "bridged" && shared.IsTrue(oldDevice["promisc"]) {
+		// Promiscuous mode was turned off on a live update.
+		err := networkSetDevPromisc(device["host_name"], false)
+		if err != nil {
+			return bounceInterfaces, err
+		}
+	}
+
 	// Refresh tc limits.
 	err := c.setNetworkLimits(device)
 	if err != nil {
@@ -3796,6 +4822,18 @@ func (c *containerLXC) setupHostVethDevice(deviceName string, device types.Devic
 		c.removeNetworkRoutes(deviceName, oldDevice)
 	}
 
+	// Refresh VRF membership, before any routes as they go into its table.
+	if oldDevice["nictype"] == "p2p" && oldDevice["vrf"] != "" && device["vrf"] == "" {
+		c.removeNetworkVrf(oldDevice)
+	}
+
+	if device["nictype"] == "p2p" && device["vrf"] != "" {
+		err = c.setNetworkVrf(device)
+		if err != nil {
+			return bounceInterfaces, err
+		}
+	}
+
 	// Setup static routes to container.
 	err = c.setNetworkRoutes(device)
 	if err != nil {
@@ -3863,6 +4901,49 @@ func (c *containerLXC) Freeze() error {
 	return err
 }
 
+// RunFreezeHook runs the shell command set in the given config key inside the
+// container, killing it if it doesn't complete within freeze.timeout seconds.
+// It's only used when pausing on request, internal freezes don't wait for it.
+func (c *containerLXC) RunFreezeHook(key string) error {
+	command := c.expandedConfig[key]
+	if command == "" {
+		return nil
+	}
+
+	timeout := 30 * time.Second
+	if c.expandedConfig["freeze.timeout"] != "" {
+		seconds, err := strconv.Atoi(c.expandedConfig["freeze.timeout"])
+		if err != nil {
+			return err
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	env := map[string]string{"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	waitCmd, _, attachedPid, err := c.Exec([]string{"/bin/sh", "-c", command}, env, nil, nil, nil, false, "/", 0, 0, containerExecSandbox{})
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitCmd()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("Command set in %s failed: %v", key, err)
+		}
+
+		return nil
+	case <-time.After(timeout):
+		unix.Kill(attachedPid, unix.SIGKILL)
+		return fmt.Errorf("Command set in %s didn't complete within %s", key, timeout)
+	}
+}
+
 func (c *containerLXC) Unfreeze() error {
 	ctxMap := log.Ctx{
 		"project":   c.project,
@@ -3882,8 +4963,15 @@ func (c *containerLXC) Unfreeze() error {
 		return nil
 	}
 
+	// A container temporarily thawed for access stays thawed from now on
+	containerThawLock.Lock()
+	key := projectPrefix(c.Project(), c.Name())
+	thawed := containerThawed[key]
+	delete(containerThawed, key)
+	containerThawLock.Unlock()
+
 	// Check that we're frozen
-	if !c.IsFrozen() {
+	if !thawed && !c.IsFrozen() {
 		return fmt.Errorf("The container is already running")
 	}
 
@@ -3901,6 +4989,14 @@ func (c *containerLXC) Unfreeze() error {
 		logger.Error("Failed unfreezing container", ctxMap)
 	}
 
+	// The container is no longer paused due to memory usage
+	if c.localConfig["volatile.last_state.memory_paused"] != "" {
+		err := c.VolatileSet(map[string]string{"volatile.last_state.memory_paused": ""})
+		if err != nil {
+			logger.Warn("Failed to clear memory pause", log.Ctx{"container": c.name, "err": err})
+		}
+	}
+
 	logger.Info("Unfroze container", ctxMap)
 	eventSendLifecycle(c.project, "container-resumed",
 		fmt.Sprintf("/1.0/containers/%s", c.name), nil)
@@ -3908,6 +5004,77 @@ func (c *containerLXC) Unfreeze() error {
 	return err
 }
 
+// Number of users of each container thawed by thawForAccess, by container.
+var containerThawUsers = map[string]int{}
+
+// Containers thawed by thawForAccess which are to be frozen again, a manual
+// unfreeze clearing that.
+var containerThawed = map[string]bool{}
+var containerThawLock sync.Mutex
+
+// thawForAccess makes sure the container isn't frozen before attaching to it.
+// Frozen containers are temporarily thawed if security.thaw_on_access is set,
+// in which case the returned function must be called to freeze it again. The
+// container is only frozen again once all concurrent users are done with it.
+func (c *containerLXC) thawForAccess() (func(), error) {
+	containerThawLock.Lock()
+	defer containerThawLock.Unlock()
+
+	key := projectPrefix(c.Project(), c.Name())
+	if containerThawUsers[key] == 0 {
+		if !c.IsFrozen() {
+			return func() {}, nil
+		}
+
+		if !shared.IsTrue(c.expandedConfig["security.thaw_on_access"]) {
+			return nil, fmt.Errorf("Container is frozen")
+		}
+
+		err := c.initLXC(false)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.c.Unfreeze()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to thaw container")
+		}
+
+		containerThawed[key] = true
+	}
+
+	containerThawUsers[key]++
+
+	once := sync.Once{}
+	refreeze := func() {
+		once.Do(func() {
+			containerThawLock.Lock()
+			defer containerThawLock.Unlock()
+
+			containerThawUsers[key]--
+			if containerThawUsers[key] > 0 {
+				return
+			}
+
+			delete(containerThawUsers, key)
+
+			// Leave the container alone if it was unfrozen meanwhile
+			if !containerThawed[key] {
+				return
+			}
+
+			delete(containerThawed, key)
+
+			err := c.c.Freeze()
+			if err != nil {
+				logger.Error("Failed to freeze container again", log.Ctx{"container": c.name, "err": err})
+			}
+		})
+	}
+
+	return refreeze, nil
+}
+
 var LxcMonitorStateError = fmt.Errorf("Monitor is hung")
 
 // Get lxc container state, with 1 second timeout
@@ -3952,6 +5119,7 @@ func (c *containerLXC) Render() (interface{}, interface{}, error) {
 			LastUsedAt:      c.lastUsedDate,
 			Name:            strings.SplitN(c.name, "/", 2)[1],
 			Stateful:        c.stateful,
+			MetadataOnly:    c.IsMetadataOnly(),
 		}
 		ct.Architecture = architectureName
 		ct.Config = c.localConfig
@@ -3991,11 +5159,25 @@ func (c *containerLXC) Render() (interface{}, interface{}, error) {
 	ct.LastUsedAt = c.lastUsedDate
 	ct.Profiles = c.profiles
 	ct.Stateful = c.stateful
+	ct.AutostartPriority = c.AutostartPriority()
+
+	if c.stateful && c.localConfig["volatile.last_state.stateful_at"] != "" {
+		statefulAt, err := time.Parse(time.RFC3339, c.localConfig["volatile.last_state.stateful_at"])
+		if err == nil {
+			ct.StatefulAt = statefulAt
+		}
+	}
 
 	return &ct, etag, nil
 }
 
 func (c *containerLXC) RenderFull() (*api.ContainerFull, interface{}, error) {
+	return c.renderFull(nil)
+}
+
+// renderFull renders the container, optionally using the host counters
+// gathered by networkGetHostCounters for its network state.
+func (c *containerLXC) renderFull(hostCounters map[string]api.ContainerStateNetworkCounters) (*api.ContainerFull, interface{}, error) {
 	if c.IsSnapshot() {
 		return nil, nil, fmt.Errorf("RenderFull only works with containers")
 	}
@@ -4010,7 +5192,7 @@ func (c *containerLXC) RenderFull() (*api.ContainerFull, interface{}, error) {
 	ct := api.ContainerFull{Container: *base.(*api.Container)}
 
 	// Add the ContainerState
-	ct.State, err = c.RenderState()
+	ct.State, err = c.renderState(hostCounters)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -4054,6 +5236,14 @@ func (c *containerLXC) RenderFull() (*api.ContainerFull, interface{}, error) {
 }
 
 func (c *containerLXC) RenderState() (*api.ContainerState, error) {
+	return c.renderState(nil)
+}
+
+// renderState renders the container's state. If hostCounters is set, the
+// traffic counters of the nics are taken from it instead of being queried in
+// the container's network namespace. Interfaces without a host side veth, such
+// as the loopback, then don't report any counters.
+func (c *containerLXC) renderState(hostCounters map[string]api.ContainerStateNetworkCounters) (*api.ContainerState, error) {
 	cState, err := c.getLxcState()
 	if err != nil {
 		return nil, err
@@ -4062,6 +5252,17 @@ func (c *containerLXC) RenderState() (*api.ContainerState, error) {
 	status := api.ContainerState{
 		Status:     statusCode.String(),
 		StatusCode: statusCode,
+		Nesting:    c.nestingState(),
+		Idmaps:     c.idmapsState(),
+		Ready:      c.IsReady(),
+	}
+
+	status.LastExitCode = -1
+	if c.localConfig["volatile.last_state.exit_code"] != "" {
+		code, err := strconv.ParseInt(c.localConfig["volatile.last_state.exit_code"], 10, 64)
+		if err == nil {
+			status.LastExitCode = code
+		}
 	}
 
 	if c.IsRunning() {
@@ -4069,7 +5270,7 @@ func (c *containerLXC) RenderState() (*api.ContainerState, error) {
 		status.CPU = c.cpuState()
 		status.Disk = c.diskState()
 		status.Memory = c.memoryState()
-		status.Network = c.networkState()
+		status.Network = c.networkState(hostCounters)
 		status.Pid = int64(pid)
 		status.Processes = c.processesState()
 	}
@@ -4103,6 +5304,84 @@ func (c *containerLXC) Snapshots() ([]container, error) {
 	return containers, nil
 }
 
+// snapshotsDiff lists the config keys, devices and profiles which differ
+// between two snapshots. Values missing from one of the snapshots are empty.
+type snapshotsDiff struct {
+	Config   map[string][2]string
+	Devices  map[string][2]map[string]string
+	Profiles [2][]string
+}
+
+// SnapshotsDiff compares the config, devices and profiles of two snapshots of
+// the container.
+func (c *containerLXC) SnapshotsDiff(from string, to string) (*snapshotsDiff, error) {
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := map[string]*api.ContainerSnapshot{}
+	for _, snap := range snapshots {
+		_, name, _ := containerGetParentAndSnapshotName(snap.Name())
+		if name != from && name != to {
+			continue
+		}
+
+		render, _, err := snap.Render()
+		if err != nil {
+			return nil, err
+		}
+
+		rendered[name] = render.(*api.ContainerSnapshot)
+	}
+
+	for _, name := range []string{from, to} {
+		if rendered[name] == nil {
+			return nil, fmt.Errorf("Snapshot \"%s\" not found", name)
+		}
+	}
+
+	a := rendered[from]
+	b := rendered[to]
+
+	diff := snapshotsDiff{
+		Config:  map[string][2]string{},
+		Devices: map[string][2]map[string]string{},
+	}
+
+	for key, value := range a.Config {
+		if b.Config[key] != value {
+			diff.Config[key] = [2]string{value, b.Config[key]}
+		}
+	}
+
+	for key, value := range b.Config {
+		_, ok := a.Config[key]
+		if !ok {
+			diff.Config[key] = [2]string{"", value}
+		}
+	}
+
+	for name, device := range a.Devices {
+		if !types.Devices(b.Devices).Contains(name, device) {
+			diff.Devices[name] = [2]map[string]string{device, b.Devices[name]}
+		}
+	}
+
+	for name, device := range b.Devices {
+		_, ok := a.Devices[name]
+		if !ok {
+			diff.Devices[name] = [2]map[string]string{nil, device}
+		}
+	}
+
+	if strings.Join(a.Profiles, "\n") != strings.Join(b.Profiles, "\n") {
+		diff.Profiles = [2][]string{a.Profiles, b.Profiles}
+	}
+
+	return &diff, nil
+}
+
 func (c *containerLXC) Backups() ([]backup, error) {
 	// Get all the backups
 	backupNames, err := c.state.Cluster.ContainerGetBackups(c.project, c.name)
@@ -4127,6 +5406,14 @@ func (c *containerLXC) Backups() ([]backup, error) {
 func (c *containerLXC) Restore(sourceContainer container, stateful bool) error {
 	var ctxMap log.Ctx
 
+	if sourceContainer.IsMetadataOnly() {
+		if stateful {
+			return fmt.Errorf("Metadata-only snapshots can't be restored statefully")
+		}
+
+		return c.restoreMetadata(sourceContainer)
+	}
+
 	// Initialize storage interface for the container.
 	err := c.initStorage()
 	if err != nil {
@@ -4304,6 +5591,58 @@ func (c *containerLXC) Restore(sourceContainer container, stateful bool) error {
 	return nil
 }
 
+// restoreMetadata reverts the configuration, devices and profiles of the container to those
+// recorded in a metadata-only snapshot, leaving the filesystem untouched. The current volatile
+// keys are kept as they describe the container's on-disk and runtime state.
+func (c *containerLXC) restoreMetadata(sourceContainer container) error {
+	ctxMap := log.Ctx{
+		"project": c.project,
+		"name":    c.name,
+		"source":  sourceContainer.Name()}
+
+	logger.Info("Restoring container configuration", ctxMap)
+
+	config := map[string]string{}
+	for k, v := range sourceContainer.LocalConfig() {
+		if strings.HasPrefix(k, "volatile.") {
+			continue
+		}
+
+		config[k] = v
+	}
+
+	for k, v := range c.localConfig {
+		if strings.HasPrefix(k, "volatile.") {
+			config[k] = v
+		}
+	}
+
+	args := db.ContainerArgs{
+		Architecture: sourceContainer.Architecture(),
+		Config:       config,
+		Description:  sourceContainer.Description(),
+		Devices:      sourceContainer.LocalDevices(),
+		Ephemeral:    sourceContainer.IsEphemeral(),
+		Profiles:     sourceContainer.Profiles(),
+		Project:      sourceContainer.Project(),
+	}
+
+	err := c.Update(args, false)
+	if err != nil {
+		logger.Error("Failed restoring container configuration", ctxMap)
+		return err
+	}
+
+	eventSendLifecycle(c.project, "container-snapshot-restored",
+		fmt.Sprintf("/1.0/containers/%s", c.name), map[string]interface{}{
+			"snapshot_name": c.name,
+		})
+
+	logger.Info("Restored container configuration", ctxMap)
+
+	return nil
+}
+
 func (c *containerLXC) cleanup() {
 	// Unmount any leftovers
 	c.removeUnixDevices()
@@ -4331,6 +5670,16 @@ func (c *containerLXC) Delete() error {
 
 	logger.Info("Deleting container", ctxMap)
 
+	err := c.checkLocalNode()
+	if err != nil {
+		logger.Error("Failed deleting container", ctxMap)
+		return err
+	}
+
+	lxcCGroupDevicesWarnedLock.Lock()
+	delete(lxcCGroupDevicesWarned, c.id)
+	lxcCGroupDevicesWarnedLock.Unlock()
+
 	if shared.IsTrue(c.expandedConfig["security.protection.delete"]) && !c.IsSnapshot() {
 		err := fmt.Errorf("Container is protected")
 		logger.Warn("Failed to delete container", log.Ctx{"name": c.Name(), "err": err})
@@ -4355,14 +5704,14 @@ func (c *containerLXC) Delete() error {
 	}
 
 	// Attempt to initialize storage interface for the container.
-	err := c.initStorage()
+	err = c.initStorage()
 	if err != nil {
 		logger.Warnf("Failed to init storage: %v", err)
 	}
 
 	if c.IsSnapshot() {
 		// Remove the snapshot
-		if c.storage != nil && !isImport {
+		if c.storage != nil && !isImport && !c.IsMetadataOnly() {
 			err := c.storage.ContainerSnapshotDelete(c)
 			if err != nil {
 				logger.Warn("Failed to delete snapshot", log.Ctx{"name": c.Name(), "err": err})
@@ -4497,8 +5846,25 @@ func (c *containerLXC) Rename(newName string) error {
 		return fmt.Errorf("Invalid container name")
 	}
 
+	// liblxc ties the running container's monitor to its name, so a running
+	// container is stopped for the rename and started again under its new
+	// name afterwards (or its old one if the rename fails).
 	if c.IsRunning() {
-		return fmt.Errorf("Renaming of running container not allowed")
+		if c.IsEphemeral() {
+			return fmt.Errorf("Renaming of running ephemeral container not allowed")
+		}
+
+		err := c.Stop(false)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			err := c.Start(false)
+			if err != nil {
+				logger.Error("Failed to restart renamed container", log.Ctx{"container": c.Name(), "err": err})
+			}
+		}()
 	}
 
 	// Clean things up
@@ -4522,12 +5888,14 @@ func (c *containerLXC) Rename(newName string) error {
 		}
 	}
 
-	// Rename the storage entry
+	// Rename the storage entry (metadata-only snapshots have nothing on disk)
 	if c.IsSnapshot() {
-		err := c.storage.ContainerSnapshotRename(c, newName)
-		if err != nil {
-			logger.Error("Failed renaming container", ctxMap)
-			return err
+		if !c.IsMetadataOnly() {
+			err := c.storage.ContainerSnapshotRename(c, newName)
+			if err != nil {
+				logger.Error("Failed renaming container", ctxMap)
+				return err
+			}
 		}
 	} else {
 		err := c.storage.ContainerRename(c, newName)
@@ -4602,6 +5970,15 @@ func (c *containerLXC) Rename(newName string) error {
 	// Set the new name in the struct
 	c.name = newName
 
+	// Re-apply any rename templates on next start
+	if !c.IsSnapshot() {
+		err = c.TemplateApply("rename")
+		if err != nil {
+			logger.Error("Failed renaming container", ctxMap)
+			return err
+		}
+	}
+
 	// Update the storage volume name in the storage interface.
 	sNew := c.storage.GetStoragePoolVolumeWritable()
 	c.storage.SetStoragePoolVolumeWritable(&sNew)
@@ -4647,10 +6024,31 @@ func (c *containerLXC) CGroupGet(key string) (string, error) {
 		return "", fmt.Errorf("Can't get cgroups on a stopped container")
 	}
 
+	if c.cgroupUnified(key) {
+		unifiedKey, _ := cgroupUnifiedItem(key, "")
+		if unifiedKey == "" {
+			return "", fmt.Errorf("The cgroup %s isn't available on the unified hierarchy", key)
+		}
+
+		key = unifiedKey
+	}
+
 	value := c.c.CgroupItem(key)
 	return strings.Join(value, "\n"), nil
 }
 
+// CPUSet returns the cpus the container is currently pinned to, either
+// through an explicit set in limits.cpu or by the scheduler when balancing
+// containers with a cpu count.
+func (c *containerLXC) CPUSet() (string, error) {
+	value, err := c.CGroupGet("cpuset.cpus")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(value), nil
+}
+
 func (c *containerLXC) CGroupSet(key string, value string) error {
 	// Load the go-lxc struct
 	err := c.initLXC(false)
@@ -4663,10 +6061,18 @@ func (c *containerLXC) CGroupSet(key string, value string) error {
 		return fmt.Errorf("Can't set cgroups on a stopped container")
 	}
 
-	err = c.c.SetCgroupItem(key, value)
-	if err != nil {
-		return fmt.Errorf("Failed to set cgroup %s=\"%s\": %s", key, value, err)
-	}
+	// Values without an equivalent on the unified hierarchy are dropped
+	if c.cgroupUnified(key) {
+		key, value = cgroupUnifiedItem(key, value)
+		if key == "" {
+			return nil
+		}
+	}
+
+	err = c.c.SetCgroupItem(key, value)
+	if err != nil {
+		return fmt.Errorf("Failed to set cgroup %s=\"%s\": %s", key, value, err)
+	}
 
 	return nil
 }
@@ -4709,26 +6115,22 @@ type backupFile struct {
 	Volume    *api.StorageVolume       `yaml:"volume"`
 }
 
-func writeBackupFile(c container) error {
-	// We only write backup files out for actual containers
+// ExportFullConfig returns the complete state of the container as stored in
+// backup.yaml: its local and expanded config and devices (which include the
+// idmap volatile keys), profiles, snapshots and storage.
+func (c *containerLXC) ExportFullConfig() (*backupFile, error) {
 	if c.IsSnapshot() {
-		return nil
-	}
-
-	// Immediately return if the container directory doesn't exist yet
-	if !shared.PathExists(c.Path()) {
-		return os.ErrNotExist
+		return nil, fmt.Errorf("Only containers can be exported")
 	}
 
-	// Generate the YAML
 	ci, _, err := c.Render()
 	if err != nil {
-		return errors.Wrap(err, "Failed to render container metadata")
+		return nil, errors.Wrap(err, "Failed to render container metadata")
 	}
 
 	snapshots, err := c.Snapshots()
 	if err != nil {
-		return errors.Wrap(err, "Failed to get snapshots")
+		return nil, errors.Wrap(err, "Failed to get snapshots")
 	}
 
 	var sis []*api.ContainerSnapshot
@@ -4736,7 +6138,7 @@ func writeBackupFile(c container) error {
 	for _, s := range snapshots {
 		si, _, err := s.Render()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		sis = append(sis, si.(*api.ContainerSnapshot))
@@ -4744,26 +6146,116 @@ func writeBackupFile(c container) error {
 
 	poolName, err := c.StoragePool()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s := c.DaemonState()
-	poolID, pool, err := s.Cluster.StoragePoolGet(poolName)
+	poolID, pool, err := c.state.Cluster.StoragePoolGet(poolName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, volume, err := s.Cluster.StoragePoolNodeVolumeGetTypeByProject(c.Project(), c.Name(), storagePoolVolumeTypeContainer, poolID)
+	_, volume, err := c.state.Cluster.StoragePoolNodeVolumeGetTypeByProject(c.project, c.name, storagePoolVolumeTypeContainer, poolID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	data, err := yaml.Marshal(&backupFile{
+	return &backupFile{
 		Container: ci.(*api.Container),
 		Snapshots: sis,
 		Pool:      pool,
 		Volume:    volume,
+	}, nil
+}
+
+// ImportFullConfig reconstructs the container and its snapshots from the
+// state returned by ExportFullConfig, without going through the database.
+// The expanded config and devices are taken as recorded, so the result renders
+// the same as the exported container even if its profiles changed since.
+func ImportFullConfig(s *state.State, project string, backup *backupFile) (*containerLXC, []*containerLXC, error) {
+	if backup.Container == nil {
+		return nil, nil, fmt.Errorf("The backup doesn't contain a container")
+	}
+
+	ci := backup.Container
+	arch, err := osarch.ArchitectureId(ci.Architecture)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := containerLXCInstantiate(s, db.ContainerArgs{
+		Project:      project,
+		Architecture: arch,
+		Config:       ci.Config,
+		CreationDate: ci.CreatedAt,
+		Ctype:        db.CTypeRegular,
+		Description:  ci.Description,
+		Devices:      ci.Devices,
+		Ephemeral:    ci.Ephemeral,
+		LastUsedDate: ci.LastUsedAt,
+		Name:         ci.Name,
+		Node:         ci.Location,
+		Profiles:     ci.Profiles,
+		Stateful:     ci.Stateful,
 	})
+	c.expandedConfig = ci.ExpandedConfig
+	c.expandedDevices = ci.ExpandedDevices
+	runtime.SetFinalizer(c, containerLXCUnload)
+
+	// Make sure the recorded idmap is usable
+	_, err = c.NextIdmap()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to parse the container idmap")
+	}
+
+	snapshots := []*containerLXC{}
+	for _, si := range backup.Snapshots {
+		arch, err := osarch.ArchitectureId(si.Architecture)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sc := containerLXCInstantiate(s, db.ContainerArgs{
+			Project:      project,
+			Architecture: arch,
+			Config:       si.Config,
+			CreationDate: si.CreatedAt,
+			Ctype:        db.CTypeSnapshot,
+			Devices:      si.Devices,
+			Ephemeral:    si.Ephemeral,
+			LastUsedDate: si.LastUsedAt,
+			Name:         ci.Name + shared.SnapshotDelimiter + si.Name,
+			Node:         ci.Location,
+			Profiles:     si.Profiles,
+			Stateful:     si.Stateful,
+			ExpiryDate:   si.ExpiresAt,
+		})
+		sc.expandedConfig = si.ExpandedConfig
+		sc.expandedDevices = si.ExpandedDevices
+
+		snapshots = append(snapshots, sc)
+	}
+
+	return c, snapshots, nil
+}
+
+func writeBackupFile(c container) error {
+	// We only write backup files out for actual containers
+	if c.IsSnapshot() {
+		return nil
+	}
+
+	// Immediately return if the container directory doesn't exist yet
+	if !shared.PathExists(c.Path()) {
+		return os.ErrNotExist
+	}
+
+	// Generate the YAML
+	backup, err := c.ExportFullConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(backup)
 	if err != nil {
 		return err
 	}
@@ -4794,7 +6286,108 @@ func writeBackupFile(c container) error {
 	return nil
 }
 
+// SnapshotDevice snapshots the custom storage volume backing the given disk
+// device, independently of the container's own snapshots. A snapshot name is
+// generated if none is passed, the name used is returned.
+func (c *containerLXC) SnapshotDevice(deviceName string, snapshotName string) (string, error) {
+	m, ok := c.expandedDevices[deviceName]
+	if !ok || m["type"] != "disk" {
+		return "", fmt.Errorf("No disk device named \"%s\"", deviceName)
+	}
+
+	if m["path"] == "/" {
+		return "", fmt.Errorf("The root disk is snapshotted along with the container")
+	}
+
+	if m["pool"] == "" {
+		return "", fmt.Errorf("Disk device \"%s\" isn't backed by a custom storage volume", deviceName)
+	}
+
+	volumeName := m["source"]
+	if snapshotName == "" {
+		i := c.state.Cluster.StorageVolumeNextSnapshot(volumeName, storagePoolVolumeTypeCustom)
+		snapshotName = fmt.Sprintf("snap%d", i)
+	}
+
+	err := storageValidName(snapshotName)
+	if err != nil {
+		return "", err
+	}
+
+	poolID, err := c.state.Cluster.StoragePoolGetID(m["pool"])
+	if err != nil {
+		return "", err
+	}
+
+	fullSnapName := fmt.Sprintf("%s%s%s", volumeName, shared.SnapshotDelimiter, snapshotName)
+	_, _, err = c.state.Cluster.StoragePoolNodeVolumeGetType(fullSnapName, storagePoolVolumeTypeCustom, poolID)
+	if err != db.ErrNoSuchObject {
+		if err != nil {
+			return "", err
+		}
+
+		return "", fmt.Errorf("Snapshot '%s' already in use", snapshotName)
+	}
+
+	s, err := storagePoolVolumeInit(c.state, "default", m["pool"], volumeName, storagePoolVolumeTypeCustom)
+	if err != nil {
+		return "", err
+	}
+
+	ourMount, err := s.StoragePoolVolumeMount()
+	if err != nil {
+		return "", err
+	}
+	if ourMount {
+		defer s.StoragePoolVolumeUmount()
+	}
+
+	err = storagePoolVolumeSnapshotCreateInternal(c.state, s, m["pool"], storagePoolVolumeTypeNameCustom, fullSnapName)
+	if err != nil {
+		return "", err
+	}
+
+	return snapshotName, nil
+}
+
+// RemoveDevicesByType removes all local devices of the given type from the container, going
+// through Update so running containers get them detached. Devices coming from profiles are
+// left alone.
+func (c *containerLXC) RemoveDevicesByType(devType string) error {
+	devices := types.Devices{}
+	found := false
+	for name, m := range c.localDevices {
+		if m["type"] == devType {
+			found = true
+			continue
+		}
+
+		devices[name] = m
+	}
+
+	if !found {
+		return nil
+	}
+
+	args := db.ContainerArgs{
+		Architecture: c.Architecture(),
+		Config:       c.LocalConfig(),
+		Description:  c.Description(),
+		Devices:      devices,
+		Ephemeral:    c.IsEphemeral(),
+		Profiles:     c.Profiles(),
+		Project:      c.Project(),
+	}
+
+	return c.Update(args, true)
+}
+
 func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
+	err := c.checkLocalNode()
+	if err != nil {
+		return err
+	}
+
 	// Set sane defaults for unset keys
 	if args.Project == "" {
 		args.Project = "default"
@@ -4817,7 +6410,7 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 	}
 
 	// Validate the new config
-	err := containerValidConfig(c.state.OS, args.Config, false, false)
+	err = containerValidConfig(c.state.OS, args.Config, false, false)
 	if err != nil {
 		return errors.Wrap(err, "Invalid config")
 	}
@@ -4828,6 +6421,11 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 		return errors.Wrap(err, "Invalid devices")
 	}
 
+	err = containerValidChangedDeviceKeys(c.localDevices, args.Devices)
+	if err != nil {
+		return errors.Wrap(err, "Invalid devices")
+	}
+
 	// Validate the new profiles
 	profiles, err := c.state.Cluster.Profiles(args.Project)
 	if err != nil {
@@ -4997,6 +6595,15 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 		return errors.Wrap(err, "Invalid expanded config")
 	}
 
+	// Only check the pinned cpus when changed, so that containers pinned to
+	// cpus which went away can still be updated to fix that
+	if shared.StringInSlice("limits.cpu", changedConfig) && c.expandedConfig["limits.cpu"] != "" && !c.state.OS.MockMode {
+		err = deviceValidCPUSet(c.expandedConfig["limits.cpu"])
+		if err != nil {
+			return errors.Wrap(err, "Invalid limits.cpu")
+		}
+	}
+
 	// Do some validation of the devices diff
 	err = containerValidDevices(c.state.Cluster, c.expandedDevices, false, true)
 	if err != nil {
@@ -5021,7 +6628,7 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 	}
 
 	// If apparmor changed, re-validate the apparmor profile
-	if shared.StringInSlice("raw.apparmor", changedConfig) || shared.StringInSlice("security.nesting", changedConfig) {
+	if shared.StringInSlice("raw.apparmor", changedConfig) || shared.StringInSlice("security.nesting", changedConfig) || shared.StringInSlice("security.apparmor.profile", changedConfig) {
 		err = AAParseProfile(c)
 		if err != nil {
 			return errors.Wrap(err, "Parse AppArmor profile")
@@ -5095,6 +6702,11 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 		return fmt.Errorf("The storage pool of the root disk can only be changed through move")
 	}
 
+	// Check for filesystem change
+	if oldExpandedDevices[oldRootDiskDeviceKey]["fs"] != c.expandedDevices[newRootDiskDeviceKey]["fs"] {
+		return fmt.Errorf("The filesystem of the root disk can only be set at creation time")
+	}
+
 	// Deal with quota changes
 	oldRootDiskDeviceSize := oldExpandedDevices[oldRootDiskDeviceKey]["size"]
 	newRootDiskDeviceSize := c.expandedDevices[newRootDiskDeviceKey]["size"]
@@ -5104,8 +6716,23 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 	if newRootDiskDeviceSize != oldRootDiskDeviceSize {
 		storageTypeName := c.storage.GetStorageTypeName()
 		storageIsReady := c.storage.ContainerStorageReady(c)
-		if (storageTypeName == "lvm" || storageTypeName == "ceph") && isRunning || !storageIsReady {
+		if !storageIsReady {
 			c.localConfig["volatile.apply_quota"] = newRootDiskDeviceSize
+		} else if (storageTypeName == "lvm" || storageTypeName == "ceph") && isRunning {
+			size, err := units.ParseByteSizeString(newRootDiskDeviceSize)
+			if err != nil {
+				return err
+			}
+
+			// Grow the volume and its filesystem online when possible,
+			// otherwise resize it on next start
+			err = c.storage.StorageEntitySetQuota(storagePoolVolumeTypeContainer, size, c)
+			if err != nil {
+				logger.Info("Deferring root disk resize to next start", log.Ctx{"container": c.name, "project": c.project, "size": newRootDiskDeviceSize, "err": err})
+				c.localConfig["volatile.apply_quota"] = newRootDiskDeviceSize
+			} else {
+				delete(c.localConfig, "volatile.apply_quota")
+			}
 		} else {
 			size, err := units.ParseByteSizeString(newRootDiskDeviceSize)
 			if err != nil {
@@ -5141,6 +6768,7 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 	// Apply the live changes
 	if isRunning {
 		// Live update the container config
+		memoryChanged := false
 		for _, key := range changedConfig {
 			value := c.expandedConfig[key]
 
@@ -5168,11 +6796,15 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 					}
 				}
 			} else if key == "linux.kernel_modules" && value != "" {
-				for _, module := range strings.Split(value, ",") {
-					module = strings.TrimPrefix(module, " ")
-					err := util.LoadModule(module)
+				kernelModules, err := shared.ParseKernelModules(value)
+				if err != nil {
+					return err
+				}
+
+				for _, module := range kernelModules {
+					err := util.LoadModule(module.Name, module.Params...)
 					if err != nil {
-						return fmt.Errorf("Failed to load kernel module '%s': %s", module, err)
+						return fmt.Errorf("Failed to load kernel module '%s': %s", module.Name, err)
 					}
 				}
 			} else if key == "limits.disk.priority" {
@@ -5200,160 +6832,7 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 					return err
 				}
 			} else if key == "limits.memory" || strings.HasPrefix(key, "limits.memory.") {
-				// Skip if no memory CGroup
-				if !c.state.OS.CGroupMemoryController {
-					continue
-				}
-
-				// Set the new memory limit
-				memory := c.expandedConfig["limits.memory"]
-				memoryEnforce := c.expandedConfig["limits.memory.enforce"]
-				memorySwap := c.expandedConfig["limits.memory.swap"]
-
-				// Parse memory
-				if memory == "" {
-					memory = "-1"
-				} else if strings.HasSuffix(memory, "%") {
-					percent, err := strconv.ParseInt(strings.TrimSuffix(memory, "%"), 10, 64)
-					if err != nil {
-						return err
-					}
-
-					memoryTotal, err := shared.DeviceTotalMemory()
-					if err != nil {
-						return err
-					}
-
-					memory = fmt.Sprintf("%d", int64((memoryTotal/100)*percent))
-				} else {
-					valueInt, err := units.ParseByteSizeString(memory)
-					if err != nil {
-						return err
-					}
-					memory = fmt.Sprintf("%d", valueInt)
-				}
-
-				// Store the old values for revert
-				oldMemswLimit := ""
-				if c.state.OS.CGroupSwapAccounting {
-					oldMemswLimit, err = c.CGroupGet("memory.memsw.limit_in_bytes")
-					if err != nil {
-						oldMemswLimit = ""
-					}
-				}
-
-				oldLimit, err := c.CGroupGet("memory.limit_in_bytes")
-				if err != nil {
-					oldLimit = ""
-				}
-
-				oldSoftLimit, err := c.CGroupGet("memory.soft_limit_in_bytes")
-				if err != nil {
-					oldSoftLimit = ""
-				}
-
-				revertMemory := func() {
-					if oldSoftLimit != "" {
-						c.CGroupSet("memory.soft_limit_in_bytes", oldSoftLimit)
-					}
-
-					if oldLimit != "" {
-						c.CGroupSet("memory.limit_in_bytes", oldLimit)
-					}
-
-					if oldMemswLimit != "" {
-						c.CGroupSet("memory.memsw.limit_in_bytes", oldMemswLimit)
-					}
-				}
-
-				// Reset everything
-				if c.state.OS.CGroupSwapAccounting {
-					err = c.CGroupSet("memory.memsw.limit_in_bytes", "-1")
-					if err != nil {
-						revertMemory()
-						return err
-					}
-				}
-
-				err = c.CGroupSet("memory.limit_in_bytes", "-1")
-				if err != nil {
-					revertMemory()
-					return err
-				}
-
-				err = c.CGroupSet("memory.soft_limit_in_bytes", "-1")
-				if err != nil {
-					revertMemory()
-					return err
-				}
-
-				// Set the new values
-				if memoryEnforce == "soft" {
-					// Set new limit
-					err = c.CGroupSet("memory.soft_limit_in_bytes", memory)
-					if err != nil {
-						revertMemory()
-						return err
-					}
-				} else {
-					if c.state.OS.CGroupSwapAccounting && (memorySwap == "" || shared.IsTrue(memorySwap)) {
-						err = c.CGroupSet("memory.limit_in_bytes", memory)
-						if err != nil {
-							revertMemory()
-							return err
-						}
-
-						err = c.CGroupSet("memory.memsw.limit_in_bytes", memory)
-						if err != nil {
-							revertMemory()
-							return err
-						}
-					} else {
-						err = c.CGroupSet("memory.limit_in_bytes", memory)
-						if err != nil {
-							revertMemory()
-							return err
-						}
-					}
-
-					// Set soft limit to value 10% less than hard limit
-					valueInt, err := strconv.ParseInt(memory, 10, 64)
-					if err != nil {
-						revertMemory()
-						return err
-					}
-
-					err = c.CGroupSet("memory.soft_limit_in_bytes", fmt.Sprintf("%.0f", float64(valueInt)*0.9))
-					if err != nil {
-						revertMemory()
-						return err
-					}
-				}
-
-				// Configure the swappiness
-				if key == "limits.memory.swap" || key == "limits.memory.swap.priority" {
-					memorySwap := c.expandedConfig["limits.memory.swap"]
-					memorySwapPriority := c.expandedConfig["limits.memory.swap.priority"]
-					if memorySwap != "" && !shared.IsTrue(memorySwap) {
-						err = c.CGroupSet("memory.swappiness", "0")
-						if err != nil {
-							return err
-						}
-					} else {
-						priority := 0
-						if memorySwapPriority != "" {
-							priority, err = strconv.Atoi(memorySwapPriority)
-							if err != nil {
-								return err
-							}
-						}
-
-						err = c.CGroupSet("memory.swappiness", fmt.Sprintf("%d", 60-10+priority))
-						if err != nil {
-							return err
-						}
-					}
-				}
+				memoryChanged = true
 			} else if key == "limits.network.priority" {
 				err := c.setNetworkPriority()
 				if err != nil {
@@ -5388,6 +6867,12 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 				if err != nil {
 					return err
 				}
+			} else if key == "console.forward" {
+				if value == "" {
+					consoleForwardStop(c.id)
+				} else {
+					consoleForwardStart(c.state, c.id, value)
+				}
 			} else if key == "limits.processes" {
 				if !c.state.OS.CGroupPidsController {
 					continue
@@ -5412,279 +6897,103 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 			}
 		}
 
-		var usbs []usbDevice
+		// Memory limits are applied together, whichever of them changed
+		if memoryChanged {
+			err = c.applyMemoryLimits(isRunning)
+			if err != nil {
+				return err
+			}
+		}
 
-		// Live update the devices
-		for k, m := range removeDevices {
-			if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
-				prefix := fmt.Sprintf("unix.%s", k)
-				destPath := m["path"]
-				if destPath == "" {
-					destPath = m["source"]
+		// Prepare the host side of the new disks first so that most
+		// failures happen before anything changed in the container.
+		// Disks replacing a removed one reuse its host path and so can
+		// only be set up once it's gone.
+		preparedDisks := map[string]string{}
+		releasePreparedDisks := func() {
+			for k, devPath := range preparedDisks {
+				err := c.releaseDiskDevice(k, addDevices[k], devPath)
+				if err != nil {
+					logger.Error("Failed to release prepared disk device", log.Ctx{"err": err, "device": k, "container": c.Name()})
 				}
+			}
+		}
 
-				if !c.deviceExistsInDevicesFolder(prefix, destPath) && (m["required"] != "" && !shared.IsTrue(m["required"])) {
-					continue
-				}
+		for _, k := range types.SortedDeviceNames(addDevices) {
+			m := addDevices[k]
+			_, replaced := removeDevices[k]
+			if m["type"] != "disk" || m["path"] == "/" || replaced {
+				continue
+			}
 
-				err = c.removeUnixDevice(fmt.Sprintf("unix.%s", k), m, true)
-				if err != nil {
-					return err
-				}
-			} else if m["type"] == "disk" && m["path"] != "/" {
-				err = c.removeDiskDevice(k, m)
-				if err != nil {
-					return err
-				}
-			} else if m["type"] == "nic" || m["type"] == "infiniband" {
-				err = c.removeNetworkDevice(k, m)
+			devPath, err := c.createDiskDevice(k, m)
+			if err != nil {
+				releasePreparedDisks()
+				return errors.Wrapf(err, "Failed to setup device %s", k)
+			}
+
+			preparedDisks[k] = devPath
+		}
+
+		// Then apply the changes, putting back the previous devices
+		// when one of them fails
+		removed := []string{}
+		added := []string{}
+		rollbackDevices := func() {
+			for i := len(added) - 1; i >= 0; i-- {
+				err := c.liveRemoveDevice(added[i], addDevices[added[i]])
 				if err != nil {
-					return err
+					logger.Error("Failed to remove device during rollback", log.Ctx{"err": err, "device": added[i], "container": c.Name()})
 				}
+			}
 
-				err = c.removeInfinibandDevices(k, m)
+			releasePreparedDisks()
+
+			for i := len(removed) - 1; i >= 0; i-- {
+				err := c.liveInsertDevice(removed[i], removeDevices[removed[i]])
 				if err != nil {
-					return err
-				}
-			} else if m["type"] == "usb" {
-				if usbs == nil {
-					usbs, err = deviceLoadUsb()
-					if err != nil {
-						return err
-					}
-				}
-
-				/* if the device isn't present, we don't need to remove it */
-				for _, usb := range usbs {
-					if (m["vendorid"] != "" && usb.vendor != m["vendorid"]) || (m["productid"] != "" && usb.product != m["productid"]) {
-						continue
-					}
-
-					err := c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, usb.major, usb.minor, usb.path)
-					if err != nil {
-						return err
-					}
-				}
-			} else if m["type"] == "gpu" {
-				allGpus := deviceWantsAllGPUs(m)
-				gpus, nvidiaDevices, err := deviceLoadGpu(allGpus)
-				if err != nil {
-					return err
-				}
-
-				for _, gpu := range gpus {
-					if (m["vendorid"] != "" && gpu.vendorID != m["vendorid"]) ||
-						(m["pci"] != "" && gpu.pci != m["pci"]) ||
-						(m["productid"] != "" && gpu.productID != m["productid"]) ||
-						(m["id"] != "" && gpu.id != m["id"]) {
-						continue
-					}
-
-					err := c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.major, gpu.minor, gpu.path)
-					if err != nil {
-						logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-						return err
-					}
-
-					if !gpu.isNvidia {
-						continue
-					}
-
-					if gpu.nvidia.path != "" {
-						err = c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.nvidia.major, gpu.nvidia.minor, gpu.nvidia.path)
-						if err != nil {
-							logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-							return err
-						}
-					} else if !allGpus {
-						errMsg := fmt.Errorf("Failed to detect correct \"/dev/nvidia\" path")
-						logger.Errorf("%s", errMsg)
-						return errMsg
-					}
-				}
-
-				nvidiaExists := false
-				for _, gpu := range gpus {
-					if gpu.nvidia.path != "" {
-						if c.deviceExistsInDevicesFolder(fmt.Sprintf("unix.%s", k), gpu.path) {
-							nvidiaExists = true
-							break
-						}
-					}
-				}
-
-				if !nvidiaExists {
-					for _, gpu := range nvidiaDevices {
-						if shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
-							if !gpu.isCard {
-								continue
-							}
-						}
-
-						if !c.deviceExistsInDevicesFolder(fmt.Sprintf("unix.%s", k), gpu.path) {
-							continue
-						}
-
-						err = c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.major, gpu.minor, gpu.path)
-						if err != nil {
-							logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-							return err
-						}
-					}
-				}
-			} else if m["type"] == "proxy" {
-				err = c.removeProxyDevice(k)
-				if err != nil {
-					return err
+					logger.Error("Failed to restore device during rollback", log.Ctx{"err": err, "device": removed[i], "container": c.Name()})
 				}
 			}
 		}
 
-		diskDevices := map[string]types.Device{}
-		for k, m := range addDevices {
-			if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
-				err = c.insertUnixDevice(fmt.Sprintf("unix.%s", k), m, true)
-				if err != nil {
-					if m["required"] == "" || shared.IsTrue(m["required"]) {
-						return err
-					}
-				}
-			} else if m["type"] == "disk" && m["path"] != "/" {
-				diskDevices[k] = m
-			} else if m["type"] == "nic" || m["type"] == "infiniband" {
-				var err error
-				var infiniband map[string]IBF
-				if m["type"] == "infiniband" {
-					infiniband, err = deviceLoadInfiniband()
-					if err != nil {
-						return err
-					}
-				}
-
-				m, err = c.insertNetworkDevice(k, m)
-				if err != nil {
-					return err
-				}
-
-				// Plugin in all character devices
-				if m["type"] == "infiniband" {
-					key := m["parent"]
-					if m["nictype"] == "sriov" {
-						key = m["host_name"]
-					}
-
-					ifDev, ok := infiniband[key]
-					if !ok {
-						return fmt.Errorf("Specified infiniband device \"%s\" not found", key)
-					}
-
-					err := c.addInfinibandDevices(k, &ifDev, true)
-					if err != nil {
-						return err
-					}
-				}
-			} else if m["type"] == "usb" {
-				if usbs == nil {
-					usbs, err = deviceLoadUsb()
-					if err != nil {
-						return err
-					}
-				}
-
-				for _, usb := range usbs {
-					if (m["vendorid"] != "" && usb.vendor != m["vendorid"]) || (m["productid"] != "" && usb.product != m["productid"]) {
-						continue
-					}
-
-					err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, usb.major, usb.minor, usb.path, false)
-					if err != nil {
-						logger.Error("Failed to insert usb device", log.Ctx{"err": err, "usb": usb, "container": c.Name()})
-					}
-				}
-			} else if m["type"] == "gpu" {
-				allGpus := deviceWantsAllGPUs(m)
-				gpus, nvidiaDevices, err := deviceLoadGpu(allGpus)
-				if err != nil {
-					return err
-				}
-
-				sawNvidia := false
-				found := false
-				for _, gpu := range gpus {
-					if (m["vendorid"] != "" && gpu.vendorID != m["vendorid"]) ||
-						(m["pci"] != "" && gpu.pci != m["pci"]) ||
-						(m["productid"] != "" && gpu.productID != m["productid"]) ||
-						(m["id"] != "" && gpu.id != m["id"]) {
-						continue
-					}
-
-					found = true
-
-					err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.major, gpu.minor, gpu.path, false)
-					if err != nil {
-						logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-						return err
-					}
-
-					if !gpu.isNvidia {
-						continue
-					}
-
-					if gpu.nvidia.path != "" {
-						err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.nvidia.major, gpu.nvidia.minor, gpu.nvidia.path, false)
-						if err != nil {
-							logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-							return err
-						}
-					} else if !allGpus {
-						errMsg := fmt.Errorf("Failed to detect correct \"/dev/nvidia\" path")
-						logger.Errorf("%s", errMsg)
-						return errMsg
-					}
-
-					sawNvidia = true
-				}
-
-				if sawNvidia {
-					for _, gpu := range nvidiaDevices {
-						if shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
-							if !gpu.isCard {
-								continue
-							}
-						}
+		// Live update the devices, removing them in the reverse order
+		// they're attached in
+		removeNames := types.SortedDeviceNames(removeDevices)
+		for i := len(removeNames) - 1; i >= 0; i-- {
+			k := removeNames[i]
+			err = c.liveRemoveDevice(k, removeDevices[k])
+			if err != nil {
+				rollbackDevices()
+				return err
+			}
 
-						if c.deviceExistsInDevicesFolder(k, gpu.path) {
-							continue
-						}
+			removed = append(removed, k)
+		}
 
-						err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", k), m, gpu.major, gpu.minor, gpu.path, false)
-						if err != nil {
-							logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
-							return err
-						}
-					}
+		for _, k := range types.SortedDeviceNames(addDevices) {
+			m := addDevices[k]
+			devPath, prepared := preparedDisks[k]
+			if prepared {
+				err = c.attachDiskDevice(devPath, m)
+				if err == nil {
+					delete(preparedDisks, k)
 				}
+			} else {
+				err = c.liveInsertDevice(k, m)
+			}
 
-				if !found {
-					msg := "Failed to detect requested GPU device"
-					logger.Error(msg)
-					return fmt.Errorf(msg)
-				}
-			} else if m["type"] == "proxy" {
-				err = c.insertProxyDevice(k, m)
-				if err != nil {
-					return err
-				}
+			if err != nil {
+				rollbackDevices()
+				return err
 			}
-		}
 
-		err = c.addDiskDevices(diskDevices, c.insertDiskDevice)
-		if err != nil {
-			return errors.Wrap(err, "Add disk devices")
+			added = append(added, k)
 		}
 
 		updateDiskLimit := false
-		for k, m := range updateDevices {
+		for _, k := range types.SortedDeviceNames(updateDevices) {
+			m := updateDevices[k]
 			if m["type"] == "disk" {
 				updateDiskLimit = true
 			} else if m["type"] == "nic" {
@@ -5727,6 +7036,11 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 				if err != nil {
 					return err
 				}
+
+				err = c.setDiskQoS(block, limit)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -5937,140 +7251,404 @@ func (c *containerLXC) Update(args db.ContainerArgs, userRequested bool) error {
 	return nil
 }
 
-func (c *containerLXC) Export(w io.Writer, properties map[string]string) error {
-	ctxMap := log.Ctx{
-		"project":   c.project,
-		"name":      c.name,
-		"created":   c.creationDate,
-		"ephemeral": c.ephemeral,
-		"used":      c.lastUsedDate}
-
-	if c.IsRunning() {
-		return fmt.Errorf("Cannot export a running container as an image")
-	}
-
-	logger.Info("Exporting container", ctxMap)
+// liveRemoveDevice removes a device from the running container.
+func (c *containerLXC) liveRemoveDevice(name string, m types.Device) error {
+	var err error
 
-	// Start the storage
-	ourStart, err := c.StorageStart()
-	if err != nil {
-		logger.Error("Failed exporting container", ctxMap)
-		return err
-	}
-	if ourStart {
-		defer c.StorageStop()
-	}
+	if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) && m["hotplug"] != "" {
+		devs, err := deviceLoadHotplug(m["hotplug"])
+		if err != nil {
+			return err
+		}
 
-	// Unshift the container
-	idmap, err := c.DiskIdmap()
-	if err != nil {
-		logger.Error("Failed exporting container", ctxMap)
-		return err
-	}
+		for _, dev := range devs {
+			if !deviceHotplugMatch(m, dev) {
+				continue
+			}
 
-	if idmap != nil {
-		if !c.IsSnapshot() && shared.IsTrue(c.expandedConfig["security.protection.shift"]) {
-			return fmt.Errorf("Container is protected against filesystem shifting")
+			err := c.removeHotplugDevice(name, m, dev)
+			if err != nil {
+				return err
+			}
+		}
+	} else if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
+		prefix := fmt.Sprintf("unix.%s", name)
+		destPath := m["path"]
+		if destPath == "" {
+			destPath = m["source"]
 		}
 
-		var err error
-
-		if c.Storage().GetStorageType() == storageTypeZfs {
-			err = idmap.UnshiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper)
-		} else if c.Storage().GetStorageType() == storageTypeBtrfs {
-			err = UnshiftBtrfsRootfs(c.RootfsPath(), idmap)
-		} else {
-			err = idmap.UnshiftRootfs(c.RootfsPath(), nil)
+		if !c.deviceExistsInDevicesFolder(prefix, destPath) && (m["required"] != "" && !shared.IsTrue(m["required"])) {
+			return nil
 		}
+
+		err = c.removeUnixDevice(fmt.Sprintf("unix.%s", name), m, true)
 		if err != nil {
-			logger.Error("Failed exporting container", ctxMap)
 			return err
 		}
-
-		if c.Storage().GetStorageType() == storageTypeZfs {
-			defer idmap.ShiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper)
-		} else if c.Storage().GetStorageType() == storageTypeBtrfs {
-			defer ShiftBtrfsRootfs(c.RootfsPath(), idmap)
-		} else {
-			defer idmap.ShiftRootfs(c.RootfsPath(), nil)
+	} else if m["type"] == "disk" && m["path"] != "/" {
+		err = c.removeDiskDevice(name, m)
+		if err != nil {
+			return err
 		}
-	}
-
-	// Create the tarball
-	ctw := containerwriter.NewContainerTarWriter(w, idmap)
-
-	// Keep track of the first path we saw for each path with nlink>1
-	cDir := c.Path()
-
-	// Path inside the tar image is the pathname starting after cDir
-	offset := len(cDir) + 1
-
-	writeToTar := func(path string, fi os.FileInfo, err error) error {
+	} else if m["type"] == "nic" || m["type"] == "infiniband" {
+		err = c.removeNetworkDevice(name, m)
 		if err != nil {
 			return err
 		}
 
-		err = ctw.WriteFile(offset, path, fi)
+		err = c.removeInfinibandDevices(name, m)
 		if err != nil {
-			logger.Debugf("Error tarring up %s: %s", path, err)
 			return err
 		}
-		return nil
-	}
-
-	// Look for metadata.yaml
-	fnam := filepath.Join(cDir, "metadata.yaml")
-	if !shared.PathExists(fnam) {
-		// Generate a new metadata.yaml
-		tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
+	} else if m["type"] == "usb" {
+		usbs, err := deviceLoadUsb()
 		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting container", ctxMap)
 			return err
 		}
-		defer os.RemoveAll(tempDir)
 
-		// Get the container's architecture
-		var arch string
-		if c.IsSnapshot() {
-			parentName, _, _ := containerGetParentAndSnapshotName(c.name)
-			parent, err := containerLoadByProjectAndName(c.state, c.project, parentName)
+		/* if the device isn't present, we don't need to remove it */
+		for _, usb := range usbs {
+			if (m["vendorid"] != "" && usb.vendor != m["vendorid"]) || (m["productid"] != "" && usb.product != m["productid"]) {
+				continue
+			}
+
+			err := c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, usb.major, usb.minor, usb.path)
 			if err != nil {
-				ctw.Close()
-				logger.Error("Failed exporting container", ctxMap)
 				return err
 			}
-
-			arch, _ = osarch.ArchitectureName(parent.Architecture())
-		} else {
-			arch, _ = osarch.ArchitectureName(c.architecture)
+		}
+	} else if m["type"] == "gpu" {
+		allGpus := deviceWantsAllGPUs(m)
+		gpus, nvidiaDevices, err := deviceLoadGpu(allGpus)
+		if err != nil {
+			return err
 		}
 
-		if arch == "" {
-			arch, err = osarch.ArchitectureName(c.state.OS.Architectures[0])
+		for _, gpu := range gpus {
+			if (m["vendorid"] != "" && gpu.vendorID != m["vendorid"]) ||
+				(m["pci"] != "" && gpu.pci != m["pci"]) ||
+				(m["productid"] != "" && gpu.productID != m["productid"]) ||
+				(m["id"] != "" && gpu.id != m["id"]) {
+				continue
+			}
+
+			err := c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.major, gpu.minor, gpu.path)
 			if err != nil {
-				logger.Error("Failed exporting container", ctxMap)
+				logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
 				return err
 			}
-		}
 
-		// Fill in the metadata
-		meta := api.ImageMetadata{}
-		meta.Architecture = arch
-		meta.CreationDate = time.Now().UTC().Unix()
-		meta.Properties = properties
+			if !gpu.isNvidia {
+				continue
+			}
 
-		data, err := yaml.Marshal(&meta)
-		if err != nil {
-			ctw.Close()
-			logger.Error("Failed exporting container", ctxMap)
-			return err
+			if gpu.nvidia.path != "" {
+				err = c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.nvidia.major, gpu.nvidia.minor, gpu.nvidia.path)
+				if err != nil {
+					logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
+					return err
+				}
+			} else if !allGpus {
+				errMsg := fmt.Errorf("Failed to detect correct \"/dev/nvidia\" path")
+				logger.Errorf("%s", errMsg)
+				return errMsg
+			}
 		}
 
-		// Write the actual file
-		fnam = filepath.Join(tempDir, "metadata.yaml")
-		err = ioutil.WriteFile(fnam, data, 0644)
-		if err != nil {
+		nvidiaExists := false
+		for _, gpu := range gpus {
+			if gpu.nvidia.path != "" {
+				if c.deviceExistsInDevicesFolder(fmt.Sprintf("unix.%s", name), gpu.path) {
+					nvidiaExists = true
+					break
+				}
+			}
+		}
+
+		if !nvidiaExists {
+			for _, gpu := range nvidiaDevices {
+				if shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
+					if !gpu.isCard {
+						continue
+					}
+				}
+
+				if !c.deviceExistsInDevicesFolder(fmt.Sprintf("unix.%s", name), gpu.path) {
+					continue
+				}
+
+				err = c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.major, gpu.minor, gpu.path)
+				if err != nil {
+					logger.Error("Failed to remove GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
+					return err
+				}
+			}
+		}
+	} else if m["type"] == "proxy" {
+		err = c.removeProxyDevice(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// liveInsertDevice adds a device to the running container.
+func (c *containerLXC) liveInsertDevice(name string, m types.Device) error {
+	var err error
+
+	if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) && m["hotplug"] != "" {
+		devs, err := deviceLoadHotplug(m["hotplug"])
+		if err != nil {
+			return err
+		}
+
+		for _, dev := range devs {
+			if !deviceHotplugMatch(m, dev) {
+				continue
+			}
+
+			err := c.insertHotplugDevice(name, m, dev)
+			if err != nil {
+				logger.Error("Failed to insert hotplugged device", log.Ctx{"err": err, "device": dev.path, "container": c.Name()})
+			}
+		}
+	} else if shared.StringInSlice(m["type"], []string{"unix-char", "unix-block"}) {
+		err = c.insertUnixDevice(fmt.Sprintf("unix.%s", name), m, true)
+		if err != nil {
+			if m["required"] == "" || shared.IsTrue(m["required"]) {
+				return err
+			}
+		}
+	} else if m["type"] == "disk" && m["path"] != "/" {
+		err = c.insertDiskDevice(name, m)
+		if err != nil {
+			return err
+		}
+	} else if m["type"] == "nic" || m["type"] == "infiniband" {
+		var err error
+		var infiniband map[string]IBF
+		if m["type"] == "infiniband" {
+			infiniband, err = deviceLoadInfiniband()
+			if err != nil {
+				return err
+			}
+		}
+
+		m, err = c.insertNetworkDevice(name, m)
+		if err != nil {
+			return err
+		}
+
+		// Plugin in all character devices
+		if m["type"] == "infiniband" {
+			key := m["parent"]
+			if m["nictype"] == "sriov" {
+				key = m["host_name"]
+			}
+
+			ifDev, ok := infiniband[key]
+			if !ok {
+				return fmt.Errorf("Specified infiniband device \"%s\" not found", key)
+			}
+
+			err := c.addInfinibandDevices(name, &ifDev, true)
+			if err != nil {
+				return err
+			}
+		}
+	} else if m["type"] == "usb" {
+		usbs, err := deviceLoadUsb()
+		if err != nil {
+			return err
+		}
+
+		for _, usb := range usbs {
+			if (m["vendorid"] != "" && usb.vendor != m["vendorid"]) || (m["productid"] != "" && usb.product != m["productid"]) {
+				continue
+			}
+
+			err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, usb.major, usb.minor, usb.path, false)
+			if err != nil {
+				logger.Error("Failed to insert usb device", log.Ctx{"err": err, "usb": usb, "container": c.Name()})
+			}
+		}
+	} else if m["type"] == "gpu" {
+		allGpus := deviceWantsAllGPUs(m)
+		gpus, nvidiaDevices, err := deviceLoadGpu(allGpus)
+		if err != nil {
+			return err
+		}
+
+		sawNvidia := false
+		found := false
+		for _, gpu := range gpus {
+			if (m["vendorid"] != "" && gpu.vendorID != m["vendorid"]) ||
+				(m["pci"] != "" && gpu.pci != m["pci"]) ||
+				(m["productid"] != "" && gpu.productID != m["productid"]) ||
+				(m["id"] != "" && gpu.id != m["id"]) {
+				continue
+			}
+
+			found = true
+
+			err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.major, gpu.minor, gpu.path, false)
+			if err != nil {
+				logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
+				return err
+			}
+
+			if !gpu.isNvidia {
+				continue
+			}
+
+			if gpu.nvidia.path != "" {
+				err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.nvidia.major, gpu.nvidia.minor, gpu.nvidia.path, false)
+				if err != nil {
+					logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
+					return err
+				}
+			} else if !allGpus {
+				errMsg := fmt.Errorf("Failed to detect correct \"/dev/nvidia\" path")
+				logger.Errorf("%s", errMsg)
+				return errMsg
+			}
+
+			sawNvidia = true
+		}
+
+		if sawNvidia {
+			for _, gpu := range nvidiaDevices {
+				if shared.IsTrue(c.expandedConfig["nvidia.runtime"]) {
+					if !gpu.isCard {
+						continue
+					}
+				}
+
+				if c.deviceExistsInDevicesFolder(name, gpu.path) {
+					continue
+				}
+
+				err = c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", name), m, gpu.major, gpu.minor, gpu.path, false)
+				if err != nil {
+					logger.Error("Failed to insert GPU device", log.Ctx{"err": err, "gpu": gpu, "container": c.Name()})
+					return err
+				}
+			}
+		}
+
+		if !found {
+			msg := "Failed to detect requested GPU device"
+			logger.Error(msg)
+			return fmt.Errorf(msg)
+		}
+	} else if m["type"] == "proxy" {
+		err = c.insertProxyDevice(name, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *containerLXC) Export(w io.Writer, properties map[string]string) error {
+	ctxMap := log.Ctx{
+		"project":   c.project,
+		"name":      c.name,
+		"created":   c.creationDate,
+		"ephemeral": c.ephemeral,
+		"used":      c.lastUsedDate}
+
+	if c.IsRunning() {
+		return fmt.Errorf("Cannot export a running container as an image")
+	}
+
+	if c.IsMetadataOnly() {
+		return fmt.Errorf("Cannot export a metadata-only snapshot as an image")
+	}
+
+	logger.Info("Exporting container", ctxMap)
+
+	// Start the storage and unshift the container
+	idmap, cleanup, err := c.exportPrepare()
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+	defer cleanup()
+
+	// Create the tarball
+	ctw := containerwriter.NewContainerTarWriter(w, idmap)
+
+	// Keep track of the first path we saw for each path with nlink>1
+	cDir := c.Path()
+
+	// Path inside the tar image is the pathname starting after cDir
+	offset := len(cDir) + 1
+
+	writeToTar := func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		err = ctw.WriteFile(offset, path, fi)
+		if err != nil {
+			logger.Debugf("Error tarring up %s: %s", path, err)
+			return err
+		}
+		return nil
+	}
+
+	// Look for metadata.yaml
+	fnam := filepath.Join(cDir, "metadata.yaml")
+	if !shared.PathExists(fnam) {
+		// Generate a new metadata.yaml
+		tempDir, err := ioutil.TempDir("", "lxd_lxd_metadata_")
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting container", ctxMap)
+			return err
+		}
+		defer os.RemoveAll(tempDir)
+
+		// Get the container's architecture
+		architecture, err := c.exportArchitecture()
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting container", ctxMap)
+			return err
+		}
+
+		arch, _ := osarch.ArchitectureName(architecture)
+
+		if arch == "" {
+			arch, err = osarch.ArchitectureName(c.state.OS.Architectures[0])
+			if err != nil {
+				logger.Error("Failed exporting container", ctxMap)
+				return err
+			}
+		}
+
+		// Fill in the metadata
+		meta := api.ImageMetadata{}
+		meta.Architecture = arch
+		meta.CreationDate = time.Now().UTC().Unix()
+		meta.Properties = properties
+
+		data, err := yaml.Marshal(&meta)
+		if err != nil {
+			ctw.Close()
+			logger.Error("Failed exporting container", ctxMap)
+			return err
+		}
+
+		// Write the actual file
+		fnam = filepath.Join(tempDir, "metadata.yaml")
+		err = ioutil.WriteFile(fnam, data, 0644)
+		if err != nil {
 			ctw.Close()
 			logger.Error("Failed exporting container", ctxMap)
 			return err
@@ -6186,59 +7764,370 @@ func (c *containerLXC) Export(w io.Writer, properties map[string]string) error {
 	return nil
 }
 
-func collectCRIULogFile(c container, imagesDir string, function string, method string) error {
-	t := time.Now().Format(time.RFC3339)
-	newPath := shared.LogPath(c.Name(), fmt.Sprintf("%s_%s_%s.log", function, method, t))
-	return shared.FileCopy(filepath.Join(imagesDir, fmt.Sprintf("%s.log", method)), newPath)
-}
+// exportArchitecture returns the architecture to record in exported images. Snapshots
+// report the architecture of their container.
+func (c *containerLXC) exportArchitecture() (int, error) {
+	if !c.IsSnapshot() {
+		return c.architecture, nil
+	}
 
-func getCRIULogErrors(imagesDir string, method string) (string, error) {
-	f, err := os.Open(path.Join(imagesDir, fmt.Sprintf("%s.log", method)))
+	parentName, _, _ := containerGetParentAndSnapshotName(c.name)
+	parent, err := containerLoadByProjectAndName(c.state, c.project, parentName)
 	if err != nil {
-		return "", err
+		return -1, err
 	}
 
-	defer f.Close()
+	return parent.Architecture(), nil
+}
 
-	scanner := bufio.NewScanner(f)
-	ret := []string{}
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "Error") || strings.Contains(line, "Warn") {
-			ret = append(ret, scanner.Text())
+// exportPrepare starts the container's storage and unshifts its rootfs so it
+// can be archived. The returned function shifts it back and stops the storage.
+func (c *containerLXC) exportPrepare() (*idmap.IdmapSet, func(), error) {
+	reverts := []func(){}
+	cleanup := func() {
+		for i := len(reverts) - 1; i >= 0; i-- {
+			reverts[i]()
 		}
 	}
 
-	return strings.Join(ret, "\n"), nil
-}
-
-type CriuMigrationArgs struct {
-	cmd          uint
-	stateDir     string
-	function     string
-	stop         bool
-	actionScript bool
-	dumpDir      string
-	preDumpDir   string
-	features     lxc.CriuFeatures
-}
-
-func (c *containerLXC) Migrate(args *CriuMigrationArgs) error {
-	ctxMap := log.Ctx{
-		"project":      c.project,
-		"name":         c.name,
-		"created":      c.creationDate,
-		"ephemeral":    c.ephemeral,
-		"used":         c.lastUsedDate,
-		"statedir":     args.stateDir,
-		"actionscript": args.actionScript,
-		"predumpdir":   args.preDumpDir,
-		"features":     args.features,
-		"stop":         args.stop}
-
-	_, err := exec.LookPath("criu")
+	// Start the storage
+	ourStart, err := c.StorageStart()
 	if err != nil {
-		return fmt.Errorf("Unable to perform container live migration. CRIU isn't installed")
+		return nil, nil, err
+	}
+	if ourStart {
+		reverts = append(reverts, func() { c.StorageStop() })
+	}
+
+	// Unshift the container
+	idmap, err := c.DiskIdmap()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	if idmap != nil {
+		if !c.IsSnapshot() && shared.IsTrue(c.expandedConfig["security.protection.shift"]) {
+			cleanup()
+			return nil, nil, fmt.Errorf("Container is protected against filesystem shifting")
+		}
+
+		var err error
+
+		if c.Storage().GetStorageType() == storageTypeZfs {
+			err = idmap.UnshiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper, nil)
+		} else if c.Storage().GetStorageType() == storageTypeBtrfs {
+			err = UnshiftBtrfsRootfs(c.RootfsPath(), idmap, nil)
+		} else {
+			err = idmap.UnshiftRootfs(c.RootfsPath(), nil, nil)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		reverts = append(reverts, func() {
+			if c.Storage().GetStorageType() == storageTypeZfs {
+				idmap.ShiftRootfs(c.RootfsPath(), zfsIdmapSetSkipper, nil)
+			} else if c.Storage().GetStorageType() == storageTypeBtrfs {
+				ShiftBtrfsRootfs(c.RootfsPath(), idmap, nil)
+			} else {
+				idmap.ShiftRootfs(c.RootfsPath(), nil, nil)
+			}
+		})
+	}
+
+	return idmap, cleanup, nil
+}
+
+// ociArchitectures maps LXD architectures to the names used by OCI images
+var ociArchitectures = map[int]string{
+	osarch.ARCH_32BIT_INTEL_X86:             "386",
+	osarch.ARCH_64BIT_INTEL_X86:             "amd64",
+	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN:   "arm",
+	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN:   "arm64",
+	osarch.ARCH_64BIT_POWERPC_BIG_ENDIAN:    "ppc64",
+	osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN: "ppc64le",
+	osarch.ARCH_64BIT_S390_BIG_ENDIAN:       "s390x",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ExportOCI writes the container's rootfs to w as a tarball of an OCI image
+// layout holding a single layer, along with the generated image config and
+// manifest. The properties are stored as labels of the image config.
+func (c *containerLXC) ExportOCI(w io.Writer, properties map[string]string) error {
+	ctxMap := log.Ctx{
+		"project":   c.project,
+		"name":      c.name,
+		"created":   c.creationDate,
+		"ephemeral": c.ephemeral,
+		"used":      c.lastUsedDate}
+
+	if c.IsRunning() {
+		return fmt.Errorf("Cannot export a running container as an image")
+	}
+
+	if c.IsMetadataOnly() {
+		return fmt.Errorf("Cannot export a metadata-only snapshot as an image")
+	}
+
+	// Get the container's architecture
+	architecture, err := c.exportArchitecture()
+	if err != nil {
+		return err
+	}
+
+	arch, ok := ociArchitectures[architecture]
+	if !ok {
+		return fmt.Errorf("Architecture isn't supported by OCI images: %d", architecture)
+	}
+
+	logger.Info("Exporting container as OCI image", ctxMap)
+
+	// Start the storage and unshift the container
+	idmap, cleanup, err := c.exportPrepare()
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+	defer cleanup()
+
+	// Write the layer to a temporary file as its digest is needed first, next
+	// to the images so it doesn't end up on a small /tmp
+	layer, err := ioutil.TempFile(shared.VarPath("images"), "lxd_oci_layer_")
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	layerHash := sha256.New()
+	ctw := containerwriter.NewContainerTarWriter(io.MultiWriter(layer, layerHash), idmap)
+
+	// Paths inside the layer are relative to the rootfs
+	rootfs := c.RootfsPath()
+	offset := len(rootfs) + 1
+
+	err = filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == rootfs {
+			return nil
+		}
+
+		err = ctw.WriteFile(offset, path, fi)
+		if err != nil {
+			logger.Debugf("Error tarring up %s: %s", path, err)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		ctw.Close()
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	err = ctw.Close()
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	layerInfo, err := layer.Stat()
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	layerDesc := ociDescriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		Digest:    fmt.Sprintf("sha256:%s", hex.EncodeToString(layerHash.Sum(nil))),
+		Size:      layerInfo.Size(),
+	}
+
+	// Generate the image config, manifest and index
+	created := time.Now().UTC().Format(time.RFC3339)
+	config, err := json.Marshal(map[string]interface{}{
+		"created":      created,
+		"architecture": arch,
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Labels": properties,
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{layerDesc.Digest},
+		},
+		"history": []map[string]string{{
+			"created":    created,
+			"created_by": fmt.Sprintf("LXD export of %s", c.name),
+		}},
+	})
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	configDesc := ociDescriptor{
+		MediaType: "application/vnd.oci.image.config.v1+json",
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(config)),
+		Size:      int64(len(config)),
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layerDesc},
+	})
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	manifestDesc := ociDescriptor{
+		MediaType:   "application/vnd.oci.image.manifest.v1+json",
+		Digest:      fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)),
+		Size:        int64(len(manifest)),
+		Annotations: map[string]string{"org.opencontainers.image.ref.name": "latest"},
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	// Write the image layout
+	tw := tar.NewWriter(w)
+
+	writeFile := func(name string, size int64, r io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tw, r)
+		return err
+	}
+
+	blobPath := func(digest string) string {
+		return path.Join("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+	}
+
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", index},
+		{blobPath(manifestDesc.Digest), manifest},
+		{blobPath(configDesc.Digest), config},
+	}
+
+	for _, f := range files {
+		err = writeFile(f.name, int64(len(f.data)), bytes.NewReader(f.data))
+		if err != nil {
+			tw.Close()
+			logger.Error("Failed exporting container", ctxMap)
+			return err
+		}
+	}
+
+	_, err = layer.Seek(0, 0)
+	if err == nil {
+		err = writeFile(blobPath(layerDesc.Digest), layerDesc.Size, layer)
+	}
+	if err != nil {
+		tw.Close()
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		logger.Error("Failed exporting container", ctxMap)
+		return err
+	}
+
+	logger.Info("Exported container as OCI image", ctxMap)
+	return nil
+}
+
+func collectCRIULogFile(c container, imagesDir string, function string, method string) error {
+	t := time.Now().Format(time.RFC3339)
+	newPath := shared.LogPath(c.Name(), fmt.Sprintf("%s_%s_%s.log", function, method, t))
+	return shared.FileCopy(filepath.Join(imagesDir, fmt.Sprintf("%s.log", method)), newPath)
+}
+
+func getCRIULogErrors(imagesDir string, method string) (string, error) {
+	f, err := os.Open(path.Join(imagesDir, fmt.Sprintf("%s.log", method)))
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	ret := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "Error") || strings.Contains(line, "Warn") {
+			ret = append(ret, scanner.Text())
+		}
+	}
+
+	return strings.Join(ret, "\n"), nil
+}
+
+type CriuMigrationArgs struct {
+	cmd          uint
+	stateDir     string
+	function     string
+	stop         bool
+	actionScript bool
+	dumpDir      string
+	preDumpDir   string
+	features     lxc.CriuFeatures
+	bwlimit      string
+}
+
+func (c *containerLXC) Migrate(args *CriuMigrationArgs) error {
+	ctxMap := log.Ctx{
+		"project":      c.project,
+		"name":         c.name,
+		"created":      c.creationDate,
+		"ephemeral":    c.ephemeral,
+		"used":         c.lastUsedDate,
+		"statedir":     args.stateDir,
+		"actionscript": args.actionScript,
+		"predumpdir":   args.preDumpDir,
+		"features":     args.features,
+		"stop":         args.stop}
+
+	_, err := exec.LookPath("criu")
+	if err != nil {
+		return fmt.Errorf("Unable to perform container live migration. CRIU isn't installed")
 	}
 
 	logger.Info("Migrating container", ctxMap)
@@ -6304,11 +8193,11 @@ func (c *containerLXC) Migrate(args *CriuMigrationArgs) error {
 			}
 
 			if c.Storage().GetStorageType() == storageTypeZfs {
-				err = idmapset.ShiftRootfs(args.stateDir, zfsIdmapSetSkipper)
+				err = idmapset.ShiftRootfs(args.stateDir, zfsIdmapSetSkipper, nil)
 			} else if c.Storage().GetStorageType() == storageTypeBtrfs {
-				err = ShiftBtrfsRootfs(args.stateDir, idmapset)
+				err = ShiftBtrfsRootfs(args.stateDir, idmapset, nil)
 			} else {
-				err = idmapset.ShiftRootfs(args.stateDir, nil)
+				err = idmapset.ShiftRootfs(args.stateDir, nil, nil)
 			}
 			if ourStart {
 				_, err2 := c.StorageStop()
@@ -6432,176 +8321,614 @@ func (c *containerLXC) Migrate(args *CriuMigrationArgs) error {
 }
 
 func (c *containerLXC) TemplateApply(trigger string) error {
-	// "create" and "copy" are deferred until next start
-	if shared.StringInSlice(trigger, []string{"create", "copy"}) {
-		// The two events are mutually exclusive so only keep the last one
+	// "create", "copy" and "rename" are deferred until next start
+	if shared.StringInSlice(trigger, []string{"create", "copy", "rename"}) {
+		// A pending "create" or "copy" already covers a later rename
+		if trigger == "rename" && c.localConfig["volatile.apply_template"] != "" {
+			return nil
+		}
+
+		// The events are mutually exclusive so only keep the last one
 		err := c.VolatileSet(map[string]string{"volatile.apply_template": trigger})
 		if err != nil {
 			return errors.Wrap(err, "Failed to set apply_template volatile key")
 		}
 
-		return nil
+		return nil
+	}
+
+	return c.templateApplyNow(trigger)
+}
+
+func (c *containerLXC) templateApplyNow(trigger string) error {
+	// Apply the built-in hostname template if requested, on every start when the hostname is overridden
+	hostnameTriggers := []string{"create", "copy", "rename"}
+	if c.expandedConfig["boot.hostname"] != "" {
+		hostnameTriggers = append(hostnameTriggers, "start")
+	}
+
+	if shared.StringInSlice(trigger, hostnameTriggers) && shared.IsTrue(c.expandedConfig["templates.hostname"]) {
+		err := c.templateApplyHostname()
+		if err != nil {
+			return errors.Wrap(err, "Failed to apply hostname template")
+		}
+	}
+
+	// Apply the timezone on every start
+	if trigger == "start" && c.expandedConfig["linux.timezone"] != "" {
+		err := c.templateApplyTimezone()
+		if err != nil {
+			return errors.Wrap(err, "Failed to apply timezone")
+		}
+	}
+
+	// Apply the DNS configuration on every start
+	if trigger == "start" && c.expandedConfig["linux.resolv_conf"] != "" {
+		err := c.templateApplyResolvConf()
+		if err != nil {
+			return errors.Wrap(err, "Failed to apply resolv.conf")
+		}
+	}
+
+	// If there's no metadata, just return
+	fname := filepath.Join(c.Path(), "metadata.yaml")
+	if !shared.PathExists(fname) {
+		return nil
+	}
+
+	// Parse the metadata
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read metadata")
+	}
+
+	metadata := new(api.ImageMetadata)
+	err = yaml.Unmarshal(content, &metadata)
+
+	if err != nil {
+		return errors.Wrapf(err, "Could not parse %s", fname)
+	}
+
+	// Find rootUid and rootGid
+	idmapset, err := c.DiskIdmap()
+	if err != nil {
+		return errors.Wrap(err, "Failed to set ID map")
+	}
+
+	rootUid := int64(0)
+	rootGid := int64(0)
+
+	// Get the right uid and gid for the container
+	if idmapset != nil {
+		rootUid, rootGid = idmapset.ShiftIntoNs(0, 0)
+	}
+
+	// Figure out the container architecture
+	arch, err := osarch.ArchitectureName(c.architecture)
+	if err != nil {
+		arch, err = osarch.ArchitectureName(c.state.OS.Architectures[0])
+		if err != nil {
+			return errors.Wrap(err, "Failed to detect system architecture")
+		}
+	}
+
+	// Generate the container metadata
+	containerMeta := make(map[string]string)
+	containerMeta["name"] = c.name
+	containerMeta["architecture"] = arch
+
+	if c.ephemeral {
+		containerMeta["ephemeral"] = "true"
+	} else {
+		containerMeta["ephemeral"] = "false"
+	}
+
+	if c.IsPrivileged() {
+		containerMeta["privileged"] = "true"
+	} else {
+		containerMeta["privileged"] = "false"
+	}
+
+	// Go through the templates
+	for tplPath, tpl := range metadata.Templates {
+		var w *os.File
+
+		// Check if the template should be applied now
+		found := false
+		for _, tplTrigger := range tpl.When {
+			if tplTrigger == trigger {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		// Open the file to template, create if needed
+		fullpath := filepath.Join(c.RootfsPath(), strings.TrimLeft(tplPath, "/"))
+		if shared.PathExists(fullpath) {
+			if tpl.CreateOnly {
+				continue
+			}
+
+			// Open the existing file
+			w, err = os.Create(fullpath)
+			if err != nil {
+				return errors.Wrap(err, "Failed to create template file")
+			}
+		} else {
+			// Create the directories leading to the file
+			shared.MkdirAllOwner(path.Dir(fullpath), 0755, int(rootUid), int(rootGid))
+
+			// Create the file itself
+			w, err = os.Create(fullpath)
+			if err != nil {
+				return err
+			}
+
+			// Fix ownership and mode
+			w.Chown(int(rootUid), int(rootGid))
+			w.Chmod(0644)
+		}
+		defer w.Close()
+
+		// Read the template
+		tplString, err := ioutil.ReadFile(filepath.Join(c.TemplatesPath(), tpl.Template))
+		if err != nil {
+			return errors.Wrap(err, "Failed to read template file")
+		}
+
+		// Restrict filesystem access to within the container's rootfs
+		tplSet := pongo2.NewSet(fmt.Sprintf("%s-%s", c.name, tpl.Template), template.ChrootLoader{Path: c.RootfsPath()})
+
+		tplRender, err := tplSet.FromString("{% autoescape off %}" + string(tplString) + "{% endautoescape %}")
+		if err != nil {
+			return errors.Wrap(err, "Failed to render template")
+		}
+
+		configGet := func(confKey, confDefault *pongo2.Value) *pongo2.Value {
+			val, ok := c.expandedConfig[confKey.String()]
+			if !ok {
+				return confDefault
+			}
+
+			return pongo2.AsValue(strings.TrimRight(val, "\r\n"))
+		}
+
+		// Render the template
+		tplRender.ExecuteWriter(pongo2.Context{"trigger": trigger,
+			"path":       tplPath,
+			"container":  containerMeta,
+			"config":     c.expandedConfig,
+			"devices":    c.expandedDevices,
+			"properties": tpl.Properties,
+			"config_get": configGet}, w)
+	}
+
+	return nil
+}
+
+// hostname returns the hostname to use inside the container, which is its
+// name unless overridden through boot.hostname.
+func (c *containerLXC) hostname() string {
+	if c.expandedConfig["boot.hostname"] != "" {
+		return c.expandedConfig["boot.hostname"]
+	}
+
+	return c.Name()
+}
+
+// templateApplyHostname writes the container hostname to /etc/hostname and
+// points the 127.0.1.1 entry of /etc/hosts at it.
+func (c *containerLXC) templateApplyHostname() error {
+	rootUid, rootGid, err := c.templateRootIds()
+	if err != nil {
+		return err
+	}
+
+	// Render the built-in templates
+	tplSet := pongo2.NewSet(fmt.Sprintf("%s-hostname", c.name), template.ChrootLoader{Path: c.RootfsPath()})
+	tplCtx := pongo2.Context{"container": map[string]string{"name": c.name, "hostname": c.hostname()}}
+
+	render := func(tplString string) (string, error) {
+		tplRender, err := tplSet.FromString("{% autoescape off %}" + tplString + "{% endautoescape %}")
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to render template")
+		}
+
+		return tplRender.Execute(tplCtx)
+	}
+
+	hostname, err := render("{{ container.hostname }}\n")
+	if err != nil {
+		return err
+	}
+
+	hostsEntry, err := render("127.0.1.1\t{{ container.hostname }}")
+	if err != nil {
+		return err
+	}
+
+	// Create /etc if needed
+	err = c.templateMkdirAll("/etc/hosts", rootUid, rootGid)
+	if err != nil {
+		return err
+	}
+
+	// Update /etc/hosts, replacing any existing 127.0.1.1 entry
+	hosts := ""
+	hostsPath, err := c.templateFilePath("/etc/hosts")
+	if err != nil {
+		return err
+	}
+
+	content := []byte{}
+	fi, err := os.Lstat(hostsPath)
+	if err == nil && fi.Mode().IsRegular() {
+		content, err = ioutil.ReadFile(hostsPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read /etc/hosts")
+		}
+	}
+
+	found := false
+	lines := []string{}
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "127.0.1.1" {
+			if found {
+				continue
+			}
+
+			line = hostsEntry
+			found = true
+		}
+
+		hosts += line + "\n"
+	}
+
+	if !found {
+		hosts += hostsEntry + "\n"
+	}
+
+	err = c.templateWriteFile("/etc/hostname", hostname, rootUid, rootGid)
+	if err != nil {
+		return err
+	}
+
+	return c.templateWriteFile("/etc/hosts", hosts, rootUid, rootGid)
+}
+
+// templateApplyTimezone points /etc/localtime at the zoneinfo file for the
+// linux.timezone config key and records it in /etc/timezone.
+func (c *containerLXC) templateApplyTimezone() error {
+	timezone := c.expandedConfig["linux.timezone"]
+
+	rootUid, rootGid, err := c.templateRootIds()
+	if err != nil {
+		return err
+	}
+
+	zoneinfo := filepath.Join("/usr/share/zoneinfo", timezone)
+	if !shared.PathExists(filepath.Join(c.RootfsPath(), zoneinfo)) {
+		logger.Warn("Timezone not available in container", log.Ctx{"container": c.name, "timezone": timezone})
+		return nil
+	}
+
+	err = c.templateMkdirAll("/etc/localtime", rootUid, rootGid)
+	if err != nil {
+		return err
+	}
+
+	localtimePath, err := c.templateFilePath("/etc/localtime")
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(localtimePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to remove /etc/localtime")
+	}
+
+	err = os.Symlink(zoneinfo, localtimePath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create /etc/localtime")
+	}
+
+	err = os.Lchown(localtimePath, int(rootUid), int(rootGid))
+	if err != nil {
+		return err
+	}
+
+	return c.templateWriteFile("/etc/timezone", timezone+"\n", rootUid, rootGid)
+}
+
+// templateApplyResolvConf writes linux.resolv_conf to /etc/resolv.conf,
+// replacing any symlink (e.g. to a local resolver's generated file).
+func (c *containerLXC) templateApplyResolvConf() error {
+	rootUid, rootGid, err := c.templateRootIds()
+	if err != nil {
+		return err
+	}
+
+	err = c.templateMkdirAll("/etc/resolv.conf", rootUid, rootGid)
+	if err != nil {
+		return err
+	}
+
+	resolvPath, err := c.templateFilePath("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(resolvPath)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(resolvPath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to remove /etc/resolv.conf")
+		}
+	}
+
+	content := strings.TrimRight(c.expandedConfig["linux.resolv_conf"], "\n") + "\n"
+	return c.templateWriteFile("/etc/resolv.conf", content, rootUid, rootGid)
+}
+
+// templateRootIds returns the host uid and gid of the container's root user.
+func (c *containerLXC) templateRootIds() (int64, int64, error) {
+	idmapset, err := c.DiskIdmap()
+	if err != nil {
+		return -1, -1, errors.Wrap(err, "Failed to set ID map")
+	}
+
+	if idmapset == nil {
+		return 0, 0, nil
+	}
+
+	rootUid, rootGid := idmapset.ShiftIntoNs(0, 0)
+	return rootUid, rootGid, nil
+}
+
+// templateFilePath returns the host path of a file in the container's rootfs.
+// Symlinks in its parent directories are resolved as if chrooted into the
+// rootfs so they can't point outside of it, the file itself isn't followed.
+func (c *containerLXC) templateFilePath(containerPath string) (string, error) {
+	rootfs := c.RootfsPath()
+	resolved := "/"
+	pending := strings.Split(path.Dir(containerPath), "/")
+	links := 0
+
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		if component == "" || component == "." {
+			continue
+		}
+
+		if component == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			links++
+			if links > 40 {
+				return "", fmt.Errorf("Too many levels of symbolic links in %s", path.Dir(containerPath))
+			}
+
+			target, err := os.Readlink(filepath.Join(rootfs, next))
+			if err != nil {
+				return "", err
+			}
+
+			if path.IsAbs(target) {
+				resolved = "/"
+			}
+
+			pending = append(strings.Split(target, "/"), pending...)
+			continue
+		}
+
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%s isn't a directory in the container", path.Dir(containerPath))
+		}
+
+		resolved = next
+	}
+
+	return filepath.Join(rootfs, resolved, path.Base(containerPath)), nil
+}
+
+// templateMkdirAll creates the missing parent directories of a file in the
+// container's rootfs, owned by the container's root. Like templateFilePath, it
+// doesn't follow symlinks out of the rootfs.
+func (c *containerLXC) templateMkdirAll(containerPath string, rootUid int64, rootGid int64) error {
+	dir := "/"
+	for _, component := range strings.Split(path.Dir(containerPath), "/") {
+		if component == "" {
+			continue
+		}
+
+		dir = path.Join(dir, component)
+		fullpath, err := c.templateFilePath(dir)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Lstat(fullpath)
+		if err == nil {
+			continue
+		}
+
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		err = os.Mkdir(fullpath, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chown(fullpath, int(rootUid), int(rootGid))
+		if err != nil {
+			return err
+		}
 	}
 
-	return c.templateApplyNow(trigger)
+	return nil
 }
 
-func (c *containerLXC) templateApplyNow(trigger string) error {
-	// If there's no metadata, just return
-	fname := filepath.Join(c.Path(), "metadata.yaml")
-	if !shared.PathExists(fname) {
-		return nil
+// templateWriteFile writes a built-in template to a file in the container's
+// rootfs, creating it owned by the container's root if needed.
+func (c *containerLXC) templateWriteFile(containerPath string, content string, rootUid int64, rootGid int64) error {
+	fullpath, err := c.templateFilePath(containerPath)
+	if err != nil {
+		return err
 	}
 
-	// Parse the metadata
-	content, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return errors.Wrap(err, "Failed to read metadata")
+	// Don't follow symlinks out of the container's rootfs
+	fi, err := os.Lstat(fullpath)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		logger.Warn("Skipping templating of symlink", log.Ctx{"container": c.name, "path": containerPath})
+		return nil
 	}
 
-	metadata := new(api.ImageMetadata)
-	err = yaml.Unmarshal(content, &metadata)
+	exists := err == nil
 
+	err = ioutil.WriteFile(fullpath, []byte(content), 0644)
 	if err != nil {
-		return errors.Wrapf(err, "Could not parse %s", fname)
+		return errors.Wrapf(err, "Failed to write %s", containerPath)
 	}
 
-	// Find rootUid and rootGid
-	idmapset, err := c.DiskIdmap()
-	if err != nil {
-		return errors.Wrap(err, "Failed to set ID map")
+	// Fix ownership of newly created files
+	if !exists {
+		err = os.Chown(fullpath, int(rootUid), int(rootGid))
+		if err != nil {
+			return err
+		}
 	}
 
-	rootUid := int64(0)
-	rootGid := int64(0)
-
-	// Get the right uid and gid for the container
-	if idmapset != nil {
-		rootUid, rootGid = idmapset.ShiftIntoNs(0, 0)
-	}
+	return nil
+}
 
-	// Figure out the container architecture
-	arch, err := osarch.ArchitectureName(c.architecture)
-	if err != nil {
-		arch, err = osarch.ArchitectureName(c.state.OS.Architectures[0])
+// runForkfile runs a forkfile sub-command, killing it if it doesn't complete
+// within limits.file_timeout.
+func (c *containerLXC) runForkfile(args ...string) (string, error) {
+	timeout := lxcContainerFileTimeout
+	if c.expandedConfig["limits.file_timeout"] != "" {
+		value, err := strconv.ParseInt(c.expandedConfig["limits.file_timeout"], 10, 64)
 		if err != nil {
-			return errors.Wrap(err, "Failed to detect system architecture")
+			return "", err
 		}
-	}
-
-	// Generate the container metadata
-	containerMeta := make(map[string]string)
-	containerMeta["name"] = c.name
-	containerMeta["architecture"] = arch
 
-	if c.ephemeral {
-		containerMeta["ephemeral"] = "true"
-	} else {
-		containerMeta["ephemeral"] = "false"
+		timeout = time.Duration(value) * time.Second
 	}
 
-	if c.IsPrivileged() {
-		containerMeta["privileged"] = "true"
-	} else {
-		containerMeta["privileged"] = "false"
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	// Go through the templates
-	for tplPath, tpl := range metadata.Templates {
-		var w *os.File
-
-		// Check if the template should be applied now
-		found := false
-		for _, tplTrigger := range tpl.When {
-			if tplTrigger == trigger {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			continue
-		}
+	out, err := shared.RunCommandContext(ctx, c.state.OS.ExecPath, append([]string{"forkfile"}, args...)...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("File operation timed out after %s", timeout)
+	}
 
-		// Open the file to template, create if needed
-		fullpath := filepath.Join(c.RootfsPath(), strings.TrimLeft(tplPath, "/"))
-		if shared.PathExists(fullpath) {
-			if tpl.CreateOnly {
-				continue
-			}
+	return out, err
+}
 
-			// Open the existing file
-			w, err = os.Create(fullpath)
-			if err != nil {
-				return errors.Wrap(err, "Failed to create template file")
-			}
-		} else {
-			// Create the directories leading to the file
-			shared.MkdirAllOwner(path.Dir(fullpath), 0755, int(rootUid), int(rootGid))
+// lxcFileMount tracks how many file operations use the storage mount of a
+// container and whether it was mounted by the first of them.
+type lxcFileMount struct {
+	refs     int
+	ourStart bool
+}
 
-			// Create the file itself
-			w, err = os.Create(fullpath)
-			if err != nil {
-				return err
-			}
+// fileStorageStart mounts the container storage for a file operation, sharing
+// the mount with any other file operation in progress on the same container.
+// It returns whether a reference was taken which must be released through
+// fileStorageStop.
+func (c *containerLXC) fileStorageStart() (bool, error) {
+	lxcFileMountsLock.Lock()
+	defer lxcFileMountsLock.Unlock()
 
-			// Fix ownership and mode
-			w.Chown(int(rootUid), int(rootGid))
-			w.Chmod(0644)
-		}
-		defer w.Close()
+	mount, ok := lxcFileMounts[c.id]
+	if ok {
+		mount.refs++
+		return true, nil
+	}
 
-		// Read the template
-		tplString, err := ioutil.ReadFile(filepath.Join(c.TemplatesPath(), tpl.Template))
-		if err != nil {
-			return errors.Wrap(err, "Failed to read template file")
-		}
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		return false, err
+	}
 
-		// Restrict filesystem access to within the container's rootfs
-		tplSet := pongo2.NewSet(fmt.Sprintf("%s-%s", c.name, tpl.Template), template.ChrootLoader{Path: c.RootfsPath()})
+	lxcFileMounts[c.id] = &lxcFileMount{refs: 1, ourStart: ourStart}
+	return true, nil
+}
 
-		tplRender, err := tplSet.FromString("{% autoescape off %}" + string(tplString) + "{% endautoescape %}")
-		if err != nil {
-			return errors.Wrap(err, "Failed to render template")
-		}
+// fileStorageStop releases a reference taken by fileStorageStart, the last
+// file operation to finish unmounts the storage if it was mounted for them
+// and the container hasn't been started in the meantime.
+func (c *containerLXC) fileStorageStop() error {
+	lxcFileMountsLock.Lock()
+	defer lxcFileMountsLock.Unlock()
 
-		configGet := func(confKey, confDefault *pongo2.Value) *pongo2.Value {
-			val, ok := c.expandedConfig[confKey.String()]
-			if !ok {
-				return confDefault
-			}
+	mount, ok := lxcFileMounts[c.id]
+	if !ok {
+		return nil
+	}
 
-			return pongo2.AsValue(strings.TrimRight(val, "\r\n"))
-		}
+	mount.refs--
+	if mount.refs > 0 {
+		return nil
+	}
 
-		// Render the template
-		tplRender.ExecuteWriter(pongo2.Context{"trigger": trigger,
-			"path":       tplPath,
-			"container":  containerMeta,
-			"config":     c.expandedConfig,
-			"devices":    c.expandedDevices,
-			"properties": tpl.Properties,
-			"config_get": configGet}, w)
+	delete(lxcFileMounts, c.id)
+	if !mount.ourStart || c.IsRunning() {
+		return nil
 	}
 
-	return nil
+	_, err := c.StorageStop()
+	return err
 }
 
 func (c *containerLXC) FileExists(path string) error {
+	// Make sure the container can be attached to
+	if c.IsRunning() {
+		refreeze, err := c.thawForAccess()
+		if err != nil {
+			return err
+		}
+		defer refreeze()
+	}
+
 	// Setup container storage if needed
 	var ourStart bool
 	var err error
 	if !c.IsRunning() {
-		ourStart, err = c.StorageStart()
+		ourStart, err = c.fileStorageStart()
 		if err != nil {
 			return err
 		}
 	}
 
 	// Check if the file exists in the container
-	out, err := shared.RunCommand(
-		c.state.OS.ExecPath,
-		"forkfile",
+	out, err := c.runForkfile(
 		"exists",
 		c.RootfsPath(),
 		fmt.Sprintf("%d", c.InitPID()),
@@ -6609,8 +8936,8 @@ func (c *containerLXC) FileExists(path string) error {
 	)
 
 	// Tear down container storage if needed
-	if !c.IsRunning() && ourStart {
-		_, err := c.StorageStop()
+	if ourStart {
+		err := c.fileStorageStop()
 		if err != nil {
 			return err
 		}
@@ -6637,18 +8964,25 @@ func (c *containerLXC) FileExists(path string) error {
 func (c *containerLXC) FilePull(srcpath string, dstpath string) (int64, int64, os.FileMode, string, []string, error) {
 	var ourStart bool
 	var err error
+	// Make sure the container can be attached to
+	if c.IsRunning() {
+		refreeze, err := c.thawForAccess()
+		if err != nil {
+			return -1, -1, 0, "", nil, err
+		}
+		defer refreeze()
+	}
+
 	// Setup container storage if needed
 	if !c.IsRunning() {
-		ourStart, err = c.StorageStart()
+		ourStart, err = c.fileStorageStart()
 		if err != nil {
 			return -1, -1, 0, "", nil, err
 		}
 	}
 
 	// Get the file from the container
-	out, err := shared.RunCommand(
-		c.state.OS.ExecPath,
-		"forkfile",
+	out, err := c.runForkfile(
 		"pull",
 		c.RootfsPath(),
 		fmt.Sprintf("%d", c.InitPID()),
@@ -6657,8 +8991,8 @@ func (c *containerLXC) FilePull(srcpath string, dstpath string) (int64, int64, o
 	)
 
 	// Tear down container storage if needed
-	if !c.IsRunning() && ourStart {
-		_, err := c.StorageStop()
+	if ourStart {
+		err := c.fileStorageStop()
 		if err != nil {
 			return -1, -1, 0, "", nil, err
 		}
@@ -6778,10 +9112,17 @@ func (c *containerLXC) FilePush(type_ string, srcpath string, dstpath string, ui
 	var err error
 	// Setup container storage if needed
 	if !c.IsRunning() {
-		ourStart, err = c.StorageStart()
+		ourStart, err = c.fileStorageStart()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Make sure the container can be attached to
+		refreeze, err := c.thawForAccess()
 		if err != nil {
 			return err
 		}
+		defer refreeze()
 	}
 
 	defaultMode := 0640
@@ -6790,9 +9131,7 @@ func (c *containerLXC) FilePush(type_ string, srcpath string, dstpath string, ui
 	}
 
 	// Push the file to the container
-	out, err := shared.RunCommand(
-		c.state.OS.ExecPath,
-		"forkfile",
+	out, err := c.runForkfile(
 		"push",
 		c.RootfsPath(),
 		fmt.Sprintf("%d", c.InitPID()),
@@ -6809,8 +9148,8 @@ func (c *containerLXC) FilePush(type_ string, srcpath string, dstpath string, ui
 	)
 
 	// Tear down container storage if needed
-	if !c.IsRunning() && ourStart {
-		_, err := c.StorageStop()
+	if ourStart {
+		err := c.fileStorageStop()
 		if err != nil {
 			return err
 		}
@@ -6850,18 +9189,25 @@ func (c *containerLXC) FileRemove(path string) error {
 	var ourStart bool
 	var err error
 
+	// Make sure the container can be attached to
+	if c.IsRunning() {
+		refreeze, err := c.thawForAccess()
+		if err != nil {
+			return err
+		}
+		defer refreeze()
+	}
+
 	// Setup container storage if needed
 	if !c.IsRunning() {
-		ourStart, err = c.StorageStart()
+		ourStart, err = c.fileStorageStart()
 		if err != nil {
 			return err
 		}
 	}
 
 	// Remove the file from the container
-	out, err := shared.RunCommand(
-		c.state.OS.ExecPath,
-		"forkfile",
+	out, err := c.runForkfile(
 		"remove",
 		c.RootfsPath(),
 		fmt.Sprintf("%d", c.InitPID()),
@@ -6869,8 +9215,8 @@ func (c *containerLXC) FileRemove(path string) error {
 	)
 
 	// Tear down container storage if needed
-	if !c.IsRunning() && ourStart {
-		_, err := c.StorageStop()
+	if ourStart {
+		err := c.fileStorageStop()
 		if err != nil {
 			return err
 		}
@@ -6933,7 +9279,23 @@ func (c *containerLXC) ConsoleLog(opts lxc.ConsoleLogOptions) (string, error) {
 	return string(msg), nil
 }
 
-func (c *containerLXC) Exec(command []string, env map[string]string, stdin *os.File, stdout *os.File, stderr *os.File, wait bool, cwd string, uid uint32, gid uint32) (*exec.Cmd, int, int, error) {
+// Exec runs a command in the container. Unless wait is set, the returned
+// function must be called to wait for the command, which also releases what
+// was set up for it (scratch space, thawing) once it exited.
+func (c *containerLXC) Exec(command []string, env map[string]string, stdin *os.File, stdout *os.File, stderr *os.File, wait bool, cwd string, uid uint32, gid uint32, sandbox containerExecSandbox) (func() error, int, int, error) {
+	// Attaching to a frozen container would hang
+	refreeze, err := c.thawForAccess()
+	if err != nil {
+		return nil, -1, -1, err
+	}
+
+	refreezeOnReturn := true
+	defer func() {
+		if refreezeOnReturn {
+			refreeze()
+		}
+	}()
+
 	// Prepare the environment
 	envSlice := []string{}
 
@@ -6961,10 +9323,92 @@ func (c *containerLXC) Exec(command []string, env map[string]string, stdin *os.F
 		fmt.Sprintf("%d", gid),
 	}
 
+	// Extra confinement is applied by overriding the container's config for the attach
+	cleanup := func() {}
+	defer func() {
+		cleanup()
+	}()
+
+	// Provide a writable scratch directory as a tmpfs of its own, mounted
+	// below the container's shmounts so it shows up in /dev/.lxd-mounts
+	if sandbox.scratch {
+		scratchPath, err := ioutil.TempDir(c.ShmountsPath(), "exec_")
+		if err != nil {
+			return nil, -1, -1, err
+		}
+
+		cleanup = func() {
+			os.Remove(scratchPath)
+		}
+
+		hostUid, hostGid := int64(uid), int64(gid)
+		idmapset, err := c.CurrentIdmap()
+		if err != nil {
+			return nil, -1, -1, err
+		}
+
+		if idmapset != nil {
+			hostUid, hostGid = idmapset.ShiftIntoNs(hostUid, hostGid)
+		}
+
+		err = unix.Mount("tmpfs", scratchPath, "tmpfs", 0, fmt.Sprintf("size=%s,mode=0700,uid=%d,gid=%d", execScratchSize, hostUid, hostGid))
+		if err != nil {
+			return nil, -1, -1, fmt.Errorf("Failed to mount the scratch space: %s", err)
+		}
+
+		cleanup = func() {
+			unix.Unmount(scratchPath, unix.MNT_DETACH)
+			os.Remove(scratchPath)
+		}
+
+		envSlice = append(envSlice, fmt.Sprintf("TMPDIR=%s", filepath.Join("/dev/.lxd-mounts", filepath.Base(scratchPath))))
+	}
+
 	args = append(args, "--")
 	args = append(args, "env")
 	args = append(args, envSlice...)
 
+	sandboxConfig := []string{}
+	if len(sandbox.dropCapabilities) > 0 {
+		sandboxConfig = append(sandboxConfig, fmt.Sprintf("lxc.cap.drop=%s", strings.Join(sandbox.dropCapabilities, " ")))
+	}
+
+	if sandbox.noNewPrivs {
+		sandboxConfig = append(sandboxConfig, "lxc.no_new_privs=1")
+	}
+
+	if len(sandbox.syscallsDeny) > 0 {
+		profile, err := SeccompExecProfile(c, sandbox.syscallsDeny)
+		if err != nil {
+			return nil, -1, -1, err
+		}
+
+		profileFile, err := ioutil.TempFile(c.LogPath(), "exec_seccomp_")
+		if err != nil {
+			return nil, -1, -1, err
+		}
+
+		cleanupPrevious := cleanup
+		cleanup = func() {
+			cleanupPrevious()
+			os.Remove(profileFile.Name())
+		}
+
+		_, err = profileFile.WriteString(profile)
+		profileFile.Close()
+		if err != nil {
+			return nil, -1, -1, err
+		}
+
+		sandboxConfig = append(sandboxConfig, fmt.Sprintf("lxc.seccomp.profile=%s", profileFile.Name()))
+	}
+
+	if len(sandboxConfig) > 0 {
+		args = append(args, "--")
+		args = append(args, "config")
+		args = append(args, sandboxConfig...)
+	}
+
 	args = append(args, "--")
 	args = append(args, "cmd")
 	args = append(args, command...)
@@ -7017,7 +9461,19 @@ func (c *containerLXC) Exec(command []string, env map[string]string, stdin *os.F
 
 	// It's the callers responsibility to wait or not wait.
 	if !wait {
-		return &cmd, -1, attachedPid, nil
+		// Clean up and freeze the container again once the command exited
+		refreezeOnReturn = false
+		cleanupOnExit := cleanup
+		cleanup = func() {}
+		waitCmd := func() error {
+			err := cmd.Wait()
+			cleanupOnExit()
+			refreeze()
+
+			return err
+		}
+
+		return waitCmd, -1, attachedPid, nil
 	}
 
 	err = cmd.Wait()
@@ -7048,6 +9504,30 @@ func (c *containerLXC) cpuState() api.ContainerStateCPU {
 		return cpu
 	}
 
+	// On cgroup2, the usage is only available in microseconds and not per-CPU
+	if c.cgroupUnified("cpuacct") {
+		value, err := c.CGroupGet("cpu.stat")
+		if err != nil {
+			cpu.Usage = -1
+			return cpu
+		}
+
+		cpu.Usage = -1
+		for _, line := range strings.Split(value, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "usage_usec" {
+				continue
+			}
+
+			valueInt, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				cpu.Usage = valueInt * 1000
+			}
+		}
+
+		return cpu
+	}
+
 	// CPU usage in seconds
 	value, err := c.CGroupGet("cpuacct.usage")
 	if err != nil {
@@ -7061,7 +9541,25 @@ func (c *containerLXC) cpuState() api.ContainerStateCPU {
 		return cpu
 	}
 
-	cpu.Usage = valueInt
+	cpu.Usage = valueInt
+
+	// Per-CPU usage, not available on all kernels
+	value, err = c.CGroupGet("cpuacct.usage_percpu")
+	if err != nil {
+		return cpu
+	}
+
+	usagePerCPU := []int64{}
+	for _, field := range strings.Fields(value) {
+		valueInt, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return cpu
+		}
+
+		usagePerCPU = append(usagePerCPU, valueInt)
+	}
+
+	cpu.UsagePerCPU = usagePerCPU
 
 	return cpu
 }
@@ -7096,6 +9594,41 @@ func (c *containerLXC) diskState() map[string]api.ContainerStateDisk {
 	return disk
 }
 
+// DiskUsage returns the disk space used by the container's root volume and
+// the space each of its snapshots uses on top of it. The second return value
+// is true if the storage driver couldn't report the usage of some snapshots,
+// in which case the total only partially accounts for them.
+func (c *containerLXC) DiskUsage() (int64, bool, error) {
+	err := c.initStorage()
+	if err != nil {
+		return -1, false, err
+	}
+
+	usage, err := c.storage.ContainerGetUsage(c)
+	if err != nil {
+		return -1, false, err
+	}
+
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		return -1, false, err
+	}
+
+	partial := false
+	for _, snap := range snapshots {
+		snapUsage, err := c.storage.ContainerSnapshotGetUsage(snap)
+		if err != nil {
+			logger.Debug("Failed to get snapshot disk usage", log.Ctx{"container": c.Name(), "snapshot": snap.Name(), "err": err})
+			partial = true
+			continue
+		}
+
+		usage += snapUsage
+	}
+
+	return usage, partial, nil
+}
+
 func (c *containerLXC) memoryState() api.ContainerStateMemory {
 	memory := api.ContainerStateMemory{}
 
@@ -7117,7 +9650,14 @@ func (c *containerLXC) memoryState() api.ContainerStateMemory {
 		memory.UsagePeak = valueInt
 	}
 
-	if c.state.OS.CGroupSwapAccounting {
+	// On cgroup2, swap usage is accounted separately
+	if c.state.OS.CGroupSwapAccounting && c.cgroupUnified("memory") {
+		value, err := c.CGroupGet("memory.memsw.usage_in_bytes")
+		valueInt, err1 := strconv.ParseInt(value, 10, 64)
+		if err == nil && err1 == nil {
+			memory.SwapUsage = valueInt
+		}
+	} else if c.state.OS.CGroupSwapAccounting {
 		// Swap in bytes
 		if memory.Usage > 0 {
 			value, err := c.CGroupGet("memory.memsw.usage_in_bytes")
@@ -7137,10 +9677,219 @@ func (c *containerLXC) memoryState() api.ContainerStateMemory {
 		}
 	}
 
+	memory.Paused = c.IsFrozen() && shared.IsTrue(c.localConfig["volatile.last_state.memory_paused"])
+
 	return memory
 }
 
-func (c *containerLXC) networkState() map[string]api.ContainerStateNetwork {
+// memoryPauseMonitor freezes the container when its memory usage exceeds
+// limits.memory.pause_threshold percent of its memory limit. Rather than
+// polling the usage, it waits for the kernel to report changes. A container
+// that was unfrozen while above the threshold is only frozen again once its
+// usage went below it first. It runs until the container stops or the
+// threshold is unset.
+func memoryPauseMonitor(s *state.State, id int) {
+	lxcMemoryMonitorsLock.Lock()
+	if lxcMemoryMonitors[id] {
+		lxcMemoryMonitorsLock.Unlock()
+		return
+	}
+	lxcMemoryMonitors[id] = true
+	lxcMemoryMonitorsLock.Unlock()
+
+	defer func() {
+		lxcMemoryMonitorsLock.Lock()
+		delete(lxcMemoryMonitors, id)
+		lxcMemoryMonitorsLock.Unlock()
+	}()
+
+	armed := true
+	for {
+		// Reload the container to pick up config changes
+		ct, err := containerLoadById(s, id)
+		if err == db.ErrNoSuchObject {
+			return
+		} else if err != nil {
+			logger.Warn("Failed to load container for memory pause", log.Ctx{"id": id, "err": err})
+			time.Sleep(memoryPauseInterval)
+			continue
+		}
+
+		if !ct.IsRunning() {
+			return
+		}
+
+		c, ok := ct.(*containerLXC)
+		if !ok || c.expandedConfig["limits.memory.pause_threshold"] == "" {
+			return
+		}
+
+		if !c.IsFrozen() {
+			exceeded, err := c.memoryPauseThresholdExceeded()
+			if err != nil {
+				logger.Warn("Failed to check memory pause threshold", log.Ctx{"container": c.name, "err": err})
+			} else if !exceeded {
+				armed = true
+			} else if armed {
+				logger.Info("Pausing container due to memory usage", log.Ctx{"container": c.name, "threshold": c.expandedConfig["limits.memory.pause_threshold"]})
+				err = c.Freeze()
+				if err != nil {
+					logger.Error("Failed to pause container due to memory usage", log.Ctx{"container": c.name, "err": err})
+				} else {
+					armed = false
+
+					err = c.VolatileSet(map[string]string{"volatile.last_state.memory_paused": "true"})
+					if err != nil {
+						logger.Warn("Failed to record memory pause", log.Ctx{"container": c.name, "err": err})
+					}
+				}
+			}
+		}
+
+		err = c.memoryPauseWait(memoryPauseInterval)
+		if err != nil {
+			logger.Warn("Failed to wait for memory events", log.Ctx{"container": c.name, "err": err})
+			time.Sleep(memoryPauseInterval)
+		}
+	}
+}
+
+// memoryPauseWait waits up to timeout for the kernel to report that the
+// container's memory usage crossed the pause threshold (cgroup1), or that the
+// container is under memory pressure or hit one of its limits (cgroup2).
+func (c *containerLXC) memoryPauseWait(timeout time.Duration) error {
+	unified := c.state.OS.CGroupUnified("memory")
+
+	cgroup, err := cGroupProcessPath(c.InitPID(), "memory", unified)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.state.OS.CGroupMountPath("memory"), cgroup)
+
+	fds := []unix.PollFd{}
+	if unified {
+		// Memory pressure, if the kernel supports PSI
+		pressure, err := os.OpenFile(filepath.Join(path, "memory.pressure"), os.O_RDWR, 0)
+		if err == nil {
+			defer pressure.Close()
+
+			_, err = pressure.Write([]byte("some 150000 1000000"))
+			if err == nil {
+				fds = append(fds, unix.PollFd{Fd: int32(pressure.Fd()), Events: unix.POLLPRI})
+			}
+		}
+
+		events, err := os.Open(filepath.Join(path, "memory.events"))
+		if err != nil {
+			return err
+		}
+		defer events.Close()
+
+		fds = append(fds, unix.PollFd{Fd: int32(events.Fd()), Events: unix.POLLPRI})
+	} else {
+		threshold, err := c.memoryPauseThreshold()
+		if err != nil {
+			return err
+		}
+
+		// Nothing to be notified about until the limit changes
+		if threshold < 0 {
+			time.Sleep(timeout)
+			return nil
+		}
+
+		usage, err := os.Open(filepath.Join(path, "memory.usage_in_bytes"))
+		if err != nil {
+			return err
+		}
+		defer usage.Close()
+
+		efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(efd)
+
+		// The eventfd is signaled whenever the usage crosses the threshold
+		err = ioutil.WriteFile(filepath.Join(path, "cgroup.event_control"), []byte(fmt.Sprintf("%d %d %d", efd, usage.Fd(), threshold)), 0)
+		if err != nil {
+			return err
+		}
+
+		fds = append(fds, unix.PollFd{Fd: int32(efd), Events: unix.POLLIN})
+	}
+
+	_, err = unix.Poll(fds, int(timeout/time.Millisecond))
+	if err != nil && err != unix.EINTR {
+		return err
+	}
+
+	return nil
+}
+
+// memoryPauseThreshold returns the memory usage in bytes above which the
+// container gets paused, or -1 if it has no usable memory limit.
+func (c *containerLXC) memoryPauseThreshold() (int64, error) {
+	threshold, err := strconv.ParseInt(c.expandedConfig["limits.memory.pause_threshold"], 10, 64)
+	if err != nil {
+		return -1, err
+	}
+
+	limitKey := "memory.limit_in_bytes"
+	if c.expandedConfig["limits.memory.enforce"] == "soft" {
+		limitKey = "memory.soft_limit_in_bytes"
+	}
+
+	value, err := c.CGroupGet(limitKey)
+	if err != nil {
+		return -1, err
+	}
+
+	// Unlimited on cgroup2
+	if value == "max" {
+		return -1, nil
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return -1, err
+	}
+
+	// No usable limit (unlimited is reported as a huge value)
+	memoryTotal, err := shared.DeviceTotalMemory()
+	if err != nil {
+		return -1, err
+	}
+
+	if limit <= 0 || limit >= memoryTotal {
+		return -1, nil
+	}
+
+	return limit * threshold / 100, nil
+}
+
+// memoryPauseThresholdExceeded returns whether the container's memory usage
+// is above limits.memory.pause_threshold percent of its memory limit.
+func (c *containerLXC) memoryPauseThresholdExceeded() (bool, error) {
+	threshold, err := c.memoryPauseThreshold()
+	if err != nil || threshold < 0 {
+		return false, err
+	}
+
+	value, err := c.CGroupGet("memory.usage_in_bytes")
+	if err != nil {
+		return false, err
+	}
+
+	usage, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	return usage >= threshold, nil
+}
+
+func (c *containerLXC) networkState(hostCounters map[string]api.ContainerStateNetworkCounters) map[string]api.ContainerStateNetwork {
 	result := map[string]api.ContainerStateNetwork{}
 
 	pid := c.InitPID()
@@ -7148,9 +9897,24 @@ func (c *containerLXC) networkState() map[string]api.ContainerStateNetwork {
 		return result
 	}
 
+	// Only have the kernel gather the counters when they can't all be
+	// taken from the host side veths
+	skipCounters := hostCounters != nil
+	for _, name := range c.expandedDevices.DeviceNames() {
+		if c.expandedDevices[name]["type"] != "nic" {
+			continue
+		}
+
+		_, ok := hostCounters[c.localConfig[fmt.Sprintf("volatile.%s.host_name", name)]]
+		if !ok {
+			skipCounters = false
+			break
+		}
+	}
+
 	couldUseNetnsGetifaddrs := c.state.OS.NetnsGetifaddrs
 	if couldUseNetnsGetifaddrs {
-		nw, err := netutils.NetnsGetifaddrs(int32(pid))
+		nw, err := netutils.NetnsGetifaddrs(int32(pid), skipCounters)
 		if err != nil {
 			couldUseNetnsGetifaddrs = false
 			logger.Error("Failed to retrieve network information via netlink", log.Ctx{"container": c.name, "pid": pid})
@@ -7161,11 +9925,12 @@ func (c *containerLXC) networkState() map[string]api.ContainerStateNetwork {
 
 	if !couldUseNetnsGetifaddrs {
 		// Get the network state from the container
-		out, err := shared.RunCommand(
-			c.state.OS.ExecPath,
-			"forknet",
-			"info",
-			fmt.Sprintf("%d", pid))
+		args := []string{"forknet", "info", fmt.Sprintf("%d", pid)}
+		if skipCounters {
+			args = append(args, "--no-counters")
+		}
+
+		out, err := shared.RunCommand(c.state.OS.ExecPath, args...)
 
 		// Process forkgetnet response
 		if err != nil {
@@ -7195,9 +9960,73 @@ func (c *containerLXC) networkState() map[string]api.ContainerStateNetwork {
 		}
 	}
 
+	// Use the counters of the host side veths if provided
+	for name, dev := range result {
+		counters, ok := hostCounters[dev.HostName]
+		if dev.HostName == "" || !ok {
+			continue
+		}
+
+		dev.Counters = networkSwapCounters(counters)
+		result[name] = dev
+	}
+
 	return result
 }
 
+func (c *containerLXC) nestingState() api.ContainerStateNesting {
+	nesting := api.ContainerStateNesting{
+		Enabled: c.IsNesting(),
+	}
+
+	if !nesting.Enabled || !c.state.OS.AppArmorAvailable {
+		return nesting
+	}
+
+	// A nested LXD can only load its own profiles when the container is
+	// placed in its own AppArmor namespace (see initLXC), which requires
+	// an unconfined LXD, stacking support and an unprivileged container.
+	if c.state.OS.AppArmorConfined || !c.state.OS.AppArmorAdmin {
+		return nesting
+	}
+
+	nesting.AppArmorProfiles = c.state.OS.AppArmorStacking && !c.state.OS.AppArmorStacked && !c.IsPrivileged()
+
+	return nesting
+}
+
+// idmapsState returns the on-disk, next and current idmaps as recorded in the
+// volatile.last_state.idmap, volatile.idmap.next and volatile.idmap.current keys.
+func (c *containerLXC) idmapsState() api.ContainerStateIdmaps {
+	idmaps := api.ContainerStateIdmaps{
+		Disk:    []string{},
+		Next:    []string{},
+		Current: []string{},
+	}
+
+	for _, entry := range []struct {
+		name   string
+		get    func() (*idmap.IdmapSet, error)
+		target *[]string
+	}{
+		{"disk", c.DiskIdmap, &idmaps.Disk},
+		{"next", c.NextIdmap, &idmaps.Next},
+		{"current", c.CurrentIdmap, &idmaps.Current},
+	} {
+		set, err := entry.get()
+		if err != nil {
+			logger.Warn("Failed to parse idmap", log.Ctx{"container": c.name, "idmap": entry.name, "err": err})
+			continue
+		}
+
+		if set != nil {
+			*entry.target = append(*entry.target, set.ToLxcString()...)
+		}
+	}
+
+	return idmaps
+}
+
 func (c *containerLXC) processesState() int64 {
 	// Return 0 if not running
 	pid := c.InitPID()
@@ -7302,6 +10131,101 @@ func (c *containerLXC) StorageStop() (bool, error) {
 	return isOurOperation, err
 }
 
+// RepairStorage mounts the container's storage again after it went away under
+// a running container, for example following a storage driver failure, and
+// checks that its rootfs is usable. This avoids restarting the container when
+// its processes survived.
+func (c *containerLXC) RepairStorage() error {
+	if c.IsSnapshot() {
+		return fmt.Errorf("Snapshots can't be repaired")
+	}
+
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		return errors.Wrap(err, "Failed to mount the container storage")
+	}
+
+	empty, err := shared.PathIsEmpty(c.RootfsPath())
+	if err == nil && empty {
+		err = fmt.Errorf("The rootfs is empty")
+	}
+
+	if err != nil {
+		if ourStart {
+			c.StorageStop()
+		}
+
+		return errors.Wrap(err, "Container storage is still unavailable")
+	}
+
+	// Stopped containers only keep their storage mounted while in use
+	if ourStart && !c.IsRunning() {
+		_, err = c.StorageStop()
+		if err != nil {
+			return err
+		}
+	}
+
+	if ourStart {
+		logger.Info("Remounted container storage", log.Ctx{"container": c.name, "project": c.project})
+	}
+
+	return nil
+}
+
+// Trim discards the unused blocks of the container's filesystem so that thin
+// provisioned or SSD backed storage can reclaim them. Filesystems which don't
+// support discard are skipped with a warning.
+func (c *containerLXC) Trim() error {
+	if c.IsSnapshot() {
+		return fmt.Errorf("Snapshots can't be trimmed")
+	}
+
+	// Initialize storage interface for the container.
+	err := c.initStorage()
+	if err != nil {
+		return err
+	}
+
+	// Only thinly provisioned block storage gets the freed blocks back,
+	// trimming anything else would just go through the host filesystem
+	storageType := c.storage.GetStorageType()
+	if storageType != storageTypeLvm && storageType != storageTypeCeph {
+		logger.Warn("Container storage doesn't support trimming", log.Ctx{"container": c.name, "project": c.project, "driver": c.storage.GetStorageTypeName()})
+		return nil
+	}
+
+	_, err = exec.LookPath("fstrim")
+	if err != nil {
+		return fmt.Errorf("Trimming requires fstrim to be installed on the host")
+	}
+
+	// The filesystem is trimmed from the host, as unprivileged containers
+	// aren't allowed to
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		return errors.Wrap(err, "Failed to mount the container storage")
+	}
+
+	if ourStart {
+		defer c.StorageStop()
+	}
+
+	out, err := shared.RunCommand("fstrim", "-v", c.RootfsPath())
+	if err != nil {
+		if strings.Contains(out, "not supported") {
+			logger.Warn("Container filesystem doesn't support trimming", log.Ctx{"container": c.name, "project": c.project})
+			return nil
+		}
+
+		return errors.Wrap(err, "Failed to trim the container filesystem")
+	}
+
+	logger.Info("Trimmed container filesystem", log.Ctx{"container": c.name, "project": c.project, "output": strings.TrimSpace(out)})
+
+	return c.VolatileSet(map[string]string{"volatile.last_state.trimmed_at": time.Now().UTC().Format(time.RFC3339)})
+}
+
 // Mount handling
 func (c *containerLXC) insertMountLXD(source, target, fstype string, flags int, mntnsPID int) error {
 	pid := mntnsPID
@@ -7340,6 +10264,14 @@ func (c *containerLXC) insertMountLXD(source, target, fstype string, flags int,
 	}
 	defer unix.Unmount(tmpMount, unix.MNT_DETACH)
 
+	// Bind-mounts ignore MS_RDONLY until remounted
+	if flags&unix.MS_BIND != 0 && flags&unix.MS_RDONLY != 0 {
+		err = unix.Mount("", tmpMount, "", uintptr(unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY), "")
+		if err != nil {
+			return fmt.Errorf("Failed to make temporary mount read-only: %s", err)
+		}
+	}
+
 	// Move the mount inside the container
 	mntsrc := filepath.Join("/dev/.lxd-mounts", filepath.Base(tmpMount))
 	pidStr := fmt.Sprintf("%d", pid)
@@ -7385,6 +10317,28 @@ func (c *containerLXC) insertMount(source, target, fstype string, flags int) err
 	return c.insertMountLXD(source, target, fstype, flags, -1)
 }
 
+// setMountPropagation changes the propagation mode (shared, rslave, ...) of a
+// mount of the running container.
+func (c *containerLXC) setMountPropagation(mount string, mode string) error {
+	// Get the init PID
+	pid := c.InitPID()
+	if pid == -1 {
+		// Container isn't running
+		return fmt.Errorf("Can't change mount propagation in stopped container")
+	}
+
+	if !strings.HasPrefix(mount, "/") {
+		mount = "/" + mount
+	}
+
+	_, err := shared.RunCommand(c.state.OS.ExecPath, "forkmount", "lxd-propagate", fmt.Sprintf("%d", pid), mount, mode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (c *containerLXC) removeMount(mount string) error {
 	// Get the init PID
 	pid := c.InitPID()
@@ -7430,7 +10384,25 @@ func (c *containerLXC) deviceExistsInDevicesFolder(prefix string, path string) b
 	devName := fmt.Sprintf("%s.%s", strings.Replace(prefix, "/", "-", -1), strings.Replace(relativeDestPath, "/", "-", -1))
 	devPath := filepath.Join(c.DevicesPath(), devName)
 
-	return shared.PathExists(devPath)
+	return shared.PathExists(devPath)
+}
+
+// warnCGroupDevices logs a warning, once per container, when a device is
+// added while the devices cgroup controller isn't available.
+func (c *containerLXC) warnCGroupDevices(prefix string) {
+	if c.state.OS.RunningInUserNS || c.state.OS.CGroupDevicesController {
+		return
+	}
+
+	lxcCGroupDevicesWarnedLock.Lock()
+	defer lxcCGroupDevicesWarnedLock.Unlock()
+
+	if lxcCGroupDevicesWarned[c.id] {
+		return
+	}
+
+	lxcCGroupDevicesWarned[c.id] = true
+	logger.Warn("Devices cgroup controller is missing, devices may not be accessible in the container", log.Ctx{"project": c.project, "name": c.name, "device": prefix})
 }
 
 // Unix devices handling
@@ -7438,6 +10410,8 @@ func (c *containerLXC) createUnixDevice(prefix string, m types.Device, defaultMo
 	var err error
 	var major, minor int
 
+	c.warnCGroupDevices(prefix)
+
 	// Extra checks for nesting
 	if c.state.OS.RunningInUserNS {
 		for key, value := range m {
@@ -7590,8 +10564,13 @@ func (c *containerLXC) insertUnixDevice(prefix string, m types.Device, defaultMo
 	devPath := paths[0]
 	tgtPath := paths[1]
 
+	flags := unix.MS_BIND
+	if unixDeviceReadOnly(m) {
+		flags |= unix.MS_RDONLY
+	}
+
 	// Bind-mount it into the container
-	err = c.insertMount(devPath, tgtPath, "none", unix.MS_BIND)
+	err = c.insertMount(devPath, tgtPath, "none", flags)
 	if err != nil {
 		return fmt.Errorf("Failed to add mount for device: %s", err)
 	}
@@ -7630,7 +10609,7 @@ func (c *containerLXC) insertUnixDevice(prefix string, m types.Device, defaultMo
 
 	if !c.isCurrentlyPrivileged() && !c.state.OS.RunningInUserNS && c.state.OS.CGroupDevicesController {
 		// Add the new device cgroup rule
-		if err := c.CGroupSet("devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor)); err != nil {
+		if err := c.CGroupSet("devices.allow", fmt.Sprintf("%s %d:%d %s", dType, dMajor, dMinor, unixDeviceAccess(m))); err != nil {
 			return fmt.Errorf("Failed to add cgroup rule for device")
 		}
 	}
@@ -7744,7 +10723,8 @@ func (c *containerLXC) removeUnixDevice(prefix string, m types.Device, eject boo
 	}
 
 	if c.isCurrentlyPrivileged() && !c.state.OS.RunningInUserNS && c.state.OS.CGroupDevicesController {
-		// Remove the device cgroup rule
+		// Remove the device cgroup rule, denying all access so that it
+		// also reverts the rule of read-only devices
 		err = c.CGroupSet("devices.deny", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
 		if err != nil {
 			return err
@@ -7801,6 +10781,37 @@ func (c *containerLXC) removeUnixDeviceNum(prefix string, m types.Device, major
 	return nil
 }
 
+// hotplugDeviceConfig returns the config of a unix device matched by a hotplug rule
+// for the given host device node.
+func (c *containerLXC) hotplugDeviceConfig(m types.Device, dev hotplugDevice) types.Device {
+	temp := types.Device{}
+	for k, v := range m {
+		temp[k] = v
+	}
+
+	temp["source"] = dev.path
+
+	return temp
+}
+
+// hotplugDestPath returns the path in the container of a host device node
+// matched by a hotplug rule, defaulting to the same path as on the host.
+func (c *containerLXC) hotplugDestPath(m types.Device, dev hotplugDevice) string {
+	if m["path"] != "" {
+		return m["path"]
+	}
+
+	return dev.path
+}
+
+func (c *containerLXC) insertHotplugDevice(name string, m types.Device, dev hotplugDevice) error {
+	return c.insertUnixDeviceNum(fmt.Sprintf("unix.%s", name), c.hotplugDeviceConfig(m, dev), dev.major, dev.minor, c.hotplugDestPath(m, dev), false)
+}
+
+func (c *containerLXC) removeHotplugDevice(name string, m types.Device, dev hotplugDevice) error {
+	return c.removeUnixDeviceNum(fmt.Sprintf("unix.%s", name), c.hotplugDeviceConfig(m, dev), dev.major, dev.minor, c.hotplugDestPath(m, dev))
+}
+
 func (c *containerLXC) addInfinibandDevicesPerPort(deviceName string, ifDev *IBF, devices []os.FileInfo, inject bool) error {
 	for _, unixCharDev := range ifDev.PerPortDevices {
 		destPath := fmt.Sprintf("/dev/infiniband/%s", unixCharDev)
@@ -7872,7 +10883,7 @@ func (c *containerLXC) addInfinibandDevicesPerPort(deviceName string, ifDev *IBF
 				return err
 			}
 
-			err = lxcSetConfigItem(c.c, "lxc.cgroup.devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
+			err = c.setCGroupConfigItem(c.c, "devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
 			if err != nil {
 				return fmt.Errorf("Failed to add cgroup rule for device")
 			}
@@ -7920,7 +10931,7 @@ func (c *containerLXC) addInfinibandDevicesPerFun(deviceName string, ifDev *IBF,
 				return err
 			}
 
-			err = lxcSetConfigItem(c.c, "lxc.cgroup.devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
+			err = c.setCGroupConfigItem(c.c, "devices.allow", fmt.Sprintf("%s %d:%d rwm", dType, dMajor, dMinor))
 			if err != nil {
 				return fmt.Errorf("Failed to add cgroup rule for device")
 			}
@@ -8111,43 +11122,24 @@ func (c *containerLXC) doNat(proxy string, device types.Device) error {
 		return err
 	}
 
-	address, _, err := net.SplitHostPort(connectAddr.addr[0])
+	IPv4Addr, IPv6Addr, err := proxyNatNicAddrs(c.expandedDevices, connectAddr)
 	if err != nil {
 		return err
 	}
 
-	var IPv4Addr string
-	var IPv6Addr string
-
-	for _, name := range c.expandedDevices.DeviceNames() {
-		m := c.expandedDevices[name]
-		if m["type"] != "nic" || (m["type"] == "nic" && m["nictype"] != "bridged") {
-			continue
-		}
-
-		// Check whether the NIC has a static IP
-		ip := m["ipv4.address"]
-		// Ensure that the provided IP address matches the container's IP
-		// address otherwise we could mess with other containers.
-		if ip != "" && IPv4Addr == "" && (address == ip || address == "0.0.0.0") {
-			IPv4Addr = ip
-		}
-
-		ip = m["ipv6.address"]
-		if ip != "" && IPv6Addr == "" && (address == ip || address == "::") {
-			IPv6Addr = ip
-		}
-	}
-
-	if IPv4Addr == "" && IPv6Addr == "" {
-		return fmt.Errorf("NIC IP doesn't match proxy target IP")
-	}
-
 	iptablesComment := fmt.Sprintf("%s (%s)", c.Name(), proxy)
 
+	useNftables := nftablesUse()
+
 	revert := true
 	defer func() {
 		if revert {
+			if useNftables {
+				containerNftablesClear("ip", iptablesComment)
+				containerNftablesClear("ip6", iptablesComment)
+				return
+			}
+
 			if IPv4Addr != "" {
 				containerIptablesClear("ipv4", iptablesComment, "nat")
 			}
@@ -8170,6 +11162,31 @@ func (c *containerLXC) doNat(proxy string, device types.Device) error {
 			_, cPort, _ = net.SplitHostPort(connectAddr.addr[i])
 		}
 
+		if useNftables {
+			for _, chain := range []string{"prerouting", "output"} {
+				if IPv4Addr != "" {
+					// outbound <-> container and host <-> container
+					err := containerNftablesAppend("ip", iptablesComment, chain,
+						"ip", "daddr", address, listenAddr.connType, "dport", port,
+						"dnat", "to", fmt.Sprintf("%s:%s", IPv4Addr, cPort))
+					if err != nil {
+						return err
+					}
+				}
+
+				if IPv6Addr != "" {
+					err := containerNftablesAppend("ip6", iptablesComment, chain,
+						"ip6", "daddr", address, listenAddr.connType, "dport", port,
+						"dnat", "to", fmt.Sprintf("[%s]:%s", IPv6Addr, cPort))
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			continue
+		}
+
 		if IPv4Addr != "" {
 			// outbound <-> container
 			err := containerIptablesPrepend("ipv4", iptablesComment, "nat",
@@ -8221,9 +11238,11 @@ func (c *containerLXC) removeProxyDevice(devName string) error {
 		return fmt.Errorf("Can't remove proxy device from stopped container")
 	}
 
-	// Remove possible iptables entries
+	// Remove possible iptables and nftables entries
 	containerIptablesClear("ipv4", fmt.Sprintf("%s (%s)", c.Name(), devName), "nat")
 	containerIptablesClear("ipv6", fmt.Sprintf("%s (%s)", c.Name(), devName), "nat")
+	containerNftablesClear("ip", fmt.Sprintf("%s (%s)", c.Name(), devName))
+	containerNftablesClear("ip6", fmt.Sprintf("%s (%s)", c.Name(), devName))
 
 	devFileName := fmt.Sprintf("proxy.%s", devName)
 	devPath := filepath.Join(c.DevicesPath(), devFileName)
@@ -8242,9 +11261,11 @@ func (c *containerLXC) removeProxyDevice(devName string) error {
 }
 
 func (c *containerLXC) removeProxyDevices() error {
-	// Remove possible iptables entries
+	// Remove possible iptables and nftables entries
 	containerIptablesClear("ipv4", fmt.Sprintf("%s", c.Name()), "nat")
 	containerIptablesClear("ipv6", fmt.Sprintf("%s", c.Name()), "nat")
+	containerNftablesClear("ip", fmt.Sprintf("%s (", c.Name()))
+	containerNftablesClear("ip6", fmt.Sprintf("%s (", c.Name()))
 
 	// Check that we actually have devices to remove
 	if !shared.PathExists(c.DevicesPath()) {
@@ -8311,6 +11332,8 @@ func (c *containerLXC) createNetworkDevice(name string, m types.Device) (string,
 		// Host Virtual NIC name
 		if m["host_name"] != "" {
 			n1 = m["host_name"]
+		} else if m["nictype"] != "macvlan" && c.expandedConfig["network.host_name_template"] != "" {
+			n1 = deviceNextVethFromTemplate(c.expandedConfig["network.host_name_template"], c.Name(), name)
 		} else {
 			n1 = deviceNextVeth()
 		}
@@ -8345,6 +11368,23 @@ func (c *containerLXC) createNetworkDevice(name string, m types.Device) (string,
 			networkSysctlSet(fmt.Sprintf("ipv6/conf/%s/accept_ra", n1), "0")
 		}
 
+		if m["nictype"] == "p2p" && m["vrf"] != "" {
+			err = networkAttachVrf(m["vrf"], n1)
+			if err != nil {
+				deviceRemoveInterface(n2)
+				return "", err
+			}
+		}
+
+		// Give the host side the address the container uses as its gateway
+		if m["nictype"] == "p2p" {
+			err = c.setNetworkHostAddresses(n1, m)
+			if err != nil {
+				deviceRemoveInterface(n2)
+				return "", err
+			}
+		}
+
 		// Record the new device's host name for use in setupHostVethDevice()
 		hostNameKey := fmt.Sprintf("volatile.%s.host_name", name)
 		c.localConfig[hostNameKey] = n1
@@ -8796,6 +11836,68 @@ func (c *containerLXC) generateNetworkFilterIptablesRules(m types.Device, IPv6 n
 	return
 }
 
+// generateNetworkFilterNftablesRules returns a customised set of nftables filter rules based on the
+// device, equivalent to the ebtables and ip6tables ones. The first field of each rule is its chain
+// in the bridge family table.
+func (c *containerLXC) generateNetworkFilterNftablesRules(m types.Device, IPv4 net.IP, IPv6 net.IP) (rules [][]string, err error) {
+	mac, err := net.ParseMAC(m["hwaddr"])
+	if err != nil {
+		return
+	}
+
+	hostName := fmt.Sprintf("\"%s\"", m["host_name"])
+
+	// MAC source filtering rules. Blocks any packet coming from container with an incorrect Ethernet source MAC.
+	// This is required for IP filtering too.
+	for _, chain := range []string{"input", "forward"} {
+		rules = append(rules, []string{chain, "iifname", hostName, "ether", "saddr", "!=", m["hwaddr"], "drop"})
+	}
+
+	if shared.IsTrue(m["security.ipv4_filtering"]) && IPv4 != nil {
+		for _, chain := range []string{"input", "forward"} {
+			rules = append(rules,
+				// Prevent ARP MAC and IP spoofing.
+				[]string{chain, "iifname", hostName, "arp", "saddr", "ether", "!=", m["hwaddr"], "drop"},
+				[]string{chain, "iifname", hostName, "arp", "saddr", "ip", "!=", IPv4.String(), "drop"},
+			)
+
+			// Allow DHCPv4 to the host only. This must come before the IP source filtering rules below.
+			if chain == "input" {
+				rules = append(rules, []string{chain, "iifname", hostName, "ether", "saddr", m["hwaddr"], "ip", "saddr", "0.0.0.0", "ip", "daddr", "255.255.255.255", "udp", "dport", "67", "accept"})
+			}
+
+			// IP source filtering rules. Blocks any packet coming from container with an incorrect IP source address.
+			rules = append(rules, []string{chain, "iifname", hostName, "ether", "type", "ip", "ip", "saddr", "!=", IPv4.String(), "drop"})
+		}
+	}
+
+	if shared.IsTrue(m["security.ipv6_filtering"]) && IPv6 != nil {
+		ipv6Hex := hex.EncodeToString(IPv6.To16())
+		macHex := hex.EncodeToString(mac)
+
+		for _, chain := range []string{"input", "forward"} {
+			// Allow DHCPv6 and Router Solicitation to the host only. This must come before the IP source filtering rules below.
+			if chain == "input" {
+				rules = append(rules,
+					[]string{chain, "iifname", hostName, "ether", "saddr", m["hwaddr"], "ip6", "saddr", "fe80::/10", "ip6", "daddr", "ff02::1:2", "udp", "dport", "547", "accept"},
+					[]string{chain, "iifname", hostName, "ether", "saddr", m["hwaddr"], "ip6", "saddr", "fe80::/10", "ip6", "daddr", "ff02::2", "icmpv6", "type", "nd-router-solicit", "accept"},
+				)
+			}
+
+			rules = append(rules,
+				// IP source filtering rules. Blocks any packet coming from container with an incorrect IP source address.
+				[]string{chain, "iifname", hostName, "ether", "type", "ip6", "ip6", "saddr", "!=", IPv6.String(), "drop"},
+				// Prevent Neighbor Advertisement IP and MAC spoofing by checking the target address and
+				// the target link-layer address option of the ICMPv6 payload.
+				[]string{chain, "iifname", hostName, "icmpv6", "type", "nd-neighbor-advert", "@th,64,128", "!=", fmt.Sprintf("0x%s", ipv6Hex), "drop"},
+				[]string{chain, "iifname", hostName, "icmpv6", "type", "nd-neighbor-advert", "@th,208,48", "!=", fmt.Sprintf("0x%s", macHex), "drop"},
+			)
+		}
+	}
+
+	return
+}
+
 // setNetworkFilters sets up any network level filters defined for the container.
 // These are controlled by the security.mac_filtering, security.ipv4_Filtering and security.ipv6_filtering config keys.
 func (c *containerLXC) setNetworkFilters(deviceName string, m types.Device) (err error) {
@@ -8811,7 +11913,9 @@ func (c *containerLXC) setNetworkFilters(deviceName string, m types.Device) (err
 		return fmt.Errorf("Failed to set network filters: require parent defined")
 	}
 
-	if shared.IsTrue(m["security.ipv6_filtering"]) {
+	useNftables := nftablesUse()
+
+	if shared.IsTrue(m["security.ipv6_filtering"]) && !useNftables {
 		// Check br_netfilter is loaded and enabled for IPv6.
 		sysctlVal, err := networkSysctlGet("bridge/bridge-nf-call-ip6tables")
 		if err != nil || sysctlVal != "1\n" {
@@ -8829,6 +11933,30 @@ func (c *containerLXC) setNetworkFilters(deviceName string, m types.Device) (err
 		}
 	}()
 
+	// The nftables bridge family covers both the ebtables and ip6tables rules
+	if useNftables {
+		comment := fmt.Sprintf("%s (%s) - filtering", c.Name(), deviceName)
+
+		err = containerNftablesClear("bridge", comment)
+		if err != nil {
+			return err
+		}
+
+		rules, err := c.generateNetworkFilterNftablesRules(m, IPv4, IPv6)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			err = containerNftablesAppend("bridge", comment, rule[0], rule[1:]...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	rules := c.generateNetworkFilterEbtablesRules(m, IPv4, IPv6)
 	for _, rule := range rules {
 		_, err = shared.RunCommand(rule[0], rule[1:]...)
@@ -8946,22 +12074,38 @@ func (c *containerLXC) allocateNetworkFilterIPs(deviceName string, m types.Devic
 		networkStaticLock.Unlock()
 	}
 
+	// The static IPv4 address isn't handed out when DHCP is disabled
+	dhcpIPv4 := IPv4
+	if m["ipv4.dhcp"] != "" && !shared.IsTrue(m["ipv4.dhcp"]) {
+		dhcpIPv4 = nil
+	}
+
 	// If either IPv4 or IPv6 assigned is different than what is in dnsmasq config, rebuild config.
-	if (IPv4 != nil && bytes.Compare(curIPv4.IP, IPv4.To4()) != 0) || (IPv6 != nil && bytes.Compare(curIPv6.IP, IPv6.To16()) != 0) {
+	if (dhcpIPv4 != nil && bytes.Compare(curIPv4.IP, dhcpIPv4.To4()) != 0) || (IPv6 != nil && bytes.Compare(curIPv6.IP, IPv6.To16()) != 0) {
 		var IPv4Str, IPv6Str string
 
-		if IPv4 != nil {
-			IPv4Str = IPv4.String()
+		if dhcpIPv4 != nil {
+			IPv4Str = dhcpIPv4.String()
 		}
 
 		if IPv6 != nil {
 			IPv6Str = IPv6.String()
 		}
 
+		containerNames, err := networkContainerNames(c.state, c.Project())
+		if err != nil {
+			return IPv4, IPv6, err
+		}
+
+		records, err := networkDNSRecords(c.Project(), c.Name(), netConfig, m, containerNames)
+		if err != nil {
+			return IPv4, IPv6, err
+		}
+
 		networkStaticLock.Lock()
 		defer networkStaticLock.Unlock()
 
-		err = networkUpdateStaticContainer(m["parent"], c.Project(), c.Name(), netConfig, m["hwaddr"], IPv4Str, IPv6Str)
+		err = networkUpdateStaticContainer(m["parent"], c.Project(), c.Name(), netConfig, m["hwaddr"], IPv4Str, IPv6Str, records)
 		if err != nil {
 			return IPv4, IPv6, err
 		}
@@ -8987,56 +12131,261 @@ func (c *containerLXC) removeNetworkFilters(deviceName string, m types.Device) {
 		return
 	}
 
+	// Remove any nftables filters used for this device.
+	err := containerNftablesClear("bridge", fmt.Sprintf("%s (%s) - filtering", c.Name(), deviceName))
+	if err != nil {
+		logger.Error("Failed to clear nftables filtering rules", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
+	}
+
+	if nftablesUse() {
+		return
+	}
+
 	// Remove any IPv6 filters used for this container.
-	err := containerIptablesClear("ipv6", fmt.Sprintf("%s - ipv6_filtering", c.Name()), "filter")
+	err = containerIptablesClear("ipv6", fmt.Sprintf("%s - ipv6_filtering", c.Name()), "filter")
 	if err != nil {
 		logger.Error("Failed to clear ip6tables ipv6_filter rules", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
 	}
 
-	// Read current static IP allocation configured from dnsmasq host config (if exists).
-	IPv4, IPv6, err := networkDHCPStaticContainerIPs(m["parent"], c.Name())
-	if err != nil {
-		logger.Error("Failed to remove network filters", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
-	}
+	// Read current static IP allocation configured from dnsmasq host config (if exists).
+	IPv4, IPv6, err := networkDHCPStaticContainerIPs(m["parent"], c.Name())
+	if err != nil {
+		logger.Error("Failed to remove network filters", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
+	}
+
+	// Get a current list of rules active on the host.
+	out, err := shared.RunCommand("ebtables", "-L", "--Lmac2", "--Lx")
+	if err != nil {
+		logger.Error("Failed to remove network filters", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
+		return
+	}
+
+	// Get a list of rules that we would have applied on container start.
+	rules := c.generateNetworkFilterEbtablesRules(m, IPv4.IP, IPv6.IP)
+
+	// Iterate through each active rule on the host and try and match it to one the LXD rules.
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		fieldsLen := len(fields)
+
+		for _, rule := range rules {
+			// Rule doesn't match if the field lenths aren't the same, move on.
+			if len(rule) != fieldsLen {
+				continue
+			}
+
+			// Check whether active rule matches one of our rules to delete.
+			if !c.matchEbtablesRule(fields, rule, true) {
+				continue
+			}
+
+			// If we get this far, then the current host rule matches one of our LXD
+			// rules, so we should run the modified command to delete it.
+			_, err = shared.RunCommand(fields[0], fields[1:]...)
+			if err != nil {
+				logger.Error("Failed to remove network filter rule", log.Ctx{"container": c.Name(), "err": err})
+			}
+		}
+
+	}
+
+	return
+}
+
+// setNetworkConnLimit caps the number of concurrent TCP connections from and to the container's
+// IPs on the parent bridge. This is controlled by the limits.connections config key.
+func (c *containerLXC) setNetworkConnLimit(deviceName string, m types.Device) (err error) {
+	// Retrieve existing IPs, or allocate new ones if needed.
+	IPv4, IPv6, err := c.allocateNetworkFilterIPs(deviceName, m)
+	if err != nil {
+		return err
+	}
+
+	if IPv4 == nil && IPv6 == nil {
+		return fmt.Errorf("Failed to set connection limit: no known IP address for device \"%s\"", deviceName)
+	}
+
+	// If anything goes wrong, clean up so we don't leave orphaned rules.
+	defer func() {
+		if err != nil {
+			c.removeNetworkConnLimit(deviceName)
+		}
+	}()
+
+	comment := fmt.Sprintf("%s - %s connlimit", c.Name(), deviceName)
+	for _, entry := range []struct {
+		protocol string
+		ip       net.IP
+		mask     string
+	}{{"ipv4", IPv4, "32"}, {"ipv6", IPv6, "128"}} {
+		if entry.ip == nil {
+			continue
+		}
+
+		limit := func(direction string) []string {
+			return []string{"-p", "tcp", "--syn", "-m", "connlimit", "--connlimit-above", m["limits.connections"], "--connlimit-mask", entry.mask, direction, "-j", "REJECT", "--reject-with", "tcp-reset"}
+		}
+
+		rules := [][]string{
+			// Connections initiated by the container, whether routed or to the host itself.
+			append([]string{"FORWARD", "-i", m["parent"], "-s", entry.ip.String()}, limit("--connlimit-saddr")...),
+			append([]string{"INPUT", "-i", m["parent"], "-s", entry.ip.String()}, limit("--connlimit-saddr")...),
+			// Connections made to the container.
+			append([]string{"FORWARD", "-d", entry.ip.String()}, limit("--connlimit-daddr")...),
+		}
+
+		for _, rule := range rules {
+			err = containerIptablesPrepend(entry.protocol, comment, "filter", rule[0], rule[1:]...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeNetworkConnLimit removes any connection limit rules added by setNetworkConnLimit().
+func (c *containerLXC) removeNetworkConnLimit(deviceName string) {
+	comment := fmt.Sprintf("%s - %s connlimit", c.Name(), deviceName)
+	for _, protocol := range []string{"ipv4", "ipv6"} {
+		err := containerIptablesClear(protocol, comment, "filter")
+		if err != nil {
+			logger.Error("Failed to clear connection limit rules", log.Ctx{"container": c.Name(), "device": deviceName, "protocol": protocol, "err": err})
+		}
+	}
+}
+
+// setNetworkVrf enslaves the host side veth device of a p2p nic to its VRF.
+func (c *containerLXC) setNetworkVrf(m types.Device) error {
+	if !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", m["host_name"])) {
+		return fmt.Errorf("Unknown or missing host side veth: %s", m["host_name"])
+	}
+
+	return networkAttachVrf(m["vrf"], m["host_name"])
+}
+
+// removeNetworkVrf releases the host side veth device of a p2p nic from its VRF.
+func (c *containerLXC) removeNetworkVrf(m types.Device) {
+	if m["host_name"] == "" || !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", m["host_name"])) {
+		return
+	}
+
+	_, err := shared.RunCommand("ip", "link", "set", "dev", m["host_name"], "nomaster")
+	if err != nil {
+		logger.Error("Failed to remove host side veth from VRF", log.Ctx{"container": c.Name(), "device": m["host_name"], "vrf": m["vrf"], "err": err})
+	}
+}
+
+// setNetworkMSSClamp rewrites the MSS of TCP SYN packets going through the host side veth
+// device, either to the path MTU or to a fixed value.
+func (c *containerLXC) setNetworkMSSClamp(deviceName string, m types.Device) (err error) {
+	if m["host_name"] == "" {
+		return fmt.Errorf("Failed to set MSS clamping: no host side veth for device \"%s\"", deviceName)
+	}
+
+	err = networkCheckMSSClamp()
+	if err != nil {
+		return err
+	}
+
+	// If anything goes wrong, clean up so we don't leave orphaned rules.
+	defer func() {
+		if err != nil {
+			c.removeNetworkMSSClamp(deviceName)
+		}
+	}()
+
+	target := []string{"-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+	if m["mss_clamp"] != "pmtu" {
+		target = []string{"-j", "TCPMSS", "--set-mss", m["mss_clamp"]}
+	}
+
+	syn := []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN"}
+	rules := [][]string{
+		// Traffic leaving the container.
+		append(append([]string{"FORWARD", "-m", "physdev", "--physdev-in", m["host_name"]}, syn...), target...),
+		// Traffic going to the container.
+		append(append([]string{"POSTROUTING", "-m", "physdev", "--physdev-is-bridged", "--physdev-out", m["host_name"]}, syn...), target...),
+	}
+
+	comment := fmt.Sprintf("%s - %s mss_clamp", c.Name(), deviceName)
+	for _, protocol := range []string{"ipv4", "ipv6"} {
+		for _, rule := range rules {
+			err = containerIptablesPrepend(protocol, comment, "mangle", rule[0], rule[1:]...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// networkCheckMSSClamp checks that br_netfilter hands bridged traffic to
+// iptables and ip6tables, which the physdev rules of mss_clamp rely on.
+func networkCheckMSSClamp() error {
+	for _, key := range []string{"bridge-nf-call-iptables", "bridge-nf-call-ip6tables"} {
+		sysctlVal, err := networkSysctlGet(fmt.Sprintf("bridge/%s", key))
+		if err != nil || sysctlVal != "1\n" {
+			return fmt.Errorf("mss_clamp requires br_netfilter and sysctl net.bridge.%s=1", key)
+		}
+	}
+
+	return nil
+}
 
-	// Get a current list of rules active on the host.
-	out, err := shared.RunCommand("ebtables", "-L", "--Lmac2", "--Lx")
-	if err != nil {
-		logger.Error("Failed to remove network filters", log.Ctx{"container": c.Name(), "device": deviceName, "err": err})
-		return
+// removeNetworkMSSClamp removes any MSS clamping rules added by setNetworkMSSClamp().
+func (c *containerLXC) removeNetworkMSSClamp(deviceName string) {
+	comment := fmt.Sprintf("%s - %s mss_clamp", c.Name(), deviceName)
+	for _, protocol := range []string{"ipv4", "ipv6"} {
+		err := containerIptablesClear(protocol, comment, "mangle")
+		if err != nil {
+			logger.Error("Failed to clear MSS clamping rules", log.Ctx{"container": c.Name(), "device": deviceName, "protocol": protocol, "err": err})
+		}
 	}
+}
 
-	// Get a list of rules that we would have applied on container start.
-	rules := c.generateNetworkFilterEbtablesRules(m, IPv4.IP, IPv6.IP)
-
-	// Iterate through each active rule on the host and try and match it to one the LXD rules.
-	for _, line := range strings.Split(out, "\n") {
-		line = strings.TrimSpace(line)
-		fields := strings.Fields(line)
-		fieldsLen := len(fields)
+// setNetworkPMTUDiscovery applies the ipv4.pmtu_discovery setting of the container's nics to
+// its network namespace. The sysctl is namespace wide so validation ensures all nics agree.
+func (c *containerLXC) setNetworkPMTUDiscovery() error {
+	value := ""
+	for _, name := range c.expandedDevices.DeviceNames() {
+		m := c.expandedDevices[name]
+		if m["type"] == "nic" && m["ipv4.pmtu_discovery"] != "" {
+			value = m["ipv4.pmtu_discovery"]
+			break
+		}
+	}
 
-		for _, rule := range rules {
-			// Rule doesn't match if the field lenths aren't the same, move on.
-			if len(rule) != fieldsLen {
-				continue
-			}
+	if value == "" {
+		return nil
+	}
 
-			// Check whether active rule matches one of our rules to delete.
-			if !c.matchEbtablesRule(fields, rule, true) {
-				continue
-			}
+	pid := c.InitPID()
+	if pid < 1 {
+		return fmt.Errorf("Can't set path MTU discovery on stopped container")
+	}
 
-			// If we get this far, then the current host rule matches one of our LXD
-			// rules, so we should run the modified command to delete it.
-			_, err = shared.RunCommand(fields[0], fields[1:]...)
-			if err != nil {
-				logger.Error("Failed to remove network filter rule", log.Ctx{"container": c.Name(), "err": err})
-			}
-		}
+	// ip_no_pmtu_disc is inverted, 0 means path MTU discovery is enabled.
+	noPMTUDisc := "1"
+	if shared.IsTrue(value) {
+		noPMTUDisc = "0"
+	}
 
+	_, err := shared.RunCommand(
+		c.state.OS.ExecPath,
+		"forknet",
+		"sysctl",
+		fmt.Sprintf("%d", pid),
+		"net.ipv4.ip_no_pmtu_disc",
+		noPMTUDisc)
+	if err != nil {
+		return errors.Wrap(err, "Set path MTU discovery")
 	}
 
-	return
+	return nil
 }
 
 // matchEbtablesRule compares an active rule to a supplied match rule to see if they match.
@@ -9097,9 +12446,10 @@ func (c *containerLXC) insertNetworkDevice(name string, m types.Device) (types.D
 		}
 	}
 
-	// Block user trying to add an ipvlan nic on running container as is only supported via LXC
-	if m["nictype"] == "ipvlan" {
-		return nil, errors.New("Can't insert ipvlan device to running container")
+	// Block user trying to add a nic which is only supported at container start
+	err = shared.DeviceCanHotplug(m)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the interface
@@ -9231,7 +12581,11 @@ func (c *containerLXC) createDiskDevice(name string, m types.Device) (string, er
 	isRecursive := shared.IsTrue(m["recursive"])
 
 	isFile := false
-	if m["pool"] == "" {
+	if m["overlay.lowerdir"] != "" {
+		return c.createDiskOverlay(devPath, m)
+	} else if m["fuse"] != "" {
+		return c.createDiskFuse(name, devPath, m)
+	} else if m["pool"] == "" {
 		isFile = !shared.IsDir(srcPath) && !deviceIsBlockdev(srcPath)
 	} else {
 		// Deal with mounting storage volumes created via the storage
@@ -9345,24 +12699,177 @@ func (c *containerLXC) createDiskDevice(name string, m types.Device) (string, er
 	return devPath, nil
 }
 
+// createDiskOverlay mounts an overlay of the device's host directories on devPath.
+func (c *containerLXC) createDiskOverlay(devPath string, m types.Device) (string, error) {
+	lowerDirs := []string{}
+	for _, dir := range strings.Split(m["overlay.lowerdir"], ",") {
+		lowerDirs = append(lowerDirs, shared.HostPath(dir))
+	}
+
+	upperDir := ""
+	workDir := ""
+	if m["overlay.upperdir"] != "" {
+		upperDir = shared.HostPath(m["overlay.upperdir"])
+		workDir = shared.HostPath(m["overlay.workdir"])
+	}
+
+	// Check that all the directories exist
+	for _, dir := range append(lowerDirs, upperDir, workDir) {
+		if dir != "" && !shared.IsDir(dir) {
+			if shared.IsTrue(m["optional"]) {
+				return "", nil
+			}
+
+			return "", fmt.Errorf("Overlay directory %s doesn't exist", dir)
+		}
+	}
+
+	// Create the mount point
+	if !shared.PathExists(c.DevicesPath()) {
+		err := os.Mkdir(c.DevicesPath(), 0711)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if shared.PathExists(devPath) {
+		err := os.Remove(devPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := os.Mkdir(devPath, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// Without an upper directory, overlayfs is always read-only
+	err = deviceMountOverlay(lowerDirs, upperDir, workDir, devPath, shared.IsTrue(m["readonly"]))
+	if err != nil {
+		os.Remove(devPath)
+
+		// Mounting overlayfs is usually restricted inside user namespaces
+		if c.state.OS.RunningInUserNS {
+			return "", errors.Wrap(err, "Overlay mounts may not be allowed when LXD runs in a user namespace")
+		}
+
+		return "", err
+	}
+
+	return devPath, nil
+}
+
+// createDiskFuse runs the device's FUSE mount command on the host, with devPath
+// appended as the mountpoint, and records the mount so it can be cleaned up.
+func (c *containerLXC) createDiskFuse(name string, devPath string, m types.Device) (string, error) {
+	if !shared.PathExists("/dev/fuse") {
+		if shared.IsTrue(m["optional"]) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("FUSE isn't available on the host (missing /dev/fuse)")
+	}
+
+	fields := strings.Fields(m["fuse"])
+	_, err := exec.LookPath(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("FUSE mount command %q for device %s can't be found", fields[0], name)
+	}
+
+	// Create the mount point
+	if !shared.PathExists(c.DevicesPath()) {
+		err := os.Mkdir(c.DevicesPath(), 0711)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if shared.PathExists(devPath) {
+		// Leftover from a previous run
+		unix.Unmount(devPath, unix.MNT_DETACH)
+
+		err := os.Remove(devPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.Mkdir(devPath, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = shared.RunCommand(fields[0], append(fields[1:], devPath)...)
+	if err != nil {
+		os.Remove(devPath)
+
+		if shared.IsTrue(m["optional"]) {
+			logger.Warn("Skipping optional FUSE disk", log.Ctx{"container": c.name, "device": name, "err": err})
+			return "", nil
+		}
+
+		return "", errors.Wrapf(err, "Failed to mount FUSE filesystem for device %s", name)
+	}
+
+	// Track the mount so it's unmounted even if the device goes away
+	err = c.VolatileSet(map[string]string{fmt.Sprintf("volatile.%s.fuse_mount", name): devPath})
+	if err != nil {
+		unix.Unmount(devPath, unix.MNT_DETACH)
+		os.Remove(devPath)
+		return "", err
+	}
+
+	return devPath, nil
+}
+
+// removeDiskFuse unmounts the FUSE filesystem recorded for the device, if any.
+func (c *containerLXC) removeDiskFuse(name string) error {
+	key := fmt.Sprintf("volatile.%s.fuse_mount", name)
+	mountPath := c.localConfig[key]
+	if mountPath == "" {
+		return nil
+	}
+
+	if shared.IsMountPoint(mountPath) {
+		err := unix.Unmount(mountPath, unix.MNT_DETACH)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.VolatileSet(map[string]string{key: ""})
+}
+
 func (c *containerLXC) insertDiskDevice(name string, m types.Device) error {
 	// Check that the container is running
 	if !c.IsRunning() {
 		return fmt.Errorf("Can't insert device into stopped container")
 	}
 
-	isRecursive := shared.IsTrue(m["recursive"])
-
 	// Create the device on the host
 	devPath, err := c.createDiskDevice(name, m)
 	if err != nil {
 		return fmt.Errorf("Failed to setup device: %s", err)
 	}
 
+	return c.attachDiskDevice(devPath, m)
+}
+
+// attachDiskDevice bind-mounts a disk device which was set up on the host by
+// createDiskDevice into the running container.
+func (c *containerLXC) attachDiskDevice(devPath string, m types.Device) error {
+	// Check that the container is running
+	if !c.IsRunning() {
+		return fmt.Errorf("Can't insert device into stopped container")
+	}
+
 	if devPath == "" && shared.IsTrue(m["optional"]) {
 		return nil
 	}
 
+	isRecursive := shared.IsTrue(m["recursive"])
+
 	flags := unix.MS_BIND
 	if isRecursive {
 		flags |= unix.MS_REC
@@ -9370,11 +12877,20 @@ func (c *containerLXC) insertDiskDevice(name string, m types.Device) error {
 
 	// Bind-mount it into the container
 	destPath := strings.TrimSuffix(m["path"], "/")
-	err = c.insertMount(devPath, destPath, "none", flags)
+	err := c.insertMount(devPath, destPath, "none", flags)
 	if err != nil {
 		return fmt.Errorf("Failed to add mount for device: %s", err)
 	}
 
+	// Apply the propagation mode lxc.mount.entry would have on start
+	if m["propagation"] != "" {
+		err = c.setMountPropagation(destPath, m["propagation"])
+		if err != nil {
+			c.removeMount(m["path"])
+			return fmt.Errorf("Failed to set the propagation of the device's mount: %s", err)
+		}
+	}
+
 	return nil
 }
 
@@ -9442,12 +12958,30 @@ func (c *containerLXC) removeDiskDevice(name string, m types.Device) error {
 		return fmt.Errorf("Error unmounting the device: %s", err)
 	}
 
+	return c.releaseDiskDevice(name, m, devPath)
+}
+
+// releaseDiskDevice undoes the host side setup of createDiskDevice.
+func (c *containerLXC) releaseDiskDevice(name string, m types.Device, devPath string) error {
+	// Nothing was set up for a missing optional source
+	if devPath == "" {
+		return nil
+	}
+
 	// Unmount the host side
-	err = unix.Unmount(devPath, unix.MNT_DETACH)
+	err := unix.Unmount(devPath, unix.MNT_DETACH)
 	if err != nil {
 		return err
 	}
 
+	// Forget about the FUSE mount
+	if m["fuse"] != "" {
+		err = c.removeDiskFuse(name)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Check if pool-specific action should be taken
 	if m["pool"] != "" {
 		s, err := storagePoolVolumeInit(c.state, "default", m["pool"], m["source"], storagePoolVolumeTypeCustom)
@@ -9471,6 +13005,19 @@ func (c *containerLXC) removeDiskDevice(name string, m types.Device) error {
 }
 
 func (c *containerLXC) removeDiskDevices() error {
+	// Unmount the FUSE filesystems, including those of removed devices
+	for key := range c.localConfig {
+		if !strings.HasPrefix(key, "volatile.") || !strings.HasSuffix(key, ".fuse_mount") {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "volatile."), ".fuse_mount")
+		err := c.removeDiskFuse(name)
+		if err != nil {
+			logger.Error("Failed to unmount FUSE filesystem", log.Ctx{"err": err, "device": name})
+		}
+	}
+
 	// Check that we indeed have devices to remove
 	if !shared.PathExists(c.DevicesPath()) {
 		return nil
@@ -9553,6 +13100,11 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 			return nil, err
 		}
 
+		readLatency, weight, err := deviceParseDiskQoS(m["limits.read.latency"], m["limits.weight"])
+		if err != nil {
+			return nil, err
+		}
+
 		// Set the source path
 		source := shared.HostPath(m["source"])
 		if source == "" {
@@ -9567,7 +13119,7 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 		// Get the backing block devices (major:minor)
 		blocks, err := deviceGetParentBlocks(source)
 		if err != nil {
-			if readBps == 0 && readIops == 0 && writeBps == 0 && writeIops == 0 {
+			if readBps == 0 && readIops == 0 && writeBps == 0 && writeIops == 0 && readLatency == 0 && weight == 0 {
 				// If the device doesn't exist, there is no limit to clear so ignore the failure
 				continue
 			} else {
@@ -9575,7 +13127,7 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 			}
 		}
 
-		device := deviceBlockLimit{readBps: readBps, readIops: readIops, writeBps: writeBps, writeIops: writeIops}
+		device := deviceBlockLimit{readBps: readBps, readIops: readIops, writeBps: writeBps, writeIops: writeIops, readLatency: readLatency, weight: weight}
 		for _, block := range blocks {
 			blockStr := ""
 
@@ -9605,8 +13157,19 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 	// Average duplicate limits
 	for block, limits := range blockLimits {
 		var readBpsCount, readBpsTotal, readIopsCount, readIopsTotal, writeBpsCount, writeBpsTotal, writeIopsCount, writeIopsTotal int64
+		var weightCount, weightTotal, readLatency int64
 
 		for _, limit := range limits {
+			// The strictest latency target wins
+			if limit.readLatency > 0 && (readLatency == 0 || limit.readLatency < readLatency) {
+				readLatency = limit.readLatency
+			}
+
+			if limit.weight > 0 {
+				weightCount += 1
+				weightTotal += limit.weight
+			}
+
 			if limit.readBps > 0 {
 				readBpsCount += 1
 				readBpsTotal += limit.readBps
@@ -9628,7 +13191,11 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 			}
 		}
 
-		device := deviceBlockLimit{}
+		device := deviceBlockLimit{readLatency: readLatency}
+
+		if weightCount > 0 {
+			device.weight = weightTotal / weightCount
+		}
 
 		if readBpsCount > 0 {
 			device.readBps = readBpsTotal / readBpsCount
@@ -9652,6 +13219,44 @@ func (c *containerLXC) getDiskLimits() (map[string]deviceBlockLimit, error) {
 	return result, nil
 }
 
+// setDiskQoS applies the read latency target and weight of a block device to
+// the running container, clearing those which aren't set. They only exist on
+// cgroup2 and, as they depend on the kernel's I/O controllers, are only cleared
+// when the kernel provides them.
+func (c *containerLXC) setDiskQoS(block string, limit deviceBlockLimit) error {
+	if !c.cgroupUnified("blkio") {
+		return nil
+	}
+
+	latency := "max"
+	if limit.readLatency > 0 {
+		latency = fmt.Sprintf("%d", limit.readLatency)
+	}
+
+	current, err := c.CGroupGet("io.latency")
+	if limit.readLatency > 0 || (err == nil && strings.Contains(current, block+" ")) {
+		err = c.CGroupSet("io.latency", fmt.Sprintf("%s target=%s", block, latency))
+		if err != nil {
+			return err
+		}
+	}
+
+	weight := "default"
+	if limit.weight > 0 {
+		weight = fmt.Sprintf("%d", limit.weight)
+	}
+
+	current, err = c.CGroupGet("io.weight")
+	if limit.weight > 0 || (err == nil && strings.Contains(current, block+" ")) {
+		err = c.CGroupSet("io.weight", fmt.Sprintf("%s %s", block, weight))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Network I/O limits
 func (c *containerLXC) setNetworkPriority() error {
 	// Check that the container is running
@@ -9712,29 +13317,85 @@ func (c *containerLXC) setNetworkRoutes(m types.Device) error {
 		routeDev = m["parent"]
 	}
 
-	// Add additional IPv4 routes (using boot proto to avoid conflicts with network static routes)
-	if m["ipv4.routes"] != "" {
-		for _, route := range strings.Split(m["ipv4.routes"], ",") {
-			route = strings.TrimSpace(route)
-			_, err := shared.RunCommand("ip", "-4", "route", "add", route, "dev", routeDev, "proto", "boot")
-			if err != nil {
-				return err
-			}
+	// Routes of a nic in a VRF go to its table
+	routeOpts := []string{"proto", "boot"}
+	if m["nictype"] == "p2p" && m["vrf"] != "" {
+		routeOpts = append(routeOpts, "vrf", m["vrf"])
+	}
+
+	// Add additional IPv4 routes (using boot proto to avoid conflicts with network static routes)
+	if m["ipv4.routes"] != "" {
+		for _, route := range strings.Split(m["ipv4.routes"], ",") {
+			route = strings.TrimSpace(route)
+			_, err := shared.RunCommand("ip", append([]string{"-4", "route", "add", route, "dev", routeDev}, routeOpts...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Without DHCP, the static address may not be part of the bridge's subnet
+	if m["nictype"] == "bridged" && m["ipv4.dhcp"] != "" && !shared.IsTrue(m["ipv4.dhcp"]) && m["ipv4.address"] != "" {
+		_, err := shared.RunCommand("ip", append([]string{"-4", "route", "replace", fmt.Sprintf("%s/32", m["ipv4.address"]), "dev", routeDev}, routeOpts...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add additional IPv6 routes (using boot proto to avoid conflicts with network static routes)
+	if m["ipv6.routes"] != "" {
+		for _, route := range strings.Split(m["ipv6.routes"], ",") {
+			route = strings.TrimSpace(route)
+			_, err := shared.RunCommand("ip", append([]string{"-6", "route", "add", route, "dev", routeDev}, routeOpts...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setNetworkHostAddresses adds the ipv4.host_address and ipv6.host_address of
+// a p2p nic to its host side veth.
+func (c *containerLXC) setNetworkHostAddresses(hostName string, m types.Device) error {
+	if m["ipv4.host_address"] != "" {
+		_, err := shared.RunCommand("ip", "-4", "addr", "add", fmt.Sprintf("%s/32", m["ipv4.host_address"]), "dev", hostName)
+		if err != nil {
+			return fmt.Errorf("Failed to add the host address %s to %s: %s", m["ipv4.host_address"], hostName, err)
+		}
+	}
+
+	if m["ipv6.host_address"] != "" {
+		_, err := shared.RunCommand("ip", "-6", "addr", "add", fmt.Sprintf("%s/128", m["ipv6.host_address"]), "dev", hostName, "nodad")
+		if err != nil {
+			return fmt.Errorf("Failed to add the host address %s to %s: %s", m["ipv6.host_address"], hostName, err)
+		}
+	}
+
+	return nil
+}
+
+// removeNetworkHostAddresses removes the addresses added by
+// setNetworkHostAddresses, in case the host side veth outlives the container's.
+func (c *containerLXC) removeNetworkHostAddresses(m types.Device) {
+	if m["host_name"] == "" || !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", m["host_name"])) {
+		return
+	}
+
+	if m["ipv4.host_address"] != "" {
+		_, err := shared.RunCommand("ip", "-4", "addr", "del", fmt.Sprintf("%s/32", m["ipv4.host_address"]), "dev", m["host_name"])
+		if err != nil {
+			logger.Errorf("Failed to remove host address: %s from %s: %s", m["ipv4.host_address"], m["host_name"], err)
 		}
 	}
 
-	// Add additional IPv6 routes (using boot proto to avoid conflicts with network static routes)
-	if m["ipv6.routes"] != "" {
-		for _, route := range strings.Split(m["ipv6.routes"], ",") {
-			route = strings.TrimSpace(route)
-			_, err := shared.RunCommand("ip", "-6", "route", "add", route, "dev", routeDev, "proto", "boot")
-			if err != nil {
-				return err
-			}
+	if m["ipv6.host_address"] != "" {
+		_, err := shared.RunCommand("ip", "-6", "addr", "del", fmt.Sprintf("%s/128", m["ipv6.host_address"]), "dev", m["host_name"])
+		if err != nil {
+			logger.Errorf("Failed to remove host address: %s from %s: %s", m["ipv6.host_address"], m["host_name"], err)
 		}
 	}
-
-	return nil
 }
 
 // removeNetworkRoutes removes any routes created for this device on the host that were first added
@@ -9746,7 +13407,15 @@ func (c *containerLXC) removeNetworkRoutes(deviceName string, m types.Device) {
 		routeDev = m["parent"]
 	}
 
-	if m["ipv4.routes"] != "" || m["ipv6.routes"] != "" {
+	// Routes of a nic in a VRF go to its table
+	routeOpts := []string{"proto", "boot"}
+	if m["nictype"] == "p2p" && m["vrf"] != "" {
+		routeOpts = append(routeOpts, "vrf", m["vrf"])
+	}
+
+	staticRoute := m["nictype"] == "bridged" && m["ipv4.dhcp"] != "" && !shared.IsTrue(m["ipv4.dhcp"]) && m["ipv4.address"] != ""
+
+	if m["ipv4.routes"] != "" || m["ipv6.routes"] != "" || staticRoute {
 		if routeDev == "" {
 			logger.Errorf("Failed to remove static routes as route dev isn't set")
 			return
@@ -9761,18 +13430,27 @@ func (c *containerLXC) removeNetworkRoutes(deviceName string, m types.Device) {
 	if m["ipv4.routes"] != "" {
 		for _, route := range strings.Split(m["ipv4.routes"], ",") {
 			route = strings.TrimSpace(route)
-			_, err := shared.RunCommand("ip", "-4", "route", "flush", route, "dev", routeDev, "proto", "boot")
+			_, err := shared.RunCommand("ip", append([]string{"-4", "route", "flush", route, "dev", routeDev}, routeOpts...)...)
 			if err != nil {
 				logger.Errorf("Failed to remove static route: %s to %s: %s", route, routeDev, err)
 			}
 		}
 	}
 
+	// Remove the route to the static address
+	if staticRoute {
+		route := fmt.Sprintf("%s/32", m["ipv4.address"])
+		_, err := shared.RunCommand("ip", append([]string{"-4", "route", "flush", route, "dev", routeDev}, routeOpts...)...)
+		if err != nil {
+			logger.Errorf("Failed to remove static route: %s to %s: %s", route, routeDev, err)
+		}
+	}
+
 	// Remove IPv6 routes
 	if m["ipv6.routes"] != "" {
 		for _, route := range strings.Split(m["ipv6.routes"], ",") {
 			route = strings.TrimSpace(route)
-			_, err := shared.RunCommand("ip", "-6", "route", "flush", route, "dev", routeDev, "proto", "boot")
+			_, err := shared.RunCommand("ip", append([]string{"-6", "route", "flush", route, "dev", routeDev}, routeOpts...)...)
 			if err != nil {
 				logger.Errorf("Failed to remove static route: %s to %s: %s", route, routeDev, err)
 			}
@@ -9857,6 +13535,11 @@ func (c *containerLXC) IsStateful() bool {
 	return c.stateful
 }
 
+// IsMetadataOnly returns whether the container is a snapshot that only records the configuration.
+func (c *containerLXC) IsMetadataOnly() bool {
+	return c.IsSnapshot() && shared.IsTrue(c.localConfig["volatile.snapshot.metadata_only"])
+}
+
 func (c *containerLXC) IsEphemeral() bool {
 	return c.ephemeral
 }
@@ -9869,6 +13552,103 @@ func (c *containerLXC) IsNesting() bool {
 	return shared.IsTrue(c.expandedConfig["security.nesting"])
 }
 
+// IsReadOnly returns whether the container's root filesystem is read-only,
+// either through its root disk device or because it was remounted as such.
+func (c *containerLXC) IsReadOnly() bool {
+	_, rootDisk, err := shared.GetRootDiskDevice(c.expandedDevices)
+	if err == nil && shared.IsTrue(rootDisk["readonly"]) {
+		return true
+	}
+
+	pid := c.InitPID()
+	if pid <= 0 {
+		return false
+	}
+
+	var fs unix.Statfs_t
+	err = unix.Statfs(fmt.Sprintf("/proc/%d/root", pid), &fs)
+	if err != nil {
+		return false
+	}
+
+	return fs.Flags&unix.ST_RDONLY != 0
+}
+
+func (c *containerLXC) IsReady() bool {
+	return shared.IsTrue(c.localConfig["volatile.last_state.ready"])
+}
+
+// SetReady records whether the container signalled that it's ready and wakes
+// up anyone waiting for it.
+func (c *containerLXC) SetReady(ready bool) error {
+	value := ""
+	if ready {
+		value = "true"
+	}
+
+	if c.localConfig["volatile.last_state.ready"] != value {
+		err := c.VolatileSet(map[string]string{"volatile.last_state.ready": value})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ready {
+		return nil
+	}
+
+	lxcReadyListenersLock.Lock()
+	for _, listener := range lxcReadyListeners[c.id] {
+		close(listener)
+	}
+	delete(lxcReadyListeners, c.id)
+	lxcReadyListenersLock.Unlock()
+
+	eventSendLifecycle(c.project, "container-ready",
+		fmt.Sprintf("/1.0/containers/%s", c.name), nil)
+
+	return nil
+}
+
+// WaitForReady blocks until the container signals that it's ready or the
+// timeout expires.
+func (c *containerLXC) WaitForReady(timeout time.Duration) error {
+	listener := make(chan struct{})
+
+	lxcReadyListenersLock.Lock()
+	lxcReadyListeners[c.id] = append(lxcReadyListeners[c.id], listener)
+	lxcReadyListenersLock.Unlock()
+
+	defer func() {
+		lxcReadyListenersLock.Lock()
+		listeners := lxcReadyListeners[c.id]
+		for i, l := range listeners {
+			if l == listener {
+				lxcReadyListeners[c.id] = append(listeners[:i], listeners[i+1:]...)
+				break
+			}
+		}
+
+		if len(lxcReadyListeners[c.id]) == 0 {
+			delete(lxcReadyListeners, c.id)
+		}
+		lxcReadyListenersLock.Unlock()
+	}()
+
+	// The readiness may have been signalled since the container was loaded
+	value, err := c.state.Cluster.ContainerConfigGet(c.id, "volatile.last_state.ready")
+	if err == nil && shared.IsTrue(value) {
+		return nil
+	}
+
+	select {
+	case <-listener:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out waiting for the container to signal readiness")
+	}
+}
+
 func (c *containerLXC) isCurrentlyPrivileged() bool {
 	if !c.IsRunning() {
 		return c.IsPrivileged()
@@ -9963,6 +13743,314 @@ func (c *containerLXC) NextIdmap() (*idmap.IdmapSet, error) {
 	return idmapsetFromString(jsonIdmap)
 }
 
+// checkIntegrity compares the files listed in security.integrity.paths against
+// the hashes recorded in the container's integrity.json, failing on mismatch.
+// The hashes are recorded when missing or when the list of paths changed.
+func (c *containerLXC) checkIntegrity() error {
+	if c.expandedConfig["security.integrity.paths"] == "" {
+		return nil
+	}
+
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		return errors.Wrap(err, "Storage start")
+	}
+
+	if ourStart {
+		defer c.StorageStop()
+	}
+
+	// Ownership is hashed as seen from the container so that remapping
+	// the rootfs doesn't invalidate the recorded hashes
+	idmapset, err := c.DiskIdmap()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get disk idmap")
+	}
+
+	current := map[string]string{}
+	for _, entry := range strings.Split(c.expandedConfig["security.integrity.paths"], ",") {
+		containerPath := strings.TrimSpace(entry)
+
+		hash, err := c.integrityHash(containerPath, idmapset)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to hash %s", containerPath)
+		}
+
+		current[containerPath] = hash
+	}
+
+	// The manifest lives next to the rootfs, out of reach of both the
+	// container and the config API
+	manifestPath := filepath.Join(c.Path(), "integrity.json")
+	recorded := map[string]string{}
+	content, err := ioutil.ReadFile(manifestPath)
+	if err == nil {
+		err = json.Unmarshal(content, &recorded)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse %s", manifestPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Record the hashes if the set of protected paths changed
+	samePaths := len(recorded) == len(current)
+	for containerPath := range current {
+		_, ok := recorded[containerPath]
+		if !ok {
+			samePaths = false
+			break
+		}
+	}
+
+	if !samePaths {
+		manifest, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(manifestPath, manifest, 0600)
+	}
+
+	changed := []string{}
+	for containerPath, hash := range current {
+		if recorded[containerPath] != hash {
+			logger.Warn("Container file doesn't match its recorded hash", log.Ctx{"container": c.name, "path": containerPath, "expected": recorded[containerPath], "found": hash})
+			changed = append(changed, containerPath)
+		}
+	}
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("Container integrity check failed, modified files: %s", strings.Join(changed, ", "))
+	}
+
+	return nil
+}
+
+// integrityHash returns a hash of a file in the container's rootfs. Symlinks
+// are hashed by target rather than followed.
+func (c *containerLXC) integrityHash(containerPath string, idmapset *idmap.IdmapSet) (string, error) {
+	fullpath, err := c.templateFilePath(containerPath)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	fi, err := os.Lstat(fullpath)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	_, uid, gid := shared.GetOwnerMode(fi)
+	nsUid, nsGid := int64(uid), int64(gid)
+	if idmapset != nil {
+		nsUid, nsGid = idmapset.ShiftFromNs(nsUid, nsGid)
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s:%d:%d\n", fi.Mode(), nsUid, nsGid)
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullpath)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(hash, "%s", target)
+	} else if fi.Mode().IsRegular() {
+		f, err := os.Open(fullpath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(hash, f)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// shiftfsUsable returns whether shiftfs can be used for the container's rootfs.
+// Shiftfs doesn't work on top of all filesystems, so this is tested with a
+// mount once per storage pool and filesystem type.
+func (c *containerLXC) shiftfsUsable() bool {
+	if !c.state.OS.Shiftfs {
+		return false
+	}
+
+	if c.IsPrivileged() {
+		return true
+	}
+
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		logger.Warn("Failed to mount the container's storage to test shiftfs", log.Ctx{"container": c.name, "err": err})
+		return false
+	}
+
+	if ourStart {
+		defer c.StorageStop()
+	}
+
+	rootfs := c.RootfsPath()
+	var fs unix.Statfs_t
+	err = unix.Statfs(rootfs, &fs)
+	if err != nil {
+		return false
+	}
+
+	poolName, _ := c.StoragePool()
+	key := fmt.Sprintf("%s/%x", poolName, fs.Type)
+
+	lxcShiftfsSupportLock.Lock()
+	defer lxcShiftfsSupportLock.Unlock()
+
+	supported, ok := lxcShiftfsSupport[key]
+	if ok {
+		return supported
+	}
+
+	err = shiftfsTestMount(rootfs)
+	supported = err == nil
+	if !supported {
+		logger.Warn("Shiftfs can't be used on this storage pool, falling back to shifting the filesystem", log.Ctx{"pool": poolName, "container": c.name, "err": err})
+	}
+
+	lxcShiftfsSupport[key] = supported
+
+	return supported
+}
+
+// shiftfsTestMount does the mark and shift mounts used on container start on
+// a temporary mountpoint, checking the result can be read.
+func shiftfsTestMount(path string) error {
+	err := unix.Mount(path, path, "shiftfs", 0, "mark,passthrough=3")
+	if err != nil {
+		return err
+	}
+	defer unix.Unmount(path, unix.MNT_DETACH)
+
+	target, err := ioutil.TempDir("", "lxd_shiftfs_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(target)
+
+	err = unix.Mount(path, target, "shiftfs", 0, "passthrough=3")
+	if err != nil {
+		return err
+	}
+	defer unix.Unmount(target, unix.MNT_DETACH)
+
+	_, err = ioutil.ReadDir(target)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkDiskIdmap returns the disk idmap after checking it against the
+// ownership of a few well-known paths of the container's rootfs. If the
+// recorded idmap is invalid or doesn't match, the idmap the rootfs is actually
+// shifted with is returned and recorded in volatile.last_state.idmap, provided
+// it matches either an unshifted rootfs or the next idmap.
+func (c *containerLXC) checkDiskIdmap(nextIdmap *idmap.IdmapSet) (*idmap.IdmapSet, error) {
+	diskIdmap, diskErr := c.DiskIdmap()
+
+	ourStart, err := c.StorageStart()
+	if err != nil {
+		return nil, errors.Wrap(err, "Storage start")
+	}
+
+	if ourStart {
+		defer c.StorageStop()
+	}
+
+	// All sampled paths are expected to be owned by the container's root
+	uid := -1
+	gid := -1
+	for _, name := range []string{"", "etc", "usr", "root"} {
+		fi, err := os.Lstat(filepath.Join(c.RootfsPath(), name))
+		if err != nil {
+			continue
+		}
+
+		_, fileUid, fileGid := shared.GetOwnerMode(fi)
+		if uid == -1 {
+			uid = fileUid
+			gid = fileGid
+			continue
+		}
+
+		// Inconsistent ownership, don't try to be clever
+		if fileUid != uid || fileGid != gid {
+			return diskIdmap, diskErr
+		}
+	}
+
+	// Nothing to sample (e.g. empty rootfs)
+	if uid == -1 {
+		return diskIdmap, diskErr
+	}
+
+	rootUid := func(set *idmap.IdmapSet) (int, int) {
+		if set == nil {
+			return 0, 0
+		}
+
+		setUid, setGid := set.ShiftIntoNs(0, 0)
+		return int(setUid), int(setGid)
+	}
+
+	if diskErr == nil {
+		expectedUid, expectedGid := rootUid(diskIdmap)
+		if uid == expectedUid && gid == expectedGid {
+			return diskIdmap, nil
+		}
+
+		logger.Warn("Container rootfs ownership doesn't match the recorded idmap", log.Ctx{"container": c.name, "uid": uid, "gid": gid, "expectedUid": expectedUid, "expectedGid": expectedGid})
+	} else {
+		logger.Warn("Invalid recorded container idmap", log.Ctx{"container": c.name, "err": diskErr})
+	}
+
+	// Re-derive the disk idmap if the ownership matches a known candidate
+	var realIdmap *idmap.IdmapSet
+	nextUid, nextGid := rootUid(nextIdmap)
+	if nextIdmap != nil && uid == nextUid && gid == nextGid {
+		realIdmap = nextIdmap
+	} else if uid != 0 || gid != 0 {
+		// Unknown shift, keep what was recorded
+		return diskIdmap, diskErr
+	}
+
+	jsonDiskIdmap := "[]"
+	if realIdmap != nil {
+		idmapBytes, err := json.Marshal(realIdmap.Idmap)
+		if err != nil {
+			return nil, err
+		}
+
+		jsonDiskIdmap = string(idmapBytes)
+	}
+
+	err = c.VolatileSet(map[string]string{"volatile.last_state.idmap": jsonDiskIdmap})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Set volatile.last_state.idmap config key on container %q (id %d)", c.name, c.id)
+	}
+
+	logger.Info("Repaired container disk idmap", log.Ctx{"container": c.name, "idmap": jsonDiskIdmap})
+
+	return realIdmap, nil
+}
+
 func (c *containerLXC) DaemonState() *state.State {
 	// FIXME: This function should go away, since the abstract container
 	//        interface should not be coupled with internal state details.
@@ -10001,6 +14089,17 @@ func (c *containerLXC) State() string {
 	return state.String()
 }
 
+// AutostartPriority returns the parsed boot.autostart.priority of the
+// container, defaulting to 0 when unset or invalid.
+func (c *containerLXC) AutostartPriority() int {
+	priority, err := strconv.Atoi(c.expandedConfig["boot.autostart.priority"])
+	if err != nil || priority < 0 {
+		return 0
+	}
+
+	return priority
+}
+
 // Various container paths
 func (c *containerLXC) Path() string {
 	name := projectPrefix(c.Project(), c.Name())
@@ -10022,6 +14121,10 @@ func (c *containerLXC) LogPath() string {
 	return shared.LogPath(name)
 }
 
+func (c *containerLXC) LogFollow(level string) (io.ReadCloser, error) {
+	return newLxcLogFollower(c.LogFilePath(), level)
+}
+
 func (c *containerLXC) LogFilePath() string {
 	return filepath.Join(c.LogPath(), "lxc.log")
 }
@@ -10073,6 +14176,24 @@ func (c *containerLXC) ExpiryDate() time.Time {
 	return time.Time{}
 }
 
+// shiftProgress returns an idmap shift progress callback reporting the number of files and
+// bytes processed through updateProgress, at most once a second.
+func (c *containerLXC) shiftProgress(action string) func(files int64, bytes int64) {
+	if c.op == nil {
+		return nil
+	}
+
+	last := time.Time{}
+	return func(files int64, bytes int64) {
+		if time.Since(last) < time.Second {
+			return
+		}
+
+		last = time.Now()
+		c.updateProgress(fmt.Sprintf("%s: %d files (%s)", action, files, units.GetByteSizeString(bytes, 2)))
+	}
+}
+
 func (c *containerLXC) updateProgress(progress string) {
 	if c.op == nil {
 		return
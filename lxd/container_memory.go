@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/units"
+)
+
+// containerMemoryLimitItems returns the memory cgroup files (by their v1 name)
+// and values matching the limits.memory* keys of a config, in the order they
+// need to be set in. Limits are first reset so that they can be set in any
+// order relative to their previous values.
+func containerMemoryLimitItems(config map[string]string, memoryTotal int64, swapAccounting bool, unified bool) ([][2]string, error) {
+	memory := config["limits.memory"]
+	memoryEnforce := config["limits.memory.enforce"]
+	memorySwap := config["limits.memory.swap"]
+	memorySwapPriority := config["limits.memory.swap.priority"]
+	memorySwappiness := config["limits.memory.swappiness"]
+
+	// Parse memory
+	var valueInt int64
+	if memory == "" {
+		valueInt = -1
+	} else if strings.HasSuffix(memory, "%") {
+		percent, err := strconv.ParseInt(strings.TrimSuffix(memory, "%"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		valueInt = int64((memoryTotal / 100) * percent)
+	} else {
+		var err error
+		valueInt, err = units.ParseByteSizeString(memory)
+		if err != nil {
+			return nil, err
+		}
+	}
+	memory = fmt.Sprintf("%d", valueInt)
+
+	// Reset everything (swap is limited on its own on cgroup2)
+	items := [][2]string{}
+	if swapAccounting && unified {
+		items = append(items, [2]string{"memory.swap.max", "max"})
+	} else if swapAccounting {
+		items = append(items, [2]string{"memory.memsw.limit_in_bytes", "-1"})
+	}
+	items = append(items, [2]string{"memory.limit_in_bytes", "-1"}, [2]string{"memory.soft_limit_in_bytes", "-1"})
+
+	// Set the new values
+	if memoryEnforce == "soft" {
+		items = append(items, [2]string{"memory.soft_limit_in_bytes", memory})
+	} else {
+		items = append(items, [2]string{"memory.limit_in_bytes", memory})
+		if swapAccounting && (memorySwap == "" || shared.IsTrue(memorySwap)) {
+			if unified {
+				items = append(items, [2]string{"memory.swap.max", "max"})
+			} else {
+				items = append(items, [2]string{"memory.memsw.limit_in_bytes", memory})
+			}
+		}
+
+		// Set soft limit to value 10% less than hard limit (on cgroup2
+		// that would throttle the container instead)
+		if valueInt > 0 && !unified {
+			items = append(items, [2]string{"memory.soft_limit_in_bytes", fmt.Sprintf("%.0f", float64(valueInt)*0.9)})
+		}
+	}
+
+	// Configure the swappiness
+	if memorySwap != "" && !shared.IsTrue(memorySwap) {
+		// There's no swappiness on cgroup2, forbid swapping instead
+		if unified {
+			items = append(items, [2]string{"memory.swap.max", "0"})
+		} else {
+			items = append(items, [2]string{"memory.swappiness", "0"})
+		}
+	} else if memorySwappiness != "" {
+		items = append(items, [2]string{"memory.swappiness", memorySwappiness})
+	} else {
+		priority := 0
+		if memorySwapPriority != "" {
+			var err error
+			priority, err = strconv.Atoi(memorySwapPriority)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		items = append(items, [2]string{"memory.swappiness", fmt.Sprintf("%d", 60-10+priority)})
+	}
+
+	return items, nil
+}
+
+// applyMemoryLimits applies all the limits.memory* keys of the container to
+// its cgroup at once, whichever of them changed. All values are restored if
+// any of them can't be set. Stopped containers get them through initLXC on
+// start.
+func (c *containerLXC) applyMemoryLimits(running bool) error {
+	if !running || !c.state.OS.CGroupMemoryController {
+		return nil
+	}
+
+	memoryTotal, err := shared.DeviceTotalMemory()
+	if err != nil {
+		return err
+	}
+
+	items, err := containerMemoryLimitItems(c.expandedConfig, memoryTotal, c.state.OS.CGroupSwapAccounting, c.cgroupUnified("memory"))
+	if err != nil {
+		return err
+	}
+
+	// Store the old values for revert, files which can't be read (e.g.
+	// swappiness on cgroup2) being left alone
+	oldItems := [][2]string{}
+	for _, key := range []string{"memory.limit_in_bytes", "memory.memsw.limit_in_bytes", "memory.swap.max", "memory.soft_limit_in_bytes", "memory.swappiness"} {
+		if key == "memory.memsw.limit_in_bytes" && !c.state.OS.CGroupSwapAccounting {
+			continue
+		}
+
+		value, err := c.CGroupGet(key)
+		if err != nil || strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		oldItems = append(oldItems, [2]string{key, strings.TrimSpace(value)})
+	}
+
+	revert := func() {
+		// Lift the limits first so that the old ones can be set back
+		for _, item := range items {
+			if item[1] == "-1" || item[1] == "max" {
+				c.CGroupSet(item[0], item[1])
+			}
+		}
+
+		for _, item := range oldItems {
+			c.CGroupSet(item[0], item[1])
+		}
+	}
+
+	for _, item := range items {
+		err := c.CGroupSet(item[0], item[1])
+		if err != nil {
+			revert()
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerMemoryLimitItems(t *testing.T) {
+	// Swap settings are applied along with the limit
+	config := map[string]string{"limits.memory": "1GiB", "limits.memory.swap": "false"}
+	items, err := containerMemoryLimitItems(config, 0, true, false)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"memory.memsw.limit_in_bytes", "-1"},
+		{"memory.limit_in_bytes", "-1"},
+		{"memory.soft_limit_in_bytes", "-1"},
+		{"memory.limit_in_bytes", "1073741824"},
+		{"memory.soft_limit_in_bytes", "966367642"},
+		{"memory.swappiness", "0"},
+	}, items)
+
+	// Soft limit as a percentage of the host memory, on cgroup2
+	config = map[string]string{"limits.memory": "50%", "limits.memory.enforce": "soft", "limits.memory.swap.priority": "5"}
+	items, err = containerMemoryLimitItems(config, 4000, true, true)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"memory.swap.max", "max"},
+		{"memory.limit_in_bytes", "-1"},
+		{"memory.soft_limit_in_bytes", "-1"},
+		{"memory.soft_limit_in_bytes", "2000"},
+		{"memory.swappiness", "55"},
+	}, items)
+
+	// Swap disabled on cgroup2
+	config = map[string]string{"limits.memory": "1GiB", "limits.memory.swap": "false"}
+	items, err = containerMemoryLimitItems(config, 0, true, true)
+	require.NoError(t, err)
+	require.Equal(t, [2]string{"memory.swap.max", "0"}, items[len(items)-1])
+
+	// Swap enabled on cgroup2, where limits.memory only covers the memory
+	config = map[string]string{"limits.memory": "1GiB"}
+	items, err = containerMemoryLimitItems(config, 0, true, true)
+	require.NoError(t, err)
+	require.Equal(t, [2]string{"memory.swap.max", "max"}, items[4])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsFamily is a metric along with its samples, keyed by their labels.
+type metricsFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]float64
+}
+
+// metricsLabels formats the given label name and value pairs.
+func metricsLabels(pairs ...string) string {
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], metricsLabelReplacer.Replace(pairs[i+1])))
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(labels, ","))
+}
+
+// metricsRender writes the metric families in the Prometheus text exposition
+// format, samples being sorted so the output is stable.
+func metricsRender(families []metricsFamily) []byte {
+	buf := bytes.Buffer{}
+	for _, family := range families {
+		if len(family.samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", family.name, family.kind)
+
+		labels := []string{}
+		for label := range family.samples {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		for _, label := range labels {
+			fmt.Fprintf(&buf, "%s%s %v\n", family.name, label, family.samples[label])
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// containerMetrics converts the state of a container into metric families.
+func containerMetrics(project string, name string, state *api.ContainerState) []metricsFamily {
+	labels := metricsLabels("project", project, "name", name)
+	deviceLabels := func(device string) string {
+		return metricsLabels("project", project, "name", name, "device", device)
+	}
+
+	running := 0.0
+	if state.StatusCode == api.Running || state.StatusCode == api.Frozen {
+		running = 1
+	}
+
+	families := []metricsFamily{
+		{"lxd_container_running", "Whether the container is running.", "gauge", map[string]float64{labels: running}},
+	}
+
+	// Usage is only known for running containers
+	if running == 0 {
+		return families
+	}
+
+	disk := map[string]float64{}
+	for device, usage := range state.Disk {
+		disk[deviceLabels(device)] = float64(usage.Usage)
+	}
+
+	rxBytes := map[string]float64{}
+	txBytes := map[string]float64{}
+	rxPackets := map[string]float64{}
+	txPackets := map[string]float64{}
+	for device, network := range state.Network {
+		rxBytes[deviceLabels(device)] = float64(network.Counters.BytesReceived)
+		txBytes[deviceLabels(device)] = float64(network.Counters.BytesSent)
+		rxPackets[deviceLabels(device)] = float64(network.Counters.PacketsReceived)
+		txPackets[deviceLabels(device)] = float64(network.Counters.PacketsSent)
+	}
+
+	return append(families, []metricsFamily{
+		{"lxd_container_cpu_seconds_total", "CPU time used by the container in seconds.", "counter", map[string]float64{labels: float64(state.CPU.Usage) / 1e9}},
+		{"lxd_container_memory_usage_bytes", "Memory used by the container.", "gauge", map[string]float64{labels: float64(state.Memory.Usage)}},
+		{"lxd_container_memory_usage_peak_bytes", "Peak memory used by the container.", "gauge", map[string]float64{labels: float64(state.Memory.UsagePeak)}},
+		{"lxd_container_swap_usage_bytes", "Swap used by the container.", "gauge", map[string]float64{labels: float64(state.Memory.SwapUsage)}},
+		{"lxd_container_swap_usage_peak_bytes", "Peak swap used by the container.", "gauge", map[string]float64{labels: float64(state.Memory.SwapUsagePeak)}},
+		{"lxd_container_processes", "Number of processes in the container.", "gauge", map[string]float64{labels: float64(state.Processes)}},
+		{"lxd_container_disk_usage_bytes", "Disk space used by the container's disk devices.", "gauge", disk},
+		{"lxd_container_network_receive_bytes_total", "Bytes received on the container's network interfaces.", "counter", rxBytes},
+		{"lxd_container_network_transmit_bytes_total", "Bytes sent on the container's network interfaces.", "counter", txBytes},
+		{"lxd_container_network_receive_packets_total", "Packets received on the container's network interfaces.", "counter", rxPackets},
+		{"lxd_container_network_transmit_packets_total", "Packets sent on the container's network interfaces.", "counter", txPackets},
+	}...)
+}
+
+// RenderMetrics renders the resource usage of the container in the
+// Prometheus text exposition format, using the same collectors as
+// RenderState.
+func (c *containerLXC) RenderMetrics() ([]byte, error) {
+	state, err := c.RenderState()
+	if err != nil {
+		return nil, err
+	}
+
+	return metricsRender(containerMetrics(c.project, c.name, state)), nil
+}
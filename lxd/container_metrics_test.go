@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+func TestContainerMetrics(t *testing.T) {
+	state := &api.ContainerState{
+		StatusCode: api.Running,
+		CPU:        api.ContainerStateCPU{Usage: 1500000000},
+		Memory:     api.ContainerStateMemory{Usage: 1024},
+		Network: map[string]api.ContainerStateNetwork{
+			"eth0": {Counters: api.ContainerStateNetworkCounters{BytesReceived: 10, BytesSent: 20}},
+		},
+		Processes: 3,
+	}
+
+	out := string(metricsRender(containerMetrics("default", "c\"1", state)))
+	lines := strings.Split(out, "\n")
+
+	require.Contains(t, lines, "# TYPE lxd_container_cpu_seconds_total counter")
+	require.Contains(t, lines, `lxd_container_running{project="default",name="c\"1"} 1`)
+	require.Contains(t, lines, `lxd_container_cpu_seconds_total{project="default",name="c\"1"} 1.5`)
+	require.Contains(t, lines, `lxd_container_memory_usage_bytes{project="default",name="c\"1"} 1024`)
+	require.Contains(t, lines, `lxd_container_network_transmit_bytes_total{project="default",name="c\"1",device="eth0"} 20`)
+
+	// No disk devices, no disk metric
+	require.NotContains(t, out, "lxd_container_disk_usage_bytes")
+}
+
+func TestContainerMetricsStopped(t *testing.T) {
+	state := &api.ContainerState{StatusCode: api.Stopped}
+
+	out := string(metricsRender(containerMetrics("default", "c1", state)))
+	require.Equal(t, `# HELP lxd_container_running Whether the container is running.
+# TYPE lxd_container_running gauge
+lxd_container_running{project="default",name="c1"} 0
+`, out)
+}
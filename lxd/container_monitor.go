@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// lxcMonitorMsgExitCode is liblxc's lxc_msg_exit_code message type
+const lxcMonitorMsgExitCode = 2
+
+// lxcMonitorMsg mirrors liblxc's struct lxc_msg, in host byte order
+type lxcMonitorMsg struct {
+	Type  int32
+	Name  [256]byte
+	Value int32
+}
+
+// Exit codes of container inits reported by liblxc, until picked up by the stop hook
+var lxcExitCodes = map[string]int{}
+var lxcExitCodesLock sync.Mutex
+
+// lxcMonitorFifoPath returns the path of the fifo liblxc sends its monitor messages to
+// for containers in the given path.
+func lxcMonitorFifoPath(lxcpath string) string {
+	return filepath.Join("/run/lxc", lxcpath, "monitor-fifo")
+}
+
+// lxcWaitStatusExitCode turns a wait status into an exit code, signals being
+// reported as 128 + the signal number.
+func lxcWaitStatusExitCode(status int32) int {
+	ws := unix.WaitStatus(status)
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return ws.ExitStatus()
+}
+
+// lxcParseMonitorMsg returns the container name and exit code of an exit code
+// message sent by liblxc's monitor. Messages are only decoded on little endian
+// hosts, anything else is ignored and the exit code left unknown.
+func lxcParseMonitorMsg(buf []byte) (string, int, bool) {
+	msg := lxcMonitorMsg{}
+	err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &msg)
+	if err != nil || msg.Type != lxcMonitorMsgExitCode {
+		return "", -1, false
+	}
+
+	name := msg.Name[:]
+	end := bytes.IndexByte(name, 0)
+	if end >= 0 {
+		name = name[:end]
+	}
+
+	return string(name), lxcWaitStatusExitCode(msg.Value), true
+}
+
+// lxcMonitorListener collects the exit codes liblxc's monitor sends when a
+// container's init exits. Liblxc only sends them if the fifo has a reader,
+// which is usually lxc-monitord, so LXD takes that role for its own containers.
+func lxcMonitorListener() {
+	path := lxcMonitorFifoPath(shared.VarPath("containers"))
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		logger.Errorf("Failed to create the liblxc monitor directory: %v", err)
+		return
+	}
+
+	err = unix.Mkfifo(path, 0600)
+	if err != nil && err != unix.EEXIST {
+		logger.Errorf("Failed to create the liblxc monitor fifo: %v", err)
+		return
+	}
+
+	// Open read-write so the fifo doesn't hit EOF between containers
+	fifo, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		logger.Errorf("Failed to open the liblxc monitor fifo: %v", err)
+		return
+	}
+	defer fifo.Close()
+
+	buf := make([]byte, binary.Size(lxcMonitorMsg{}))
+	for {
+		_, err := io.ReadFull(fifo, buf)
+		if err != nil {
+			logger.Errorf("Failed to read from the liblxc monitor fifo: %v", err)
+			return
+		}
+
+		name, code, ok := lxcParseMonitorMsg(buf)
+		if !ok {
+			continue
+		}
+
+		lxcExitCodesLock.Lock()
+		lxcExitCodes[name] = code
+		lxcExitCodesLock.Unlock()
+	}
+}
+
+// lxcInitExitCode returns the exit code of the container's init as reported by
+// liblxc's monitor. Liblxc sends it right before running the stop hooks, so
+// allow the listener a moment to pick it up.
+func lxcInitExitCode(name string) (int, bool) {
+	for i := 0; i < 10; i++ {
+		lxcExitCodesLock.Lock()
+		code, ok := lxcExitCodes[name]
+		if ok {
+			delete(lxcExitCodes, name)
+		}
+		lxcExitCodesLock.Unlock()
+
+		if ok {
+			return code, true
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return -1, false
+}
+
+// lxcMonitorRunning returns whether the liblxc monitor of a container, which
+// runs its hooks, is still around. Liblxc sets the monitor's process title to
+// "[lxc monitor] <lxcpath> <name>".
+func lxcMonitorRunning(lxcpath string, name string) bool {
+	title := fmt.Sprintf("[lxc monitor] %s %s", lxcpath, name)
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		_, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimRight(string(cmdline), "\x00 ") == title {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lxcTestMonitorMsg(t *testing.T, msgType int32, name string, value int32) []byte {
+	msg := lxcMonitorMsg{Type: msgType, Value: value}
+	copy(msg.Name[:], name)
+
+	buf := bytes.Buffer{}
+	err := binary.Write(&buf, binary.LittleEndian, msg)
+	require.NoError(t, err)
+	require.Len(t, buf.Bytes(), 264)
+
+	return buf.Bytes()
+}
+
+func TestLXCParseMonitorMsg(t *testing.T) {
+	// Regular exit
+	name, code, ok := lxcParseMonitorMsg(lxcTestMonitorMsg(t, lxcMonitorMsgExitCode, "foo_c1", 3<<8))
+	require.True(t, ok)
+	require.Equal(t, "foo_c1", name)
+	require.Equal(t, 3, code)
+
+	// Killed by SIGKILL
+	_, code, ok = lxcParseMonitorMsg(lxcTestMonitorMsg(t, lxcMonitorMsgExitCode, "c1", 9))
+	require.True(t, ok)
+	require.Equal(t, 137, code)
+
+	// State changes are ignored
+	_, _, ok = lxcParseMonitorMsg(lxcTestMonitorMsg(t, 0, "c1", 1))
+	require.False(t, ok)
+}
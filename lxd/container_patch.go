@@ -100,6 +100,14 @@ func containerPatch(d *Daemon, r *http.Request) Response {
 		}
 	}
 
+	if !d.userIsAdmin(r) && containerSecretsChanged(c.LocalConfig(), req.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if !d.userIsAdmin(r) && containerFuseChanged(c.LocalDevices(), req.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	// Check if devices was passed
 	if req.Devices == nil {
 		req.Devices = c.LocalDevices()
@@ -51,6 +51,14 @@ func containerPut(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	if configRaw.Restore == "" && !d.userIsAdmin(r) && containerSecretsChanged(c.LocalConfig(), configRaw.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if configRaw.Restore == "" && !d.userIsAdmin(r) && containerFuseChanged(c.LocalDevices(), configRaw.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	architecture, err := osarch.ArchitectureId(configRaw.Architecture)
 	if err != nil {
 		architecture = 0
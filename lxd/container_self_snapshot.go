@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/shared"
+)
+
+// Serializes the rate limiting of self-snapshots requested over /dev/lxd.
+var containerSelfSnapshotLock sync.Mutex
+
+// containerSelfSnapshotWait returns how long a container has to wait before
+// it may request a new snapshot of itself, given the time of the last one
+// and the minimum interval in seconds (security.devlxd.snapshots.interval).
+func containerSelfSnapshotWait(last string, interval string, now time.Time) time.Duration {
+	if last == "" {
+		return 0
+	}
+
+	lastTime, err := time.Parse(time.RFC3339, last)
+	if err != nil {
+		return 0
+	}
+
+	seconds := int64(300)
+	if interval != "" {
+		seconds, err = strconv.ParseInt(interval, 10, 64)
+		if err != nil {
+			return 0
+		}
+	}
+
+	wait := lastTime.Add(time.Duration(seconds) * time.Second).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// SelfSnapshot creates a snapshot the container requested of itself, the
+// same way scheduled snapshots are, and records when it was taken.
+func (c *containerLXC) SelfSnapshot(name string) error {
+	expiry, err := shared.GetSnapshotExpiry(time.Now(), c.expandedConfig["snapshots.expiry"])
+	if err != nil {
+		return err
+	}
+
+	args := db.ContainerArgs{
+		Architecture: c.Architecture(),
+		Config:       c.LocalConfig(),
+		Ctype:        db.CTypeSnapshot,
+		Devices:      c.LocalDevices(),
+		Ephemeral:    c.IsEphemeral(),
+		Name:         fmt.Sprintf("%s%s%s", c.Name(), shared.SnapshotDelimiter, name),
+		Profiles:     c.Profiles(),
+		Project:      c.Project(),
+		Stateful:     false,
+		ExpiryDate:   expiry,
+	}
+
+	_, err = containerCreateAsSnapshot(c.state, args, c)
+	if err != nil {
+		return err
+	}
+
+	return c.VolatileSet(map[string]string{"volatile.last_state.self_snapshot": time.Now().UTC().Format(time.RFC3339)})
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerSelfSnapshotWait(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	require.Equal(t, time.Duration(0), containerSelfSnapshotWait("", "", now))
+	require.Equal(t, 4*time.Minute, containerSelfSnapshotWait("2019-06-01T11:59:00Z", "", now))
+	require.Equal(t, 30*time.Second, containerSelfSnapshotWait("2019-06-01T11:59:00Z", "90", now))
+	require.Equal(t, time.Duration(0), containerSelfSnapshotWait("2019-06-01T11:00:00Z", "60", now))
+	require.Equal(t, time.Duration(0), containerSelfSnapshotWait("2019-06-01T11:59:00Z", "0", now))
+}
@@ -135,11 +135,26 @@ func containerSnapshotsPost(d *Daemon, r *http.Request) Response {
 		}
 	}
 
+	if req.MetadataOnly && req.Stateful {
+		return BadRequest(fmt.Errorf("Metadata-only snapshots can't be stateful"))
+	}
+
+	// Only mark the snapshot as metadata-only when requested
+	config := map[string]string{}
+	for k, v := range c.LocalConfig() {
+		config[k] = v
+	}
+
+	delete(config, "volatile.snapshot.metadata_only")
+	if req.MetadataOnly {
+		config["volatile.snapshot.metadata_only"] = "true"
+	}
+
 	snapshot := func(op *operation) error {
 		args := db.ContainerArgs{
 			Project:      c.Project(),
 			Architecture: c.Architecture(),
-			Config:       c.LocalConfig(),
+			Config:       config,
 			Ctype:        db.CTypeSnapshot,
 			Devices:      c.LocalDevices(),
 			Ephemeral:    c.IsEphemeral(),
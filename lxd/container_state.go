@@ -11,6 +11,9 @@ import (
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/logger"
+
+	log "github.com/lxc/lxd/shared/log15"
 )
 
 func containerState(d *Daemon, r *http.Request) Response {
@@ -182,6 +185,13 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 		opType = db.OperationContainerFreeze
 		do = func(op *operation) error {
 			c.SetOperation(op)
+
+			// Let the applications quiesce first
+			err := c.RunFreezeHook("freeze.pre_command")
+			if err != nil {
+				logger.Warn("Failed to run the pre-freeze command, freezing anyway", log.Ctx{"container": c.Name(), "err": err})
+			}
+
 			return c.Freeze()
 		}
 	case shared.Unfreeze:
@@ -192,7 +202,17 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 		opType = db.OperationContainerUnfreeze
 		do = func(op *operation) error {
 			c.SetOperation(op)
-			return c.Unfreeze()
+			err := c.Unfreeze()
+			if err != nil {
+				return err
+			}
+
+			err = c.RunFreezeHook("freeze.post_command")
+			if err != nil {
+				logger.Warn("Failed to run the post-thaw command", log.Ctx{"container": c.Name(), "err": err})
+			}
+
+			return nil
 		}
 	default:
 		return BadRequest(fmt.Errorf("unknown action %s", raw.Action))
@@ -5,11 +5,15 @@ import (
 	"testing"
 
 	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/sys"
 	"github.com/lxc/lxd/lxd/types"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/idmap"
+	"github.com/lxc/lxd/shared/logger"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"gopkg.in/yaml.v2"
 )
 
 type containerTestSuite struct {
@@ -149,6 +153,100 @@ func (suite *containerTestSuite) TestContainer_LoadFromDB() {
 		"The loaded container isn't excactly the same as the created one.")
 }
 
+func (suite *containerTestSuite) TestContainer_ExportImportFullConfig() {
+	args := db.ContainerArgs{
+		Ctype:     db.CTypeRegular,
+		Ephemeral: false,
+		Config: map[string]string{
+			"security.privileged": "true",
+			"user.foo":            "bar"},
+		Devices: types.Devices{
+			"eth0": types.Device{
+				"type":    "nic",
+				"nictype": "bridged",
+				"parent":  "unknownbr0"}},
+		Name: "testFoo",
+	}
+
+	c, err := containerCreateInternal(suite.d.State(), args)
+	suite.Req.Nil(err)
+	defer c.Delete()
+
+	backup, err := c.ExportFullConfig()
+	suite.Req.Nil(err)
+
+	// Go through the same serialization as backup.yaml
+	data, err := yaml.Marshal(backup)
+	suite.Req.Nil(err)
+
+	imported := backupFile{}
+	err = yaml.Unmarshal(data, &imported)
+	suite.Req.Nil(err)
+
+	c2, snapshots, err := ImportFullConfig(suite.d.State(), "default", &imported)
+	suite.Req.Nil(err)
+	suite.Req.Len(snapshots, 0)
+
+	out, _, err := c.Render()
+	suite.Req.Nil(err)
+
+	out2, _, err := c2.Render()
+	suite.Req.Nil(err)
+
+	suite.Equal(out, out2, "The imported container doesn't render the same as the exported one.")
+}
+
+func (suite *containerTestSuite) TestContainer_SnapshotsDiff() {
+	args := db.ContainerArgs{
+		Ctype: db.CTypeRegular,
+		Name:  "testFoo",
+	}
+
+	c, err := containerCreateInternal(suite.d.State(), args)
+	suite.Req.Nil(err)
+	defer c.Delete()
+
+	snapshots := []db.ContainerArgs{
+		{
+			Ctype:    db.CTypeSnapshot,
+			Name:     "testFoo/snap0",
+			Config:   map[string]string{"user.a": "1", "user.b": "2"},
+			Profiles: []string{"default"},
+		},
+		{
+			Ctype:  db.CTypeSnapshot,
+			Name:   "testFoo/snap1",
+			Config: map[string]string{"user.a": "1", "user.c": "3"},
+			Devices: types.Devices{
+				"eth0": types.Device{
+					"type":    "nic",
+					"nictype": "bridged",
+					"parent":  "unknownbr0"}},
+			Profiles: []string{},
+		},
+	}
+
+	for _, args := range snapshots {
+		snap, err := containerCreateInternal(suite.d.State(), args)
+		suite.Req.Nil(err)
+		defer snap.Delete()
+	}
+
+	diff, err := c.SnapshotsDiff("snap0", "snap1")
+	suite.Req.Nil(err)
+
+	suite.Equal([2]string{"2", ""}, diff.Config["user.b"])
+	suite.Equal([2]string{"", "3"}, diff.Config["user.c"])
+	suite.NotContains(diff.Config, "user.a")
+	suite.Req.Len(diff.Devices, 1)
+	suite.Nil(diff.Devices["eth0"][0])
+	suite.Equal("unknownbr0", diff.Devices["eth0"][1]["parent"])
+	suite.Equal([2][]string{{"default"}, {}}, diff.Profiles)
+
+	_, err = c.SnapshotsDiff("snap0", "missing")
+	suite.Req.Error(err)
+}
+
 func (suite *containerTestSuite) TestContainer_Path_Regular() {
 	// Regular
 	args := db.ContainerArgs{
@@ -246,6 +344,53 @@ func (suite *containerTestSuite) TestContainer_Rename() {
 	suite.Req.Equal(shared.VarPath("containers", "testFoo2"), c.Path())
 }
 
+func (suite *containerTestSuite) TestContainer_DiskUsage() {
+	c, err := containerCreateInternal(suite.d.State(), db.ContainerArgs{
+		Ctype: db.CTypeRegular,
+		Name:  "testFoo",
+	})
+	suite.Req.Nil(err)
+	defer c.Delete()
+
+	snap, err := containerCreateInternal(suite.d.State(), db.ContainerArgs{
+		Ctype: db.CTypeSnapshot,
+		Name:  "testFoo/snap0",
+	})
+	suite.Req.Nil(err)
+	defer snap.Delete()
+
+	usage, partial, err := c.DiskUsage()
+	suite.Req.Nil(err)
+	suite.Req.False(partial, "The mock storage driver reports snapshot usage.")
+	suite.Req.Equal(int64(0), usage)
+}
+
+func (suite *containerTestSuite) TestContainer_ClearStaleOperation() {
+	c, err := containerCreateInternal(suite.d.State(), db.ContainerArgs{
+		Ctype: db.CTypeRegular,
+		Name:  "testFoo",
+	})
+	suite.Req.Nil(err)
+	defer c.Delete()
+
+	suite.Req.NotNil(c.ClearStaleOperation(), "There's no operation to clear.")
+
+	op, err := c.(*containerLXC).createOperation("start", false, false)
+	suite.Req.Nil(err)
+	suite.Req.NotNil(c.ClearStaleOperation(), "Start operations are completed by LXD.")
+	op.Done(nil)
+
+	// Nothing is left to run the stop hook of a stopped container
+	op, err = c.(*containerLXC).createOperation("stop", false, false)
+	suite.Req.Nil(err)
+
+	suite.Req.Nil(c.ClearStaleOperation())
+	suite.Req.NotNil(op.Wait())
+
+	_, err = c.(*containerLXC).getOperation("")
+	suite.Req.NotNil(err, "The operation should have been removed.")
+}
+
 func (suite *containerTestSuite) TestContainer_findIdmap_isolated() {
 	c1, err := containerCreateInternal(suite.d.State(), db.ContainerArgs{
 		Ctype: db.CTypeRegular,
@@ -405,6 +550,81 @@ func (suite *containerTestSuite) TestContainer_findIdmap_maxed() {
 	}
 }
 
+func TestContainerConfigExpand(t *testing.T) {
+	config := map[string]string{
+		"user.foo":          "bar",
+		"environment.FOO":   "${config:user.foo}",
+		"environment.PATH":  "/opt/${config:environment.FOO}/bin",
+		"environment.LOOP":  "${config:environment.LOOP2}",
+		"environment.LOOP2": "${config:environment.LOOP}",
+		"environment.SHELL": "${HOME}",
+	}
+
+	value, err := containerConfigExpand(config, config["environment.PATH"], "environment.PATH")
+	require.NoError(t, err)
+	require.Equal(t, "/opt/bar/bin", value)
+
+	value, err = containerConfigExpand(config, config["environment.SHELL"], "environment.SHELL")
+	require.NoError(t, err)
+	require.Equal(t, "${HOME}", value)
+
+	_, err = containerConfigExpand(config, config["environment.LOOP"], "environment.LOOP")
+	require.Error(t, err)
+
+	_, err = containerConfigExpand(config, "${config:user.missing}")
+	require.Error(t, err)
+}
+
 func TestContainerTestSuite(t *testing.T) {
 	suite.Run(t, new(containerTestSuite))
 }
+
+type warnRecorder struct {
+	warnings []string
+}
+
+func (r *warnRecorder) Debug(msg string, ctx ...interface{}) {}
+func (r *warnRecorder) Info(msg string, ctx ...interface{})  {}
+func (r *warnRecorder) Warn(msg string, ctx ...interface{})  { r.warnings = append(r.warnings, msg) }
+func (r *warnRecorder) Error(msg string, ctx ...interface{}) {}
+func (r *warnRecorder) Crit(msg string, ctx ...interface{})  {}
+
+func TestContainerValidConfig_DeprecatedKeys(t *testing.T) {
+	recorder := &warnRecorder{}
+	oldLog := logger.Log
+	logger.Log = recorder
+	defer func() { logger.Log = oldLog }()
+
+	sysOS := &sys.OS{}
+
+	// The replacement key doesn't warn.
+	err := containerValidConfig(sysOS, map[string]string{"security.syscalls.deny_default": "false"}, false, false)
+	require.NoError(t, err)
+	require.Len(t, recorder.warnings, 0)
+
+	// The deprecated key is still accepted but warns.
+	err = containerValidConfig(sysOS, map[string]string{"security.syscalls.blacklist_default": "false"}, false, false)
+	require.NoError(t, err)
+	require.Len(t, recorder.warnings, 1)
+
+	// No warning when validating the expanded config.
+	err = containerValidConfig(sysOS, map[string]string{"security.syscalls.blacklist_default": "false"}, false, true)
+	require.NoError(t, err)
+	require.Len(t, recorder.warnings, 1)
+}
+
+func TestContainerConfigValue(t *testing.T) {
+	config := map[string]string{"security.syscalls.blacklist_default": "false"}
+
+	value, ok := shared.ContainerConfigValue(config, "security.syscalls.deny_default")
+	require.True(t, ok)
+	require.Equal(t, "false", value)
+
+	config["security.syscalls.deny_default"] = "true"
+	value, ok = shared.ContainerConfigValue(config, "security.syscalls.deny_default")
+	require.True(t, ok)
+	require.Equal(t, "true", value)
+
+	_, ok = shared.ContainerConfigValue(config, "security.syscalls.deny_compat")
+	require.False(t, ok)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// containerVolatileKey is a volatile key of a container along with what it's for.
+type containerVolatileKey struct {
+	Key         string `json:"key" yaml:"key"`
+	Value       string `json:"value" yaml:"value"`
+	Description string `json:"description" yaml:"description"`
+}
+
+// Container wide volatile keys, by category.
+var containerVolatileGlobalKeys = map[string][2]string{
+	"volatile.apply_template":           {"templates", "Template hook to trigger on next start"},
+	"volatile.base_image":               {"image", "Hash of the image the container was created from"},
+	"volatile.initial_source":           {"image", "Source the container was created from"},
+	"volatile.idmap.base":               {"idmap", "First id of the container's primary idmap range"},
+	"volatile.idmap.current":            {"idmap", "Idmap currently in use by the container"},
+	"volatile.idmap.next":               {"idmap", "Idmap to use on next start"},
+	"volatile.last_state.idmap":         {"idmap", "Idmap the container's filesystem is shifted to"},
+	"volatile.apply_quota":              {"storage", "Disk quota to apply on next start"},
+	"volatile.snapshot.metadata_only":   {"storage", "Whether the snapshot only records the configuration"},
+	"volatile.last_state.exit_code":     {"state", "Exit code of the container's init when it last stopped"},
+	"volatile.last_state.memory_paused": {"state", "Whether the container was frozen by limits.memory.pause_threshold"},
+	"volatile.last_state.power":         {"state", "Container state as of last host shutdown"},
+	"volatile.last_state.ready":         {"state", "Whether the container signalled readiness through /dev/lxd"},
+	"volatile.last_state.self_snapshot": {"storage", "Time at which the container last snapshotted itself through /dev/lxd"},
+	"volatile.last_state.start_timings": {"state", "Duration of each phase of the last start"},
+	"volatile.last_state.trimmed_at":    {"storage", "Time at which the container's filesystem was last trimmed"},
+	"volatile.last_state.stateful_at":   {"state", "Time at which the state of the container was saved"},
+}
+
+// Per-device volatile keys (volatile.<device>.<suffix>), by category. Longer
+// suffixes come first so that they take precedence.
+var containerVolatileDeviceKeys = [][3]string{
+	{".last_state.vf.spoofcheck", "network", "Original spoof check setting of the SR-IOV virtual function"},
+	{".last_state.vf.hwaddr", "network", "Original MAC address of the SR-IOV virtual function"},
+	{".last_state.vf.vlan", "network", "Original VLAN of the SR-IOV virtual function"},
+	{".last_state.vf.id", "network", "SR-IOV virtual function in use"},
+	{".last_state.created", "network", "Whether LXD created the physical device"},
+	{".last_state.hwaddr", "network", "Original MAC address of the physical device"},
+	{".last_state.mtu", "network", "Original MTU of the physical device"},
+	{".last_state.parent", "network", "Parent picked from the list of failover parents"},
+	{".last_state.promisc", "network", "Original promiscuous mode of the physical device"},
+	{".host_preserved", "network", "Whether the host side veth was kept across an in-guest reboot"},
+	{".host_name", "network", "Name of the network device on the host"},
+	{".hwaddr", "network", "MAC address of the network device"},
+	{".name", "network", "Name of the network device in the container"},
+	{".mtu", "network", "MTU of the network device"},
+	{".fuse_mount", "devices", "Host mountpoint of the FUSE filesystem"},
+}
+
+// containerVolatileDescribe returns the category and description of a volatile key.
+func containerVolatileDescribe(key string) (string, string) {
+	known, ok := containerVolatileGlobalKeys[key]
+	if ok {
+		return known[0], known[1]
+	}
+
+	for _, known := range containerVolatileDeviceKeys {
+		if strings.HasSuffix(key, known[0]) {
+			device := strings.TrimSuffix(strings.TrimPrefix(key, "volatile."), known[0])
+			return known[1], known[2] + " (" + device + ")"
+		}
+	}
+
+	return "other", "Unknown volatile key"
+}
+
+// containerVolatileKeys classifies the volatile keys of a config, keys being
+// sorted within each category.
+func containerVolatileKeys(config map[string]string) map[string][]containerVolatileKey {
+	result := map[string][]containerVolatileKey{}
+
+	for key, value := range config {
+		if !strings.HasPrefix(key, "volatile.") {
+			continue
+		}
+
+		category, description := containerVolatileDescribe(key)
+		result[category] = append(result[category], containerVolatileKey{Key: key, Value: value, Description: description})
+	}
+
+	for _, keys := range result {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	}
+
+	return result
+}
+
+// VolatileKeys returns the volatile keys of the container grouped by category
+// (network, idmap, state, storage, ...), each with a short description.
+func (c *containerLXC) VolatileKeys() map[string][]containerVolatileKey {
+	return containerVolatileKeys(c.localConfig)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerVolatileKeys(t *testing.T) {
+	config := map[string]string{
+		"limits.cpu":                     "2",
+		"volatile.idmap.next":            "[]",
+		"volatile.idmap.base":            "0",
+		"volatile.eth0.hwaddr":           "00:16:3e:00:00:01",
+		"volatile.eth0.last_state.vf.id": "3",
+		"volatile.data.fuse_mount":       "/var/lib/lxd/devices/c1/disk.data.mnt",
+		"volatile.unknown":               "x",
+	}
+
+	keys := containerVolatileKeys(config)
+	require.Len(t, keys, 4)
+
+	require.Equal(t, []containerVolatileKey{
+		{"volatile.idmap.base", "0", "First id of the container's primary idmap range"},
+		{"volatile.idmap.next", "[]", "Idmap to use on next start"},
+	}, keys["idmap"])
+
+	require.Equal(t, []containerVolatileKey{
+		{"volatile.eth0.hwaddr", "00:16:3e:00:00:01", "MAC address of the network device (eth0)"},
+		{"volatile.eth0.last_state.vf.id", "3", "SR-IOV virtual function in use (eth0)"},
+	}, keys["network"])
+
+	require.Len(t, keys["devices"], 1)
+	require.Equal(t, "volatile.unknown", keys["other"][0].Key)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -78,6 +80,12 @@ var containerExecCmd = APIEndpoint{
 	Post: APIEndpointAction{Handler: containerExecPost, AccessHandler: AllowProjectPermission("containers", "operate-containers")},
 }
 
+var containerExportCmd = APIEndpoint{
+	Name: "containers/{name}/export",
+
+	Get: APIEndpointAction{Handler: containerExportGet, AccessHandler: AllowProjectPermission("containers", "operate-containers")},
+}
+
 var containerMetadataCmd = APIEndpoint{
 	Name: "containers/{name}/metadata",
 
@@ -122,13 +130,11 @@ func (slice containerAutostartList) Len() int {
 }
 
 func (slice containerAutostartList) Less(i, j int) bool {
-	iOrder := slice[i].ExpandedConfig()["boot.autostart.priority"]
-	jOrder := slice[j].ExpandedConfig()["boot.autostart.priority"]
+	iOrder := slice[i].AutostartPriority()
+	jOrder := slice[j].AutostartPriority()
 
 	if iOrder != jOrder {
-		iOrderInt, _ := strconv.Atoi(iOrder)
-		jOrderInt, _ := strconv.Atoi(jOrder)
-		return iOrderInt > jOrderInt
+		return iOrder > jOrder
 	}
 
 	return slice[i].Name() < slice[j].Name()
@@ -166,6 +172,25 @@ func containersRestart(s *state.State) error {
 				continue
 			}
 
+			// Delayed containers start on their own without holding up the
+			// others. Only automatic starts get delayed, manual ones don't go
+			// through here.
+			startDelay, err := strconv.Atoi(config["boot.start.delay"])
+			if err == nil && startDelay > 0 {
+				logger.Info("Delaying container start", log.Ctx{"container": c.Name(), "delay": startDelay})
+
+				go func(c container, delay time.Duration) {
+					time.Sleep(delay)
+
+					err := c.Start(false)
+					if err != nil {
+						logger.Errorf("Failed to start container '%s': %v", c.Name(), err)
+					}
+				}(c, time.Duration(startDelay)*time.Second)
+
+				continue
+			}
+
 			err = c.Start(false)
 			if err != nil {
 				logger.Errorf("Failed to start container '%s': %v", c.Name(), err)
@@ -232,6 +257,86 @@ func containersOnDisk() (map[string][]string, error) {
 	return containers, nil
 }
 
+// containersRepair detects and cleans up containers left half-created by a
+// crash, returning a description of each repair performed. Only states which
+// can't correspond to a usable container are touched: container storage
+// volumes without a container record are deleted along with their record, and
+// container records without a storage volume record nor any data on disk are
+// deleted.
+func containersRepair(s *state.State) ([]string, error) {
+	var orphanedVolumes []db.ContainerVolumeRef
+	var missingVolumes []db.ContainerVolumeRef
+	err := s.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		orphanedVolumes, err = tx.StorageVolumesNodeOrphaned()
+		if err != nil {
+			return err
+		}
+
+		missingVolumes, err = tx.ContainersNodeWithoutVolume()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	repaired := []string{}
+
+	for _, ref := range orphanedVolumes {
+		ctxMap := log.Ctx{"project": ref.Project, "name": ref.Name, "pool": ref.Pool}
+
+		poolID, err := s.Cluster.StoragePoolGetID(ref.Pool)
+		if err != nil {
+			logger.Error("Failed to repair orphaned container volume", log.Ctx{"project": ref.Project, "name": ref.Name, "pool": ref.Pool, "err": err})
+			continue
+		}
+
+		// Use a placeholder container to drive the storage driver.
+		c := containerLXCInstantiate(s, db.ContainerArgs{Project: ref.Project, Name: ref.Name, Ctype: db.CTypeRegular})
+
+		st, err := storagePoolVolumeContainerCreateInit(s, ref.Project, ref.Pool, ref.Name)
+		if err == nil {
+			err = st.ContainerDelete(c)
+		}
+		if err != nil {
+			logger.Error("Failed to repair orphaned container volume", log.Ctx{"project": ref.Project, "name": ref.Name, "pool": ref.Pool, "err": err})
+			continue
+		}
+
+		err = s.Cluster.StoragePoolVolumeDelete(ref.Project, ref.Name, storagePoolVolumeTypeContainer, poolID)
+		if err != nil {
+			logger.Error("Failed to repair orphaned container volume", log.Ctx{"project": ref.Project, "name": ref.Name, "pool": ref.Pool, "err": err})
+			continue
+		}
+
+		logger.Warn("Removed orphaned container volume", ctxMap)
+		repaired = append(repaired, fmt.Sprintf("Removed storage volume %q on pool %q (project %q) without a container", ref.Name, ref.Pool, ref.Project))
+	}
+
+	for _, ref := range missingVolumes {
+		ctxMap := log.Ctx{"project": ref.Project, "name": ref.Name}
+
+		// Never drop a container which has anything on disk.
+		if shared.PathExists(containerPath(projectPrefix(ref.Project, ref.Name), false)) {
+			logger.Warn("Container has no storage volume record but has data on disk, not repairing", ctxMap)
+			continue
+		}
+
+		err := s.Cluster.ContainerRemove(ref.Project, ref.Name)
+		if err != nil {
+			logger.Error("Failed to repair container without storage volume", log.Ctx{"project": ref.Project, "name": ref.Name, "err": err})
+			continue
+		}
+
+		os.RemoveAll(shared.LogPath(projectPrefix(ref.Project, ref.Name)))
+
+		logger.Warn("Removed container without storage volume", ctxMap)
+		repaired = append(repaired, fmt.Sprintf("Removed container %q (project %q) without a storage volume", ref.Name, ref.Project))
+	}
+
+	return repaired, nil
+}
+
 func containersShutdown(s *state.State) error {
 	var wg sync.WaitGroup
 
@@ -331,6 +436,7 @@ func containerDeleteSnapshots(s *state.State, project, cname string) error {
 		return err
 	}
 
+	snapshots := []container{}
 	for _, sname := range results {
 		sc, err := containerLoadByProjectAndName(s, project, sname)
 		if err != nil {
@@ -341,10 +447,28 @@ func containerDeleteSnapshots(s *state.State, project, cname string) error {
 			continue
 		}
 
+		snapshots = append(snapshots, sc)
+	}
+
+	// Delete all the storage volumes at once if the backend supports it,
+	// the per-snapshot deletion below then only has to clean up.
+	if len(snapshots) > 1 {
+		deleter, ok := snapshots[0].Storage().(storageSnapshotsDeleter)
+		if ok {
+			err := deleter.ContainerSnapshotsDelete(snapshots)
+			if err != nil {
+				logger.Warn(
+					"containerDeleteSnapshots: Failed to bulk delete the snapshots, falling back to one by one",
+					log.Ctx{"container": cname, "err": err})
+			}
+		}
+	}
+
+	for _, sc := range snapshots {
 		if err := sc.Delete(); err != nil {
 			logger.Error(
 				"containerDeleteSnapshots: Failed to delete a snapshotcontainer",
-				log.Ctx{"container": cname, "snapshot": sname, "err": err})
+				log.Ctx{"container": cname, "snapshot": sc.Name(), "err": err})
 		}
 	}
 
@@ -197,6 +197,17 @@ func doContainersGet(d *Daemon, r *http.Request) (interface{}, error) {
 
 			queue := make(chan string, threads)
 
+			// Gather the traffic counters of all containers at once
+			var hostCounters map[string]api.ContainerStateNetworkCounters
+			if recursion > 1 {
+				counters, err := networkGetHostCounters()
+				if err != nil {
+					logger.Warnf("Failed to gather network counters: %v", err)
+				} else {
+					hostCounters = counters
+				}
+			}
+
 			for i := 0; i < threads; i++ {
 				wg.Add(1)
 
@@ -218,7 +229,14 @@ func doContainersGet(d *Daemon, r *http.Request) (interface{}, error) {
 							continue
 						}
 
-						c, _, err := nodeCts[container].RenderFull()
+						var c *api.ContainerFull
+						var err error
+						ct, ok := nodeCts[container].(*containerLXC)
+						if ok && hostCounters != nil {
+							c, _, err = ct.renderFull(hostCounters)
+						} else {
+							c, _, err = nodeCts[container].RenderFull()
+						}
 						if err != nil {
 							resultFullListAppend(container, api.ContainerFull{}, err)
 						} else {
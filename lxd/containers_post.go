@@ -584,7 +584,7 @@ func createFromCopy(d *Daemon, project string, req *api.ContainersPost) Response
 	return OperationResponse(op)
 }
 
-func createFromBackup(d *Daemon, project string, data io.Reader, pool string) Response {
+func createFromBackup(d *Daemon, r *http.Request, project string, data io.Reader, pool string) Response {
 	// Write the data to a temp file
 	f, err := ioutil.TempFile("", "lxd_backup_")
 	if err != nil {
@@ -631,9 +631,13 @@ func createFromBackup(d *Daemon, project string, data io.Reader, pool string) Re
 			return errors.Wrap(err, "Marshal internal import request")
 		}
 
+		// Import on behalf of the requester so that the same
+		// restrictions apply to the backup's config
 		req := &http.Request{
-			Body: ioutil.NopCloser(bytes.NewReader(body)),
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			RemoteAddr: r.RemoteAddr,
 		}
+		req = req.WithContext(r.Context())
 		req.URL = &url.URL{
 			RawQuery: fmt.Sprintf("project=%s", project),
 		}
@@ -675,7 +679,7 @@ func containersPost(d *Daemon, r *http.Request) Response {
 
 	// If we're getting binary content, process separately
 	if r.Header.Get("Content-Type") == "application/octet-stream" {
-		return createFromBackup(d, project, r.Body, r.Header.Get("X-LXD-pool"))
+		return createFromBackup(d, r, project, r.Body, r.Header.Get("X-LXD-pool"))
 	}
 
 	// Parse the request
@@ -684,6 +688,14 @@ func containersPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	if !d.userIsAdmin(r) && containerSecretsChanged(nil, req.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if !d.userIsAdmin(r) && containerFuseChanged(nil, req.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	targetNode := queryParam(r, "target")
 	if targetNode == "" {
 		// If no target node was specified, pick the node with the
@@ -784,6 +796,15 @@ func containersPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(fmt.Errorf("Invalid container name: '%s' is reserved for snapshots", shared.SnapshotDelimiter))
 	}
 
+	// Copies and migrations carry over the devices of existing containers,
+	// which may predate the checks on combinations of device properties
+	if shared.StringInSlice(req.Source.Type, []string{"image", "none"}) {
+		err := containerValidChangedDeviceKeys(nil, req.Devices)
+		if err != nil {
+			return BadRequest(err)
+		}
+	}
+
 	switch req.Source.Type {
 	case "image":
 		return createFromImage(d, project, &req)
@@ -74,6 +74,9 @@ type Daemon struct {
 
 	proxy func(req *http.Request) (*url.URL, error)
 
+	// Cached core.container_operation_timeout
+	containerOperationTimeouts map[string]time.Duration
+
 	externalAuth *externalAuth
 }
 
@@ -318,7 +321,10 @@ func isJSONRequest(r *http.Request) bool {
 
 // State creates a new State instance linked to our internal db and os.
 func (d *Daemon) State() *state.State {
-	return state.NewState(d.db, d.cluster, d.maas, d.os, d.endpoints)
+	s := state.NewState(d.db, d.cluster, d.maas, d.os, d.endpoints)
+	s.ContainerOperationTimeouts = d.containerOperationTimeouts
+
+	return s
 }
 
 // UnixSocket returns the full path to the unix.socket file that this daemon is
@@ -829,6 +835,8 @@ func (d *Daemon) init() error {
 			config.ProxyHTTPS(), config.ProxyHTTP(), config.ProxyIgnoreHosts(),
 		)
 
+		d.containerOperationTimeouts = config.ContainerOperationTimeouts()
+
 		candidAPIURL, candidAPIKey, candidExpiry, candidDomains = config.CandidServer()
 		maasAPIURL, maasAPIKey = config.MAASController()
 		rbacAPIURL, rbacAPIKey, rbacExpiry, rbacAgentURL, rbacAgentUsername, rbacAgentPrivateKey, rbacAgentPublicKey = config.RBACServer()
@@ -866,6 +874,9 @@ func (d *Daemon) init() error {
 		deviceInotifyDirRescan(d.State())
 		go deviceInotifyHandler(d.State())
 
+		// Collect the exit codes of container inits
+		go lxcMonitorListener()
+
 		// Setup seccomp handler
 		if d.os.SeccompListener {
 			seccompServer, err := NewSeccompServer(d, shared.VarPath("seccomp.socket"))
@@ -970,6 +981,9 @@ func (d *Daemon) Ready() error {
 
 		// Remove expired container snapshots (minutely)
 		d.tasks.Add(pruneExpiredContainerSnapshotsTask(d))
+
+		// Trim container filesystems (minutely check of configurable cron expression)
+		d.tasks.Add(autoTrimContainersTask(d))
 	}
 
 	// Start all background tasks
@@ -978,9 +992,21 @@ func (d *Daemon) Ready() error {
 	// Get daemon state struct
 	s := d.State()
 
+	// Clean up containers left half-created by a crash
+	_, err = containersRepair(s)
+	if err != nil {
+		logger.Error("Failed to repair half-created containers", log.Ctx{"err": err})
+	}
+
 	// Restore containers
 	containersRestart(s)
 
+	// Resume forwarding the console of running containers
+	err = consoleForwardResume(s)
+	if err != nil {
+		logger.Error("Failed to resume console forwarding", log.Ctx{"err": err})
+	}
+
 	// Re-balance in case things changed while LXD was down
 	deviceTaskBalance(s)
 
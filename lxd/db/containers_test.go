@@ -409,6 +409,24 @@ func TestContainerNodeList(t *testing.T) {
 	assert.Equal(t, map[string]map[string]string{"root": {"type": "disk", "x": "y"}}, containers[2].Devices)
 }
 
+func TestDevicesConfigKeyUsed(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	addContainer(t, tx, int64(1), "c1")
+	addContainerDevice(t, tx, "c1", "root", "disk", map[string]string{"path": "/"})
+
+	used, err := tx.DevicesConfigKeyUsed("hotplug")
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	addContainerDevice(t, tx, "c1", "dev", "unix-char", map[string]string{"hotplug": "/devices/*"})
+
+	used, err = tx.DevicesConfigKeyUsed("hotplug")
+	require.NoError(t, err)
+	assert.True(t, used)
+}
+
 func addContainer(t *testing.T, tx *db.ClusterTx, nodeID int64, name string) {
 	stmt := `
 INSERT INTO containers(node_id, name, architecture, type, project_id) VALUES (?, ?, 1, ?, 1)
@@ -4,9 +4,18 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/lxc/lxd/lxd/types"
 )
 
+// deviceTypeError is returned for device type codes which don't match any
+// known device type, meaning the device entry is malformed.
+type deviceTypeError int
+
+func (e deviceTypeError) Error() string {
+	return fmt.Sprintf("Invalid device type %d", int(e))
+}
+
 func dbDeviceTypeToString(t int) (string, error) {
 	switch t {
 	case 0:
@@ -28,7 +37,7 @@ func dbDeviceTypeToString(t int) (string, error) {
 	case 8:
 		return "proxy", nil
 	default:
-		return "", fmt.Errorf("Invalid device type %d", t)
+		return "", deviceTypeError(t)
 	}
 }
 
@@ -194,3 +203,20 @@ func (c *Cluster) Devices(project, qName string, isprofile bool) (types.Devices,
 
 	return devices, nil
 }
+
+// DevicesConfigKeyUsed returns whether any container or profile device has
+// the given config key set.
+func (c *ClusterTx) DevicesConfigKeyUsed(key string) (bool, error) {
+	for _, table := range []string{"containers_devices_config", "profiles_devices_config"} {
+		count, err := query.Count(c.tx, table, "key = ?", key)
+		if err != nil {
+			return false, err
+		}
+
+		if count > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
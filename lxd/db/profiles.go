@@ -163,8 +163,16 @@ func (c *Cluster) ProfilesGet(project string, names []string) ([]api.Profile, er
 
 		for i, name := range names {
 			profile, err := tx.ProfileGet(project, name)
+			if err == ErrNoSuchObject {
+				return fmt.Errorf("Profile %q doesn't exist in project %q", name, project)
+			}
 			if err != nil {
-				return errors.Wrapf(err, "Load profile %q", name)
+				_, malformed := errors.Cause(err).(deviceTypeError)
+				if malformed {
+					return errors.Wrapf(err, "Profile %q in project %q is malformed", name, project)
+				}
+
+				return errors.Wrapf(err, "Failed to load profile %q in project %q", name, project)
 			}
 			profiles[i] = *ProfileToAPI(profile)
 		}
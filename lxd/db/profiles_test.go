@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A missing profile is reported by name.
+func TestProfilesGet_Missing(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	profiles, err := cluster.ProfilesGet("default", []string{"default"})
+	require.NoError(t, err)
+	assert.Len(t, profiles, 1)
+
+	_, err = cluster.ProfilesGet("default", []string{"default", "gone"})
+	assert.EqualError(t, err, `Profile "gone" doesn't exist in project "default"`)
+}
+
+// A profile with a device of unknown type is reported as malformed.
+func TestProfilesGet_Malformed(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	_, err := cluster.DB().Exec(`
+INSERT INTO profiles_devices(profile_id, name, type)
+  SELECT id, 'bad', 99 FROM profiles WHERE name = 'default'
+`)
+	require.NoError(t, err)
+
+	_, err = cluster.ProfilesGet("default", []string{"default"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `Profile "default" in project "default" is malformed`)
+	assert.Contains(t, err.Error(), "Invalid device type 99")
+}
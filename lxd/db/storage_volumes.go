@@ -83,6 +83,80 @@ SELECT nodes.id, nodes.address
 	return addresses, nil
 }
 
+// ContainerVolumeRef identifies a container and, when known, the storage pool
+// holding its volume.
+type ContainerVolumeRef struct {
+	Project string
+	Name    string
+	Pool    string
+}
+
+// StorageVolumesNodeOrphaned returns the container storage volumes on the
+// local node which have no matching container record.
+func (c *ClusterTx) StorageVolumesNodeOrphaned() ([]ContainerVolumeRef, error) {
+	volumes := []ContainerVolumeRef{}
+	dest := func(i int) []interface{} {
+		volumes = append(volumes, ContainerVolumeRef{})
+		return []interface{}{&volumes[i].Project, &volumes[i].Name, &volumes[i].Pool}
+	}
+
+	sql := `
+SELECT projects.name, storage_volumes.name, storage_pools.name
+  FROM storage_volumes
+  JOIN projects ON projects.id = storage_volumes.project_id
+  JOIN storage_pools ON storage_pools.id = storage_volumes.storage_pool_id
+ WHERE storage_volumes.node_id=? AND storage_volumes.type=? AND storage_volumes.snapshot=0
+   AND NOT EXISTS (
+     SELECT 1 FROM containers
+      WHERE containers.project_id = storage_volumes.project_id AND containers.name = storage_volumes.name)
+`
+	stmt, err := c.tx.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	err = query.SelectObjects(stmt, dest, c.nodeID, StoragePoolVolumeTypeContainer)
+	if err != nil {
+		return nil, err
+	}
+
+	return volumes, nil
+}
+
+// ContainersNodeWithoutVolume returns the regular containers on the local node
+// which have no storage volume record.
+func (c *ClusterTx) ContainersNodeWithoutVolume() ([]ContainerVolumeRef, error) {
+	containers := []ContainerVolumeRef{}
+	dest := func(i int) []interface{} {
+		containers = append(containers, ContainerVolumeRef{})
+		return []interface{}{&containers[i].Project, &containers[i].Name}
+	}
+
+	sql := `
+SELECT projects.name, containers.name
+  FROM containers
+  JOIN projects ON projects.id = containers.project_id
+ WHERE containers.node_id=? AND containers.type=?
+   AND NOT EXISTS (
+     SELECT 1 FROM storage_volumes
+      WHERE storage_volumes.project_id = containers.project_id AND storage_volumes.name = containers.name
+        AND storage_volumes.node_id = containers.node_id AND storage_volumes.type=?)
+`
+	stmt, err := c.tx.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	err = query.SelectObjects(stmt, dest, c.nodeID, CTypeRegular, StoragePoolVolumeTypeContainer)
+	if err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
 // StorageVolumeNodeGet returns the name of the node a storage volume is on.
 func (c *Cluster) StorageVolumeNodeGet(volumeID int64) (string, error) {
 	name := ""
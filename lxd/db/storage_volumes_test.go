@@ -33,6 +33,35 @@ func TestStorageVolumeNodeAddresses(t *testing.T) {
 	assert.Equal(t, []string{"", "1.2.3.4:666"}, addresses)
 }
 
+// Container volumes and containers without a counterpart are both detected.
+func TestStorageVolumesNodeOrphaned(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	nodeID1 := int64(1) // This is the default local node
+
+	nodeID2, err := tx.NodeAdd("node2", "1.2.3.4:666")
+	require.NoError(t, err)
+
+	poolID := addPool(t, tx, "pool1")
+
+	addContainer(t, tx, nodeID1, "c1")
+	addContainerVolume(t, tx, poolID, nodeID1, "c1")
+
+	addContainer(t, tx, nodeID1, "c2")
+
+	addContainerVolume(t, tx, poolID, nodeID1, "c3")
+	addContainerVolume(t, tx, poolID, nodeID2, "c4")
+
+	volumes, err := tx.StorageVolumesNodeOrphaned()
+	require.NoError(t, err)
+	assert.Equal(t, []db.ContainerVolumeRef{{Project: "default", Name: "c3", Pool: "pool1"}}, volumes)
+
+	containers, err := tx.ContainersNodeWithoutVolume()
+	require.NoError(t, err)
+	assert.Equal(t, []db.ContainerVolumeRef{{Project: "default", Name: "c2"}}, containers)
+}
+
 func addPool(t *testing.T, tx *db.ClusterTx, name string) int64 {
 	stmt := `
 INSERT INTO storage_pools(name, driver) VALUES (?, 'dir')
@@ -53,3 +82,11 @@ INSERT INTO storage_volumes(storage_pool_id, node_id, name, type, project_id) VA
 	_, err := tx.Tx().Exec(stmt, poolID, nodeID, name)
 	require.NoError(t, err)
 }
+
+func addContainerVolume(t *testing.T, tx *db.ClusterTx, poolID, nodeID int64, name string) {
+	stmt := `
+INSERT INTO storage_volumes(storage_pool_id, node_id, name, type, project_id) VALUES (?, ?, ?, ?, 1)
+`
+	_, err := tx.Tx().Exec(stmt, poolID, nodeID, name, db.StoragePoolVolumeTypeContainer)
+	require.NoError(t, err)
+}
@@ -18,11 +18,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/jaypipes/pcidb"
 	"golang.org/x/sys/unix"
 
+	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/lxd/sys"
 	"github.com/lxc/lxd/lxd/util"
@@ -40,6 +42,10 @@ type deviceBlockLimit struct {
 	readIops  int64
 	writeBps  int64
 	writeIops int64
+
+	// cgroup2 only
+	readLatency int64 // Target latency in microseconds
+	weight      int64
 }
 
 type deviceTaskCPU struct {
@@ -66,6 +72,22 @@ type usbDevice struct {
 	ueventLen   int
 }
 
+// hotplugDevice is a host device node matched against the hotplug rules of
+// unix-char and unix-block devices.
+type hotplugDevice struct {
+	action string
+
+	// Path of the device in /sys, without the /sys prefix
+	devpath string
+	block   bool
+
+	path        string
+	major       int
+	minor       int
+	ueventParts []string
+	ueventLen   int
+}
+
 // /dev/nvidia[0-9]+
 type nvidiaGpuCard struct {
 	path  string
@@ -580,7 +602,7 @@ func createUSBDevice(action string, vendor string, product string, major string,
 	}, nil
 }
 
-func deviceNetlinkListener() (chan []string, chan []string, chan usbDevice, error) {
+func deviceNetlinkListener() (chan []string, chan []string, chan usbDevice, chan hotplugDevice, error) {
 	NETLINK_KOBJECT_UEVENT := 15
 	UEVENT_BUFFER_SIZE := 2048
 
@@ -589,7 +611,7 @@ func deviceNetlinkListener() (chan []string, chan []string, chan usbDevice, erro
 		NETLINK_KOBJECT_UEVENT,
 	)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	nl := unix.SockaddrNetlink{
@@ -600,14 +622,15 @@ func deviceNetlinkListener() (chan []string, chan []string, chan usbDevice, erro
 
 	err = unix.Bind(fd, &nl)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	chCPU := make(chan []string, 1)
 	chNetwork := make(chan []string, 0)
 	chUSB := make(chan usbDevice)
+	chHotplug := make(chan hotplugDevice)
 
-	go func(chCPU chan []string, chNetwork chan []string, chUSB chan usbDevice) {
+	go func(chCPU chan []string, chNetwork chan []string, chUSB chan usbDevice, chHotplug chan hotplugDevice) {
 		b := make([]byte, UEVENT_BUFFER_SIZE*2)
 		for {
 			r, err := unix.Read(fd, b)
@@ -726,10 +749,99 @@ func deviceNetlinkListener() (chan []string, chan []string, chan usbDevice, erro
 				chUSB <- usb
 			}
 
+			// Any device node may match a hotplug rule
+			if props["DEVNAME"] != "" && props["MAJOR"] != "" && props["MINOR"] != "" {
+				if props["ACTION"] != "add" && props["ACTION"] != "remove" {
+					continue
+				}
+
+				major, err := strconv.Atoi(props["MAJOR"])
+				if err != nil {
+					continue
+				}
+
+				minor, err := strconv.Atoi(props["MINOR"])
+				if err != nil {
+					continue
+				}
+
+				devname := props["DEVNAME"]
+				if !filepath.IsAbs(devname) {
+					devname = fmt.Sprintf("/dev/%s", devname)
+				}
+
+				chHotplug <- hotplugDevice{
+					action:      props["ACTION"],
+					devpath:     props["DEVPATH"],
+					block:       props["SUBSYSTEM"] == "block",
+					path:        devname,
+					major:       major,
+					minor:       minor,
+					ueventParts: ueventParts[:len(ueventParts)-1],
+					ueventLen:   ueventLen,
+				}
+			}
+		}
+	}(chCPU, chNetwork, chUSB, chHotplug)
+
+	return chCPU, chNetwork, chUSB, chHotplug, nil
+}
+
+// deviceHostCPUs returns the cpus of the host in the given state (present or
+// online).
+func deviceHostCPUs(state string) ([]int, error) {
+	buf, err := ioutil.ReadFile(filepath.Join("/sys/devices/system/cpu", state))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCpuset(strings.TrimSpace(string(buf)))
+}
+
+// deviceCPUSetSplit parses a cpu set (e.g. 0-3,8) and splits it between the
+// cpus which are part of available and the others.
+func deviceCPUSetSplit(set string, available []int) ([]int, []int, error) {
+	cpus, err := parseCpuset(set)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := []int{}
+	missing := []int{}
+	for _, id := range cpus {
+		if shared.IntInSlice(id, available) {
+			found = append(found, id)
+		} else {
+			missing = append(missing, id)
 		}
-	}(chCPU, chNetwork, chUSB)
+	}
 
-	return chCPU, chNetwork, chUSB, nil
+	return found, missing, nil
+}
+
+// deviceValidCPUSet checks that the cpus limits.cpu pins the container to
+// exist on this node. Counts are left to the load-balancer.
+func deviceValidCPUSet(value string) error {
+	_, err := strconv.Atoi(value)
+	if err == nil {
+		return nil
+	}
+
+	present, err := deviceHostCPUs("present")
+	if err != nil {
+		return err
+	}
+
+	_, missing, err := deviceCPUSetSplit(value, present)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("CPU %d doesn't exist on this node", missing[0])
+	}
+
+	return nil
 }
 
 func parseCpuset(cpu string) ([]int, error) {
@@ -845,8 +957,9 @@ func deviceTaskBalance(s *state.State) {
 		return
 	}
 
-	fixedContainers := map[int][]container{}
-	balancedContainers := map[container]int{}
+	fixedContainers := map[int][]string{}
+	balancedContainers := map[string]int{}
+	byName := map[string]container{}
 	for _, c := range containers {
 		conf := c.ExpandedConfig()
 		cpulimit, ok := conf["limits.cpu"]
@@ -858,11 +971,14 @@ func deviceTaskBalance(s *state.State) {
 			continue
 		}
 
+		name := projectPrefix(c.Project(), c.Name())
+		byName[name] = c
+
 		count, err := strconv.Atoi(cpulimit)
 		if err == nil {
 			// Load-balance
 			count = min(count, len(cpus))
-			balancedContainers[c] = count
+			balancedContainers[name] = count
 		} else {
 			// Pinned
 			containerCpus, err := parseCpuset(cpulimit)
@@ -874,18 +990,34 @@ func deviceTaskBalance(s *state.State) {
 					continue
 				}
 
-				_, ok := fixedContainers[nr]
-				if ok {
-					fixedContainers[nr] = append(fixedContainers[nr], c)
-				} else {
-					fixedContainers[nr] = []container{c}
-				}
+				fixedContainers[nr] = append(fixedContainers[nr], name)
 			}
 		}
 	}
 
-	// Balance things
-	pinning := map[container][]string{}
+	pinning := deviceTaskPinning(cpus, fixedContainers, balancedContainers)
+
+	// Set the new pinning
+	for name, set := range pinning {
+		// Confirm the container didn't just stop
+		ctn := byName[name]
+		if !ctn.IsRunning() {
+			continue
+		}
+
+		err := ctn.CGroupSet("cpuset.cpus", strings.Join(set, ","))
+		if err != nil {
+			logger.Error("balance: Unable to set cpuset", log.Ctx{"name": ctn.Name(), "err": err, "value": strings.Join(set, ",")})
+		}
+	}
+}
+
+// deviceTaskPinning computes the cpus each container gets pinned to. Those
+// with a set of cpus in limits.cpu are pinned to it while those with a count
+// get the cpus which are the least used at that point. Containers are keyed by
+// name and processed in order so that the result is stable.
+func deviceTaskPinning(cpus []int, fixedContainers map[int][]string, balancedContainers map[string]int) map[string][]string {
+	pinning := map[string][]string{}
 	usage := map[int]deviceTaskCPU{}
 
 	for _, id := range cpus {
@@ -906,53 +1038,41 @@ func deviceTaskBalance(s *state.State) {
 		}
 		id := c.strId
 		for _, ctn := range ctns {
-			_, ok := pinning[ctn]
-			if ok {
-				pinning[ctn] = append(pinning[ctn], id)
-			} else {
-				pinning[ctn] = []string{id}
-			}
+			pinning[ctn] = append(pinning[ctn], id)
 			*c.count += 1
 		}
 	}
 
 	sortedUsage := make(deviceTaskCPUs, 0)
-	for _, value := range usage {
-		sortedUsage = append(sortedUsage, value)
+	for _, id := range cpus {
+		sortedUsage = append(sortedUsage, usage[id])
 	}
 
-	for ctn, count := range balancedContainers {
-		sort.Sort(sortedUsage)
+	names := []string{}
+	for name := range balancedContainers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, ctn := range names {
+		count := balancedContainers[ctn]
+		sort.Stable(sortedUsage)
 		for _, cpu := range sortedUsage {
 			if count == 0 {
 				break
 			}
 			count -= 1
 
-			id := cpu.strId
-			_, ok := pinning[ctn]
-			if ok {
-				pinning[ctn] = append(pinning[ctn], id)
-			} else {
-				pinning[ctn] = []string{id}
-			}
+			pinning[ctn] = append(pinning[ctn], cpu.strId)
 			*cpu.count += 1
 		}
 	}
 
-	// Set the new pinning
-	for ctn, set := range pinning {
-		// Confirm the container didn't just stop
-		if !ctn.IsRunning() {
-			continue
-		}
-
+	for _, set := range pinning {
 		sort.Strings(set)
-		err := ctn.CGroupSet("cpuset.cpus", strings.Join(set, ","))
-		if err != nil {
-			logger.Error("balance: Unable to set cpuset", log.Ctx{"name": ctn.Name(), "err": err, "value": strings.Join(set, ",")})
-		}
 	}
+
+	return pinning
 }
 
 func deviceNetworkPriority(s *state.State, netif string) {
@@ -1039,8 +1159,96 @@ func deviceUSBEvent(s *state.State, usb usbDevice) {
 	}
 }
 
+// deviceHotplugEvent attaches or detaches a host device node to or from the
+// running containers which have a matching hotplug rule.
+func deviceHotplugEvent(s *state.State, dev hotplugDevice) {
+	// Every device node event ends up here, only load the containers if
+	// some device may actually match
+	used := false
+	err := s.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		used, err = tx.DevicesConfigKeyUsed("hotplug")
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to check for hotplug rules", log.Ctx{"err": err})
+		return
+	}
+
+	if !used {
+		return
+	}
+
+	containers, err := containerLoadNodeAll(s)
+	if err != nil {
+		logger.Error("Problem loading containers list", log.Ctx{"err": err})
+		return
+	}
+
+	for _, containerIf := range containers {
+		c, ok := containerIf.(*containerLXC)
+		if !ok {
+			logger.Errorf("Got device event on non-LXC container?")
+			return
+		}
+
+		if !c.IsRunning() {
+			continue
+		}
+
+		devices := c.ExpandedDevices()
+		for _, name := range devices.DeviceNames() {
+			m := devices[name]
+			if !deviceHotplugMatch(m, dev) {
+				continue
+			}
+
+			if dev.action == "add" {
+				err := c.insertHotplugDevice(name, m, dev)
+				if err != nil {
+					logger.Error("Failed to create hotplugged device", log.Ctx{"err": err, "device": dev.path, "container": c.Name()})
+					continue
+				}
+			} else {
+				err := c.removeHotplugDevice(name, m, dev)
+				if err != nil {
+					logger.Error("Failed to remove hotplugged device", log.Ctx{"err": err, "device": dev.path, "container": c.Name()})
+					continue
+				}
+			}
+
+			ueventArray := make([]string, 4)
+			ueventArray[0] = "forkuevent"
+			ueventArray[1] = "inject"
+			ueventArray[2] = fmt.Sprintf("%d", c.InitPID())
+			ueventArray[3] = fmt.Sprintf("%d", dev.ueventLen)
+			ueventArray = append(ueventArray, dev.ueventParts...)
+			shared.RunCommand(s.OS.ExecPath, ueventArray...)
+		}
+	}
+}
+
+// deviceHotplugMatch returns whether the host device matches the hotplug rule
+// of a unix-char or unix-block device.
+func deviceHotplugMatch(m map[string]string, dev hotplugDevice) bool {
+	if m["hotplug"] == "" {
+		return false
+	}
+
+	if (m["type"] == "unix-block") != dev.block || (m["type"] != "unix-block" && m["type"] != "unix-char") {
+		return false
+	}
+
+	match, err := filepath.Match(m["hotplug"], dev.devpath)
+	if err != nil {
+		return false
+	}
+
+	return match
+}
+
 func deviceEventListener(s *state.State) {
-	chNetlinkCPU, chNetlinkNetwork, chUSB, err := deviceNetlinkListener()
+	chNetlinkCPU, chNetlinkNetwork, chUSB, chHotplug, err := deviceNetlinkListener()
 	if err != nil {
 		logger.Errorf("scheduler: Couldn't setup netlink listener: %v", err)
 		return
@@ -1075,6 +1283,8 @@ func deviceEventListener(s *state.State) {
 			networkAutoAttach(s.Cluster, e[0])
 		case e := <-chUSB:
 			deviceUSBEvent(s, e)
+		case e := <-chHotplug:
+			deviceHotplugEvent(s, e)
 		case e := <-deviceSchedRebalance:
 			if len(e) != 3 {
 				logger.Errorf("Scheduler: received an invalid rebalance event")
@@ -1181,6 +1391,60 @@ func deviceNextVeth() string {
 	return "veth" + hex.EncodeToString(randBytes)
 }
 
+// deviceNextVethFromTemplate returns a host veth device name generated from the
+// network.host_name_template container config key, falling back to a random
+// name if the template can't produce an unused interface name.
+func deviceNextVethFromTemplate(template string, containerName string, deviceName string) string {
+	name := strings.NewReplacer(
+		"{containerName}", containerName,
+		"{deviceName}", deviceName).Replace(template)
+
+	// Only keep characters which are safe in interface names
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+
+		return -1
+	}, name)
+
+	// Truncate to the kernel limit
+	if len(name) > 15 {
+		name = name[:15]
+	}
+
+	if name == "" {
+		return deviceNextVeth()
+	}
+
+	if !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", name)) {
+		return name
+	}
+
+	// The name is taken, retry with a random suffix
+	if len(name) > 11 {
+		name = name[:11]
+	}
+
+	for i := 0; i < 10; i++ {
+		randBytes := make([]byte, 2)
+		rand.Read(randBytes)
+		candidate := name + hex.EncodeToString(randBytes)
+
+		if !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", candidate)) {
+			return candidate
+		}
+	}
+
+	return deviceNextVeth()
+}
+
+// deviceValidMigUUID checks that the given string is an NVIDIA MIG device UUID,
+// either "MIG-<uuid>" or the older "MIG-GPU-<uuid>/<gi>/<ci>" form.
+func deviceValidMigUUID(value string) bool {
+	return regexp.MustCompile(`^MIG-(GPU-[0-9a-fA-F-]{36}/[0-9]+/[0-9]+|[0-9a-fA-F-]{36})$`).MatchString(value)
+}
+
 func deviceRemoveInterface(nic string) error {
 	_, err := shared.RunCommand("ip", "link", "del", "dev", nic)
 	return err
@@ -1253,6 +1517,32 @@ func deviceMountDisk(srcPath string, dstPath string, readonly bool, recursive bo
 	return nil
 }
 
+// deviceMountOverlay mounts an overlayfs of the given directories on dstPath.
+func deviceMountOverlay(lowerDirs []string, upperDir string, workDir string, dstPath string, readonly bool) error {
+	flags := 0
+	if readonly {
+		flags |= unix.MS_RDONLY
+	}
+
+	options := fmt.Sprintf("lowerdir=%s", strings.Join(lowerDirs, ":"))
+	if upperDir != "" {
+		options = fmt.Sprintf("%s,upperdir=%s,workdir=%s", options, upperDir, workDir)
+	}
+
+	err := unix.Mount("overlay", dstPath, "overlay", uintptr(flags), options)
+	if err != nil {
+		return fmt.Errorf("Unable to mount overlay at %s: %s", dstPath, err)
+	}
+
+	flags = unix.MS_REC | unix.MS_SLAVE
+	err = unix.Mount("", dstPath, "", uintptr(flags), "")
+	if err != nil {
+		return fmt.Errorf("unable to make mount %s private: %s", dstPath, err)
+	}
+
+	return nil
+}
+
 func deviceParseCPU(cpuAllowance string, cpuPriority string) (string, string, string, error) {
 	var err error
 
@@ -1315,6 +1605,39 @@ func deviceParseCPU(cpuAllowance string, cpuPriority string) (string, string, st
 	return fmt.Sprintf("%d", cpuShares), cpuCfsQuota, cpuCfsPeriod, nil
 }
 
+// deviceMountinfoSource returns the device (major:minor) and mount source of
+// the innermost mount containing path, as listed in a mountinfo file. Bind
+// mounts are listed with the device backing them rather than their source.
+func deviceMountinfoSource(mountinfo io.Reader, path string) []string {
+	var device []string
+
+	scanner := bufio.NewScanner(mountinfo)
+	match := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		rows := strings.Fields(line)
+		if len(rows) < 10 {
+			continue
+		}
+
+		if len(rows[4]) <= len(match) {
+			continue
+		}
+
+		// Only consider whole path components (/mnt/data isn't in /mnt/dat)
+		if path != rows[4] && !strings.HasPrefix(path, strings.TrimSuffix(rows[4], "/")+"/") {
+			continue
+		}
+
+		match = rows[4]
+
+		// Go backward to avoid problems with optional fields
+		device = []string{rows[2], rows[len(rows)-2]}
+	}
+
+	return device
+}
+
 func deviceGetParentBlocks(path string) ([]string, error) {
 	var devices []string
 	var device []string
@@ -1337,26 +1660,7 @@ func deviceGetParentBlocks(path string) ([]string, error) {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	match := ""
-	for scanner.Scan() {
-		line := scanner.Text()
-		rows := strings.Fields(line)
-
-		if len(rows[4]) <= len(match) {
-			continue
-		}
-
-		if expPath != rows[4] && !strings.HasPrefix(expPath, rows[4]) {
-			continue
-		}
-
-		match = rows[4]
-
-		// Go backward to avoid problems with optional fields
-		device = []string{rows[2], rows[len(rows)-2]}
-	}
-
+	device = deviceMountinfoSource(file, expPath)
 	if device == nil {
 		return nil, fmt.Errorf("Couldn't find a match /proc/self/mountinfo entry")
 	}
@@ -1500,6 +1804,31 @@ func deviceParseDiskLimit(readSpeed string, writeSpeed string) (int64, int64, in
 	return readBps, readIops, writeBps, writeIops, nil
 }
 
+// deviceParseDiskQoS parses the read latency target (e.g. 10ms) and the weight
+// (1-10000) of a disk, returning the latency in microseconds.
+func deviceParseDiskQoS(readLatency string, weight string) (int64, int64, error) {
+	var latency, weightInt int64
+
+	if readLatency != "" {
+		duration, err := time.ParseDuration(readLatency)
+		if err != nil || duration < time.Microsecond {
+			return -1, -1, fmt.Errorf("Invalid read latency target: %s", readLatency)
+		}
+
+		latency = int64(duration / time.Microsecond)
+	}
+
+	if weight != "" {
+		var err error
+		weightInt, err = strconv.ParseInt(weight, 10, 64)
+		if err != nil || weightInt < 1 || weightInt > 10000 {
+			return -1, -1, fmt.Errorf("Invalid disk weight (expected 1-10000): %s", weight)
+		}
+	}
+
+	return latency, weightInt, nil
+}
+
 const USB_PATH = "/sys/bus/usb/devices"
 
 func loadRawValues(p string) (map[string]string, error) {
@@ -1576,6 +1905,59 @@ func deviceLoadUsb() ([]usbDevice, error) {
 	return result, nil
 }
 
+// deviceLoadHotplug returns the device nodes currently present on the host
+// whose path in /sys matches the given hotplug pattern.
+func deviceLoadHotplug(pattern string) ([]hotplugDevice, error) {
+	result := []hotplugDevice{}
+
+	matches, err := filepath.Glob(filepath.Join("/sys", pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, match := range matches {
+		content, err := ioutil.ReadFile(filepath.Join(match, "uevent"))
+		if err != nil {
+			continue
+		}
+
+		props := map[string]string{}
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.SplitN(line, "=", 2)
+			if len(fields) == 2 {
+				props[fields[0]] = fields[1]
+			}
+		}
+
+		if props["DEVNAME"] == "" || props["MAJOR"] == "" || props["MINOR"] == "" {
+			continue
+		}
+
+		major, err := strconv.Atoi(props["MAJOR"])
+		if err != nil {
+			return nil, err
+		}
+
+		minor, err := strconv.Atoi(props["MINOR"])
+		if err != nil {
+			return nil, err
+		}
+
+		subsystem, _ := os.Readlink(filepath.Join(match, "subsystem"))
+
+		result = append(result, hotplugDevice{
+			action:  "add",
+			devpath: strings.TrimPrefix(match, "/sys"),
+			block:   filepath.Base(subsystem) == "block",
+			path:    filepath.Join("/dev", props["DEVNAME"]),
+			major:   major,
+			minor:   minor,
+		})
+	}
+
+	return result, nil
+}
+
 const SCIB string = "/sys/class/infiniband"
 const SCNET string = "/sys/class/net"
 
@@ -2280,3 +2662,40 @@ func deviceInotifyHandler(s *state.State) {
 		}
 	}
 }
+
+// diskSourceTimeout returns how long to wait for the source of a disk device
+// to respond, from its source.timeout property (10s by default, 0 to wait
+// forever).
+func diskSourceTimeout(m map[string]string) time.Duration {
+	if m["source.timeout"] == "" {
+		return 10 * time.Second
+	}
+
+	timeout, err := strconv.ParseUint(m["source.timeout"], 10, 32)
+	if err != nil {
+		return 10 * time.Second
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// pathExistsTimeout is like shared.PathExists but gives up after the timeout,
+// as stat can hang indefinitely on an unreachable network filesystem. A zero
+// timeout waits forever.
+func pathExistsTimeout(path string, timeout time.Duration) (bool, error) {
+	if timeout == 0 {
+		return shared.PathExists(path), nil
+	}
+
+	result := make(chan bool, 1)
+	go func() {
+		result <- shared.PathExists(path)
+	}()
+
+	select {
+	case exists := <-result:
+		return exists, nil
+	case <-time.After(timeout):
+		return false, fmt.Errorf("Timed out after %s", timeout)
+	}
+}
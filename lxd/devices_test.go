@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceTaskPinning(t *testing.T) {
+	cpus := []int{0, 1, 2, 3}
+	fixed := map[int][]string{
+		0: {"pinned"},
+		1: {"pinned"},
+	}
+	balanced := map[string]int{
+		"c1": 2,
+		"c2": 1,
+		"c3": 4,
+	}
+
+	pinning := deviceTaskPinning(cpus, fixed, balanced)
+	require.Equal(t, []string{"0", "1"}, pinning["pinned"])
+	require.Equal(t, []string{"2", "3"}, pinning["c1"])
+	require.Equal(t, []string{"2"}, pinning["c2"])
+	require.Equal(t, []string{"0", "1", "2", "3"}, pinning["c3"])
+
+	// The result doesn't depend on map ordering
+	for i := 0; i < 10; i++ {
+		require.Equal(t, pinning, deviceTaskPinning(cpus, fixed, balanced))
+	}
+}
+
+func TestDeviceMountinfoSource(t *testing.T) {
+	mountinfo := `24 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 24 8:16 / /srv rw,relatime shared:2 - xfs /dev/sdb rw
+31 30 8:32 /data /srv/data rw,relatime shared:3 - ext4 /dev/sdc1 rw
+32 24 8:48 / /srv/dat rw,relatime shared:4 - ext4 /dev/sdd rw
+`
+
+	// Nested bind mount backed by another device than its parent
+	require.Equal(t, []string{"8:32", "/dev/sdc1"}, deviceMountinfoSource(strings.NewReader(mountinfo), "/srv/data/www"))
+	require.Equal(t, []string{"8:32", "/dev/sdc1"}, deviceMountinfoSource(strings.NewReader(mountinfo), "/srv/data"))
+
+	// Sibling sharing a prefix
+	require.Equal(t, []string{"8:48", "/dev/sdd"}, deviceMountinfoSource(strings.NewReader(mountinfo), "/srv/dat/x"))
+	require.Equal(t, []string{"8:16", "/dev/sdb"}, deviceMountinfoSource(strings.NewReader(mountinfo), "/srv/database"))
+	require.Equal(t, []string{"8:1", "/dev/sda1"}, deviceMountinfoSource(strings.NewReader(mountinfo), "/home"))
+}
+
+func TestDeviceParseDiskQoS(t *testing.T) {
+	latency, weight, err := deviceParseDiskQoS("10ms", "500")
+	require.NoError(t, err)
+	require.Equal(t, int64(10000), latency)
+	require.Equal(t, int64(500), weight)
+
+	_, _, err = deviceParseDiskQoS("10", "")
+	require.EqualError(t, err, "Invalid read latency target: 10")
+
+	_, _, err = deviceParseDiskQoS("", "0")
+	require.EqualError(t, err, "Invalid disk weight (expected 1-10000): 0")
+}
+
+func TestDeviceCPUSetSplit(t *testing.T) {
+	found, missing, err := deviceCPUSetSplit("0-3,8", []int{0, 1, 2, 3, 4, 5, 6, 7})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3}, found)
+	require.Equal(t, []int{8}, missing)
+
+	_, _, err = deviceCPUSetSplit("0-a", []int{0})
+	require.EqualError(t, err, "Invalid cpuset value: 0-a")
+}
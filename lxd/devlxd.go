@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -19,6 +20,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 
+	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/logger"
@@ -102,6 +104,98 @@ var devlxdMetadataGet = devLxdHandler{"/1.0/meta-data", func(d *Daemon, c contai
 	return okResponse(fmt.Sprintf("#cloud-config\ninstance-id: %s\nlocal-hostname: %s\n%s", c.Name(), c.Name(), value), "raw")
 }}
 
+var devlxdReadyHandler = devLxdHandler{"/1.0/ready", func(d *Daemon, c container, w http.ResponseWriter, r *http.Request) *devLxdResponse {
+	if r.Method == "GET" {
+		return okResponse(shared.Jmap{"ready": c.IsReady()}, "json")
+	}
+
+	if r.Method != "PUT" {
+		return &devLxdResponse{"method not allowed", http.StatusMethodNotAllowed, "raw"}
+	}
+
+	req := struct {
+		Ready bool `json:"ready"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return &devLxdResponse{"bad request", http.StatusBadRequest, "raw"}
+	}
+
+	err = c.SetReady(req.Ready)
+	if err != nil {
+		return &devLxdResponse{"internal server error", http.StatusInternalServerError, "raw"}
+	}
+
+	return okResponse("", "raw")
+}}
+
+var devlxdSnapshotsPost = devLxdHandler{"/1.0/snapshots", func(d *Daemon, c container, w http.ResponseWriter, r *http.Request) *devLxdResponse {
+	if r.Method != "POST" {
+		return &devLxdResponse{"method not allowed", http.StatusMethodNotAllowed, "raw"}
+	}
+
+	if !shared.IsTrue(c.ExpandedConfig()["security.devlxd.snapshots"]) {
+		return &devLxdResponse{"not authorized", http.StatusForbidden, "raw"}
+	}
+
+	req := struct {
+		Name string `json:"name"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return &devLxdResponse{"bad request", http.StatusBadRequest, "raw"}
+	}
+
+	if strings.Contains(req.Name, "/") {
+		return &devLxdResponse{"snapshot names may not contain slashes", http.StatusBadRequest, "raw"}
+	}
+
+	containerSelfSnapshotLock.Lock()
+	defer containerSelfSnapshotLock.Unlock()
+
+	wait := containerSelfSnapshotWait(c.LocalConfig()["volatile.last_state.self_snapshot"], c.ExpandedConfig()["security.devlxd.snapshots.interval"], time.Now())
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(wait.Seconds()+1)))
+		return &devLxdResponse{fmt.Sprintf("too many requests, retry in %s", wait.Round(time.Second)), http.StatusTooManyRequests, "raw"}
+	}
+
+	if req.Name == "" {
+		req.Name, err = containerDetermineNextSnapshotName(d, c, "snap%d")
+		if err != nil {
+			return &devLxdResponse{"internal server error", http.StatusInternalServerError, "raw"}
+		}
+	}
+
+	// Snapshot names are only unique within the container's project
+	exists := false
+	err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.ContainerID(c.Project(), c.Name()+shared.SnapshotDelimiter+req.Name)
+		if err == db.ErrNoSuchObject {
+			return nil
+		}
+
+		exists = err == nil
+		return err
+	})
+	if err != nil {
+		return &devLxdResponse{"internal server error", http.StatusInternalServerError, "raw"}
+	}
+
+	if exists {
+		return &devLxdResponse{"snapshot already exists", http.StatusConflict, "raw"}
+	}
+
+	err = c.SelfSnapshot(req.Name)
+	if err != nil {
+		logger.Errorf("Failed to create self-snapshot %s of %s: %v", req.Name, c.Name(), err)
+		return &devLxdResponse{"internal server error", http.StatusInternalServerError, "raw"}
+	}
+
+	return okResponse(shared.Jmap{"name": req.Name}, "json")
+}}
+
 var devlxdEventsLock sync.Mutex
 var devlxdEventListeners map[int]map[string]*eventListener = make(map[int]map[string]*eventListener)
 
@@ -124,6 +218,9 @@ var devlxdEventsGet = devLxdHandler{"/1.0/events", func(d *Daemon, c container,
 		messageTypes: strings.Split(typeStr, ","),
 	}
 
+	// Hold back other events until the current devices were replayed
+	listener.lock.Lock()
+
 	devlxdEventsLock.Lock()
 	cid := c.Id()
 	_, ok := devlxdEventListeners[cid]
@@ -135,6 +232,34 @@ var devlxdEventsGet = devLxdHandler{"/1.0/events", func(d *Daemon, c container,
 
 	logger.Debugf("New container event listener for '%s': %s", c.Name(), listener.id)
 
+	// Devices are added before anything in the container can listen, so
+	// announce the current ones to every new listener instead
+	if shared.StringInSlice("device", listener.messageTypes) {
+		devices := c.ExpandedDevices()
+		for _, name := range devices.DeviceNames() {
+			body, err := json.Marshal(shared.Jmap{
+				"type":      "device",
+				"timestamp": time.Now(),
+				"metadata": map[string]interface{}{
+					"action": "added",
+					"name":   name,
+					"config": devices[name],
+				},
+			})
+			if err != nil {
+				continue
+			}
+
+			err = conn.WriteMessage(websocket.TextMessage, body)
+			if err != nil {
+				logger.Debugf("Failed to replay devices to container event listener for '%s': %s", c.Name(), listener.id)
+				break
+			}
+		}
+	}
+
+	listener.lock.Unlock()
+
 	<-listener.active
 
 	return &devLxdResponse{"websocket", http.StatusOK, "websocket"}
@@ -211,6 +336,8 @@ var handlers = []devLxdHandler{
 	devlxdMetadataGet,
 	devlxdEventsGet,
 	devlxdImageExport,
+	devlxdReadyHandler,
+	devlxdSnapshotsPost,
 }
 
 func hoistReq(f func(*Daemon, container, http.ResponseWriter, *http.Request) *devLxdResponse, d *Daemon) func(http.ResponseWriter, *http.Request) {
@@ -156,6 +156,10 @@ func main() {
 	netcatCmd := cmdNetcat{global: &globalCmd}
 	app.AddCommand(netcatCmd.Command())
 
+	// repair sub-command
+	repairCmd := cmdRepair{global: &globalCmd}
+	app.AddCommand(repairCmd.Command())
+
 	// shutdown sub-command
 	shutdownCmd := cmdShutdown{global: &globalCmd}
 	app.AddCommand(shutdownCmd.Command())
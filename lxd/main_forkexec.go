@@ -19,13 +19,16 @@ type cmdForkexec struct {
 func (c *cmdForkexec) Command() *cobra.Command {
 	// Main subcommand
 	cmd := &cobra.Command{}
-	cmd.Use = "forkexec <container name> <containers path> <config> <cwd> <uid> <gid> -- env [key=value...] -- cmd <args...>"
+	cmd.Use = "forkexec <container name> <containers path> <config> <cwd> <uid> <gid> -- env [key=value...] [-- config [key=value...]] -- cmd <args...>"
 	cmd.Short = "Execute a task inside the container"
 	cmd.Long = `Description:
   Execute a task inside the container
 
   This internal command is used to spawn a task inside the container and
   allow LXD to interact with it.
+
+  The optional config section overrides container config keys for the
+  spawned task only, which is used to confine it further.
 `
 	cmd.RunE = c.Run
 	cmd.Hidden = true
@@ -111,6 +114,16 @@ func (c *cmdForkexec) Run(cmd *cobra.Command, args []string) error {
 				opts.Cwd = fields[1]
 			}
 			env = append(env, arg)
+		} else if section == "config" {
+			fields := strings.SplitN(arg, "=", 2)
+			if len(fields) != 2 {
+				return fmt.Errorf("Invalid config item: %s", arg)
+			}
+
+			err = d.SetConfigItem(fields[0], fields[1])
+			if err != nil {
+				return fmt.Errorf("Failed to set config item %q: %q", fields[0], err)
+			}
 		} else if section == "cmd" {
 			command = append(command, arg)
 		} else {
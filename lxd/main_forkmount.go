@@ -163,6 +163,57 @@ void do_lxd_forkmount(pid_t pid) {
 	_exit(0);
 }
 
+static int propagation_flags(const char *mode, unsigned long *flags)
+{
+	const char *name = mode;
+
+	*flags = 0;
+	if (mode[0] == 'r') {
+		*flags |= MS_REC;
+		name++;
+	}
+
+	if (strcmp(name, "private") == 0)
+		*flags |= MS_PRIVATE;
+	else if (strcmp(name, "shared") == 0)
+		*flags |= MS_SHARED;
+	else if (strcmp(name, "slave") == 0)
+		*flags |= MS_SLAVE;
+	else if (strcmp(name, "unbindable") == 0)
+		*flags |= MS_UNBINDABLE;
+	else
+		return -EINVAL;
+
+	return 0;
+}
+
+void do_lxd_forkpropagate(pid_t pid) {
+	char *path, *mode;
+	unsigned long flags;
+
+	attach_userns(pid);
+
+	if (dosetns(pid, "mnt") < 0) {
+		fprintf(stderr, "Failed setns to container mount namespace: %s\n", strerror(errno));
+		_exit(1);
+	}
+
+	path = advance_arg(true);
+	mode = advance_arg(true);
+
+	if (propagation_flags(mode, &flags) < 0) {
+		fprintf(stderr, "Invalid propagation mode: %s\n", mode);
+		_exit(1);
+	}
+
+	if (mount(NULL, path, NULL, flags, NULL) < 0) {
+		fprintf(stderr, "Failed setting propagation of %s to %s: %s\n", path, mode, strerror(errno));
+		_exit(1);
+	}
+
+	_exit(0);
+}
+
 void do_lxd_forkumount(pid_t pid) {
 	int ret;
 	char *path = NULL;
@@ -331,6 +382,15 @@ void forkmount() {
 		do_lxd_forkumount(pid);
 	} else if (strcmp(command, "lxc-umount") == 0) {
 		do_lxc_forkumount();
+	} else if (strcmp(command, "lxd-propagate") == 0) {
+		// Get the pid
+		cur = advance_arg(false);
+		if (cur == NULL || (strcmp(cur, "--help") == 0 || strcmp(cur, "--version") == 0 || strcmp(cur, "-h") == 0)) {
+			return;
+		}
+		pid = atoi(cur);
+
+		do_lxd_forkpropagate(pid);
 	}
 }
 */
@@ -370,6 +430,13 @@ func (c *cmdForkmount) Command() *cobra.Command {
 	cmdUmount.RunE = c.Run
 	cmd.AddCommand(cmdUmount)
 
+	// propagate
+	cmdPropagate := &cobra.Command{}
+	cmdPropagate.Use = "propagate <PID> <path> <mode>"
+	cmdPropagate.Args = cobra.ExactArgs(3)
+	cmdPropagate.RunE = c.Run
+	cmd.AddCommand(cmdPropagate)
+
 	return cmd
 }
 
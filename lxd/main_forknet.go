@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -71,6 +74,11 @@ void forknet() {
 		forkdonetinfo(pid);
 	}
 
+	if (strcmp(command, "sysctl") == 0) {
+		pid = atoi(cur);
+		forkdonetinfo(pid);
+	}
+
 	if (strcmp(command, "detach") == 0)
 		forkdonetdetach(cur);
 }
@@ -81,6 +89,8 @@ import "github.com/lxc/lxd/shared"
 
 type cmdForknet struct {
 	global *cmdGlobal
+
+	flagNoCounters bool
 }
 
 func (c *cmdForknet) Command() *cobra.Command {
@@ -101,8 +111,16 @@ func (c *cmdForknet) Command() *cobra.Command {
 	cmdInfo.Use = "info <PID>"
 	cmdInfo.Args = cobra.ExactArgs(1)
 	cmdInfo.RunE = c.RunInfo
+	cmdInfo.Flags().BoolVar(&c.flagNoCounters, "no-counters", false, "Don't gather the traffic counters")
 	cmd.AddCommand(cmdInfo)
 
+	// sysctl
+	cmdSysctl := &cobra.Command{}
+	cmdSysctl.Use = "sysctl <PID> <key> <value>"
+	cmdSysctl.Args = cobra.ExactArgs(3)
+	cmdSysctl.RunE = c.RunSysctl
+	cmd.AddCommand(cmdSysctl)
+
 	// detach
 	cmdDetach := &cobra.Command{}
 	cmdDetach.Use = "detach <netns file> <LXD PID> <ifname> <hostname>"
@@ -114,7 +132,7 @@ func (c *cmdForknet) Command() *cobra.Command {
 }
 
 func (c *cmdForknet) RunInfo(cmd *cobra.Command, args []string) error {
-	networks, err := netutils.NetnsGetifaddrs(-1)
+	networks, err := netutils.NetnsGetifaddrs(-1, c.flagNoCounters)
 	if err != nil {
 		return err
 	}
@@ -129,6 +147,19 @@ func (c *cmdForknet) RunInfo(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func (c *cmdForknet) RunSysctl(cmd *cobra.Command, args []string) error {
+	key := args[1]
+	value := args[2]
+
+	// Only allow network sysctls as those are the only ones tied to the network namespace.
+	if !strings.HasPrefix(key, "net.") || strings.Contains(key, "/") {
+		return fmt.Errorf("Invalid network sysctl: %s", key)
+	}
+
+	path := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+	return ioutil.WriteFile(path, []byte(value), 0)
+}
+
 func (c *cmdForknet) RunDetach(cmd *cobra.Command, args []string) error {
 	lxdPID := args[1]
 	ifName := args[2]
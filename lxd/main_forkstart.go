@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
@@ -63,6 +65,27 @@ func (c *cmdForkstart) Run(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error opening startup config file: %q", err)
 	}
 
+	// LXD passes the container's secrets as NUL separated NAME=value
+	// entries on stdin rather than through the saved config
+	stat, err := os.Stdin.Stat()
+	if err == nil && stat.Mode()&os.ModeNamedPipe != 0 {
+		secrets, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Error reading secrets: %q", err)
+		}
+
+		for _, entry := range strings.Split(string(secrets), "\x00") {
+			if entry == "" {
+				continue
+			}
+
+			err = d.SetConfigItem("lxc.environment", entry)
+			if err != nil {
+				return fmt.Errorf("Error setting secret environment: %q", err)
+			}
+		}
+	}
+
 	/* due to https://github.com/golang/go/issues/13155 and the
 	 * CollectOutput call we make for the forkstart process, we need to
 	 * close our stdin/stdout/stderr here. Collecting some of the logs is
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lxc/lxd/client"
+)
+
+type cmdRepair struct {
+	global *cmdGlobal
+}
+
+func (c *cmdRepair) Command() *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Use = "repair"
+	cmd.Short = "Clean up half-created containers"
+	cmd.Long = `Description:
+  Clean up half-created containers
+
+  A crash during container creation can leave behind a storage volume
+  without a matching container, or a container without any storage.
+  This command detects such leftovers on the local node and removes them.
+
+  The same check is run automatically when LXD starts.
+`
+	cmd.RunE = c.Run
+
+	return cmd
+}
+
+func (c *cmdRepair) Run(cmd *cobra.Command, args []string) error {
+	// Sanity checks
+	if len(args) > 0 {
+		cmd.Help()
+		return fmt.Errorf("Too many arguments")
+	}
+
+	// Only root should run this
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("This must be run as root")
+	}
+
+	d, err := lxd.ConnectLXDUnix("", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, _, err := d.RawQuery("POST", "/internal/containers/repair", nil, "")
+	if err != nil {
+		return err
+	}
+
+	repaired := []string{}
+	err = json.Unmarshal(resp.Metadata, &repaired)
+	if err != nil {
+		return err
+	}
+
+	if len(repaired) == 0 {
+		fmt.Println("Nothing to repair")
+		return nil
+	}
+
+	for _, entry := range repaired {
+		fmt.Println(entry)
+	}
+
+	return nil
+}
@@ -22,13 +22,18 @@ import (
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/logger"
+	"github.com/lxc/lxd/shared/units"
 )
 
 func NewMigrationSource(c container, stateful bool, containerOnly bool) (*migrationSourceWs, error) {
 	ret := migrationSourceWs{migrationFields{container: c}, make(chan bool, 1)}
 	ret.containerOnly = containerOnly
 
-	var err error
+	err := containerCheckMetadataOnlySnapshots(c, containerOnly)
+	if err != nil {
+		return nil, err
+	}
+
 	ret.controlSecret, err = shared.RandomCryptoString()
 	if err != nil {
 		return nil, err
@@ -214,6 +219,21 @@ func readCriuStatsDump(path string) (uint64, uint64, error) {
 	return written, skipped, nil
 }
 
+// migrationBwlimit converts a migration.bwlimit value into the KiB/s value
+// expected by rsync's --bwlimit.
+func migrationBwlimit(value string) (string, error) {
+	limit, err := units.ParseByteSizeString(value)
+	if err != nil {
+		return "", fmt.Errorf("Invalid migration.bwlimit: %v", err)
+	}
+
+	if limit < 1024 {
+		return "", fmt.Errorf("Invalid migration.bwlimit: must be at least 1KiB")
+	}
+
+	return fmt.Sprintf("%d", limit/1024), nil
+}
+
 type preDumpLoopArgs struct {
 	checkpointDir string
 	bwlimit       string
@@ -237,6 +257,7 @@ func (s *migrationSourceWs) preDumpLoop(args *preDumpLoopArgs) (bool, error) {
 		dumpDir:      args.dumpDir,
 		stateDir:     args.checkpointDir,
 		function:     "migration",
+		bwlimit:      args.bwlimit,
 	}
 
 	logger.Debugf("Doing another pre-dump in %s", args.preDumpDir)
@@ -251,7 +272,7 @@ func (s *migrationSourceWs) preDumpLoop(args *preDumpLoopArgs) (bool, error) {
 	// Send the pre-dump.
 	ctName, _, _ := containerGetParentAndSnapshotName(s.container.Name())
 	state := s.container.DaemonState()
-	err = RsyncSend(ctName, shared.AddSlash(args.checkpointDir), s.criuConn, nil, args.rsyncFeatures, args.bwlimit, state.OS.ExecPath)
+	err = RsyncSend(ctName, shared.AddSlash(args.checkpointDir), s.criuConn, nil, args.rsyncFeatures, criuMigrationArgs.bwlimit, state.OS.ExecPath)
 	if err != nil {
 		return final, err
 	}
@@ -456,6 +477,15 @@ func (s *migrationSourceWs) Do(migrateOp *operation) error {
 		}
 	}
 
+	// Check if the container has its own rate limit set for migration.
+	if s.container.ExpandedConfig()["migration.bwlimit"] != "" {
+		bwlimit, err = migrationBwlimit(s.container.ExpandedConfig()["migration.bwlimit"])
+		if err != nil {
+			s.sendControl(err)
+			return err
+		}
+	}
+
 	// Check if the other side knows about pre-dumping and
 	// the associated rsync protocol
 	use_pre_dumps = header.GetPredump()
@@ -498,6 +528,19 @@ func (s *migrationSourceWs) Do(migrateOp *operation) error {
 			return abort(err)
 		}
 
+		// The final CRIU dump, its state transfer is rate limited like
+		// the filesystem's
+		criuMigrationArgs := CriuMigrationArgs{
+			cmd:          lxc.MIGRATE_DUMP,
+			stop:         true,
+			actionScript: false,
+			preDumpDir:   "",
+			dumpDir:      "final",
+			stateDir:     checkpointDir,
+			function:     "migration",
+			bwlimit:      bwlimit,
+		}
+
 		if util.RuntimeLiblxcVersionAtLeast(2, 0, 4) {
 			/* What happens below is slightly convoluted. Due to various
 			 * complications with networking, there's no easy way for criu
@@ -606,17 +649,10 @@ func (s *migrationSourceWs) Do(migrateOp *operation) error {
 				return abort(err)
 			}
 
-			go func() {
-				criuMigrationArgs := CriuMigrationArgs{
-					cmd:          lxc.MIGRATE_DUMP,
-					stop:         true,
-					actionScript: true,
-					preDumpDir:   preDumpDir,
-					dumpDir:      "final",
-					stateDir:     checkpointDir,
-					function:     "migration",
-				}
+			criuMigrationArgs.actionScript = true
+			criuMigrationArgs.preDumpDir = preDumpDir
 
+			go func() {
 				// Do the final CRIU dump. This is needs no special
 				// handling if pre-dumps are used or not
 				dumpSuccess <- s.container.Migrate(&criuMigrationArgs)
@@ -634,16 +670,6 @@ func (s *migrationSourceWs) Do(migrateOp *operation) error {
 		} else {
 			logger.Debugf("The version of liblxc is older than 2.0.4 and the live migration will probably fail")
 			defer os.RemoveAll(checkpointDir)
-			criuMigrationArgs := CriuMigrationArgs{
-				cmd:          lxc.MIGRATE_DUMP,
-				stateDir:     checkpointDir,
-				function:     "migration",
-				stop:         true,
-				actionScript: false,
-				dumpDir:      "final",
-				preDumpDir:   "",
-			}
-
 			err = s.container.Migrate(&criuMigrationArgs)
 			if err != nil {
 				return abort(err)
@@ -659,7 +685,7 @@ func (s *migrationSourceWs) Do(migrateOp *operation) error {
 		 */
 		ctName, _, _ := containerGetParentAndSnapshotName(s.container.Name())
 		state := s.container.DaemonState()
-		err = RsyncSend(ctName, shared.AddSlash(checkpointDir), s.criuConn, nil, rsyncFeatures, bwlimit, state.OS.ExecPath)
+		err = RsyncSend(ctName, shared.AddSlash(checkpointDir), s.criuConn, nil, rsyncFeatures, criuMigrationArgs.bwlimit, state.OS.ExecPath)
 		if err != nil {
 			return abort(err)
 		}
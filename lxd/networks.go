@@ -1839,6 +1839,9 @@ func (n *network) Start() error {
 			} else {
 				dnsmasqCmd = append(dnsmasqCmd, []string{"-s", dnsDomain, "-S", fmt.Sprintf("/%s/", dnsDomain)}...)
 			}
+
+			// Records registered by the containers (dns.register)
+			dnsmasqCmd = append(dnsmasqCmd, fmt.Sprintf("--hostsdir=%s", shared.VarPath("networks", n.name, "dnsmasq.records")))
 		}
 
 		// Create a config file to contain additional config (and to prevent dnsmasq from reading /etc/dnsmasq.conf)
@@ -1867,6 +1870,14 @@ func (n *network) Start() error {
 			}
 		}
 
+		// Create DNS records directory
+		if !shared.PathExists(shared.VarPath("networks", n.name, "dnsmasq.records")) {
+			err = os.MkdirAll(shared.VarPath("networks", n.name, "dnsmasq.records"), 0755)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Check for dnsmasq
 		_, err := exec.LookPath("dnsmasq")
 		if err != nil {
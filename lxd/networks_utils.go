@@ -19,11 +19,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/mdlayher/eui64"
+	"github.com/pkg/errors"
 
 	"golang.org/x/sys/unix"
 
@@ -68,6 +71,30 @@ func networkAttachInterface(netName string, devName string) error {
 	return nil
 }
 
+// networkAttachVrf enslaves the given interface to a VRF device, checking
+// that it exists and really is a VRF.
+func networkAttachVrf(vrfName string, devName string) error {
+	if !shared.PathExists(fmt.Sprintf("/sys/class/net/%s", vrfName)) {
+		return fmt.Errorf("VRF device %q doesn't exist", vrfName)
+	}
+
+	out, err := shared.RunCommand("ip", "-d", "-o", "link", "show", "dev", vrfName)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(out, " vrf table ") {
+		return fmt.Errorf("Device %q isn't a VRF", vrfName)
+	}
+
+	_, err = shared.RunCommand("ip", "link", "set", "dev", devName, "master", vrfName)
+	if err != nil {
+		return fmt.Errorf("Failed to add interface %q to VRF %q: %s", devName, vrfName, err)
+	}
+
+	return nil
+}
+
 func networkDetachInterface(netName string, devName string) error {
 	if shared.PathExists(fmt.Sprintf("/sys/class/net/%s/bridge", netName)) {
 		_, err := shared.RunCommand("ip", "link", "set", "dev", devName, "nomaster")
@@ -1248,8 +1275,99 @@ func networkDHCPFindFreeIPv4(usedIPs map[[4]byte]dhcpAllocation, netConfig map[s
 	return nil, fmt.Errorf("No available IP could not be found")
 }
 
-// networkUpdateStaticContainer writes a single dhcp-host line for a container/network combination.
-func networkUpdateStaticContainer(network string, project string, cName string, netConfig map[string]string, hwaddr string, ipv4Address string, ipv6Address string) error {
+// networkDNSRecords renders the hosts file entries registering a container's
+// name (and the nic's dns.aliases) in the network's DNS for its static addresses.
+// Names live under the network's domain, below a sub-domain named after the
+// project for containers outside of the default one, and aliases may neither
+// leave that domain nor take the name of another container of the project.
+func networkDNSRecords(project string, cName string, netConfig map[string]string, m map[string]string, containerNames []string) (string, error) {
+	if !shared.IsTrue(m["dns.register"]) || netConfig["dns.mode"] == "none" {
+		return "", nil
+	}
+
+	domain := netConfig["dns.domain"]
+	if domain == "" {
+		domain = "lxd"
+	}
+
+	if project != "default" {
+		domain = fmt.Sprintf("%s.%s", project, domain)
+	}
+
+	if m["dns.domain"] != "" {
+		if m["dns.domain"] != domain && !strings.HasSuffix(m["dns.domain"], "."+domain) {
+			return "", fmt.Errorf("DNS domain %s isn't within the network's domain %s", m["dns.domain"], domain)
+		}
+
+		domain = m["dns.domain"]
+	}
+
+	names := []string{fmt.Sprintf("%s.%s", cName, domain)}
+	if m["dns.aliases"] != "" {
+		for _, alias := range strings.Split(m["dns.aliases"], ",") {
+			alias = strings.TrimSpace(alias)
+			if !strings.Contains(alias, ".") {
+				alias = fmt.Sprintf("%s.%s", alias, domain)
+			}
+
+			if !strings.HasSuffix(alias, "."+domain) {
+				return "", fmt.Errorf("DNS alias %s isn't within the domain %s", alias, domain)
+			}
+
+			for _, name := range containerNames {
+				if name != cName && alias == fmt.Sprintf("%s.%s", name, domain) {
+					return "", fmt.Errorf("DNS alias %s is the name of container %s", alias, name)
+				}
+			}
+
+			names = append(names, alias)
+		}
+	}
+
+	records := ""
+	for _, address := range []string{m["ipv4.address"], m["ipv6.address"]} {
+		if address == "" {
+			continue
+		}
+
+		records += fmt.Sprintf("%s %s\n", address, strings.Join(names, " "))
+	}
+
+	return records, nil
+}
+
+// networkContainerNames returns the names of all the containers of a project,
+// which other containers can't register as DNS aliases.
+func networkContainerNames(s *state.State, project string) ([]string, error) {
+	var names []string
+	err := s.Cluster.Transaction(func(tx *db.ClusterTx) error {
+		var err error
+		names, err = tx.ContainerNames(project)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// networkUpdateStaticContainer writes a single dhcp-host line for a container/network combination
+// along with its DNS records (if any).
+func networkUpdateStaticContainer(network string, project string, cName string, netConfig map[string]string, hwaddr string, ipv4Address string, ipv6Address string, records string) error {
+	recordsPath := shared.VarPath("networks", network, "dnsmasq.records", projectPrefix(project, cName))
+	if records != "" {
+		err := ioutil.WriteFile(recordsPath, []byte(records), 0644)
+		if err != nil {
+			return err
+		}
+	} else if shared.PathExists(recordsPath) {
+		err := os.Remove(recordsPath)
+		if err != nil {
+			return err
+		}
+	}
+
 	line := hwaddr
 
 	// Generate the dhcp-host line
@@ -1302,6 +1420,8 @@ func networkUpdateStatic(s *state.State, networkName string) error {
 
 	// Build a list of dhcp host entries
 	entries := map[string][][]string{}
+	netConfigs := map[string]map[string]string{}
+	projectNames := map[string][]string{}
 	for _, c := range containers {
 		// Go through all its devices (including profiles
 		for k, d := range c.ExpandedDevices() {
@@ -1337,7 +1457,39 @@ func networkUpdateStatic(s *state.State, networkName string) error {
 				}
 			}
 
-			entries[d["parent"]] = append(entries[d["parent"]], []string{d["hwaddr"], c.Project(), c.Name(), d["ipv4.address"], d["ipv6.address"]})
+			// Render the DNS records before the DHCP handling alters the addresses
+			netConfig, ok := netConfigs[d["parent"]]
+			if !ok {
+				n, err := networkLoadByName(s, d["parent"])
+				if err != nil {
+					return err
+				}
+
+				netConfig = n.Config()
+				netConfigs[d["parent"]] = netConfig
+			}
+			containerNames, ok := projectNames[c.Project()]
+			if !ok {
+				containerNames, err = networkContainerNames(s, c.Project())
+				if err != nil {
+					return err
+				}
+
+				projectNames[c.Project()] = containerNames
+			}
+
+			records, err := networkDNSRecords(c.Project(), c.Name(), netConfig, d, containerNames)
+			if err != nil {
+				logger.Warnf("Skipping invalid DNS records of container %s (%s): %v", c.Name(), k, err)
+				records = ""
+			}
+
+			// Don't hand out the static IPv4 address if DHCP is disabled
+			if d["ipv4.dhcp"] != "" && !shared.IsTrue(d["ipv4.dhcp"]) {
+				d["ipv4.address"] = ""
+			}
+
+			entries[d["parent"]] = append(entries[d["parent"]], []string{d["hwaddr"], c.Project(), c.Name(), d["ipv4.address"], d["ipv6.address"], records})
 		}
 	}
 
@@ -1369,6 +1521,20 @@ func networkUpdateStatic(s *state.State, networkName string) error {
 			}
 		}
 
+		if shared.PathExists(shared.VarPath("networks", network, "dnsmasq.records")) {
+			files, err = ioutil.ReadDir(shared.VarPath("networks", network, "dnsmasq.records"))
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range files {
+				err = os.Remove(shared.VarPath("networks", network, "dnsmasq.records", entry.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
 		// Apply the changes
 		for entryIdx, entry := range entries {
 			hwaddr := entry[0]
@@ -1376,6 +1542,7 @@ func networkUpdateStatic(s *state.State, networkName string) error {
 			cName := entry[2]
 			ipv4Address := entry[3]
 			ipv6Address := entry[4]
+			records := entry[5]
 			line := hwaddr
 
 			// Look for duplicates
@@ -1412,7 +1579,7 @@ func networkUpdateStatic(s *state.State, networkName string) error {
 			}
 
 			// Generate the dhcp-host line
-			err := networkUpdateStaticContainer(network, project, cName, config, hwaddr, ipv4Address, ipv6Address)
+			err := networkUpdateStaticContainer(network, project, cName, config, hwaddr, ipv4Address, ipv6Address, records)
 			if err != nil {
 				return err
 			}
@@ -1790,6 +1957,36 @@ func networkSetDevMTU(devName string, mtu uint64) error {
 	return nil
 }
 
+// networkGetDevPromisc retrieves whether a named network device is in promiscuous mode.
+func networkGetDevPromisc(devName string) (bool, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/flags", devName))
+	if err != nil {
+		return false, err
+	}
+
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"), 16, 32)
+	if err != nil {
+		return false, err
+	}
+
+	return flags&syscall.IFF_PROMISC != 0, nil
+}
+
+// networkSetDevPromisc sets the promiscuous mode of a named network device.
+func networkSetDevPromisc(devName string, promisc bool) error {
+	mode := "off"
+	if promisc {
+		mode = "on"
+	}
+
+	_, err := shared.RunCommand("ip", "link", "set", "dev", devName, "promisc", mode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // networkGetDevMAC retrieves the current MAC setting for a named network device.
 func networkGetDevMAC(devName string) (string, error) {
 	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/address", devName))
@@ -2116,3 +2313,67 @@ func networkDHCPv6CreateIAAddress(IP net.IP) []byte {
 	binary.BigEndian.PutUint32(data[24:28], uint32(0))                    // Valid lifetime
 	return data
 }
+
+// networkGetHostCounters returns the traffic counters of all the host's
+// network interfaces, keyed by interface name, using a single netlink dump.
+func networkGetHostCounters() (map[string]api.ContainerStateNetworkCounters, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETLINK, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to dump the network interfaces")
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the network interfaces dump")
+	}
+
+	counters := map[string]api.ContainerStateNetworkCounters{}
+	for i := range msgs {
+		if msgs[i].Header.Type != unix.RTM_NEWLINK {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		name := ""
+		var stats []byte
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFLA_IFNAME:
+				name = strings.TrimRight(string(attr.Value), "\x00")
+			case unix.IFLA_STATS64:
+				stats = attr.Value
+			}
+		}
+
+		// struct rtnl_link_stats64 starts with rx_packets, tx_packets,
+		// rx_bytes and tx_bytes
+		if name == "" || len(stats) < 32 {
+			continue
+		}
+
+		values := (*[4]uint64)(unsafe.Pointer(&stats[0]))
+		counters[name] = api.ContainerStateNetworkCounters{
+			PacketsReceived: int64(values[0]),
+			PacketsSent:     int64(values[1]),
+			BytesReceived:   int64(values[2]),
+			BytesSent:       int64(values[3]),
+		}
+	}
+
+	return counters, nil
+}
+
+// networkSwapCounters converts the counters of one end of a veth pair into
+// those of the other end.
+func networkSwapCounters(counters api.ContainerStateNetworkCounters) api.ContainerStateNetworkCounters {
+	return api.ContainerStateNetworkCounters{
+		BytesReceived:   counters.BytesSent,
+		BytesSent:       counters.BytesReceived,
+		PacketsReceived: counters.PacketsSent,
+		PacketsSent:     counters.PacketsReceived,
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkDNSRecords(t *testing.T) {
+	nic := map[string]string{
+		"dns.register": "true",
+		"dns.aliases":  "web, db.web.lxd",
+		"ipv4.address": "10.0.0.10",
+		"ipv6.address": "fd42::10",
+	}
+
+	records, err := networkDNSRecords("default", "c1", map[string]string{}, nic, []string{"c1", "c2"})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.10 c1.lxd web.lxd db.web.lxd\nfd42::10 c1.lxd web.lxd db.web.lxd\n", records)
+
+	// Names of other projects live in their own sub-domain
+	nic = map[string]string{"dns.register": "true", "dns.aliases": "web", "ipv4.address": "10.0.0.10"}
+	records, err = networkDNSRecords("foo", "c1", map[string]string{}, nic, []string{"c1"})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.10 c1.foo.lxd web.foo.lxd\n", records)
+
+	// Aliases can't leave the network's domain or take another container's name
+	nic = map[string]string{"dns.register": "true", "dns.aliases": "github.com", "ipv4.address": "10.0.0.10"}
+	_, err = networkDNSRecords("default", "c1", map[string]string{}, nic, []string{"c1"})
+	require.EqualError(t, err, "DNS alias github.com isn't within the domain lxd")
+
+	nic["dns.aliases"] = "c2"
+	_, err = networkDNSRecords("default", "c1", map[string]string{}, nic, []string{"c1", "c2"})
+	require.EqualError(t, err, "DNS alias c2.lxd is the name of container c2")
+
+	// The nic domain must be within the network's
+	nic = map[string]string{"dns.register": "true", "dns.domain": "internal.example", "ipv4.address": "10.0.0.10"}
+	records, err = networkDNSRecords("default", "c1", map[string]string{"dns.domain": "example"}, nic, nil)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.10 c1.internal.example\n", records)
+
+	nic["dns.domain"] = "internal"
+	_, err = networkDNSRecords("default", "c1", map[string]string{"dns.domain": "example"}, nic, nil)
+	require.EqualError(t, err, "DNS domain internal isn't within the network's domain example")
+
+	records, err = networkDNSRecords("default", "c1", map[string]string{"dns.mode": "none"}, nic, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", records)
+
+	nic["dns.register"] = "false"
+	records, err = networkDNSRecords("default", "c1", map[string]string{}, nic, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", records)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// All the rules LXD generates through nftables live in a "lxd" table of the
+// relevant family (bridge for the filters, ip and ip6 for NAT).
+const nftablesTable = "lxd"
+
+// Base chains created on demand in the LXD tables.
+var nftablesChains = map[string]string{
+	"input":      "type filter hook input priority 0;",
+	"forward":    "type filter hook forward priority 0;",
+	"prerouting": "type nat hook prerouting priority -100;",
+	"output":     "type nat hook output priority -100;",
+}
+
+// nftablesUse returns whether the firewall rules should be generated for
+// nftables, which is the case on hosts that have nft but lack the iptables or
+// ebtables tools.
+func nftablesUse() bool {
+	_, err := exec.LookPath("nft")
+	if err != nil {
+		return false
+	}
+
+	for _, cmd := range []string{"iptables", "ebtables"} {
+		_, err := exec.LookPath(cmd)
+		if err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nftablesAppend(family string, comment string, chain string, rule ...string) error {
+	spec, ok := nftablesChains[chain]
+	if !ok {
+		return fmt.Errorf("Unknown nftables chain: %s", chain)
+	}
+
+	// Make sure the table and the base chain exist
+	_, err := shared.RunCommand("nft", "add", "table", family, nftablesTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.RunCommand("nft", "add", "chain", family, nftablesTable, chain, fmt.Sprintf("{ %s }", spec))
+	if err != nil {
+		return err
+	}
+
+	args := []string{"add", "rule", family, nftablesTable, chain}
+	args = append(args, rule...)
+	args = append(args, "comment", fmt.Sprintf("\"generated for %s\"", comment))
+
+	_, err = shared.TryRunCommand("nft", args...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func nftablesClear(family string, comment string) error {
+	_, err := exec.LookPath("nft")
+	if err != nil {
+		return nil
+	}
+
+	// Nothing to do if the table was never created
+	output, err := shared.RunCommand("nft", "-a", "list", "table", family, nftablesTable)
+	if err != nil {
+		return nil
+	}
+
+	chain := ""
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "chain" {
+			chain = fields[1]
+			continue
+		}
+
+		if !strings.Contains(line, fmt.Sprintf("comment \"generated for %s", comment)) {
+			continue
+		}
+
+		// Rules are listed with a trailing "# handle <N>"
+		if len(fields) < 2 || fields[len(fields)-2] != "handle" {
+			continue
+		}
+
+		_, err = shared.TryRunCommand("nft", "delete", "rule", family, nftablesTable, chain, "handle", fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containerNftablesAppend(family string, comment string, chain string, rule ...string) error {
+	return nftablesAppend(family, fmt.Sprintf("LXD container %s", comment), chain, rule...)
+}
+
+func containerNftablesClear(family string, comment string) error {
+	return nftablesClear(family, fmt.Sprintf("LXD container %s", comment))
+}
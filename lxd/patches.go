@@ -4,9 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -69,6 +71,7 @@ var patches = []patch{
 	{name: "storage_api_rename_container_snapshots_dir_again", run: patchStorageApiRenameContainerSnapshotsDir},
 	{name: "storage_api_rename_container_snapshots_links_again", run: patchStorageApiUpdateContainerSnapshots},
 	{name: "storage_api_rename_container_snapshots_dir_again_again", run: patchStorageApiRenameContainerSnapshotsDir},
+	{name: "clamp_autostart_priority", run: patchClampAutostartPriority},
 }
 
 type patch struct {
@@ -122,6 +125,63 @@ func patchesApplyAll(d *Daemon) error {
 }
 
 // Patches begin here
+func patchClampAutostartPriority(name string, d *Daemon) error {
+	tx, err := d.cluster.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+
+	// boot.autostart.priority used to accept any integer but must now fit in a uint32
+	for _, table := range []string{"containers_config", "profiles_config"} {
+		rows, err := tx.Query(fmt.Sprintf("SELECT id, value FROM %s WHERE key='boot.autostart.priority'", table))
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to fetch %s", table)
+		}
+
+		values := map[int]string{}
+		for rows.Next() {
+			var id int
+			var value string
+
+			err = rows.Scan(&id, &value)
+			if err != nil {
+				rows.Close()
+				tx.Rollback()
+				return errors.Wrapf(err, "failed to fetch %s", table)
+			}
+
+			values[id] = value
+		}
+		rows.Close()
+
+		for id, value := range values {
+			if shared.IsUint32(value) == nil {
+				continue
+			}
+
+			priority, err := strconv.ParseInt(value, 10, 64)
+			newValue := "0"
+			if err == nil && priority > math.MaxUint32 {
+				newValue = strconv.FormatInt(math.MaxUint32, 10)
+			}
+
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET value=? WHERE id=?", table), newValue, id)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "failed to update %s", table)
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
+
 func patchRenameCustomVolumeLVs(name string, d *Daemon) error {
 	// Ignore the error since it will also fail if there are no pools.
 	pools, _ := d.cluster.StoragePools()
@@ -100,6 +100,14 @@ func profilesPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(fmt.Errorf("Invalid profile name '%s'", req.Name))
 	}
 
+	if !d.userIsAdmin(r) && containerSecretsChanged(nil, req.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if !d.userIsAdmin(r) && containerFuseChanged(nil, req.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	err := containerValidConfig(d.os, req.Config, true, false)
 	if err != nil {
 		return BadRequest(err)
@@ -110,6 +118,11 @@ func profilesPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	err = containerValidChangedDeviceKeys(nil, req.Devices)
+	if err != nil {
+		return BadRequest(err)
+	}
+
 	// Update DB entry
 	err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
 		hasProfiles, err := tx.ProjectHasProfiles(project)
@@ -246,6 +259,14 @@ func profilePut(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	if !d.userIsAdmin(r) && containerSecretsChanged(profile.Config, req.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if !d.userIsAdmin(r) && containerFuseChanged(profile.Devices, req.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	err = doProfileUpdate(d, project, name, id, profile, req)
 
 	if err == nil && !isClusterNotification(r) {
@@ -343,6 +364,14 @@ func profilePatch(d *Daemon, r *http.Request) Response {
 		}
 	}
 
+	if !d.userIsAdmin(r) && containerSecretsChanged(profile.Config, req.Config) {
+		return Forbidden(fmt.Errorf("Only administrators may set environment_file.* keys"))
+	}
+
+	if !d.userIsAdmin(r) && containerFuseChanged(profile.Devices, req.Devices) {
+		return Forbidden(fmt.Errorf("Only administrators may set the fuse property of disk devices"))
+	}
+
 	// Get Devices
 	if req.Devices == nil {
 		req.Devices = profile.Devices
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/lxc/lxd/lxd/types"
 	"github.com/lxc/lxd/shared"
 )
 
@@ -26,6 +28,44 @@ type proxyProcInfo struct {
 	proxyProtocol  string
 }
 
+// proxyNatNicAddrs returns the static IPv4 and IPv6 addresses of the bridged
+// nics matching the connect address of a NAT proxy device.
+func proxyNatNicAddrs(devices types.Devices, connectAddr *proxyAddress) (string, string, error) {
+	address, _, err := net.SplitHostPort(connectAddr.addr[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	var IPv4Addr string
+	var IPv6Addr string
+
+	for _, name := range devices.DeviceNames() {
+		m := devices[name]
+		if m["type"] != "nic" || (m["type"] == "nic" && m["nictype"] != "bridged") {
+			continue
+		}
+
+		// Check whether the NIC has a static IP
+		ip := m["ipv4.address"]
+		// Ensure that the provided IP address matches the container's IP
+		// address otherwise we could mess with other containers.
+		if ip != "" && IPv4Addr == "" && (address == ip || address == "0.0.0.0") {
+			IPv4Addr = ip
+		}
+
+		ip = m["ipv6.address"]
+		if ip != "" && IPv6Addr == "" && (address == ip || address == "::") {
+			IPv6Addr = ip
+		}
+	}
+
+	if IPv4Addr == "" && IPv6Addr == "" {
+		return "", "", fmt.Errorf("NIC IP doesn't match proxy target IP")
+	}
+
+	return IPv4Addr, IPv6Addr, nil
+}
+
 func parseAddr(addr string) (string, string) {
 	fields := strings.SplitN(addr, ":", 2)
 	return fields[0], fields[1]
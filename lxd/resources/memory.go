@@ -134,6 +134,17 @@ func parseMeminfo(path string) (*meminfo, error) {
 	return &memory, nil
 }
 
+// GetHugepages returns the size of the default hugepages and how many of them
+// are currently free on the host.
+func GetHugepages() (uint64, uint64, error) {
+	info, err := parseMeminfo("/proc/meminfo")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to parse /proc/meminfo")
+	}
+
+	return info.HugepagesSize, info.HugepagesFree, nil
+}
+
 // GetMemory returns a filled api.ResourcesMemory struct ready for use by LXD
 func GetMemory() (*api.ResourcesMemory, error) {
 	memory := api.ResourcesMemory{}
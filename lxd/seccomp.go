@@ -461,6 +461,8 @@ func ContainerNeedsSeccomp(c container) bool {
 		"raw.seccomp",
 		"security.syscalls.whitelist",
 		"security.syscalls.blacklist",
+		"security.syscalls.allow",
+		"security.syscalls.deny",
 	}
 
 	for _, k := range keys {
@@ -470,7 +472,7 @@ func ContainerNeedsSeccomp(c container) bool {
 		}
 	}
 
-	compat := config["security.syscalls.blacklist_compat"]
+	compat, _ := shared.ContainerConfigValue(config, "security.syscalls.deny_compat")
 	if shared.IsTrue(compat) {
 		return true
 	}
@@ -478,7 +480,7 @@ func ContainerNeedsSeccomp(c container) bool {
 	/* this are enabled by default, so if the keys aren't present, that
 	 * means "true"
 	 */
-	default_, ok := config["security.syscalls.blacklist_default"]
+	default_, ok := shared.ContainerConfigValue(config, "security.syscalls.deny_default")
 	if !ok || shared.IsTrue(default_) {
 		return true
 	}
@@ -503,9 +505,18 @@ func getSeccompProfileContent(c container) (string, error) {
 		return policy, nil
 	}
 
+	allow := config["security.syscalls.allow"]
+	if allow != "" {
+		policy += "whitelist\n[all]\n"
+		for _, name := range strings.Split(allow, ",") {
+			policy += fmt.Sprintf("%s\n", strings.TrimSpace(name))
+		}
+		return policy, nil
+	}
+
 	policy += "blacklist\n"
 
-	default_, ok := config["security.syscalls.blacklist_default"]
+	default_, ok := shared.ContainerConfigValue(config, "security.syscalls.deny_default")
 	if !ok || shared.IsTrue(default_) {
 		policy += DEFAULT_SECCOMP_POLICY
 	}
@@ -514,7 +525,7 @@ func getSeccompProfileContent(c container) (string, error) {
 		policy += SECCOMP_NOTIFY_POLICY
 	}
 
-	compat := config["security.syscalls.blacklist_compat"]
+	compat, _ := shared.ContainerConfigValue(config, "security.syscalls.deny_compat")
 	if shared.IsTrue(compat) {
 		arch, err := osarch.ArchitectureName(c.Architecture())
 		if err != nil {
@@ -528,6 +539,42 @@ func getSeccompProfileContent(c container) (string, error) {
 		policy += blacklist
 	}
 
+	deny := config["security.syscalls.deny"]
+	if deny != "" {
+		if !strings.HasSuffix(policy, "\n") {
+			policy += "\n"
+		}
+
+		policy += "[all]\n"
+		for _, name := range strings.Split(deny, ",") {
+			policy += fmt.Sprintf("%s errno 38\n", strings.TrimSpace(name))
+		}
+	}
+
+	return policy, nil
+}
+
+// SeccompExecProfile returns the container's seccomp policy with the given
+// syscalls additionally denied, for use by a sandboxed exec.
+func SeccompExecProfile(c container, deny []string) (string, error) {
+	policy, err := getSeccompProfileContent(c)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(policy, "2\n") {
+		return "", fmt.Errorf("Denying extra syscalls requires a version 2 seccomp policy")
+	}
+
+	if !strings.HasSuffix(policy, "\n") {
+		policy += "\n"
+	}
+
+	policy += "[all]\n"
+	for _, name := range deny {
+		policy += fmt.Sprintf("%s errno 38\n", name)
+	}
+
 	return policy, nil
 }
 
@@ -1,6 +1,8 @@
 package state
 
 import (
+	"time"
+
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/endpoints"
 	"github.com/lxc/lxd/lxd/maas"
@@ -16,6 +18,10 @@ type State struct {
 	MAAS      *maas.Controller
 	OS        *sys.OS
 	Endpoints *endpoints.Endpoints
+
+	// Timeouts of container operations from core.container_operation_timeout,
+	// keyed by action, the default one being keyed by ""
+	ContainerOperationTimeouts map[string]time.Duration
 }
 
 // NewState returns a new State object with the given database and operating
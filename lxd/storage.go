@@ -190,6 +190,7 @@ type storage interface {
 	ContainerRename(container container, newName string) error
 	ContainerRestore(container container, sourceContainer container) error
 	ContainerGetUsage(container container) (int64, error)
+	ContainerSnapshotGetUsage(snapshotContainer container) (int64, error)
 	GetContainerPoolInfo() (int64, string, string)
 	ContainerStorageReady(container container) bool
 
@@ -244,6 +245,15 @@ type storage interface {
 	StorageMigrationSink(conn *websocket.Conn, op *operation, args MigrationSinkArgs) error
 }
 
+// The storageSnapshotsDeleter interface is implemented by storage backends
+// which can delete several snapshots of a container in a single operation.
+type storageSnapshotsDeleter interface {
+	// ContainerSnapshotsDelete deletes the storage volumes of the given
+	// snapshots which must all belong to the same container. Any leftover
+	// is cleaned up by the regular ContainerSnapshotDelete.
+	ContainerSnapshotsDelete(snapshots []container) error
+}
+
 func storageCoreInit(driver string) (storage, error) {
 	sType, err := storageStringToType(driver)
 	if err != nil {
@@ -532,9 +542,9 @@ func storagePoolVolumeAttachInit(s *state.State, poolName string, volumeName str
 			var err error
 
 			if st.GetStorageType() == storageTypeZfs {
-				err = lastIdmap.UnshiftRootfs(remapPath, zfsIdmapSetSkipper)
+				err = lastIdmap.UnshiftRootfs(remapPath, zfsIdmapSetSkipper, nil)
 			} else {
-				err = lastIdmap.UnshiftRootfs(remapPath, nil)
+				err = lastIdmap.UnshiftRootfs(remapPath, nil, nil)
 			}
 			if err != nil {
 				logger.Errorf("Failed to unshift \"%s\"", remapPath)
@@ -548,9 +558,9 @@ func storagePoolVolumeAttachInit(s *state.State, poolName string, volumeName str
 			var err error
 
 			if st.GetStorageType() == storageTypeZfs {
-				err = nextIdmap.ShiftRootfs(remapPath, zfsIdmapSetSkipper)
+				err = nextIdmap.ShiftRootfs(remapPath, zfsIdmapSetSkipper, nil)
 			} else {
-				err = nextIdmap.ShiftRootfs(remapPath, nil)
+				err = nextIdmap.ShiftRootfs(remapPath, nil, nil)
 			}
 			if err != nil {
 				logger.Errorf("Failed to shift \"%s\"", remapPath)
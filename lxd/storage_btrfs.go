@@ -1381,6 +1381,12 @@ func (s *storageBtrfs) ContainerGetUsage(container container) (int64, error) {
 	return s.btrfsPoolVolumeQGroupUsage(container.Path())
 }
 
+func (s *storageBtrfs) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	// The exclusive usage of the snapshot's qgroup is what it adds on top
+	// of the container
+	return s.btrfsPoolVolumeQGroupUsage(getSnapshotMountPoint(snapshotContainer.Project(), s.pool.Name, snapshotContainer.Name()))
+}
+
 func (s *storageBtrfs) doContainerSnapshotCreate(project string, targetName string, sourceName string) error {
 	logger.Debugf("Creating BTRFS storage volume for snapshot \"%s\" on storage pool \"%s\"", s.volume.Name, s.pool.Name)
 
@@ -827,6 +827,12 @@ func (s *storageCeph) ContainerCreate(container container) error {
 func (s *storageCeph) ContainerCreateFromImage(container container, fingerprint string, tracker *ioprogress.ProgressTracker) error {
 	logger.Debugf(`Creating RBD storage volume for container "%s" on storage pool "%s"`, s.volume.Name, s.pool.Name)
 
+	// The image volume can only be cloned if the container uses the
+	// same filesystem.
+	if s.getRBDFilesystem() != s.getRBDPoolFilesystem() {
+		return s.containerCreateFromImageUnpack(container, fingerprint, tracker)
+	}
+
 	revert := true
 
 	containerPath := container.Path()
@@ -1623,6 +1629,10 @@ func (s *storageCeph) ContainerGetUsage(container container) (int64, error) {
 	return -1, fmt.Errorf("RBD quotas are currently not supported")
 }
 
+func (s *storageCeph) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	return -1, fmt.Errorf("RBD quotas are currently not supported")
+}
+
 func (s *storageCeph) ContainerSnapshotCreate(snapshotContainer container, sourceContainer container) error {
 	containerMntPoint := getContainerMountPoint(sourceContainer.Project(), s.pool.Name, sourceContainer.Name())
 	if shared.IsMountPoint(containerMntPoint) {
@@ -2431,14 +2441,6 @@ func (s *storageCeph) StorageEntitySetQuota(volumeType int, size int64, data int
 	case storagePoolVolumeTypeContainer:
 		c = data.(container)
 		ctName := c.Name()
-		if c.IsRunning() {
-			msg := fmt.Sprintf(`Cannot resize RBD storage volume `+
-				`for container "%s" when it is running`,
-				ctName)
-			logger.Errorf(msg)
-			return fmt.Errorf(msg)
-		}
-
 		RBDDevPath, ret = getRBDMappedDevPath(s.ClusterName,
 			s.OSDPoolName, storagePoolVolumeTypeNameContainer,
 			s.volume.Name, true, s.UserName)
@@ -2467,6 +2469,15 @@ func (s *storageCeph) StorageEntitySetQuota(volumeType int, size int64, data int
 		return nil
 	}
 
+	// Running containers can only be grown (online)
+	if c != nil && c.IsRunning() && !storageCanGrowOnline(fsType, oldSize, size) {
+		msg := fmt.Sprintf(`Cannot resize RBD storage volume `+
+			`for container "%s" when it is running`,
+			c.Name())
+		logger.Errorf(msg)
+		return fmt.Errorf(msg)
+	}
+
 	if size < oldSize {
 		err = s.rbdShrink(RBDDevPath, size, fsType, mountpoint,
 			volumeType, volumeName, data)
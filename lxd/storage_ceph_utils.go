@@ -16,6 +16,7 @@ import (
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/ioprogress"
 	"github.com/lxc/lxd/shared/logger"
 	"github.com/lxc/lxd/shared/units"
 )
@@ -685,6 +686,16 @@ func (s *storageCeph) getRBDFilesystem() string {
 	return "ext4"
 }
 
+// getRBDPoolFilesystem returns the default filesystem of the storage pool,
+// which is the one cached image volumes are created with.
+func (s *storageCeph) getRBDPoolFilesystem() string {
+	if s.pool.Config["volume.block.filesystem"] != "" {
+		return s.pool.Config["volume.block.filesystem"]
+	}
+
+	return "ext4"
+}
+
 // getRBDMountOptions returns the mount options the storage volume is supposed
 // to be mounted with
 // The option string that is returned needs to be passed to the approriate
@@ -1683,6 +1694,54 @@ func (s *storageCeph) cephRBDVolumeBackupCreate(tmpPath string, backup backup, s
 	return nil
 }
 
+// containerCreateFromImageUnpack creates a new RBD storage volume for the
+// container and unpacks the image into it instead of cloning the image
+// volume. This is used when the container doesn't use the pool's filesystem.
+func (s *storageCeph) containerCreateFromImageUnpack(container container, fingerprint string, tracker *ioprogress.ProgressTracker) error {
+	containerName := container.Name()
+	err := s.doContainerCreate(container.Project(), containerName, container.IsPrivileged())
+	if err != nil {
+		return err
+	}
+
+	revert := true
+	defer func() {
+		if !revert {
+			return
+		}
+
+		s.ContainerDelete(container)
+	}()
+
+	ourMount, err := s.ContainerMount(container)
+	if err != nil {
+		return err
+	}
+	if ourMount {
+		defer s.ContainerUmount(container, container.Path())
+	}
+
+	imagePath := shared.VarPath("images", fingerprint)
+	containerMntPoint := getContainerMountPoint(container.Project(), s.pool.Name, containerName)
+	err = unpackImage(imagePath, containerMntPoint, storageTypeCeph, s.s.OS.RunningInUserNS, tracker)
+	if err != nil {
+		logger.Errorf(`Failed to unpack image "%s" into RBD storage volume for container "%s" on storage pool "%s": %s`, imagePath, containerName, s.pool.Name, err)
+		return err
+	}
+
+	err = container.TemplateApply("create")
+	if err != nil {
+		logger.Errorf(`Failed to apply create template for container "%s": %s`, containerName, err)
+		return err
+	}
+
+	logger.Debugf(`Created RBD storage volume for container "%s" on storage pool "%s"`, containerName, s.pool.Name)
+
+	revert = false
+
+	return nil
+}
+
 func (s *storageCeph) doContainerCreate(project, name string, privileged bool) error {
 	logger.Debugf(`Creating RBD storage volume for container "%s" on storage pool "%s"`, name, s.pool.Name)
 
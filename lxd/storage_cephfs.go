@@ -667,6 +667,10 @@ func (s *storageCephFs) ContainerGetUsage(c container) (int64, error) {
 	return -1, fmt.Errorf("CEPHFS cannot be used for containers")
 }
 
+func (s *storageCephFs) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	return -1, fmt.Errorf("CEPHFS cannot be used for containers")
+}
+
 func (s *storageCephFs) ContainerSnapshotCreate(snapshotContainer container, sourceContainer container) error {
 	return fmt.Errorf("CEPHFS cannot be used for containers")
 }
@@ -937,6 +937,11 @@ func (s *storageDir) ContainerGetUsage(c container) (int64, error) {
 	return size, nil
 }
 
+func (s *storageDir) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	// Snapshots are plain copies outside of the container's quota project
+	return -1, fmt.Errorf("The DIR storage backend doesn't track snapshot usage")
+}
+
 func (s *storageDir) ContainerSnapshotCreate(snapshotContainer container, sourceContainer container) error {
 	logger.Debugf("Creating DIR storage volume for snapshot \"%s\" on storage pool \"%s\"", s.volume.Name, s.pool.Name)
 
@@ -1012,7 +1012,9 @@ func (s *storageLvm) ContainerCreateFromImage(container container, fingerprint s
 	containerLvmName := containerNameToLVName(containerName)
 
 	var err error
-	if s.useThinpool {
+	// Only clone the image volume if the container uses the same
+	// filesystem, otherwise unpack the image into a fresh volume.
+	if s.useThinpool && s.getLvmFilesystem() == s.getLvmPoolFilesystem() {
 		err = s.containerCreateFromImageThinLv(container, fingerprint)
 	} else {
 		err = s.containerCreateFromImageLv(container, fingerprint)
@@ -1393,6 +1395,11 @@ func (s *storageLvm) ContainerRename(container container, newContainerName strin
 		}
 
 		for _, snap := range snaps {
+			// Metadata-only snapshots have no LV to rename
+			if snap.IsMetadataOnly() {
+				continue
+			}
+
 			baseSnapName := filepath.Base(snap.Name())
 			newSnapshotName := newContainerName + shared.SnapshotDelimiter + baseSnapName
 			err := s.ContainerRename(snap, newSnapshotName)
@@ -1523,6 +1530,10 @@ func (s *storageLvm) ContainerGetUsage(container container) (int64, error) {
 	return -1, fmt.Errorf("the LVM container backend doesn't support quotas")
 }
 
+func (s *storageLvm) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	return -1, fmt.Errorf("the LVM container backend doesn't support quotas")
+}
+
 func (s *storageLvm) ContainerSnapshotCreate(snapshotContainer container, sourceContainer container) error {
 	logger.Debugf("Creating LVM storage volume for snapshot \"%s\" on storage pool \"%s\"", s.volume.Name, s.pool.Name)
 
@@ -2107,14 +2118,6 @@ func (s *storageLvm) StorageEntitySetQuota(volumeType int, size int64, data inte
 	case storagePoolVolumeTypeContainer:
 		c = data.(container)
 		ctName := c.Name()
-		if c.IsRunning() {
-			msg := fmt.Sprintf(`Cannot resize LVM storage volume `+
-				`for container "%s" when it is running`,
-				ctName)
-			logger.Errorf(msg)
-			return fmt.Errorf(msg)
-		}
-
 		ctLvmName := containerNameToLVName(ctName)
 		lvDevPath = getLvmDevPath("default", poolName, storagePoolVolumeAPIEndpointContainers, ctLvmName)
 		mountpoint = getContainerMountPoint(c.Project(), s.pool.Name, ctName)
@@ -2135,6 +2138,15 @@ func (s *storageLvm) StorageEntitySetQuota(volumeType int, size int64, data inte
 		return nil
 	}
 
+	// Running containers can only be grown (online)
+	if c != nil && c.IsRunning() && !storageCanGrowOnline(fsType, oldSize, size) {
+		msg := fmt.Sprintf(`Cannot resize LVM storage volume `+
+			`for container "%s" when it is running`,
+			c.Name())
+		logger.Errorf(msg)
+		return fmt.Errorf(msg)
+	}
+
 	if size < oldSize {
 		err = s.lvReduce(lvDevPath, size, fsType, mountpoint, volumeType, data)
 	} else if size > oldSize {
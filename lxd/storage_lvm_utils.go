@@ -118,6 +118,16 @@ func (s *storageLvm) getLvmFilesystem() string {
 	return "ext4"
 }
 
+// getLvmPoolFilesystem returns the default filesystem of the storage pool,
+// which is the one cached image volumes are created with.
+func (s *storageLvm) getLvmPoolFilesystem() string {
+	if s.pool.Config["volume.block.filesystem"] != "" {
+		return s.pool.Config["volume.block.filesystem"]
+	}
+
+	return "ext4"
+}
+
 func (s *storageLvm) getLvmVolumeSize() (string, error) {
 	sz, err := units.ParseByteSizeString(s.volume.Config["size"])
 	if err != nil {
@@ -164,6 +164,12 @@ func (s *storageMock) ContainerGetUsage(
 
 	return 0, nil
 }
+
+func (s *storageMock) ContainerSnapshotGetUsage(
+	snapshotContainer container) (int64, error) {
+
+	return 0, nil
+}
 func (s *storageMock) ContainerSnapshotCreate(
 	snapshotContainer container, sourceContainer container) error {
 
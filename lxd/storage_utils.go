@@ -268,6 +268,12 @@ func btrfsGenerateNewUUID(lvpath string) (string, error) {
 	return msg, nil
 }
 
+// storageCanGrowOnline returns whether a filesystem can be grown from oldSize
+// to newSize while mounted (e.g. as the root of a running container).
+func storageCanGrowOnline(fsType string, oldSize int64, newSize int64) bool {
+	return newSize > oldSize && shared.StringInSlice(fsType, []string{"", "ext4", "xfs", "btrfs"})
+}
+
 func growFileSystem(fsType string, devPath string, mntpoint string) error {
 	var msg string
 	var err error
@@ -277,7 +283,8 @@ func growFileSystem(fsType string, devPath string, mntpoint string) error {
 	case "ext4":
 		msg, err = shared.TryRunCommand("resize2fs", devPath)
 	case "xfs":
-		msg, err = shared.TryRunCommand("xfs_growfs", devPath)
+		// xfs can only be grown through its mountpoint
+		msg, err = shared.TryRunCommand("xfs_growfs", mntpoint)
 	case "btrfs":
 		msg, err = shared.TryRunCommand("btrfs", "filesystem", "resize", "max", mntpoint)
 	default:
@@ -113,29 +113,9 @@ func storagePoolVolumeSnapshotsTypePost(d *Daemon, r *http.Request) Response {
 		defer storage.StoragePoolVolumeUmount()
 	}
 
-	volWritable := storage.GetStoragePoolVolumeWritable()
 	fullSnapName := fmt.Sprintf("%s%s%s", volumeName, shared.SnapshotDelimiter, req.Name)
-	req.Name = fullSnapName
 	snapshot := func(op *operation) error {
-		dbArgs := &db.StorageVolumeArgs{
-			Name:        fullSnapName,
-			PoolName:    poolName,
-			TypeName:    volumeTypeName,
-			Snapshot:    true,
-			Config:      volWritable.Config,
-			Description: volWritable.Description,
-		}
-
-		err = storage.StoragePoolVolumeSnapshotCreate(&req)
-		if err != nil {
-			return err
-		}
-
-		_, err = storagePoolVolumeSnapshotDBCreateInternal(d.State(), dbArgs)
-		if err != nil {
-			return err
-		}
-		return nil
+		return storagePoolVolumeSnapshotCreateInternal(d.State(), storage, poolName, volumeTypeName, fullSnapName)
 	}
 
 	resources := map[string][]string{}
@@ -255,13 +255,15 @@ func storagePoolVolumeUpdateUsers(d *Daemon, oldPoolName string,
 	oldVolumeName string, newPoolName string, newVolumeName string) error {
 
 	s := d.State()
-	// update all containers
-	cts, err := containerLoadAll(s)
+	// update the local containers using the volume, Update refusing to
+	// touch containers located on other cluster members
+	cts, err := containerLoadNodeAll(s)
 	if err != nil {
 		return err
 	}
 
 	for _, c := range cts {
+		found := false
 		devices := c.LocalDevices()
 		for k := range devices {
 			if devices[k]["type"] != "disk" {
@@ -289,6 +291,7 @@ func storagePoolVolumeUpdateUsers(d *Daemon, oldPoolName string,
 			}
 
 			// found entry
+			found = true
 
 			if oldPoolName != newPoolName {
 				devices[k]["pool"] = newPoolName
@@ -303,6 +306,10 @@ func storagePoolVolumeUpdateUsers(d *Daemon, oldPoolName string,
 			}
 		}
 
+		if !found {
+			continue
+		}
+
 		args := db.ContainerArgs{
 			Architecture: c.Architecture(),
 			Description:  c.Description(),
@@ -681,6 +688,32 @@ func storagePoolVolumeSnapshotCopyInternal(state *state.State, poolName string,
 	return storagePoolVolumeSnapshotDBCreateInternal(state, dbArgs)
 }
 
+// storagePoolVolumeSnapshotCreateInternal snapshots the storage volume the
+// passed storage was initialized with and records the snapshot in the database.
+func storagePoolVolumeSnapshotCreateInternal(state *state.State, s storage, poolName string, volumeTypeName string, fullSnapName string) error {
+	volWritable := s.GetStoragePoolVolumeWritable()
+	dbArgs := &db.StorageVolumeArgs{
+		Name:        fullSnapName,
+		PoolName:    poolName,
+		TypeName:    volumeTypeName,
+		Snapshot:    true,
+		Config:      volWritable.Config,
+		Description: volWritable.Description,
+	}
+
+	err := s.StoragePoolVolumeSnapshotCreate(&api.StorageVolumeSnapshotsPost{Name: fullSnapName})
+	if err != nil {
+		return err
+	}
+
+	_, err = storagePoolVolumeSnapshotDBCreateInternal(state, dbArgs)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func storagePoolVolumeSnapshotDBCreateInternal(state *state.State, dbArgs *db.StorageVolumeArgs) (storage, error) {
 	// Create database entry for new storage volume.
 	err := storagePoolVolumeDBCreate(state, dbArgs.PoolName, dbArgs.Name, dbArgs.Description, dbArgs.TypeName, true, dbArgs.Config)
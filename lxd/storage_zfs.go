@@ -1610,6 +1610,36 @@ func (s *storageZfs) ContainerGetUsage(container container) (int64, error) {
 	return valueInt, nil
 }
 
+func (s *storageZfs) ContainerSnapshotGetUsage(snapshotContainer container) (int64, error) {
+	if s.pool.Config["volume.zfs.use_refquota"] != "" {
+		zfsUseRefquota = s.pool.Config["volume.zfs.use_refquota"]
+	}
+	if s.volume.Config["zfs.use_refquota"] != "" {
+		zfsUseRefquota = s.volume.Config["zfs.use_refquota"]
+	}
+
+	// Without refquota, the "used" property of the container's dataset
+	// already accounts for its snapshots
+	if !shared.IsTrue(zfsUseRefquota) {
+		return 0, nil
+	}
+
+	cName, snapOnlyName, _ := containerGetParentAndSnapshotName(snapshotContainer.Name())
+	fs := fmt.Sprintf("containers/%s@snapshot-%s", projectPrefix(snapshotContainer.Project(), cName), snapOnlyName)
+
+	value, err := zfsFilesystemEntityPropertyGet(s.getOnDiskPoolName(), fs, "used")
+	if err != nil {
+		return -1, err
+	}
+
+	valueInt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return -1, err
+	}
+
+	return valueInt, nil
+}
+
 func (s *storageZfs) doContainerSnapshotCreate(project, targetName string, sourceName string) error {
 	snapshotContainerName := targetName
 	logger.Debugf("Creating ZFS storage volume for snapshot \"%s\" on storage pool \"%s\"", snapshotContainerName, s.pool.Name)
@@ -1754,6 +1784,58 @@ func (s *storageZfs) ContainerSnapshotDelete(snapshotContainer container) error
 	return nil
 }
 
+func (s *storageZfs) ContainerSnapshotsDelete(snapshots []container) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	logger.Debugf("Deleting %d ZFS snapshots of container \"%s\" on storage pool \"%s\"", len(snapshots), s.volume.Name, s.pool.Name)
+
+	poolName := s.getOnDiskPoolName()
+	project := snapshots[0].Project()
+	cName, _, _ := containerGetParentAndSnapshotName(snapshots[0].Name())
+	fs := fmt.Sprintf("containers/%s", projectPrefix(project, cName))
+
+	snapNames := []string{}
+	for _, snapshot := range snapshots {
+		if snapshot.IsMetadataOnly() {
+			continue
+		}
+
+		parentName, snapOnlyName, _ := containerGetParentAndSnapshotName(snapshot.Name())
+		if parentName != cName || snapshot.Project() != project {
+			return fmt.Errorf("Snapshots must all belong to the same container")
+		}
+
+		snapName := fmt.Sprintf("snapshot-%s", snapOnlyName)
+		if !zfsFilesystemEntityExists(poolName, fmt.Sprintf("%s@%s", fs, snapName)) {
+			continue
+		}
+
+		// Snapshots with dependent clones are dealt with one by one
+		removable, err := zfsPoolVolumeSnapshotRemovable(poolName, fs, snapName)
+		if err != nil {
+			return err
+		}
+
+		if removable {
+			snapNames = append(snapNames, snapName)
+		}
+	}
+
+	if len(snapNames) == 0 {
+		return nil
+	}
+
+	err := zfsPoolVolumeSnapshotsDestroy(poolName, fs, snapNames)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Deleted %d ZFS snapshots of container \"%s\" on storage pool \"%s\"", len(snapNames), s.volume.Name, s.pool.Name)
+	return nil
+}
+
 func (s *storageZfs) ContainerSnapshotRename(snapshotContainer container, newName string) error {
 	logger.Debugf("Renaming ZFS storage volume for snapshot \"%s\" from %s to %s", s.volume.Name, s.volume.Name, newName)
 
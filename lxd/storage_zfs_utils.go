@@ -445,6 +445,20 @@ func zfsPoolVolumeSnapshotDestroy(pool, path string, name string) error {
 	return nil
 }
 
+func zfsPoolVolumeSnapshotsDestroy(pool, path string, names []string) error {
+	output, err := shared.RunCommand(
+		"zfs",
+		"destroy",
+		"-r",
+		fmt.Sprintf("%s/%s@%s", pool, path, strings.Join(names, ",")))
+	if err != nil {
+		logger.Errorf("zfs destroy failed: %s", output)
+		return fmt.Errorf("Failed to destroy ZFS snapshots: %s", output)
+	}
+
+	return nil
+}
+
 func zfsPoolVolumeSnapshotRestore(pool string, path string, name string) error {
 	output, err := shared.TryRunCommand(
 		"zfs",
@@ -2,6 +2,11 @@ package sys
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/logger"
@@ -9,6 +14,8 @@ import (
 
 // Detect CGroup support.
 func (s *OS) initCGroup() {
+	s.initCGroupUnified()
+
 	flags := []*bool{
 		&s.CGroupBlkioController,
 		&s.CGroupCPUController,
@@ -16,6 +23,7 @@ func (s *OS) initCGroup() {
 		&s.CGroupCPUsetController,
 		&s.CGroupDevicesController,
 		&s.CGroupFreezerController,
+		&s.CGroupHugetlbController,
 		&s.CGroupMemoryController,
 		&s.CGroupNetPrioController,
 		&s.CGroupPidsController,
@@ -23,12 +31,114 @@ func (s *OS) initCGroup() {
 	}
 	for i, flag := range flags {
 		*flag = shared.PathExists("/sys/fs/cgroup/" + cGroups[i].path)
+		if !*flag && cGroups[i].unified != "" {
+			*flag = s.cgroupUnifiedHas(cGroups[i].unified)
+		}
+
 		if !*flag {
 			logger.Warnf(cGroups[i].warn)
 		}
 	}
 }
 
+// Detect the unified hierarchy (cgroup v2), either mounted on its own or
+// alongside the v1 controllers (hybrid layout).
+func (s *OS) initCGroupUnified() {
+	s.CGroupVersion = 1
+	s.cgroupUnified = map[string]bool{}
+
+	if cgroupIsUnified("/sys/fs/cgroup") {
+		s.CGroupVersion = 2
+		s.cgroupUnifiedPath = "/sys/fs/cgroup"
+	} else if cgroupIsUnified("/sys/fs/cgroup/unified") {
+		s.cgroupUnifiedPath = "/sys/fs/cgroup/unified"
+	} else {
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(s.cgroupUnifiedPath, "cgroup.controllers"))
+	if err != nil {
+		logger.Warnf("Couldn't read the controllers of the unified CGroup hierarchy: %v", err)
+	}
+	controllers := strings.Fields(string(content))
+
+	for name, unifiedName := range cGroupUnifiedNames {
+		// In hybrid layouts, the containers get whatever v1 hierarchy
+		// is mounted and only the remaining controllers on cgroup2.
+		if s.CGroupVersion == 1 && shared.PathExists("/sys/fs/cgroup/"+name) {
+			continue
+		}
+
+		if unifiedName == "" {
+			s.cgroupUnified[name] = s.CGroupVersion == 2
+			continue
+		}
+
+		s.cgroupUnified[name] = shared.StringInSlice(unifiedName, controllers)
+	}
+}
+
+// CGroupUnified returns whether the containers see the given controller
+// (by its v1 name, e.g. blkio or cpuacct) on the unified hierarchy.
+func (s *OS) CGroupUnified(controller string) bool {
+	return s.cgroupUnified[controller]
+}
+
+// CGroupMountPath returns where the hierarchy the containers get the given
+// controller (by its v1 name) from is mounted.
+func (s *OS) CGroupMountPath(controller string) string {
+	if s.CGroupUnified(controller) {
+		return s.cgroupUnifiedPath
+	}
+
+	return filepath.Join("/sys/fs/cgroup", controller)
+}
+
+// cgroupUnifiedHas checks for a controller, optionally followed by one of its
+// files (e.g. memory/memory.swap.max), on the unified hierarchy.
+func (s *OS) cgroupUnifiedHas(entry string) bool {
+	fields := strings.SplitN(entry, "/", 2)
+	if !s.CGroupUnified(fields[0]) {
+		return false
+	}
+
+	if len(fields) == 1 {
+		return true
+	}
+
+	// Interface files only show up in non-root cgroups, look in our own.
+	return shared.PathExists(filepath.Join(s.cgroupUnifiedPath, cgroupUnifiedSelf(), fields[1]))
+}
+
+// cgroupIsUnified returns whether a cgroup2 filesystem is mounted at path.
+func cgroupIsUnified(path string) bool {
+	fs := unix.Statfs_t{}
+
+	err := unix.Statfs(path, &fs)
+	if err != nil {
+		return false
+	}
+
+	return fs.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// cgroupUnifiedSelf returns the cgroup of the current process on the unified
+// hierarchy.
+func cgroupUnifiedSelf() string {
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "/"
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+
+	return "/"
+}
+
 func cGroupMissing(name, message string) string {
 	return fmt.Sprintf("Couldn't find the CGroup %s, %s.", name, message)
 }
@@ -37,18 +147,34 @@ func cGroupDisabled(name, message string) string {
 	return fmt.Sprintf("CGroup %s is disabled, %s.", name, message)
 }
 
+// Unified hierarchy names of the v1 controllers. The devices and freezer
+// controllers are built into cgroup2 rather than listed as controllers.
+var cGroupUnifiedNames = map[string]string{
+	"blkio":   "io",
+	"cpu":     "cpu",
+	"cpuacct": "cpu",
+	"cpuset":  "cpuset",
+	"devices": "",
+	"freezer": "",
+	"hugetlb": "hugetlb",
+	"memory":  "memory",
+	"pids":    "pids",
+}
+
 var cGroups = []struct {
-	path string
-	warn string
+	path    string
+	unified string
+	warn    string
 }{
-	{"blkio", cGroupMissing("blkio", "I/O limits will be ignored")},
-	{"cpu", cGroupMissing("CPU controller", "CPU time limits will be ignored")},
-	{"cpuacct", cGroupMissing("CPUacct controller", "CPU accounting will not be available")},
-	{"cpuset", cGroupMissing("CPUset controller", "CPU pinning will be ignored")},
-	{"devices", cGroupMissing("devices controller", "device access control won't work")},
-	{"freezer", cGroupMissing("freezer controller", "pausing/resuming containers won't work")},
-	{"memory", cGroupMissing("memory controller", "memory limits will be ignored")},
-	{"net_prio", cGroupMissing("network class controller", "network limits will be ignored")},
-	{"pids", cGroupMissing("pids controller", "process limits will be ignored")},
-	{"memory/memory.memsw.limit_in_bytes", cGroupDisabled("memory swap accounting", "swap limits will be ignored")},
+	{"blkio", "blkio", cGroupMissing("blkio", "I/O limits will be ignored")},
+	{"cpu", "cpu", cGroupMissing("CPU controller", "CPU time limits will be ignored")},
+	{"cpuacct", "cpuacct", cGroupMissing("CPUacct controller", "CPU accounting will not be available")},
+	{"cpuset", "cpuset", cGroupMissing("CPUset controller", "CPU pinning will be ignored")},
+	{"devices", "devices", cGroupMissing("devices controller", "device access control won't work")},
+	{"freezer", "freezer", cGroupMissing("freezer controller", "pausing/resuming containers won't work")},
+	{"hugetlb", "hugetlb", cGroupMissing("hugetlb controller", "hugepage limits will be ignored")},
+	{"memory", "memory", cGroupMissing("memory controller", "memory limits will be ignored")},
+	{"net_prio", "", cGroupMissing("network class controller", "network limits will be ignored")},
+	{"pids", "pids", cGroupMissing("pids controller", "process limits will be ignored")},
+	{"memory/memory.memsw.limit_in_bytes", "memory/memory.swap.max", cGroupDisabled("memory swap accounting", "swap limits will be ignored")},
 }
@@ -50,6 +50,7 @@ func (s *OS) initDirs() error {
 		{filepath.Join(s.VarDir, "images"), 0700},
 		{s.LogDir, 0700},
 		{filepath.Join(s.VarDir, "networks"), 0711},
+		{filepath.Join(s.VarDir, "secrets"), 0700},
 		{filepath.Join(s.VarDir, "security"), 0700},
 		{filepath.Join(s.VarDir, "shmounts"), 0711},
 		{filepath.Join(s.VarDir, "snapshots"), 0700},
@@ -60,10 +60,15 @@ type OS struct {
 	CGroupCPUsetController  bool
 	CGroupDevicesController bool
 	CGroupFreezerController bool
+	CGroupHugetlbController bool
 	CGroupMemoryController  bool
 	CGroupNetPrioController bool
 	CGroupPidsController    bool
 	CGroupSwapAccounting    bool
+	CGroupVersion           int // 2 on a pure unified hierarchy, 1 otherwise
+
+	cgroupUnified     map[string]bool // v1 controllers the containers get on the unified hierarchy
+	cgroupUnifiedPath string
 
 	// Kernel features
 	NetnsGetifaddrs bool
@@ -61,7 +61,7 @@ func (list Devices) Update(newlist Devices) (map[string]Device, map[string]Devic
 
 		updateDiff = deviceEqualsDiffKeys(oldDevice, newDevice)
 
-		for _, k := range []string{"limits.max", "limits.read", "limits.write", "limits.egress", "limits.ingress", "ipv4.address", "ipv6.address", "ipv4.routes", "ipv6.routes"} {
+		for _, k := range []string{"limits.max", "limits.read", "limits.write", "limits.read.latency", "limits.weight", "limits.egress", "limits.ingress", "ipv4.address", "ipv6.address", "ipv4.routes", "ipv6.routes"} {
 			delete(oldDevice, k)
 			delete(newDevice, k)
 		}
@@ -86,3 +86,16 @@ func (list Devices) DeviceNames() []string {
 	sort.Sort(sortable)
 	return sortable.Names()
 }
+
+// SortedDeviceNames returns the name of the devices as returned by Update,
+// sorted like DeviceNames. That's the order in which devices get attached:
+// by type, disks by path so that parent mounts come first, and then by name.
+func SortedDeviceNames(devices map[string]Device) []string {
+	sortable := sortableDevices{}
+	for k, d := range devices {
+		sortable = append(sortable, namedDevice{k, d})
+	}
+
+	sort.Sort(sortable)
+	return sortable.Names()
+}
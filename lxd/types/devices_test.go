@@ -20,3 +20,45 @@ func TestSortableDevices(t *testing.T) {
 		t.Error("devices sorted incorrectly")
 	}
 }
+
+func TestSortedDeviceNames(t *testing.T) {
+	devices := map[string]Device{
+		"b": {"type": "disk", "path": "/foo/bar"},
+		"a": {"type": "disk", "path": "/foo/bar/baz"},
+		"c": {"type": "disk", "path": "/foo"},
+		"d": {"type": "nic"},
+	}
+
+	expected := []string{"c", "b", "a", "d"}
+
+	result := SortedDeviceNames(devices)
+	if !reflect.DeepEqual(result, expected) {
+		t.Error("devices sorted incorrectly")
+	}
+}
+
+func TestDevicesUpdatePropagation(t *testing.T) {
+	oldDevices := Devices{
+		"data": Device{"type": "disk", "path": "/data", "source": "/srv/data", "limits.read": "10MB"},
+	}
+
+	// Changing limits is done in place
+	newDevices := Devices{
+		"data": Device{"type": "disk", "path": "/data", "source": "/srv/data", "limits.read": "20MB"},
+	}
+
+	rmList, addList, updateList, _ := oldDevices.Update(newDevices)
+	if len(rmList) != 0 || len(addList) != 0 || len(updateList) != 1 {
+		t.Error("limits change not applied in place")
+	}
+
+	// Changing the propagation mode requires the disk to be mounted again
+	newDevices = Devices{
+		"data": Device{"type": "disk", "path": "/data", "source": "/srv/data", "limits.read": "10MB", "propagation": "rshared"},
+	}
+
+	rmList, addList, updateList, _ = oldDevices.Update(newDevices)
+	if !reflect.DeepEqual(addList["data"], Device(newDevices["data"])) || rmList["data"] == nil || len(updateList) != 0 {
+		t.Error("propagation change didn't remount the disk")
+	}
+}
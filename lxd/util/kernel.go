@@ -7,12 +7,12 @@ import (
 )
 
 // LoadModule loads the kernel module with the given name, by invoking
-// modprobe.
-func LoadModule(module string) error {
+// modprobe. The parameters only apply if the module isn't loaded yet.
+func LoadModule(module string, params ...string) error {
 	if shared.PathExists(fmt.Sprintf("/sys/module/%s", module)) {
 		return nil
 	}
 
-	_, err := shared.RunCommand("modprobe", module)
+	_, err := shared.RunCommand("modprobe", append([]string{module}, params...)...)
 	return err
 }
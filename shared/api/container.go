@@ -73,6 +73,12 @@ type Container struct {
 
 	// API extension: clustering
 	Location string `json:"location" yaml:"location"`
+
+	// API extension: container_stateful_at
+	StatefulAt time.Time `json:"stateful_at" yaml:"stateful_at"`
+
+	// API extension: container_autostart_priority
+	AutostartPriority int `json:"autostart_priority" yaml:"autostart_priority"`
 }
 
 // ContainerFull is a combination of Container, ContainerState and CotnainerSnapshot
@@ -23,4 +23,12 @@ type ContainerExecPost struct {
 	User  uint32 `json:"user" yaml:"user"`
 	Group uint32 `json:"group" yaml:"group"`
 	Cwd   string `json:"cwd" yaml:"cwd"`
+
+	// API extension: container_exec_sandbox
+	DropCapabilities []string `json:"drop-capabilities" yaml:"drop-capabilities"`
+	NoNewPrivs       bool     `json:"no-new-privs" yaml:"no-new-privs"`
+	SyscallsDeny     []string `json:"syscalls-deny" yaml:"syscalls-deny"`
+
+	// API extension: container_exec_scratch
+	Scratch bool `json:"scratch" yaml:"scratch"`
 }
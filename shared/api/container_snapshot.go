@@ -11,6 +11,9 @@ type ContainerSnapshotsPost struct {
 
 	// API extension: snapshot_expiry_creation
 	ExpiresAt *time.Time `json:"expires_at" yaml:"expires_at"`
+
+	// API extension: container_snapshot_metadata_only
+	MetadataOnly bool `json:"metadata_only" yaml:"metadata_only"`
 }
 
 // ContainerSnapshotPost represents the fields required to rename/move a LXD container snapshot
@@ -44,6 +47,9 @@ type ContainerSnapshot struct {
 	LastUsedAt      time.Time                    `json:"last_used_at" yaml:"last_used_at"`
 	Name            string                       `json:"name" yaml:"name"`
 	Stateful        bool                         `json:"stateful" yaml:"stateful"`
+
+	// API extension: container_snapshot_metadata_only
+	MetadataOnly bool `json:"metadata_only" yaml:"metadata_only"`
 }
 
 // Writable converts a full ContainerSnapshot struct into a ContainerSnapshotPut struct
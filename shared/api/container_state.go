@@ -20,6 +20,18 @@ type ContainerState struct {
 
 	// API extension: container_cpu_time
 	CPU ContainerStateCPU `json:"cpu" yaml:"cpu"`
+
+	// API extension: container_state_nesting
+	Nesting ContainerStateNesting `json:"nesting" yaml:"nesting"`
+
+	// API extension: container_state_idmaps
+	Idmaps ContainerStateIdmaps `json:"idmaps" yaml:"idmaps"`
+
+	// API extension: container_ready
+	Ready bool `json:"ready" yaml:"ready"`
+
+	// API extension: container_exit_code
+	LastExitCode int64 `json:"last_exit_code" yaml:"last_exit_code"`
 }
 
 // ContainerStateDisk represents the disk information section of a LXD container's state
@@ -32,6 +44,34 @@ type ContainerStateDisk struct {
 // API extension: container_cpu_time
 type ContainerStateCPU struct {
 	Usage int64 `json:"usage" yaml:"usage"`
+
+	// API extension: container_cpu_usage_percpu
+	UsagePerCPU []int64 `json:"usage_percpu,omitempty" yaml:"usage_percpu,omitempty"`
+}
+
+// ContainerStateNesting represents the nesting information section of a LXD container's state
+//
+// API extension: container_state_nesting
+type ContainerStateNesting struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Whether a nested LXD can load its own AppArmor profiles
+	AppArmorProfiles bool `json:"apparmor_profiles" yaml:"apparmor_profiles"`
+}
+
+// ContainerStateIdmaps represents the idmap information section of a LXD container's state,
+// each map being a list of "u|g <nsid> <hostid> <range>" entries
+//
+// API extension: container_state_idmaps
+type ContainerStateIdmaps struct {
+	// The map the container's filesystem is currently shifted to
+	Disk []string `json:"disk" yaml:"disk"`
+
+	// The map the container will use on next start
+	Next []string `json:"next" yaml:"next"`
+
+	// The map the running container uses
+	Current []string `json:"current" yaml:"current"`
 }
 
 // ContainerStateMemory represents the memory information section of a LXD container's state
@@ -40,6 +80,9 @@ type ContainerStateMemory struct {
 	UsagePeak     int64 `json:"usage_peak" yaml:"usage_peak"`
 	SwapUsage     int64 `json:"swap_usage" yaml:"swap_usage"`
 	SwapUsagePeak int64 `json:"swap_usage_peak" yaml:"swap_usage_peak"`
+
+	// API extension: container_memory_pause
+	Paused bool `json:"paused" yaml:"paused"`
 }
 
 // ContainerStateNetwork represents the network information section of a LXD container's state
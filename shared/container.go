@@ -2,6 +2,8 @@ package shared
 
 import (
 	"fmt"
+	"net"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -107,6 +109,109 @@ func IsAny(value string) error {
 	return nil
 }
 
+// IsSyscallList validates a comma separated list of system call names
+func IsSyscallList(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !StringInSlice(name, SyscallNames) {
+			return fmt.Errorf("Unknown system call '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// IsSysfsPathList validates a comma separated list of absolute paths under /sys
+func IsSysfsPathList(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if !strings.HasPrefix(path, "/sys/") || filepath.Clean(path) != path {
+			return fmt.Errorf("Invalid sysfs path '%s'. Must be a clean absolute path under /sys", path)
+		}
+
+		if strings.ContainsAny(path, " \t\n") {
+			return fmt.Errorf("Invalid sysfs path '%s'. Must not contain whitespace", path)
+		}
+	}
+
+	return nil
+}
+
+// KernelLimits is the list of resources which can be set through limits.kernel.*
+var KernelLimits = []string{"as", "core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nice", "nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack"}
+
+// ParseKernelLimit converts a limits.kernel.* value into the soft[:hard]
+// format expected by lxc.prlimit, accepting "unlimited" and "infinity".
+func ParseKernelLimit(value string) (string, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) > 2 {
+		return "", fmt.Errorf("Invalid kernel limit '%s'. Must be a single value or a soft:hard pair", value)
+	}
+
+	for i, field := range fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "unlimited" || field == "infinity" {
+			fields[i] = "unlimited"
+			continue
+		}
+
+		_, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Invalid kernel limit '%s'. Must be a number, \"unlimited\" or \"infinity\"", value)
+		}
+
+		fields[i] = field
+	}
+
+	return strings.Join(fields, ":"), nil
+}
+
+// KernelModule is a module to load for a container along with its parameters.
+type KernelModule struct {
+	Name   string
+	Params []string
+}
+
+// ParseKernelModules parses a linux.kernel_modules value, a comma separated
+// list of module names each optionally followed by colon separated
+// parameters (e.g. "nf_conntrack:hashsize=32768,br_netfilter").
+func ParseKernelModules(value string) ([]KernelModule, error) {
+	modules := []KernelModule{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Names and parameters are passed as arguments to modprobe and so
+		// mustn't look like options
+		fields := strings.Split(entry, ":")
+		match, _ := regexp.MatchString("^[_a-zA-Z0-9][-_a-zA-Z0-9]*$", fields[0])
+		if !match {
+			return nil, fmt.Errorf("Invalid kernel module name '%s'", fields[0])
+		}
+
+		for _, param := range fields[1:] {
+			match, _ := regexp.MatchString("^[_a-zA-Z0-9][-_a-zA-Z0-9]*(=[^\\s]+)?$", param)
+			if !match {
+				return nil, fmt.Errorf("Invalid parameter '%s' for kernel module '%s'", param, fields[0])
+			}
+		}
+
+		modules = append(modules, KernelModule{Name: fields[0], Params: fields[1:]})
+	}
+
+	return modules, nil
+}
+
 // IsRootDiskDevice returns true if the given device representation is
 // configured as root disk for a container. It typically get passed a specific
 // entry of api.Container.Devices.
@@ -118,6 +223,18 @@ func IsRootDiskDevice(device map[string]string) bool {
 	return false
 }
 
+// DeviceCanHotplug returns an error if the given device representation can't
+// be added to or removed from a running container. It doesn't check whether
+// the resources the device refers to are available.
+func DeviceCanHotplug(device map[string]string) error {
+	// ipvlan nics are only set up by LXC when the container starts
+	if device["type"] == "nic" && device["nictype"] == "ipvlan" {
+		return fmt.Errorf("Can't insert ipvlan device to running container")
+	}
+
+	return nil
+}
+
 // GetRootDiskDevice returns the container device that is configured as root disk
 func GetRootDiskDevice(devices map[string]map[string]string) (string, map[string]string, error) {
 	var devName string
@@ -141,15 +258,101 @@ func GetRootDiskDevice(devices map[string]map[string]string) (string, map[string
 	return "", nil, fmt.Errorf("No root device could be found")
 }
 
+// isSchedule validates a cron schedule (without seconds).
+func isSchedule(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if len(strings.Split(value, " ")) != 5 {
+		return fmt.Errorf("Schedule must be of the form: <minute> <hour> <day-of-month> <month> <day-of-week>")
+	}
+
+	_, err := cron.Parse(fmt.Sprintf("* %s", value))
+	if err != nil {
+		return errors.Wrap(err, "Error parsing schedule")
+	}
+
+	return nil
+}
+
 // KnownContainerConfigKeys maps all fully defined, well-known config keys
 // to an appropriate checker function, which validates whether or not a
 // given value is syntactically legal.
 var KnownContainerConfigKeys = map[string]func(value string) error{
-	"boot.autostart":             IsBool,
-	"boot.autostart.delay":       IsInt64,
-	"boot.autostart.priority":    IsInt64,
-	"boot.stop.priority":         IsInt64,
-	"boot.host_shutdown_timeout": IsInt64,
+	"boot.autostart":               IsBool,
+	"boot.autostart.delay":         IsInt64,
+	"boot.autostart.priority":      IsUint32,
+	"boot.stop.priority":           IsInt64,
+	"boot.host_shutdown_timeout":   IsInt64,
+	"boot.reboot.preserve_network": IsBool,
+	"boot.start.delay":             IsUint32,
+
+	"console.forward": func(value string) error {
+		if value == "" || value == "local" {
+			return nil
+		}
+
+		fields := strings.SplitN(value, ":", 2)
+		if len(fields) != 2 || !StringInSlice(fields[0], []string{"tcp", "udp"}) {
+			return fmt.Errorf("Invalid console forwarding target, must be \"local\" or \"tcp|udp:<host>:<port>\": %s", value)
+		}
+
+		_, _, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			return errors.Wrapf(err, "Invalid syslog server address: %s", fields[1])
+		}
+
+		return nil
+	},
+	"console.log.size": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		size, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if size <= 0 {
+			return fmt.Errorf("Invalid console log size: %s", value)
+		}
+
+		return nil
+	},
+	"boot.hostname": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		if !ValidHostname(value) {
+			return fmt.Errorf("Invalid hostname: %s", value)
+		}
+
+		return nil
+	},
+
+	"freeze.pre_command":  IsAny,
+	"freeze.post_command": IsAny,
+	"freeze.timeout":      IsUint32,
+
+	"limits.core": func(value string) error {
+		if value == "" || value == "unlimited" {
+			return nil
+		}
+
+		size, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if size < 0 {
+			return fmt.Errorf("Invalid core dump size: %s", value)
+		}
+
+		return nil
+	},
 
 	"limits.cpu": func(value string) error {
 		if value == "" {
@@ -211,6 +414,8 @@ var KnownContainerConfigKeys = map[string]func(value string) error{
 
 	"limits.disk.priority": IsPriority,
 
+	"limits.file_timeout": IsInt64,
+
 	"limits.memory": func(value string) error {
 		if value == "" {
 			return nil
@@ -235,29 +440,239 @@ var KnownContainerConfigKeys = map[string]func(value string) error{
 	"limits.memory.enforce": func(value string) error {
 		return IsOneOf(value, []string{"soft", "hard"})
 	},
+	"limits.memory.hugepages": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		size, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if size <= 0 {
+			return fmt.Errorf("Invalid hugepages size: %s", value)
+		}
+
+		return nil
+	},
+	"limits.memory.pause_threshold": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		threshold, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || threshold < 1 || threshold > 100 {
+			return fmt.Errorf("Invalid memory pause threshold '%s'. Must be a percentage between 1 and 100", value)
+		}
+
+		return nil
+	},
 	"limits.memory.swap":          IsBool,
 	"limits.memory.swap.priority": IsPriority,
+	"limits.memory.swappiness": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		valueInt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value for an integer: %s", value)
+		}
+
+		if valueInt < 0 || valueInt > 100 {
+			return fmt.Errorf("Invalid value for swappiness '%s'. Must be between 0 and 100", value)
+		}
+
+		return nil
+	},
 
 	"limits.network.priority": IsPriority,
 
 	"limits.processes": IsInt64,
 
-	"linux.kernel_modules": IsAny,
+	"limits.shm": func(value string) error {
+		if value == "" {
+			return nil
+		}
 
+		size, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if size <= 0 {
+			return fmt.Errorf("Invalid /dev/shm size: %s", value)
+		}
+
+		return nil
+	},
+
+	"limits.tmpfs": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		size, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if size <= 0 {
+			return fmt.Errorf("Invalid tmpfs size: %s", value)
+		}
+
+		return nil
+	},
+	"limits.tmpfs.path": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("The tmpfs path must be absolute")
+		}
+
+		if value == "/" || strings.ContainsAny(value, " \t\n") || StringInSlice("..", strings.Split(value, "/")) {
+			return fmt.Errorf("Invalid tmpfs path: %s", value)
+		}
+
+		return nil
+	},
+
+	"linux.cgroup.parent": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		// Only allow relative paths made of plain components so the
+		// container can't be placed outside of the managed hierarchy.
+		for _, component := range strings.Split(value, "/") {
+			if component == "" || component == "." || component == ".." {
+				return fmt.Errorf("Invalid cgroup parent: %s", value)
+			}
+
+			match, _ := regexp.MatchString("^[-_.@a-zA-Z0-9]+$", component)
+			if !match {
+				return fmt.Errorf("Invalid cgroup parent: %s", value)
+			}
+		}
+
+		return nil
+	},
+	"linux.kernel_modules": func(value string) error {
+		_, err := ParseKernelModules(value)
+		return err
+	},
+	"linux.rtc":          IsBool,
+	"linux.tun":          IsBool,
+	"linux.rtc.required": IsBool,
+	"linux.sysfs.ro":     IsSysfsPathList,
+	"linux.sysfs.rw":     IsSysfsPathList,
+	"linux.resolv_conf": func(value string) error {
+		for _, line := range strings.Split(value, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+
+			if !StringInSlice(fields[0], []string{"nameserver", "domain", "search", "sortlist", "options"}) {
+				return fmt.Errorf("Invalid resolv.conf directive: %s", fields[0])
+			}
+
+			if len(fields) < 2 {
+				return fmt.Errorf("Missing value for resolv.conf directive: %s", fields[0])
+			}
+
+			if fields[0] == "nameserver" && net.ParseIP(fields[1]) == nil {
+				return fmt.Errorf("Invalid nameserver address: %s", fields[1])
+			}
+		}
+
+		return nil
+	},
+	"linux.timezone": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		for _, component := range strings.Split(value, "/") {
+			match, _ := regexp.MatchString("^[-+_a-zA-Z0-9]+$", component)
+			if !match {
+				return fmt.Errorf("Invalid timezone: %s", value)
+			}
+		}
+
+		return nil
+	},
+
+	"migration.bwlimit": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		limit, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return err
+		}
+
+		if limit < 1024 {
+			return fmt.Errorf("Bandwidth limit must be at least 1KiB")
+		}
+
+		return nil
+	},
 	"migration.incremental.memory":            IsBool,
 	"migration.incremental.memory.iterations": IsUint32,
 	"migration.incremental.memory.goal":       IsUint32,
 
+	"network.host_name_template": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		// Strip the supported placeholders and validate what remains
+		stripped := strings.NewReplacer("{containerName}", "", "{deviceName}", "").Replace(value)
+
+		match, _ := regexp.MatchString("^[-_a-zA-Z0-9]*$", stripped)
+		if !match {
+			return fmt.Errorf("Invalid host name template, only letters, digits, '-', '_', {containerName} and {deviceName} are allowed")
+		}
+
+		return nil
+	},
+
 	"nvidia.runtime":             IsBool,
 	"nvidia.driver.capabilities": IsAny,
 	"nvidia.require.cuda":        IsAny,
 	"nvidia.require.driver":      IsAny,
 
+	"security.apparmor.profile": IsAny,
+
 	"security.nesting":       IsBool,
 	"security.privileged":    IsBool,
 	"security.devlxd":        IsBool,
 	"security.devlxd.images": IsBool,
 
+	"security.devlxd.snapshots":          IsBool,
+	"security.devlxd.snapshots.interval": IsUint32,
+
+	"security.thaw_on_access": IsBool,
+
+	"security.integrity.paths": func(value string) error {
+		if value == "" {
+			return nil
+		}
+
+		for _, entry := range strings.Split(value, ",") {
+			if !strings.HasPrefix(strings.TrimSpace(entry), "/") {
+				return fmt.Errorf("Invalid path '%s'. Must be absolute", entry)
+			}
+		}
+
+		return nil
+	},
+
 	"security.protection.delete": IsBool,
 	"security.protection.shift":  IsBool,
 
@@ -269,24 +684,14 @@ var KnownContainerConfigKeys = map[string]func(value string) error{
 	"security.syscalls.blacklist_compat":  IsBool,
 	"security.syscalls.blacklist":         IsAny,
 	"security.syscalls.whitelist":         IsAny,
+	"security.syscalls.allow":             IsSyscallList,
+	"security.syscalls.deny":              IsSyscallList,
+	"security.syscalls.deny_default":      IsBool,
+	"security.syscalls.deny_compat":       IsBool,
 
-	"snapshots.schedule": func(value string) error {
-		if value == "" {
-			return nil
-		}
-
-		if len(strings.Split(value, " ")) != 5 {
-			return fmt.Errorf("Schedule must be of the form: <minute> <hour> <day-of-month> <month> <day-of-week>")
-		}
-
-		_, err := cron.Parse(fmt.Sprintf("* %s", value))
-		if err != nil {
-			return errors.Wrap(err, "Error parsing schedule")
-		}
-
-		return nil
-	},
+	"snapshots.schedule":         isSchedule,
 	"snapshots.schedule.stopped": IsBool,
+	"trim.schedule":              isSchedule,
 	"snapshots.pattern":          IsAny,
 	"snapshots.expiry": func(value string) error {
 		// Validate expression
@@ -294,20 +699,62 @@ var KnownContainerConfigKeys = map[string]func(value string) error{
 		return err
 	},
 
+	"templates.hostname": IsBool,
+
 	// Caller is responsible for full validation of any raw.* value
 	"raw.apparmor": IsAny,
 	"raw.lxc":      IsAny,
 	"raw.seccomp":  IsAny,
 	"raw.idmap":    IsAny,
 
-	"volatile.apply_template":   IsAny,
-	"volatile.base_image":       IsAny,
-	"volatile.last_state.idmap": IsAny,
-	"volatile.last_state.power": IsAny,
-	"volatile.idmap.base":       IsAny,
-	"volatile.idmap.current":    IsAny,
-	"volatile.idmap.next":       IsAny,
-	"volatile.apply_quota":      IsAny,
+	"volatile.apply_template":           IsAny,
+	"volatile.base_image":               IsAny,
+	"volatile.last_state.exit_code":     IsInt64,
+	"volatile.last_state.idmap":         IsAny,
+	"volatile.last_state.memory_paused": IsAny,
+	"volatile.last_state.power":         IsAny,
+	"volatile.last_state.ready":         IsBool,
+	"volatile.last_state.self_snapshot": IsAny,
+	"volatile.last_state.start_timings": IsAny,
+	"volatile.last_state.stateful_at":   IsAny,
+	"volatile.last_state.trimmed_at":    IsAny,
+	"volatile.idmap.base":               IsAny,
+	"volatile.idmap.current":            IsAny,
+	"volatile.idmap.next":               IsAny,
+	"volatile.apply_quota":              IsAny,
+	"volatile.snapshot.metadata_only":   IsBool,
+}
+
+// DeprecatedContainerConfigKeys maps container config keys which are still
+// supported but have a newer preferred form to that replacement. Only keys
+// whose replacement takes the same values belong here, so that migrating is
+// a plain rename (security.syscalls.blacklist/whitelist hold raw seccomp
+// policy lines and aren't equivalent to security.syscalls.deny/allow).
+var DeprecatedContainerConfigKeys = map[string]string{
+	"security.syscalls.blacklist_default": "security.syscalls.deny_default",
+	"security.syscalls.blacklist_compat":  "security.syscalls.deny_compat",
+}
+
+// ContainerConfigValue returns the value of a container config key, falling
+// back to the deprecated key it replaces when it isn't set.
+func ContainerConfigValue(config map[string]string, key string) (string, bool) {
+	value, ok := config[key]
+	if ok {
+		return value, true
+	}
+
+	for deprecated, replacement := range DeprecatedContainerConfigKeys {
+		if replacement != key {
+			continue
+		}
+
+		value, ok = config[deprecated]
+		if ok {
+			return value, true
+		}
+	}
+
+	return "", false
 }
 
 // ConfigKeyChecker returns a function that will check whether or not
@@ -334,6 +781,14 @@ func ConfigKeyChecker(key string) (func(value string) error, error) {
 			return IsAny, nil
 		}
 
+		if strings.HasSuffix(key, ".host_preserved") {
+			return IsBool, nil
+		}
+
+		if strings.HasSuffix(key, ".fuse_mount") {
+			return IsAny, nil
+		}
+
 		if strings.HasSuffix(key, ".mtu") {
 			return IsAny, nil
 		}
@@ -342,6 +797,10 @@ func ConfigKeyChecker(key string) (func(value string) error, error) {
 			return IsAny, nil
 		}
 
+		if strings.HasSuffix(key, ".parent") {
+			return IsAny, nil
+		}
+
 		if strings.HasSuffix(key, ".id") {
 			return IsAny, nil
 		}
@@ -353,12 +812,30 @@ func ConfigKeyChecker(key string) (func(value string) error, error) {
 		if strings.HasSuffix(key, ".spoofcheck") {
 			return IsAny, nil
 		}
+
+		if strings.HasSuffix(key, ".promisc") {
+			return IsBool, nil
+		}
 	}
 
 	if strings.HasPrefix(key, "environment.") {
 		return IsAny, nil
 	}
 
+	if strings.HasPrefix(key, "environment_file.") {
+		return func(value string) error {
+			if value == "" {
+				return nil
+			}
+
+			if filepath.IsAbs(value) || strings.HasPrefix(filepath.Clean(value), "..") {
+				return fmt.Errorf("Secret file '%s' must be relative to the secrets directory", value)
+			}
+
+			return nil
+		}, nil
+	}
+
 	if strings.HasPrefix(key, "user.") {
 		return IsAny, nil
 	}
@@ -369,7 +846,19 @@ func ConfigKeyChecker(key string) (func(value string) error, error) {
 
 	if strings.HasPrefix(key, "limits.kernel.") &&
 		(len(key) > len("limits.kernel.")) {
-		return IsAny, nil
+		limit := strings.TrimPrefix(key, "limits.kernel.")
+		if !StringInSlice(limit, KernelLimits) {
+			return nil, fmt.Errorf("Unknown kernel limit '%s' (must be one of %s)", limit, strings.Join(KernelLimits, ", "))
+		}
+
+		return func(value string) error {
+			if value == "" {
+				return nil
+			}
+
+			_, err := ParseKernelLimit(value)
+			return err
+		}, nil
 	}
 
 	return nil, fmt.Errorf("Unknown configuration key: %s", key)
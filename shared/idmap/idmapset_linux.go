@@ -504,7 +504,7 @@ func (m IdmapSet) ShiftFromNs(uid int64, gid int64) (int64, int64) {
 	return m.doShiftIntoNs(uid, gid, "out")
 }
 
-func (set *IdmapSet) doUidshiftIntoContainer(dir string, testmode bool, how string, skipper func(dir string, absPath string, fi os.FileInfo) bool) error {
+func (set *IdmapSet) doUidshiftIntoContainer(dir string, testmode bool, how string, skipper func(dir string, absPath string, fi os.FileInfo) bool, progress func(files int64, bytes int64)) error {
 	if how == "in" && atomic.LoadInt32(&VFS3Fscaps) == VFS3FscapsUnknown {
 		if SupportsVFS3Fscaps(dir) {
 			atomic.StoreInt32(&VFS3Fscaps, VFS3FscapsSupported)
@@ -523,6 +523,8 @@ func (set *IdmapSet) doUidshiftIntoContainer(dir string, testmode bool, how stri
 	dir = strings.TrimRight(dir, "/")
 
 	hardLinks := []uint64{}
+	files := int64(0)
+	bytes := int64(0)
 	convert := func(path string, fi os.FileInfo, err error) (e error) {
 		if err != nil {
 			return err
@@ -548,6 +550,16 @@ func (set *IdmapSet) doUidshiftIntoContainer(dir string, testmode bool, how stri
 			hardLinks = append(hardLinks, inode)
 		}
 
+		// Report progress
+		if progress != nil {
+			files++
+			if fi.Mode().IsRegular() {
+				bytes += fi.Size()
+			}
+
+			progress(files, bytes)
+		}
+
 		uid := int64(intUid)
 		gid := int64(intGid)
 		caps := []byte{}
@@ -612,23 +624,27 @@ func (set *IdmapSet) doUidshiftIntoContainer(dir string, testmode bool, how stri
 }
 
 func (set *IdmapSet) UidshiftIntoContainer(dir string, testmode bool) error {
-	return set.doUidshiftIntoContainer(dir, testmode, "in", nil)
+	return set.doUidshiftIntoContainer(dir, testmode, "in", nil, nil)
 }
 
 func (set *IdmapSet) UidshiftFromContainer(dir string, testmode bool) error {
-	return set.doUidshiftIntoContainer(dir, testmode, "out", nil)
+	return set.doUidshiftIntoContainer(dir, testmode, "out", nil, nil)
 }
 
-func (set *IdmapSet) ShiftRootfs(p string, skipper func(dir string, absPath string, fi os.FileInfo) bool) error {
-	return set.doUidshiftIntoContainer(p, false, "in", skipper)
+// ShiftRootfs shifts the ownership of everything under p into the container. If set, progress
+// is called after each entry with the number of files and bytes processed so far.
+func (set *IdmapSet) ShiftRootfs(p string, skipper func(dir string, absPath string, fi os.FileInfo) bool, progress func(files int64, bytes int64)) error {
+	return set.doUidshiftIntoContainer(p, false, "in", skipper, progress)
 }
 
-func (set *IdmapSet) UnshiftRootfs(p string, skipper func(dir string, absPath string, fi os.FileInfo) bool) error {
-	return set.doUidshiftIntoContainer(p, false, "out", skipper)
+// UnshiftRootfs shifts the ownership of everything under p out of the container. If set,
+// progress is called after each entry with the number of files and bytes processed so far.
+func (set *IdmapSet) UnshiftRootfs(p string, skipper func(dir string, absPath string, fi os.FileInfo) bool, progress func(files int64, bytes int64)) error {
+	return set.doUidshiftIntoContainer(p, false, "out", skipper, progress)
 }
 
 func (set *IdmapSet) ShiftFile(p string) error {
-	return set.ShiftRootfs(p, nil)
+	return set.ShiftRootfs(p, nil, nil)
 }
 
 /*
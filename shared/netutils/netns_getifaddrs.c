@@ -21,6 +21,10 @@
 
 #include "network.c"
 
+#ifndef RTEXT_FILTER_SKIP_STATS
+#define RTEXT_FILTER_SKIP_STATS (1 << 3)
+#endif
+
 struct netns_ifaddrs {
 	struct netns_ifaddrs *ifa_next;
 
@@ -338,7 +342,7 @@ static int nl_msg_to_ifaddr(void *pctx, bool *netnsid_aware, struct nlmsghdr *h)
 			   __NETLINK_ALIGN((nmsg)->nlmsg_len)))
 
 static int __netlink_recv(int fd, unsigned int seq, int type, int af,
-			  __s32 netns_id, bool *netnsid_aware,
+			  __s32 netns_id, bool skip_stats, bool *netnsid_aware,
 			  int (*cb)(void *ctx, bool *netnsid_aware,
 				    struct nlmsghdr *h),
 			  void *ctx)
@@ -394,6 +398,11 @@ static int __netlink_recv(int fd, unsigned int seq, int type, int af,
 	if (netns_id >= 0)
 		addattr(hdr, 1024, property, &netns_id, sizeof(netns_id));
 
+	if (type == RTM_GETLINK && skip_stats) {
+		__u32 ext_mask = RTEXT_FILTER_SKIP_STATS;
+		addattr(hdr, 1024, IFLA_EXT_MASK, &ext_mask, sizeof(ext_mask));
+	}
+
 	r = __netlink_send(fd, hdr);
 	if (r < 0)
 		return -1;
@@ -421,7 +430,7 @@ static int __netlink_recv(int fd, unsigned int seq, int type, int af,
 }
 
 static int __rtnl_enumerate(int link_af, int addr_af, __s32 netns_id,
-			    bool *netnsid_aware,
+			    bool skip_stats, bool *netnsid_aware,
 			    int (*cb)(void *ctx, bool *netnsid_aware, struct nlmsghdr *h),
 			    void *ctx)
 {
@@ -440,10 +449,10 @@ static int __rtnl_enumerate(int link_af, int addr_af, __s32 netns_id,
 		return -1;
 	}
 
-	r = __netlink_recv(fd, 1, RTM_GETLINK, link_af, netns_id,
+	r = __netlink_recv(fd, 1, RTM_GETLINK, link_af, netns_id, skip_stats,
 			   &getlink_netnsid_aware, cb, ctx);
 	if (!r)
-		r = __netlink_recv(fd, 2, RTM_GETADDR, addr_af, netns_id,
+		r = __netlink_recv(fd, 2, RTM_GETADDR, addr_af, netns_id, false,
 				   &getaddr_netnsid_aware, cb, ctx);
 
 	saved_errno = errno;
@@ -459,7 +468,7 @@ static int __rtnl_enumerate(int link_af, int addr_af, __s32 netns_id,
 }
 
 static int netns_getifaddrs(struct netns_ifaddrs **ifap, __s32 netns_id,
-			    bool *netnsid_aware)
+			    bool skip_stats, bool *netnsid_aware)
 {
 	int r, saved_errno;
 	struct ifaddrs_ctx _ctx;
@@ -467,8 +476,8 @@ static int netns_getifaddrs(struct netns_ifaddrs **ifap, __s32 netns_id,
 
 	memset(ctx, 0, sizeof *ctx);
 
-	r = __rtnl_enumerate(AF_UNSPEC, AF_UNSPEC, netns_id, netnsid_aware,
-			     nl_msg_to_ifaddr, ctx);
+	r = __rtnl_enumerate(AF_UNSPEC, AF_UNSPEC, netns_id, skip_stats,
+			     netnsid_aware, nl_msg_to_ifaddr, ctx);
 	saved_errno = errno;
 	if (r < 0)
 		netns_freeifaddrs(&ctx->first->ifa);
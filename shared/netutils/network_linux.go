@@ -25,7 +25,11 @@ import (
 // #cgo CFLAGS: -std=gnu11 -Wvla
 import "C"
 
-func NetnsGetifaddrs(initPID int32) (map[string]api.ContainerStateNetwork, error) {
+// NetnsGetifaddrs returns the network interfaces and addresses of the network
+// namespace of the given process (or the current one when -1). The traffic
+// counters are left empty if skipCounters is set, saving the kernel from
+// gathering them.
+func NetnsGetifaddrs(initPID int32, skipCounters bool) (map[string]api.ContainerStateNetwork, error) {
 	var netnsid_aware C.bool
 	var ifaddrs *C.struct_netns_ifaddrs
 	var netnsID C.__s32
@@ -45,7 +49,7 @@ func NetnsGetifaddrs(initPID int32) (map[string]api.ContainerStateNetwork, error
 		netnsID = -1
 	}
 
-	ret := C.netns_getifaddrs(&ifaddrs, netnsID, &netnsid_aware)
+	ret := C.netns_getifaddrs(&ifaddrs, netnsID, C.bool(skipCounters), &netnsid_aware)
 	if ret < 0 {
 		return nil, fmt.Errorf("Failed to retrieve network interfaces and addresses")
 	}
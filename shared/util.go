@@ -3,6 +3,7 @@ package shared
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/gob"
 	"encoding/hex"
@@ -786,6 +787,38 @@ func RunCommand(name string, arg ...string) (string, error) {
 	return string(output), nil
 }
 
+// RunCommandStdin runs a command like RunCommand, feeding it stdin.
+func RunCommandStdin(stdin io.Reader, name string, arg ...string) (string, error) {
+	cmd := exec.Command(name, arg...)
+	cmd.Stdin = stdin
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err := RunError{
+			msg: fmt.Sprintf("Failed to run: %s %s: %s", name, strings.Join(arg, " "), strings.TrimSpace(string(output))),
+			Err: err,
+		}
+		return string(output), err
+	}
+
+	return string(output), nil
+}
+
+// RunCommandContext runs a command like RunCommand, killing it if the context
+// is done before the command completes.
+func RunCommandContext(ctx context.Context, name string, arg ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, arg...).CombinedOutput()
+	if err != nil {
+		err := RunError{
+			msg: fmt.Sprintf("Failed to run: %s %s: %s", name, strings.Join(arg, " "), strings.TrimSpace(string(output))),
+			Err: err,
+		}
+		return string(output), err
+	}
+
+	return string(output), nil
+}
+
 func RunCommandWithFds(stdin io.Reader, stdout io.Writer, name string, arg ...string) error {
 	cmd := exec.Command(name, arg...)
 
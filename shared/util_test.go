@@ -174,3 +174,29 @@ func TestGetSnapshotExpiry(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, time.Time{}, expiryDate)
 }
+
+func TestParseKernelModules(t *testing.T) {
+	modules, err := ParseKernelModules("nf_conntrack:hashsize=32768, br_netfilter,ip_vs:conn_tab_bits=12:debug")
+	require.NoError(t, err)
+	require.Equal(t, []KernelModule{
+		{Name: "nf_conntrack", Params: []string{"hashsize=32768"}},
+		{Name: "br_netfilter", Params: []string{}},
+		{Name: "ip_vs", Params: []string{"conn_tab_bits=12", "debug"}},
+	}, modules)
+
+	modules, err = ParseKernelModules("")
+	require.NoError(t, err)
+	require.Empty(t, modules)
+
+	_, err = ParseKernelModules("../evil")
+	require.Error(t, err)
+
+	_, err = ParseKernelModules("nf_conntrack:hash size=1")
+	require.Error(t, err)
+
+	_, err = ParseKernelModules("nf_conntrack:--config=/tmp/evil.conf")
+	require.Error(t, err)
+
+	_, err = ParseKernelModules("-r")
+	require.Error(t, err)
+}
@@ -159,6 +159,69 @@ var APIExtensions = []string{
 	"container_nic_ipfilter",
 	"resources_v2",
 	"container_exec_user_group_cwd",
+	"container_hostname_template",
+	"container_migration_bwlimit",
+	"container_nic_host_name_template",
+	"container_tmpfs_limits",
+	"container_state_nesting",
+	"container_gpu_mig",
+	"container_cgroup_parent",
+	"container_rtc",
+	"container_disk_overlay",
+	"container_stateful_at",
+	"container_environment_templating",
+	"container_integrity",
+	"nic_parent_failover",
+	"container_cpu_usage_percpu",
+	"container_thaw_on_access",
+	"container_resolv_conf",
+	"container_nic_dhcp",
+	"container_memory_pause",
+	"container_root_disk_fs",
+	"container_sysfs_binds",
+	"container_syscall_lists",
+	"container_shm_limit",
+	"container_nic_connlimit",
+	"container_exec_sandbox",
+	"container_reboot_preserve_network",
+	"container_file_timeout",
+	"container_nic_pmtu",
+	"container_snapshot_metadata_only",
+	"container_hostname",
+	"container_kernel_module_params",
+	"container_state_idmaps",
+	"container_nic_vrf",
+	"container_tun",
+	"container_console_log_size",
+	"container_ready",
+	"container_nftables",
+	"container_freeze_hooks",
+	"container_exit_code",
+	"unix_device_hotplug_rule",
+	"container_hugepages_limit",
+	"container_apparmor_profile",
+	"container_start_timings",
+	"container_console_forward",
+	"container_core_limit",
+	"disk_source_timeout",
+	"container_nic_host_address",
+	"container_disk_fuse",
+	"container_nic_promisc",
+	"container_start_delay",
+	"container_environment_file",
+	"container_trim",
+	"container_memory_swappiness",
+	"container_nic_dns",
+	"container_exec_scratch",
+	"devlxd_snapshots",
+	"cgroup_v2",
+	"container_operation_timeout",
+	"container_disk_qos",
+	"unix_device_readonly",
+	"container_autostart_priority",
+	"container_export_oci",
+	"container_syscall_deny_keys",
+	"container_rename_running",
 }
 
 // APIExtensionsCount returns the number of available API extensions.
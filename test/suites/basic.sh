@@ -140,6 +140,12 @@ test_basic_usage() {
   lxc delete baz
   lxc image delete foo-image foo-image2
 
+  # Test renaming a running container
+  lxc launch testimage baz
+  lxc rename baz baz2
+  lxc info baz2 | grep -q "Status: Running"
+  lxc delete baz2 --force
+
   # Test image compression on publish
   lxc publish bar --alias=foo-image-compressed --compression=bzip2 prop=val1
   lxc image show foo-image-compressed | grep val1
@@ -413,7 +419,7 @@ test_basic_usage() {
   init=$(lxc info lxd-seccomp-test | grep Pid | cut -f2 -d" ")
   [ "$(grep Seccomp "/proc/${init}/status" | cut -f2)" -eq "2" ]
   lxc stop --force lxd-seccomp-test
-  lxc config set lxd-seccomp-test security.syscalls.blacklist_default false
+  lxc config set lxd-seccomp-test security.syscalls.deny_default false
   lxc start lxd-seccomp-test
   init=$(lxc info lxd-seccomp-test | grep Pid | cut -f2 -d" ")
   [ "$(grep Seccomp "/proc/${init}/status" | cut -f2)" -eq "0" ]